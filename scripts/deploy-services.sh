@@ -14,7 +14,11 @@ echo "  Building Rust order service..."
 docker build -t rust-order-service:latest ./services/rust-order-service
 
 echo "  Building Go inventory service..."
-docker build -t go-inventory-service:latest ./services/go-inventory-service
+docker build -t go-inventory-service:latest \
+  --build-arg VERSION="$(git describe --tags --always --dirty 2>/dev/null || echo dev)" \
+  --build-arg GIT_SHA="$(git rev-parse --short HEAD 2>/dev/null || echo unknown)" \
+  --build-arg BUILD_DATE="$(date -u +%Y-%m-%dT%H:%M:%SZ)" \
+  ./services/go-inventory-service
 
 # Create demo namespace
 echo "📦 Creating demo namespace..."
@@ -9,6 +9,12 @@ BASE_URL_INVENTORY=${3:-"http://localhost:8002"}
 DURATION=${4:-60}  # Duration in seconds
 REQUESTS_PER_SECOND=${5:-10}
 
+# Identifies the load generator to the inventory service when API keys are enabled
+INVENTORY_AUTH=()
+if [ -n "$INVENTORY_API_KEY" ]; then
+  INVENTORY_AUTH=(-H "X-API-Key: $INVENTORY_API_KEY")
+fi
+
 echo "Configuration:"
 echo "  User Service: $BASE_URL_USER"
 echo "  Order Service: $BASE_URL_ORDER"
@@ -57,16 +63,16 @@ while [ $(date +%s) -lt $END_TIME ]; do
   # Inventory service requests
   (
     # Create inventory
-    curl -s -X POST "$BASE_URL_INVENTORY/api/inventory" \
+    curl -s -X POST "$BASE_URL_INVENTORY/api/inventory" "${INVENTORY_AUTH[@]}" \
       -H "Content-Type: application/json" \
       -d "{\"product_name\":\"Product$REQUEST_COUNT\",\"sku\":\"SKU-$REQUEST_COUNT\",\"quantity\":$((RANDOM % 200 + 50)),\"location\":\"Warehouse $((RANDOM % 3 + 1))\"}" \
       > /dev/null 2>&1
     
     # List inventory
-    curl -s "$BASE_URL_INVENTORY/api/inventory?limit=10" > /dev/null 2>&1
+    curl -s "${INVENTORY_AUTH[@]}" "$BASE_URL_INVENTORY/api/inventory?limit=10" > /dev/null 2>&1
     
     # Get stock levels
-    curl -s "$BASE_URL_INVENTORY/api/stock-levels" > /dev/null 2>&1
+    curl -s "${INVENTORY_AUTH[@]}" "$BASE_URL_INVENTORY/api/stock-levels" > /dev/null 2>&1
   ) &
   
   # Progress indicator
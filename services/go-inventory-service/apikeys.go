@@ -0,0 +1,88 @@
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var callerRequestsTotal = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "api_requests_by_caller_total",
+		Help: "Total number of API requests by authenticated caller",
+	},
+	[]string{"caller", "method", "endpoint", "status"},
+)
+
+// APIKeyStore maps static API keys to the identity of the client using them
+type APIKeyStore struct {
+	// Keyed by the SHA-256 of the API key, so lookups don't leak timing
+	// information about the key itself
+	identities map[[sha256.Size]byte]string
+	roles      map[string][]string
+}
+
+// Load API keys from the directory in API_KEYS_DIR. Every file in it is one
+// client: the file name is the client identity and the content is its key.
+// This is the layout of a Kubernetes secret mounted as a volume. Returns nil
+// when API_KEYS_DIR is not set.
+func loadAPIKeys(cfg AuthConfig) (*APIKeyStore, error) {
+	dir := cfg.APIKeysDir
+	if dir == "" {
+		return nil, nil
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read API keys directory: %w", err)
+	}
+
+	roles, err := parseAPIKeyRoles(cfg.APIKeyRoles)
+	if err != nil {
+		return nil, err
+	}
+
+	store := &APIKeyStore{identities: map[[sha256.Size]byte]string{}, roles: roles}
+	for _, entry := range entries {
+		// Skip the hidden ..data links Kubernetes creates for atomic updates
+		if entry.IsDir() || strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+
+		data, err := os.ReadFile(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read API key %s: %w", entry.Name(), err)
+		}
+		key := strings.TrimSpace(string(data))
+		if key == "" {
+			return nil, fmt.Errorf("API key %s is empty", entry.Name())
+		}
+		store.identities[sha256.Sum256([]byte(key))] = entry.Name()
+	}
+
+	if len(store.identities) == 0 {
+		return nil, fmt.Errorf("no API keys found in %s", dir)
+	}
+	log.Printf("API key authentication enabled (%d clients)", len(store.identities))
+	return store, nil
+}
+
+// Authenticate returns the principal for an API key
+func (s *APIKeyStore) Authenticate(key string) (*Principal, bool) {
+	identity, ok := s.identities[sha256.Sum256([]byte(key))]
+	if !ok {
+		return nil, false
+	}
+	return &Principal{
+		Subject: identity,
+		Caller:  identity,
+		Method:  "api_key",
+		Roles:   s.roles[identity],
+	}, true
+}
@@ -0,0 +1,380 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Principal is the authenticated caller of a request
+type Principal struct {
+	Subject string
+	// Low-cardinality name of the calling client, used as a metric label
+	Caller string
+	Method string
+	Roles  []string
+	Claims jwt.MapClaims
+}
+
+type principalKey struct{}
+
+// Get the authenticated caller from a request context, if any
+func principalFromContext(ctx context.Context) (*Principal, bool) {
+	p, ok := ctx.Value(principalKey{}).(*Principal)
+	return p, ok
+}
+
+// JWTVerifier validates bearer tokens against an OIDC issuer's signing keys
+type JWTVerifier struct {
+	issuer   string
+	audience string
+	// Claim holding the caller's roles
+	rolesClaim string
+	jwks       *jwksCache
+}
+
+// Create a JWT verifier. Returns nil when AUTH_JWT_ISSUER is not set, which
+// leaves the API unauthenticated.
+func newJWTVerifier(ctx context.Context, cfg AuthConfig, clientCfg HTTPClientConfig) (*JWTVerifier, error) {
+	issuer := cfg.JWTIssuer
+	if issuer == "" {
+		return nil, nil
+	}
+
+	client := newHTTPClient("oidc", clientCfg, nil)
+	jwksURL := cfg.JWKSURL
+	if jwksURL == "" {
+		var err error
+		jwksURL, err = discoverJWKSURL(ctx, client, issuer)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	log.Printf("JWT authentication enabled (issuer: %s, JWKS: %s)", issuer, jwksURL)
+
+	return &JWTVerifier{
+		issuer:     issuer,
+		audience:   cfg.JWTAudience,
+		rolesClaim: cfg.RolesClaim,
+		jwks:       newJWKSCache(client, jwksURL),
+	}, nil
+}
+
+// Look up the JWKS location in the issuer's OIDC discovery document
+func discoverJWKSURL(ctx context.Context, client httpDoer, issuer string) (string, error) {
+	url := strings.TrimSuffix(issuer, "/") + "/.well-known/openid-configuration"
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return "", err
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("failed to fetch OIDC discovery document: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("failed to fetch OIDC discovery document: %s", resp.Status)
+	}
+
+	var doc struct {
+		JWKSURI string `json:"jwks_uri"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&doc); err != nil {
+		return "", fmt.Errorf("failed to decode OIDC discovery document: %w", err)
+	}
+	if doc.JWKSURI == "" {
+		return "", errors.New("OIDC discovery document has no jwks_uri")
+	}
+	return doc.JWKSURI, nil
+}
+
+// Verify checks the token's signature, issuer, audience and expiry
+func (v *JWTVerifier) Verify(ctx context.Context, tokenString string) (*Principal, error) {
+	opts := []jwt.ParserOption{
+		jwt.WithIssuer(v.issuer),
+		jwt.WithValidMethods([]string{"RS256", "RS384", "RS512", "ES256", "ES384", "ES512"}),
+		jwt.WithExpirationRequired(),
+		jwt.WithLeeway(30 * time.Second),
+	}
+	if v.audience != "" {
+		opts = append(opts, jwt.WithAudience(v.audience))
+	}
+
+	claims := jwt.MapClaims{}
+	_, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
+		kid, _ := token.Header["kid"].(string)
+		return v.jwks.key(ctx, kid)
+	}, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	subject, err := claims.GetSubject()
+	if err != nil || subject == "" {
+		return nil, errors.New("token has no subject")
+	}
+
+	// Users are too many to label metrics with, so JWT callers are
+	// identified by the OAuth client that obtained the token
+	caller, _ := claims["azp"].(string)
+	if caller == "" {
+		caller, _ = claims["client_id"].(string)
+	}
+	if caller == "" {
+		caller = "jwt"
+	}
+
+	return &Principal{
+		Subject: subject,
+		Caller:  caller,
+		Method:  "jwt",
+		Roles:   rolesFromClaims(claims, v.rolesClaim),
+		Claims:  claims,
+	}, nil
+}
+
+// jwksCache holds the issuer's signing keys, refetching them periodically
+// and when a token refers to an unknown key (after a key rotation)
+type jwksCache struct {
+	client httpDoer
+	url    string
+
+	mu        sync.Mutex
+	keys      map[string]interface{}
+	fetchedAt time.Time
+}
+
+const (
+	jwksRefreshInterval = time.Hour
+	// Minimum time between fetches triggered by unknown key IDs
+	jwksMinRefetchInterval = 30 * time.Second
+)
+
+func newJWKSCache(client httpDoer, url string) *jwksCache {
+	return &jwksCache{client: client, url: url}
+}
+
+func (c *jwksCache) key(ctx context.Context, kid string) (interface{}, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	age := time.Since(c.fetchedAt)
+	if key, ok := c.keys[kid]; ok && age < jwksRefreshInterval {
+		return key, nil
+	}
+
+	if c.keys == nil || age >= jwksMinRefetchInterval {
+		keys, err := fetchJWKS(ctx, c.client, c.url)
+		if err != nil {
+			// Keep using the keys we have if the issuer is briefly unreachable
+			if key, ok := c.keys[kid]; ok {
+				return key, nil
+			}
+			return nil, err
+		}
+		c.keys = keys
+		c.fetchedAt = time.Now()
+	}
+
+	if key, ok := c.keys[kid]; ok {
+		return key, nil
+	}
+	return nil, fmt.Errorf("unknown signing key %q", kid)
+}
+
+type jsonWebKey struct {
+	Kid string `json:"kid"`
+	Kty string `json:"kty"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func fetchJWKS(ctx context.Context, client httpDoer, url string) (map[string]interface{}, error) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch JWKS: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to fetch JWKS: %s", resp.Status)
+	}
+
+	var set struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&set); err != nil {
+		return nil, fmt.Errorf("failed to decode JWKS: %w", err)
+	}
+
+	keys := make(map[string]interface{}, len(set.Keys))
+	for _, jwk := range set.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		key, err := jwk.publicKey()
+		if err != nil {
+			log.Printf("Skipping JWKS key %q: %v", jwk.Kid, err)
+			continue
+		}
+		keys[jwk.Kid] = key
+	}
+	return keys, nil
+}
+
+func (k jsonWebKey) publicKey() (interface{}, error) {
+	decode := base64.RawURLEncoding.DecodeString
+
+	switch k.Kty {
+	case "RSA":
+		n, err := decode(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decode(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := decode(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decode(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{
+			Curve: curve,
+			X:     new(big.Int).SetBytes(x),
+			Y:     new(big.Int).SetBytes(y),
+		}, nil
+	default:
+		return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+	}
+}
+
+// Authentication middleware for the /api routes. Requests need either an
+// X-API-Key header or a bearer token, depending on which methods are
+// configured; others are rejected with 401. The caller of accepted requests
+// is attached to the request context and span, and every request is written
+// to the audit log.
+func (app *App) authenticate(c *gin.Context) {
+	if app.jwt == nil && app.apiKeys == nil {
+		c.Next()
+		return
+	}
+
+	ctx := c.Request.Context()
+	span := trace.SpanFromContext(ctx)
+
+	var principal *Principal
+	if key := c.GetHeader("X-API-Key"); key != "" && app.apiKeys != nil {
+		var ok bool
+		principal, ok = app.apiKeys.Authenticate(key)
+		if !ok {
+			app.rejectUnauthenticated(c, "unknown API key")
+			return
+		}
+	} else if app.jwt != nil {
+		token, ok := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer ")
+		if !ok || token == "" {
+			app.rejectUnauthenticated(c, "missing bearer token")
+			return
+		}
+
+		var err error
+		principal, err = app.jwt.Verify(ctx, token)
+		if err != nil {
+			app.rejectUnauthenticated(c, err.Error())
+			return
+		}
+	} else {
+		app.rejectUnauthenticated(c, "missing API key")
+		return
+	}
+
+	span.SetAttributes(
+		attribute.String("enduser.id", principal.Subject),
+		attribute.String("auth.method", principal.Method),
+		attribute.String("auth.caller", principal.Caller),
+	)
+	if scope, ok := principal.Claims["scope"].(string); ok {
+		span.SetAttributes(attribute.String("enduser.scope", scope))
+	}
+
+	ctx = context.WithValue(ctx, principalKey{}, principal)
+	c.Request = c.Request.WithContext(ctx)
+
+	c.Next()
+
+	callerRequestsTotal.WithLabelValues(principal.Caller, c.Request.Method, c.FullPath(),
+		strconv.Itoa(c.Writer.Status())).Inc()
+	logWithTrace(ctx, "INFO", "API request",
+		"log_type", "audit",
+		"subject", principal.Subject,
+		"caller", principal.Caller,
+		"auth_method", principal.Method,
+		"method", c.Request.Method,
+		"path", c.FullPath(),
+		"status", c.Writer.Status(),
+	)
+}
+
+func (app *App) rejectUnauthenticated(c *gin.Context, reason string) {
+	ctx := c.Request.Context()
+
+	trace.SpanFromContext(ctx).AddEvent("auth.rejected", trace.WithAttributes(
+		attribute.String("auth.failure_reason", reason),
+	))
+	recordSecurityEvent(c, securityEventAuthFailed, "", http.StatusUnauthorized, "reason", reason)
+
+	if app.jwt != nil {
+		c.Header("WWW-Authenticate", `Bearer error="invalid_token"`)
+	}
+	c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+}
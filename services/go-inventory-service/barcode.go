@@ -0,0 +1,231 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+var barcodeResponses = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "barcode_responses_total",
+		Help: "Barcode images by result: rendered, or not_modified when the client's copy was still current",
+	},
+	[]string{"result"},
+)
+
+// Barcodes only change with the SKU, so caches and CDNs may keep them
+const barcodeMaxAge = 24 * time.Hour
+
+// Widths of the bars and spaces of the Code 128 symbols, starting with a
+// bar, by symbol value. Every symbol is 11 modules wide, the stop symbol 13.
+var code128Patterns = [107]string{
+	"212222", "222122", "222221", "121223", "121322", "131222", "122213", "122312", "132212", "221213",
+	"221312", "231212", "112232", "122132", "122231", "113222", "123122", "123221", "223211", "221132",
+	"221231", "213212", "223112", "312131", "311222", "321122", "321221", "312212", "322112", "322211",
+	"212123", "212321", "232121", "111323", "131123", "131321", "112313", "132113", "132311", "211313",
+	"231113", "231311", "112133", "112331", "132131", "113123", "113321", "133121", "313121", "211331",
+	"231131", "213113", "213311", "213131", "311123", "311321", "331121", "312113", "312311", "332111",
+	"314111", "221411", "431111", "111224", "111422", "121124", "121421", "141122", "141221", "112214",
+	"112412", "122114", "122411", "142112", "142211", "241211", "221114", "413111", "241112", "134111",
+	"111242", "121142", "121241", "114212", "124112", "124211", "411212", "421112", "421211", "212141",
+	"214121", "412121", "111143", "111341", "131141", "114113", "114311", "411113", "411311", "113141",
+	"114131", "311141", "411131", "211412", "211214", "211232", "2331112",
+}
+
+const (
+	code128StartB = 104
+	code128Stop   = 106
+	// Blank modules on either side, so scanners find where the code starts
+	code128QuietZone = 10
+)
+
+// Encode text with Code 128 code set B, which covers printable ASCII, into
+// the widths of its bars and spaces, alternating and starting with a bar
+func encodeCode128(text string) ([]int, error) {
+	if text == "" {
+		return nil, fmt.Errorf("nothing to encode")
+	}
+	symbols := []int{code128StartB}
+	checksum := code128StartB
+	for _, r := range text {
+		if r < 32 || r > 126 {
+			return nil, fmt.Errorf("%q can't be encoded in Code 128 code set B", r)
+		}
+		value := int(r) - 32
+		symbols = append(symbols, value)
+		checksum += (len(symbols) - 1) * value
+	}
+	symbols = append(symbols, checksum%103, code128Stop)
+
+	var widths []int
+	for _, s := range symbols {
+		for _, w := range code128Patterns[s] {
+			widths = append(widths, int(w-'0'))
+		}
+	}
+	return widths, nil
+}
+
+// Render a Code 128 barcode as a PNG, scale pixels per module wide
+func renderCode128(text string, scale, height int) ([]byte, error) {
+	widths, err := encodeCode128(text)
+	if err != nil {
+		return nil, err
+	}
+	modules := 2 * code128QuietZone
+	for _, w := range widths {
+		modules += w
+	}
+
+	img := image.NewPaletted(image.Rect(0, 0, modules*scale, height), color.Palette{color.White, color.Black})
+	x := code128QuietZone * scale
+	for i, w := range widths {
+		// Even widths are bars, odd ones spaces
+		if i%2 == 0 {
+			for px := x; px < x+w*scale; px++ {
+				for y := 0; y < height; y++ {
+					img.SetColorIndex(px, y, 1)
+				}
+			}
+		}
+		x += w * scale
+	}
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// The query parameter as an int between min and max, def if not given
+func intQuery(c *gin.Context, name string, def, min, max int) (int, error) {
+	s := c.Query(name)
+	if s == "" {
+		return def, nil
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil || n < min || n > max {
+		return 0, fmt.Errorf("%s must be between %d and %d", name, min, max)
+	}
+	return n, nil
+}
+
+// Get the item's SKU as a Code 128 barcode (PNG). The ETag only depends on
+// the SKU and the size, so every replica gives the same one, and a client
+// or CDN revalidating its copy gets a 304.
+func (app *App) getItemBarcode(c *gin.Context) {
+	ctx := c.Request.Context()
+	ctx, span := app.tracer.Start(ctx, "getItemBarcode")
+	defer span.End()
+
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid item ID"})
+		return
+	}
+	span.SetAttributes(attribute.Int("item.id", id))
+	scale, err := intQuery(c, "scale", 2, 1, 8)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	height, err := intQuery(c, "height", 80, 20, 400)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	item, ok := app.items.byID.Get(id)
+	span.SetAttributes(attribute.Bool("cache.hit", ok))
+	if !ok {
+		item, err = app.itemStore.FindItem(ctx, "id", id)
+		if err == sql.ErrNoRows {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Item not found"})
+			return
+		}
+		if err != nil {
+			logWithTrace(ctx, "ERROR", "Error fetching inventory item", "error", err.Error())
+			span.RecordError(err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch item"})
+			return
+		}
+		app.items.Add(item)
+	}
+	span.SetAttributes(attribute.String("item.sku", item.SKU), attribute.String("barcode.symbology", "code128"))
+
+	sum := sha256.Sum256([]byte(fmt.Sprintf("code128|%s|%d|%d", item.SKU, scale, height)))
+	etag := `"` + hex.EncodeToString(sum[:16]) + `"`
+	c.Header("ETag", etag)
+	c.Header("Cache-Control", fmt.Sprintf("public, max-age=%d", int(barcodeMaxAge.Seconds())))
+	if c.GetHeader("If-None-Match") == etag {
+		barcodeResponses.WithLabelValues("not_modified").Inc()
+		requestsTotal.WithLabelValues("GET", "/api/inventory/:id/barcode", "304").Inc()
+		c.Status(http.StatusNotModified)
+		return
+	}
+
+	body, err := renderCode128(item.SKU, scale, height)
+	if err != nil {
+		logWithTrace(ctx, "WARN", "SKU can't be rendered as a barcode", "item_id", id, "sku", item.SKU, "error", err.Error())
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": "The SKU can't be encoded as a barcode: " + err.Error()})
+		return
+	}
+
+	barcodeResponses.WithLabelValues("rendered").Inc()
+	requestsTotal.WithLabelValues("GET", "/api/inventory/:id/barcode", "200").Inc()
+	c.Data(http.StatusOK, "image/png", body)
+}
+
+// Look up the item a scanned barcode belongs to. Barcodes carry the SKU,
+// so this is the SKU lookup for scanners, which only accepts what a Code
+// 128 barcode can hold.
+func (app *App) getItemByBarcode(c *gin.Context) {
+	ctx := c.Request.Context()
+	ctx, span := app.tracer.Start(ctx, "getItemByBarcode")
+	defer span.End()
+
+	code := c.Param("code")
+	span.SetAttributes(attribute.String("barcode.code", code))
+	if _, err := encodeCode128(code); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid barcode: " + err.Error()})
+		return
+	}
+
+	item, ok := app.items.bySKU.Get(code)
+	span.SetAttributes(attribute.Bool("cache.hit", ok))
+	if !ok {
+		var err error
+		item, err = app.itemStore.FindItem(ctx, "sku", code)
+		if err == sql.ErrNoRows {
+			logWithTrace(ctx, "WARN", "No item for scanned barcode", "code", code)
+			c.JSON(http.StatusNotFound, gin.H{"error": "Item not found"})
+			return
+		}
+		if err != nil {
+			logWithTrace(ctx, "ERROR", "Error fetching inventory item", "error", err.Error())
+			span.RecordError(err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch item"})
+			return
+		}
+		app.items.Add(item)
+	}
+
+	itemsQueried.Inc()
+	requestsTotal.WithLabelValues("GET", "/api/inventory/barcode/:code", "200").Inc()
+	app.render(c, http.StatusOK, item)
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestCode128Patterns(t *testing.T) {
+	seen := map[string]bool{}
+	for value, pattern := range code128Patterns {
+		width := 0
+		for _, w := range pattern {
+			width += int(w - '0')
+		}
+		if want := 11; value == code128Stop && width != 13 || value != code128Stop && width != want {
+			t.Errorf("symbol %d is %d modules wide", value, width)
+		}
+		if seen[pattern] {
+			t.Errorf("symbol %d has the pattern of another one", value)
+		}
+		seen[pattern] = true
+	}
+}
+
+// Scan a rendered barcode: read the widths along a row of pixels and turn
+// them back into symbols, checking the start, checksum and stop
+func scanCode128(t *testing.T, body []byte, scale int) string {
+	t.Helper()
+	img, err := png.Decode(bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var widths []int
+	dark := func(x int) bool { r, _, _, _ := img.At(x, 0).RGBA(); return r == 0 }
+	for x := 0; x < img.Bounds().Dx(); {
+		start := x
+		for x < img.Bounds().Dx() && dark(x) == dark(start) {
+			x++
+		}
+		if len(widths) > 0 || dark(start) {
+			widths = append(widths, (x-start)/scale)
+		}
+	}
+	// Drop the quiet zone on the right
+	widths = widths[:len(widths)-1]
+
+	symbol := map[string]int{}
+	for value, pattern := range code128Patterns {
+		symbol[pattern] = value
+	}
+	var values []int
+	for i := 0; i+6 <= len(widths); i += 6 {
+		pattern := ""
+		for _, w := range widths[i : i+6] {
+			pattern += string(rune('0' + w))
+		}
+		if i+7 == len(widths) {
+			pattern += string(rune('0' + widths[i+6]))
+		}
+		value, ok := symbol[pattern]
+		if !ok {
+			t.Fatalf("unknown symbol %s", pattern)
+		}
+		values = append(values, value)
+	}
+
+	if len(values) < 4 || values[0] != code128StartB || values[len(values)-1] != code128Stop {
+		t.Fatalf("got symbols %v, want start B ... stop", values)
+	}
+	data, check := values[1:len(values)-2], values[len(values)-2]
+	sum := code128StartB
+	text := ""
+	for i, v := range data {
+		sum += (i + 1) * v
+		text += string(rune(v + 32))
+	}
+	if sum%103 != check {
+		t.Fatalf("got checksum %d, want %d", check, sum%103)
+	}
+	return text
+}
+
+func TestGetItemBarcode(t *testing.T) {
+	items := &fakeItemStore{}
+	items.CreateItem(context.Background(), &InventoryItem{ProductName: "Widget", SKU: "WID-0042.b", Quantity: 1})
+	items.CreateItem(context.Background(), &InventoryItem{ProductName: "Crème", SKU: "CRÈME-1", Quantity: 1})
+	app := newFakeApp(t, items, &fakeStockStore{}, systemClock{})
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.GET("/api/inventory/:id/barcode", app.getItemBarcode)
+	router.GET("/api/inventory/barcode/:code", app.getItemByBarcode)
+	get := func(path, etag string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		if etag != "" {
+			req.Header.Set("If-None-Match", etag)
+		}
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := get("/api/inventory/1/barcode?scale=3&height=40", "")
+	if rec.Code != http.StatusOK || rec.Header().Get("Content-Type") != "image/png" || rec.Header().Get("ETag") == "" {
+		t.Fatalf("got status %d and headers %v", rec.Code, rec.Header())
+	}
+	if text := scanCode128(t, rec.Body.Bytes(), 3); text != "WID-0042.b" {
+		t.Errorf("scanned %q, want the SKU", text)
+	}
+
+	// A client with the current copy doesn't get it again, one with
+	// another size does
+	if again := get("/api/inventory/1/barcode?scale=3&height=40", rec.Header().Get("ETag")); again.Code != http.StatusNotModified || again.Body.Len() != 0 {
+		t.Errorf("got status %d, want 304", again.Code)
+	}
+	if other := get("/api/inventory/1/barcode", rec.Header().Get("ETag")); other.Code != http.StatusOK {
+		t.Errorf("got status %d for another size, want 200", other.Code)
+	}
+
+	for path, want := range map[string]int{
+		"/api/inventory/2/barcode":          http.StatusUnprocessableEntity,
+		"/api/inventory/3/barcode":          http.StatusNotFound,
+		"/api/inventory/x/barcode":          http.StatusBadRequest,
+		"/api/inventory/1/barcode?scale=9":  http.StatusBadRequest,
+		"/api/inventory/barcode/W%09X":      http.StatusBadRequest,
+		"/api/inventory/barcode/UNKNOWN-99": http.StatusNotFound,
+	} {
+		if rec := get(path, ""); rec.Code != want {
+			t.Errorf("%s: got status %d, want %d", path, rec.Code, want)
+		}
+	}
+
+	// Scanning the barcode finds the item
+	rec = get("/api/inventory/barcode/WID-0042.b", "")
+	var item InventoryItem
+	if err := json.Unmarshal(rec.Body.Bytes(), &item); err != nil || rec.Code != http.StatusOK || item.ID != 1 {
+		t.Errorf("got status %d, item %+v", rec.Code, item)
+	}
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+)
+
+var (
+	spanQueueSize = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "otel_span_queue_size",
+			Help: "Spans waiting to be exported to the collector",
+		},
+	)
+
+	spanQueueCapacity = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "otel_span_queue_capacity",
+			Help: "Spans that can wait to be exported before new ones are dropped (OTEL_BSP_MAX_QUEUE_SIZE)",
+		},
+	)
+
+	spansDropped = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "otel_spans_dropped_total",
+			Help: "Spans dropped because the export queue was full",
+		},
+	)
+
+	spansExported = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "otel_spans_exported_total",
+			Help: "Spans handed to the exporter by result: success or failed",
+		},
+		[]string{"result"},
+	)
+
+	spanExportDuration = promauto.NewHistogram(
+		prometheus.HistogramOpts{
+			Name:    "otel_span_export_duration_seconds",
+			Help:    "Time taken to export a batch of spans to the collector",
+			Buckets: []float64{.001, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30},
+		},
+	)
+)
+
+// spanBatcher is a batch span processor like the SDK's, which queues the
+// ended spans and exports them in batches, with its queue measured: the
+// SDK's drops spans when its queue is full without a trace of it.
+type spanBatcher struct {
+	exporter sdktrace.SpanExporter
+	cfg      SpanBatchConfig
+	queue    chan sdktrace.ReadOnlySpan
+	// Asks the loop to export everything queued, closing the channel
+	// it's given once done
+	flush chan chan struct{}
+	// Hands the loop a new exporter, see SwapExporter
+	swap chan exporterSwap
+
+	mu      sync.RWMutex
+	stopped bool
+	// Closed by Shutdown, to stop the loop, which closes done
+	stop chan struct{}
+	done chan struct{}
+}
+
+func newSpanBatcher(exporter sdktrace.SpanExporter, cfg SpanBatchConfig) *spanBatcher {
+	b := &spanBatcher{
+		exporter: exporter,
+		cfg:      cfg,
+		queue:    make(chan sdktrace.ReadOnlySpan, cfg.MaxQueueSize),
+		flush:    make(chan chan struct{}),
+		swap:     make(chan exporterSwap),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	spanQueueCapacity.Set(float64(cfg.MaxQueueSize))
+	go b.loop()
+	return b
+}
+
+func (b *spanBatcher) OnStart(parent context.Context, s sdktrace.ReadWriteSpan) {}
+
+// OnEnd queues a sampled span, or drops it when the queue is full rather
+// than hold up the request that ended it
+func (b *spanBatcher) OnEnd(s sdktrace.ReadOnlySpan) {
+	if !s.SpanContext().IsSampled() {
+		return
+	}
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	if b.stopped {
+		return
+	}
+	select {
+	case b.queue <- s:
+		spanQueueSize.Inc()
+	default:
+		spansDropped.Inc()
+	}
+}
+
+// Export a batch when it's full or OTEL_BSP_SCHEDULE_DELAY after the last
+// export, whichever comes first
+func (b *spanBatcher) loop() {
+	defer close(b.done)
+	delay := time.Duration(b.cfg.ScheduleDelay) * time.Millisecond
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	batch := make([]sdktrace.ReadOnlySpan, 0, b.cfg.MaxExportBatchSize)
+
+	export := func() {
+		if len(batch) > 0 {
+			b.export(batch)
+			batch = batch[:0]
+		}
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		timer.Reset(delay)
+	}
+	// Everything queued so far, in batches
+	drain := func() {
+		for {
+			select {
+			case s := <-b.queue:
+				spanQueueSize.Dec()
+				if batch = append(batch, s); len(batch) == b.cfg.MaxExportBatchSize {
+					export()
+				}
+			default:
+				export()
+				return
+			}
+		}
+	}
+
+	for {
+		select {
+		case s := <-b.queue:
+			spanQueueSize.Dec()
+			if batch = append(batch, s); len(batch) == b.cfg.MaxExportBatchSize {
+				export()
+			}
+		case <-timer.C:
+			export()
+		case flushed := <-b.flush:
+			drain()
+			close(flushed)
+		case req := <-b.swap:
+			drain()
+			req.old <- b.exporter
+			b.exporter = req.exporter
+		case <-b.stop:
+			drain()
+			return
+		}
+	}
+}
+
+func (b *spanBatcher) export(batch []sdktrace.ReadOnlySpan) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(b.cfg.ExportTimeout)*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	err := b.exporter.ExportSpans(ctx, batch)
+	spanExportDuration.Observe(time.Since(start).Seconds())
+	if err != nil {
+		spansExported.WithLabelValues("failed").Add(float64(len(batch)))
+		// To the OpenTelemetry error handler, like the SDK's batcher
+		otel.Handle(err)
+		return
+	}
+	spansExported.WithLabelValues("success").Add(float64(len(batch)))
+}
+
+// ForceFlush exports the spans queued so far
+func (b *spanBatcher) ForceFlush(ctx context.Context) error {
+	flushed := make(chan struct{})
+	select {
+	case b.flush <- flushed:
+	case <-b.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	select {
+	case <-flushed:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+type exporterSwap struct {
+	exporter sdktrace.SpanExporter
+	old      chan sdktrace.SpanExporter
+}
+
+// SwapExporter exports the spans queued so far with the current exporter
+// and the ones after with the new one. It returns the old exporter, for the
+// caller to shut down.
+func (b *spanBatcher) SwapExporter(ctx context.Context, exporter sdktrace.SpanExporter) (sdktrace.SpanExporter, error) {
+	req := exporterSwap{exporter: exporter, old: make(chan sdktrace.SpanExporter, 1)}
+	select {
+	case b.swap <- req:
+	case <-b.done:
+		return nil, errors.New("span batcher is shut down")
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	// The export of the queued spans is bounded by OTEL_BSP_EXPORT_TIMEOUT
+	return <-req.old, nil
+}
+
+// Shutdown exports the spans queued so far, ignoring the ones that end
+// later, and shuts the exporter down
+func (b *spanBatcher) Shutdown(ctx context.Context) error {
+	b.mu.Lock()
+	if b.stopped {
+		b.mu.Unlock()
+		return nil
+	}
+	b.stopped = true
+	close(b.stop)
+	b.mu.Unlock()
+
+	select {
+	case <-b.done:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	return b.exporter.Shutdown(ctx)
+}
+
+var _ sdktrace.SpanProcessor = (*spanBatcher)(nil)
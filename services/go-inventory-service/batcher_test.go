@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+
+	"inventory-service/internal/testkit"
+)
+
+// blockingExporter holds every export until release is closed
+type blockingExporter struct {
+	tracetest.InMemoryExporter
+	release chan struct{}
+	started chan struct{}
+	once    sync.Once
+}
+
+func (e *blockingExporter) ExportSpans(ctx context.Context, spans []sdktrace.ReadOnlySpan) error {
+	e.once.Do(func() { close(e.started) })
+	<-e.release
+	return e.InMemoryExporter.ExportSpans(ctx, spans)
+}
+
+func endSpans(tp *sdktrace.TracerProvider, n int) {
+	for i := 0; i < n; i++ {
+		_, span := tp.Tracer("test").Start(context.Background(), "span")
+		span.End()
+	}
+}
+
+func TestSpanBatcherExportsInBatches(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	batcher := newSpanBatcher(exporter, SpanBatchConfig{MaxQueueSize: 10, ScheduleDelay: 20, ExportTimeout: 1000, MaxExportBatchSize: 3})
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(batcher))
+
+	// A full batch goes without waiting for the delay, the rest after it
+	testkit.AssertCounterDelta(t, spansExported.WithLabelValues("success"), 4, func() {
+		endSpans(tp, 4)
+		deadline := time.Now().Add(time.Second)
+		for len(exporter.GetSpans()) < 4 && time.Now().Before(deadline) {
+			time.Sleep(5 * time.Millisecond)
+		}
+	})
+	if n := len(exporter.GetSpans()); n != 4 {
+		t.Fatalf("got %d spans exported, want 4", n)
+	}
+
+	endSpans(tp, 2)
+	if err := tp.ForceFlush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(exporter.GetSpans()); n != 6 {
+		t.Errorf("got %d spans exported after a flush, want 6", n)
+	}
+
+	// Shutdown exports what's queued, and nothing after
+	testkit.AssertCounterDelta(t, spansExported.WithLabelValues("success"), 1, func() {
+		endSpans(tp, 1)
+		if err := tp.Shutdown(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		endSpans(tp, 1)
+		batcher.ForceFlush(context.Background())
+	})
+}
+
+func TestSpanBatcherDropsWhenFull(t *testing.T) {
+	exporter := &blockingExporter{release: make(chan struct{}), started: make(chan struct{})}
+	batcher := newSpanBatcher(exporter, SpanBatchConfig{MaxQueueSize: 2, ScheduleDelay: 1000, ExportTimeout: 1000, MaxExportBatchSize: 1})
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(batcher))
+
+	// The first span is being exported, the next two fill the queue
+	endSpans(tp, 1)
+	<-exporter.started
+	testkit.AssertCounterDelta(t, spansDropped, 1, func() {
+		endSpans(tp, 3)
+	})
+
+	testkit.AssertCounterDelta(t, spansExported.WithLabelValues("success"), 3, func() {
+		close(exporter.release)
+		if err := tp.ForceFlush(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	})
+	if n := len(exporter.GetSpans()); n != 3 {
+		t.Errorf("got %d spans exported, want 3", n)
+	}
+	tp.Shutdown(context.Background())
+}
+
+func TestSpanBatcherSwapExporter(t *testing.T) {
+	old := tracetest.NewInMemoryExporter()
+	batcher := newSpanBatcher(old, SpanBatchConfig{MaxQueueSize: 10, ScheduleDelay: 1000, ExportTimeout: 1000, MaxExportBatchSize: 5})
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(batcher))
+	defer tp.Shutdown(context.Background())
+
+	// The queued spans go to the old exporter, the ones after to the new one
+	endSpans(tp, 2)
+	next := tracetest.NewInMemoryExporter()
+	swapped, err := batcher.SwapExporter(context.Background(), next)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if swapped != old || len(old.GetSpans()) != 2 {
+		t.Fatalf("got %d spans exported by the old exporter, want 2", len(old.GetSpans()))
+	}
+	endSpans(tp, 1)
+	if err := tp.ForceFlush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if len(old.GetSpans()) != 2 || len(next.GetSpans()) != 1 {
+		t.Errorf("got %d and %d spans exported, want 2 and 1", len(old.GetSpans()), len(next.GetSpans()))
+	}
+}
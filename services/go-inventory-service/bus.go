@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"runtime/debug"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	eventDeliveries = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "event_bus_deliveries_total",
+			Help: "Domain events handed to the event bus subscribers, by subscriber and result: delivered, failed, panic or dropped",
+		},
+		[]string{"subscriber", "result"},
+	)
+
+	eventDeliveryDuration = promauto.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "event_bus_delivery_duration_seconds",
+			Help:    "Time the event bus subscribers took to handle a domain event",
+			Buckets: []float64{.0001, .0005, .001, .005, .01, .025, .05, .1, .25, .5, 1},
+		},
+		[]string{"subscriber"},
+	)
+
+	lastDomainEvent = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "domain_event_last_timestamp_seconds",
+			Help: "Unix time of the last domain event of each type this replica published",
+		},
+		[]string{"type"},
+	)
+)
+
+// EventHandler reacts to a domain event published on the bus
+type EventHandler func(ctx context.Context, e DomainEvent) error
+
+type eventSubscription struct {
+	name    string
+	handler EventHandler
+	// The event types it takes, nil for all of them
+	types map[string]bool
+	async bool
+	// Called in the publisher's trace when an async delivery is dropped
+	dropped EventHandler
+}
+
+// EventBus hands the domain events the handlers publish to the subscribers
+// that react to them, so a handler doesn't know who does. Synchronous
+// subscribers run in the publisher's trace before Publish returns, and must
+// be quick; asynchronous ones run as worker pool jobs linked to it. A
+// subscriber's error or panic is logged and counted, and reaches neither
+// the publisher nor the other subscribers.
+//
+// Subscribers are added at startup, before anything is published.
+type EventBus struct {
+	workers *WorkerPool
+	subs    []eventSubscription
+}
+
+func newEventBus(workers *WorkerPool) *EventBus {
+	return &EventBus{workers: workers}
+}
+
+// Subscribe runs handler in the publisher's trace for the events of the
+// given types, or of any type when there are none
+func (b *EventBus) Subscribe(name string, handler EventHandler, types ...string) {
+	b.subscribe(eventSubscription{name: name, handler: handler}, types)
+}
+
+// SubscribeAsync runs handler as a background job, for subscribers that do
+// I/O. The event is dropped when the worker queue is full, and dropped, if
+// not nil, is called with it instead, e.g. to undo what the publisher did
+// for the delivery.
+func (b *EventBus) SubscribeAsync(name string, handler, dropped EventHandler, types ...string) {
+	b.subscribe(eventSubscription{name: name, handler: handler, async: true, dropped: dropped}, types)
+}
+
+func (b *EventBus) subscribe(s eventSubscription, types []string) {
+	if len(types) > 0 {
+		s.types = map[string]bool{}
+		for _, t := range types {
+			s.types[t] = true
+		}
+	}
+	b.subs = append(b.subs, s)
+}
+
+// Publish hands e to its subscribers
+func (b *EventBus) Publish(ctx context.Context, e DomainEvent) {
+	if b == nil {
+		return
+	}
+	for _, s := range b.subs {
+		if s.types != nil && !s.types[e.Type] {
+			continue
+		}
+		if !s.async {
+			if err := s.deliver(ctx, e); err != nil {
+				logWithTrace(ctx, "WARN", "Event subscriber failed", "subscriber", s.name,
+					"type", e.Type, "error", err.Error())
+			}
+			continue
+		}
+
+		s := s
+		if err := b.workers.Submit(ctx, "event "+s.name, func(ctx context.Context) error {
+			return s.deliver(ctx, e)
+		}); err != nil {
+			eventDeliveries.WithLabelValues(s.name, "dropped").Inc()
+			logWithTrace(ctx, "WARN", "Domain event dropped", "subscriber", s.name,
+				"type", e.Type, "error", err.Error())
+			if s.dropped == nil {
+				continue
+			}
+			if err := s.dropped(ctx, e); err != nil {
+				logWithTrace(ctx, "WARN", "Event subscriber failed to handle a dropped event", "subscriber", s.name,
+					"type", e.Type, "error", err.Error())
+			}
+		}
+	}
+}
+
+// Run the handler, measured, with a panic turned into an error
+func (s eventSubscription) deliver(ctx context.Context, e DomainEvent) (err error) {
+	start := time.Now()
+	result := "delivered"
+	defer func() {
+		if r := recover(); r != nil {
+			result = "panic"
+			err = fmt.Errorf("panic: %v", r)
+			logWithTrace(ctx, "ERROR", "Event subscriber panicked", "subscriber", s.name,
+				"type", e.Type, "panic", fmt.Sprint(r), "stack", string(debug.Stack()))
+		} else if err != nil {
+			result = "failed"
+		}
+		eventDeliveryDuration.WithLabelValues(s.name).Observe(time.Since(start).Seconds())
+		eventDeliveries.WithLabelValues(s.name, result).Inc()
+	}()
+	return s.handler(ctx, e)
+}
+
+// Subscriber keeping domain_event_last_timestamp_seconds, for alerts such as
+// no reservation in the last 10 minutes
+func observeEvent(ctx context.Context, e DomainEvent) error {
+	lastDomainEvent.WithLabelValues(e.Type).Set(float64(e.OccurredAt.Unix()))
+	return nil
+}
+
+// The event types that make cached items or responses stale
+var cacheEventTypes = []string{eventItemCreated, eventItemPriceChanged, eventReservationConfirmed,
+	eventStockLevelRepaired, eventItemsCleanedUp, eventSnapshotRestored}
+
+// Subscriber dropping the cached items and responses an event made stale.
+// Synchronous, so a client reads its own write as soon as the handler
+// returns.
+func (app *App) invalidateCaches(ctx context.Context, e DomainEvent) error {
+	switch e.Type {
+	case eventItemCreated, eventItemPriceChanged:
+		id, err := strconv.Atoi(e.EntityID)
+		if err != nil {
+			return fmt.Errorf("item ID %q: %w", e.EntityID, err)
+		}
+		sku, _ := e.Data["sku"].(string)
+		app.items.Invalidate(InventoryItem{ID: id, SKU: sku})
+		groups := []string{cacheGroupItems}
+		if e.Type == eventItemCreated {
+			groups = append(groups, cacheGroupStockLevels)
+		}
+		app.responses.Invalidate(ctx, e.Type, groups...)
+	case eventReservationConfirmed:
+		// The item's quantity changed. The event doesn't have its SKU,
+		// which is needed to drop it from the cache by SKU too.
+		id, _ := e.Data["item_id"].(int)
+		item, err := app.itemStore.FindItem(ctx, "id", id)
+		if err != nil {
+			item = InventoryItem{ID: id}
+		}
+		app.items.Invalidate(item)
+		app.responses.Invalidate(ctx, e.Type, cacheGroupItems)
+	case eventStockLevelRepaired:
+		app.responses.Invalidate(ctx, e.Type, cacheGroupStockLevels)
+	case eventItemsCleanedUp, eventSnapshotRestored:
+		app.items.Purge()
+		app.responses.Invalidate(ctx, e.Type, cacheGroupItems, cacheGroupStockLevels)
+	}
+	return nil
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"inventory-service/internal/testkit"
+)
+
+func TestEventBusDelivers(t *testing.T) {
+	tr := testkit.InstallTracing(t)
+	pool := newWorkerPool(tr.Tracer("test"), WorkerConfig{Size: 1, QueueSize: 10})
+	bus := newEventBus(pool)
+
+	var all, reservations []string
+	bus.Subscribe("all", func(ctx context.Context, e DomainEvent) error {
+		all = append(all, e.Type)
+		return nil
+	})
+	bus.Subscribe("reservations", func(ctx context.Context, e DomainEvent) error {
+		reservations = append(reservations, e.Type)
+		return nil
+	}, eventStockReserved, eventReservationExpired)
+	// A failing subscriber doesn't keep the event from the others
+	bus.Subscribe("panicky", func(ctx context.Context, e DomainEvent) error {
+		panic("boom")
+	})
+	bus.Subscribe("failing", func(ctx context.Context, e DomainEvent) error {
+		return errors.New("down")
+	})
+	async := make(chan DomainEvent, 10)
+	bus.SubscribeAsync("async", func(ctx context.Context, e DomainEvent) error {
+		async <- e
+		return nil
+	}, nil, eventItemCreated)
+
+	ctx, parent := tr.Tracer("test").Start(context.Background(), "request")
+	testkit.AssertCounterDelta(t, eventDeliveries.WithLabelValues("panicky", "panic"), 2, func() {
+		testkit.AssertCounterDelta(t, eventDeliveries.WithLabelValues("failing", "failed"), 2, func() {
+			bus.Publish(ctx, DomainEvent{Type: eventItemCreated, EntityID: "1"})
+			bus.Publish(ctx, DomainEvent{Type: eventStockReserved, EntityID: "2"})
+		})
+	})
+	parent.End()
+
+	if len(all) != 2 || len(reservations) != 1 || reservations[0] != eventStockReserved {
+		t.Errorf("got %v for all and %v for reservations", all, reservations)
+	}
+	if e := <-async; e.EntityID != "1" {
+		t.Errorf("got async event %+v", e)
+	}
+	if err := pool.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if len(async) != 0 {
+		t.Errorf("async subscriber got an event of a type it didn't subscribe to")
+	}
+	span := tr.AssertSpan(t, "job event async")
+	if len(span.Links) != 1 || span.Links[0].SpanContext.SpanID() != parent.SpanContext().SpanID() {
+		t.Errorf("async delivery not linked to the publishing span: %+v", span.Links)
+	}
+}
+
+func TestEventBusDropsWhenWorkersStopped(t *testing.T) {
+	pool := newWorkerPool(testkit.InstallTracing(t).Tracer("test"), WorkerConfig{Size: 1, QueueSize: 10})
+	pool.Shutdown(context.Background())
+	bus := newEventBus(pool)
+	var dropped []DomainEvent
+	bus.SubscribeAsync("late", func(ctx context.Context, e DomainEvent) error {
+		t.Error("event delivered after shutdown")
+		return nil
+	}, func(ctx context.Context, e DomainEvent) error {
+		dropped = append(dropped, e)
+		return nil
+	})
+
+	testkit.AssertCounterDelta(t, eventDeliveries.WithLabelValues("late", "dropped"), 1, func() {
+		bus.Publish(context.Background(), DomainEvent{Type: eventItemCreated, EntityID: "1"})
+	})
+	if len(dropped) != 1 || dropped[0].EntityID != "1" {
+		t.Errorf("subscriber not told about the dropped event: %+v", dropped)
+	}
+}
+
+func TestCacheSubscriber(t *testing.T) {
+	app := newFakeApp(t, &fakeItemStore{}, &fakeStockStore{}, systemClock{})
+	app.items = newItemCache(ItemCacheConfig{Size: 10, TTL: time.Minute}, app.clock)
+	app.items.Add(InventoryItem{ID: 7, SKU: "W-7"})
+	app.items.Add(InventoryItem{ID: 8, SKU: "W-8"})
+	store := newMemoryResponseStore(10, app.clock)
+	app.responses = &ResponseCache{store: store, ttl: time.Minute}
+	app.bus = newEventBus(nil)
+	app.bus.Subscribe("cache", app.invalidateCaches, cacheEventTypes...)
+	generations := func() (int64, int64) {
+		items, _ := store.Generation(context.Background(), cacheGroupItems)
+		stockLevels, _ := store.Generation(context.Background(), cacheGroupStockLevels)
+		return items, stockLevels
+	}
+
+	ctx := context.Background()
+	testkit.AssertCounterDelta(t, responseCacheInvalidations.WithLabelValues(cacheGroupItems, eventItemPriceChanged), 1, func() {
+		app.publishEvent(ctx, eventItemPriceChanged, "item", 7, "Set the price of W-7 to 2.50", map[string]interface{}{"sku": "W-7"})
+	})
+	if _, ok := app.items.byID.Get(7); ok {
+		t.Error("item 7 still cached by ID")
+	}
+	if _, ok := app.items.bySKU.Get("W-7"); ok {
+		t.Error("item 7 still cached by SKU")
+	}
+	if _, ok := app.items.byID.Get(8); !ok {
+		t.Error("item 8 dropped by a change of item 7")
+	}
+	if items, stockLevels := generations(); items != 1 || stockLevels != 0 {
+		t.Errorf("got generations %d and %d, want only the items invalidated", items, stockLevels)
+	}
+
+	// Not a change of what is cached
+	app.publishEvent(ctx, eventReservationExpired, "reservation", 3, "Reservation of 1 of item 8 expired", map[string]interface{}{"item_id": 8})
+	app.publishEvent(ctx, eventStockLevelRepaired, "stock_level", "W-8", "Wrote the stock level of W-8", nil)
+	if items, stockLevels := generations(); items != 1 || stockLevels != 1 {
+		t.Errorf("got generations %d and %d, want the stock levels invalidated", items, stockLevels)
+	}
+
+	app.publishEvent(ctx, eventItemsCleanedUp, "janitor", "2024-03-01T12:00:00Z", "Removed 6 demo items", nil)
+	if _, ok := app.items.byID.Get(8); ok {
+		t.Error("items still cached after the janitor removed some")
+	}
+	if items, stockLevels := generations(); items != 2 || stockLevels != 2 {
+		t.Errorf("got generations %d and %d, want both invalidated", items, stockLevels)
+	}
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"container/list"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	cacheRequests = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "cache_requests_total",
+			Help: "Total number of cache lookups by cache and result (hit or miss)",
+		},
+		[]string{"cache", "result"},
+	)
+
+	cacheEvictions = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "cache_evictions_total",
+			Help: "Total number of entries evicted from a cache because it was full",
+		},
+		[]string{"cache"},
+	)
+
+	cacheEntries = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "cache_entries",
+			Help: "Current number of entries in a cache",
+		},
+		[]string{"cache"},
+	)
+)
+
+// lruCache is a fixed size least-recently-used cache whose entries expire
+// after a TTL. A nil cache is valid and caches nothing.
+type lruCache[K comparable, V any] struct {
+	name     string
+	capacity int
+	ttl      time.Duration
+	clock    Clock
+
+	mu      sync.Mutex
+	order   *list.List
+	entries map[K]*list.Element
+}
+
+type lruEntry[K comparable, V any] struct {
+	key       K
+	value     V
+	expiresAt time.Time
+}
+
+func newLRUCache[K comparable, V any](name string, capacity int, ttl time.Duration, clock Clock) *lruCache[K, V] {
+	if capacity <= 0 {
+		return nil
+	}
+	return &lruCache[K, V]{
+		name:     name,
+		capacity: capacity,
+		ttl:      ttl,
+		clock:    clock,
+		order:    list.New(),
+		entries:  make(map[K]*list.Element, capacity),
+	}
+}
+
+// Get returns the cached value for key, if present and not expired
+func (c *lruCache[K, V]) Get(key K) (V, bool) {
+	var zero V
+	if c == nil {
+		return zero, false
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.entries[key]
+	if ok && c.clock.Now().After(el.Value.(*lruEntry[K, V]).expiresAt) {
+		c.removeElement(el)
+		ok = false
+	}
+	if !ok {
+		cacheRequests.WithLabelValues(c.name, "miss").Inc()
+		return zero, false
+	}
+
+	cacheRequests.WithLabelValues(c.name, "hit").Inc()
+	c.order.MoveToFront(el)
+	return el.Value.(*lruEntry[K, V]).value, true
+}
+
+// Add stores value under key, evicting the least recently used entry when
+// the cache is full
+func (c *lruCache[K, V]) Add(key K, value V) {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	expiresAt := c.clock.Now().Add(c.ttl)
+	if el, ok := c.entries[key]; ok {
+		entry := el.Value.(*lruEntry[K, V])
+		entry.value = value
+		entry.expiresAt = expiresAt
+		c.order.MoveToFront(el)
+		return
+	}
+
+	c.entries[key] = c.order.PushFront(&lruEntry[K, V]{key: key, value: value, expiresAt: expiresAt})
+	if c.order.Len() > c.capacity {
+		c.removeElement(c.order.Back())
+		cacheEvictions.WithLabelValues(c.name).Inc()
+	}
+	cacheEntries.WithLabelValues(c.name).Set(float64(c.order.Len()))
+}
+
+// Remove drops key from the cache
+func (c *lruCache[K, V]) Remove(key K) {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.entries[key]; ok {
+		c.removeElement(el)
+	}
+}
+
+// Purge drops every entry
+func (c *lruCache[K, V]) Purge() {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.order.Init()
+	c.entries = make(map[K]*list.Element, c.capacity)
+	cacheEntries.WithLabelValues(c.name).Set(0)
+}
+
+func (c *lruCache[K, V]) removeElement(el *list.Element) {
+	c.order.Remove(el)
+	delete(c.entries, el.Value.(*lruEntry[K, V]).key)
+	cacheEntries.WithLabelValues(c.name).Set(float64(c.order.Len()))
+}
+
+// ItemCache holds recently read inventory items by ID and by SKU, so hot
+// items in the load generator's skewed read pattern don't hit Postgres on
+// every request
+type ItemCache struct {
+	byID  *lruCache[int, InventoryItem]
+	bySKU *lruCache[string, InventoryItem]
+}
+
+// Create the item cache. A size of 0 disables it.
+func newItemCache(cfg ItemCacheConfig, clock Clock) *ItemCache {
+	return &ItemCache{
+		byID:  newLRUCache[int, InventoryItem]("items_by_id", cfg.Size, cfg.TTL, clock),
+		bySKU: newLRUCache[string, InventoryItem]("items_by_sku", cfg.Size, cfg.TTL, clock),
+	}
+}
+
+func (c *ItemCache) Add(item InventoryItem) {
+	c.byID.Add(item.ID, item)
+	c.bySKU.Add(item.SKU, item)
+}
+
+// Invalidate drops an item that was written from both indexes
+func (c *ItemCache) Invalidate(item InventoryItem) {
+	c.byID.Remove(item.ID)
+	c.bySKU.Remove(item.SKU)
+}
+
+// Purge drops every item, after the table was replaced
+func (c *ItemCache) Purge() {
+	c.byID.Purge()
+	c.bySKU.Purge()
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// Change log of the inventory table for the delta sync. A trigger records
+// every insert, update and delete, so no write path can forget to. The
+// advisory lock serializes replicas starting together; on first run the
+// existing items are backfilled as created.
+const createChangeLogQuery = `
+	SELECT pg_advisory_xact_lock(hashtext('inventory_changes'));
+
+	CREATE TABLE IF NOT EXISTS inventory_changes (
+		seq BIGSERIAL PRIMARY KEY,
+		item_id INTEGER NOT NULL,
+		op VARCHAR(10) NOT NULL,
+		changed_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		txid BIGINT NOT NULL DEFAULT txid_current()
+	);
+	CREATE INDEX IF NOT EXISTS inventory_changes_changed_at ON inventory_changes (changed_at);
+
+	INSERT INTO inventory_changes (item_id, op, changed_at)
+	SELECT id, 'created', created_at FROM inventory
+	WHERE NOT EXISTS (SELECT 1 FROM inventory_changes)
+	ORDER BY id;
+
+	CREATE OR REPLACE FUNCTION record_inventory_change() RETURNS trigger AS $$
+	BEGIN
+		IF TG_OP = 'DELETE' THEN
+			INSERT INTO inventory_changes (item_id, op) VALUES (OLD.id, 'deleted');
+			RETURN OLD;
+		END IF;
+		INSERT INTO inventory_changes (item_id, op)
+		VALUES (NEW.id, CASE TG_OP WHEN 'INSERT' THEN 'created' ELSE 'updated' END);
+		RETURN NEW;
+	END;
+	$$ LANGUAGE plpgsql;
+
+	CREATE OR REPLACE TRIGGER inventory_changes
+	AFTER INSERT OR UPDATE OR DELETE ON inventory
+	FOR EACH ROW EXECUTE FUNCTION record_inventory_change();
+`
+
+// ItemChange is one entry of the inventory change log
+type ItemChange struct {
+	Seq int64 `json:"seq"`
+	// "created", "updated" or "deleted"
+	Op        string    `json:"op"`
+	ItemID    int       `json:"item_id"`
+	ChangedAt time.Time `json:"changed_at"`
+	// The item as it is now, absent for a deleted item
+	Item *InventoryItem `json:"item,omitempty"`
+}
+
+// ChangePage is a page of the change log. Cursor is passed back as since
+// to get the changes that follow.
+type ChangePage struct {
+	Changes []ItemChange `json:"changes"`
+	Cursor  string       `json:"cursor"`
+	HasMore bool         `json:"has_more"`
+}
+
+const (
+	defaultChangesLimit = 100
+	maxChangesLimit     = 1000
+)
+
+// Parse the since parameter: a cursor from a previous page, an RFC 3339
+// timestamp, or nothing for the whole change log
+func parseSince(since string) (afterSeq int64, after time.Time, err error) {
+	if since == "" {
+		return 0, time.Time{}, nil
+	}
+	if seq, err := strconv.ParseInt(since, 10, 64); err == nil && seq >= 0 {
+		return seq, time.Time{}, nil
+	}
+	t, err := time.Parse(time.RFC3339Nano, since)
+	if err != nil {
+		return 0, time.Time{}, fmt.Errorf("since must be a cursor or an RFC 3339 timestamp")
+	}
+	// The change log is in the database's time zone, UTC
+	return 0, t.UTC(), nil
+}
+
+// List the items created, updated and deleted since a cursor or a point in
+// time, for clients that keep a copy of the inventory in sync (PostgreSQL)
+func (app *App) listChanges(c *gin.Context) {
+	ctx := c.Request.Context()
+	ctx, span := app.tracer.Start(ctx, "listChanges")
+	defer span.End()
+
+	since := c.Query("since")
+	afterSeq, after, err := parseSince(since)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	limit := defaultChangesLimit
+	if s := c.Query("limit"); s != "" {
+		limit, err = strconv.Atoi(s)
+		if err != nil || limit < 1 || limit > maxChangesLimit {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("limit must be between 1 and %d", maxChangesLimit)})
+			return
+		}
+	}
+	span.SetAttributes(attribute.String("changes.since", since), attribute.Int("changes.limit", limit))
+
+	// A cursor's own change is kept until the log is trimmed past it, and
+	// then the changes after it may be gone too
+	if afterSeq > 0 {
+		oldest, err := app.itemStore.OldestChangeSeq(ctx)
+		if err != nil {
+			logWithTrace(ctx, "ERROR", "Error listing inventory changes", "error", err.Error())
+			span.RecordError(err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list changes"})
+			return
+		}
+		if afterSeq < oldest {
+			requestsTotal.WithLabelValues("GET", "/api/inventory/changes", "410").Inc()
+			c.JSON(http.StatusGone, gin.H{"error": "Changes since the cursor are no longer kept, list the inventory again"})
+			return
+		}
+	}
+
+	// One more than asked for, to know whether there are more
+	changes, err := app.itemStore.ListChanges(ctx, afterSeq, after, limit+1)
+	if err != nil {
+		logWithTrace(ctx, "ERROR", "Error listing inventory changes", "error", err.Error())
+		span.RecordError(err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list changes"})
+		return
+	}
+
+	page := ChangePage{Changes: changes, Cursor: since}
+	if len(changes) > limit {
+		page.Changes, page.HasMore = changes[:limit], true
+	}
+	if n := len(page.Changes); n > 0 {
+		page.Cursor = strconv.FormatInt(page.Changes[n-1].Seq, 10)
+	}
+	span.SetAttributes(attribute.Int("changes.count", len(page.Changes)))
+
+	requestsTotal.WithLabelValues("GET", "/api/inventory/changes", "200").Inc()
+	logWithTrace(ctx, "INFO", "Inventory changes listed", "since", since, "count", len(page.Changes))
+
+	app.renderJSON(c, http.StatusOK, page)
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func getChanges(t *testing.T, app *App, query string) (*httptest.ResponseRecorder, ChangePage) {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.GET("/api/inventory/changes", app.listChanges)
+
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/inventory/changes"+query, nil))
+	var page ChangePage
+	if rec.Code == http.StatusOK {
+		if err := json.Unmarshal(rec.Body.Bytes(), &page); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return rec, page
+}
+
+func TestListChangesPages(t *testing.T) {
+	start := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	items := &fakeItemStore{}
+	for i := 1; i <= 5; i++ {
+		items.changes = append(items.changes, ItemChange{
+			Seq: int64(i), Op: "created", ItemID: i, ChangedAt: start.Add(time.Duration(i) * time.Minute),
+		})
+	}
+	app := newFakeApp(t, items, &fakeStockStore{}, systemClock{})
+	app.json = jsonEncoders["std"]
+
+	_, page := getChanges(t, app, "?limit=2")
+	if len(page.Changes) != 2 || !page.HasMore || page.Cursor != "2" {
+		t.Fatalf("first page: %+v", page)
+	}
+
+	// Following the cursor to the end
+	_, page = getChanges(t, app, "?limit=2&since="+page.Cursor)
+	_, page = getChanges(t, app, "?limit=2&since="+page.Cursor)
+	if len(page.Changes) != 1 || page.HasMore || page.Cursor != "5" {
+		t.Fatalf("last page: %+v", page)
+	}
+
+	// Polling with nothing new keeps the cursor
+	_, page = getChanges(t, app, "?since=5")
+	if len(page.Changes) != 0 || page.Cursor != "5" {
+		t.Errorf("empty page: %+v", page)
+	}
+
+	// A timestamp starts from that point in time
+	_, page = getChanges(t, app, "?since="+start.Add(3*time.Minute).Format(time.RFC3339))
+	if len(page.Changes) != 2 || page.Changes[0].Seq != 4 {
+		t.Errorf("changes since a timestamp: %+v", page)
+	}
+}
+
+func TestListChangesTrimmedCursor(t *testing.T) {
+	items := &fakeItemStore{changes: []ItemChange{
+		{Seq: 8, Op: "created", ItemID: 1, ChangedAt: time.Now()},
+		{Seq: 9, Op: "updated", ItemID: 1, ChangedAt: time.Now()},
+	}}
+	app := newFakeApp(t, items, &fakeStockStore{}, systemClock{})
+
+	// The changes after 5 are trimmed up to 8
+	if rec, _ := getChanges(t, app, "?since=5"); rec.Code != http.StatusGone {
+		t.Errorf("cursor before the oldest change: got status %d, want 410", rec.Code)
+	}
+	if rec, page := getChanges(t, app, "?since=8"); rec.Code != http.StatusOK || len(page.Changes) != 1 {
+		t.Errorf("cursor at the oldest change: got status %d, %+v", rec.Code, page)
+	}
+}
+
+func TestListChangesInvalidParams(t *testing.T) {
+	app := newFakeApp(t, &fakeItemStore{}, &fakeStockStore{}, systemClock{})
+	for _, query := range []string{"?since=yesterday", "?since=-1", "?limit=0", "?limit=5000"} {
+		if rec, _ := getChanges(t, app, query); rec.Code != http.StatusBadRequest {
+			t.Errorf("%s: got status %d, want 400", query, rec.Code)
+		}
+	}
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Chaos holds the fault injection settings used for demo scenarios.
+// Settings can be changed while the service is running.
+type Chaos struct {
+	mu sync.RWMutex
+
+	// Percentage (0-100) of database queries that are slowed down
+	slowQueryPercent float64
+	slowQueryDelay   time.Duration
+	// Server-side time limit for the slow Mongo aggregation; when it is
+	// shorter than the delay the aggregation fails instead of just being slow
+	slowQueryMongoMaxTime time.Duration
+
+	// When set, every Mongo operation fails as if the database was down
+	mongoBroken bool
+	// When set, the PostgreSQL read replica fails as if it was down
+	replicaBroken bool
+
+	// Goroutines leaked per second, and the channel that releases them
+	leakRate    float64
+	leakRelease chan struct{}
+
+	// Offset added to the service's clock
+	skew time.Duration
+
+	rand randSource
+}
+
+var errMongoUnavailable = errors.New("chaos: mongodb is unavailable")
+
+var leakedGoroutines = promauto.NewGauge(
+	prometheus.GaugeOpts{
+		Name: "chaos_leaked_goroutines",
+		Help: "Number of goroutines currently leaked by the chaos goroutine leak",
+	},
+)
+
+// Create the chaos subsystem with its startup settings
+func newChaos(cfg ChaosConfig) *Chaos {
+	ch := &Chaos{
+		slowQueryPercent:      cfg.SlowQueryPercent,
+		slowQueryDelay:        cfg.SlowQueryDelay,
+		slowQueryMongoMaxTime: cfg.SlowQueryMongoMaxTime,
+		leakRate:              cfg.GoroutineLeakRate,
+		leakRelease:           make(chan struct{}),
+		skew:                  cfg.ClockSkew,
+		rand:                  globalRand{},
+	}
+
+	if ch.slowQueryPercent > 0 {
+		log.Printf("Chaos: slowing down %.1f%% of queries by %s", ch.slowQueryPercent, ch.slowQueryDelay)
+	}
+	if ch.leakRate > 0 {
+		log.Printf("Chaos: leaking %.1f goroutines per second", ch.leakRate)
+	}
+	if ch.skew != 0 {
+		log.Printf("Chaos: clock skewed by %s", ch.skew)
+	}
+	return ch
+}
+
+// SetSlowQueries changes the slow query simulation at runtime.
+// A percent of zero turns it off.
+func (ch *Chaos) SetSlowQueries(percent float64, delay time.Duration) {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+	ch.slowQueryPercent = percent
+	if delay > 0 {
+		ch.slowQueryDelay = delay
+	}
+}
+
+// nextSlowQuery decides whether the next query should be slowed down and
+// returns the delay to inject, or zero.
+func (ch *Chaos) nextSlowQuery() time.Duration {
+	ch.mu.RLock()
+	defer ch.mu.RUnlock()
+	if ch.slowQueryPercent <= 0 || ch.rand.Float64()*100 >= ch.slowQueryPercent {
+		return 0
+	}
+	return ch.slowQueryDelay
+}
+
+// SetMongoBroken makes all Mongo operations fail (or work again).
+func (ch *Chaos) SetMongoBroken(broken bool) {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+	ch.mongoBroken = broken
+}
+
+// SetReplicaBroken makes the read replica fail (or work again), so reads
+// fail over to the primary
+func (ch *Chaos) SetReplicaBroken(broken bool) {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+	ch.replicaBroken = broken
+}
+
+// SetGoroutineLeak changes how many goroutines are leaked per second.
+// A rate of zero stops leaking but keeps already leaked goroutines.
+func (ch *Chaos) SetGoroutineLeak(rate float64) {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+	ch.leakRate = rate
+}
+
+// SetClockSkew sets how far the service's clock is off. Timestamps of
+// written items and stock levels are shifted by it.
+func (ch *Chaos) SetClockSkew(skew time.Duration) {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+	ch.skew = skew
+}
+
+func (ch *Chaos) clockSkew() time.Duration {
+	ch.mu.RLock()
+	defer ch.mu.RUnlock()
+	return ch.skew
+}
+
+// Reset turns off all fault injection and releases leaked goroutines.
+func (ch *Chaos) Reset() {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+	ch.slowQueryPercent = 0
+	ch.mongoBroken = false
+	ch.replicaBroken = false
+	ch.leakRate = 0
+	ch.skew = 0
+	close(ch.leakRelease)
+	ch.leakRelease = make(chan struct{})
+}
+
+func (ch *Chaos) goroutineLeak() (float64, chan struct{}) {
+	ch.mu.RLock()
+	defer ch.mu.RUnlock()
+	return ch.leakRate, ch.leakRelease
+}
+
+// Leak goroutines at the configured rate until ctx is done. Each leaked
+// goroutine blocks until the next Reset, like a worker waiting on a channel
+// nobody will ever send to.
+func (ch *Chaos) runGoroutineLeaker(ctx context.Context) {
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+
+	pending := 0.0
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			rate, release := ch.goroutineLeak()
+			if rate <= 0 {
+				pending = 0
+				continue
+			}
+			for pending += rate / 10; pending >= 1; pending-- {
+				leakedGoroutines.Inc()
+				go leakedWorker(release)
+			}
+		}
+	}
+}
+
+func leakedWorker(release <-chan struct{}) {
+	defer leakedGoroutines.Dec()
+	<-release
+}
+
+// mongoFault returns the error to fail a Mongo operation with, if any
+func (ch *Chaos) mongoFault() error {
+	ch.mu.RLock()
+	defer ch.mu.RUnlock()
+	if ch.mongoBroken {
+		return errMongoUnavailable
+	}
+	return nil
+}
+
+// replicaFault returns the error to fail a replica query with, if any
+func (ch *Chaos) replicaFault() error {
+	ch.mu.RLock()
+	defer ch.mu.RUnlock()
+	if ch.replicaBroken {
+		return errReplicaUnavailable
+	}
+	return nil
+}
+
+func (ch *Chaos) mongoMaxTime() time.Duration {
+	ch.mu.RLock()
+	defer ch.mu.RUnlock()
+	return ch.slowQueryMongoMaxTime
+}
+
+// Run pg_sleep ahead of a query when the slow query simulation picks it.
+// The sleep runs inside PostgreSQL, so it shows up in the database's own
+// statistics and holds a pool connection just like a real slow query.
+func (ch *Chaos) slowPostgres(ctx context.Context, db *sql.DB) {
+	delay := ch.nextSlowQuery()
+	if delay == 0 {
+		return
+	}
+
+	trace.SpanFromContext(ctx).AddEvent("chaos.slow_query", trace.WithAttributes(
+		attribute.String("db.system", "postgresql"),
+		attribute.Float64("chaos.delay_seconds", delay.Seconds()),
+	))
+	logWithTrace(ctx, "INFO", "Chaos: injecting slow Postgres query", "delay", delay.String())
+
+	if _, err := db.ExecContext(ctx, "SELECT pg_sleep($1)", delay.Seconds()); err != nil {
+		logWithTrace(ctx, "WARN", "Slow query simulation failed", "db", "postgres", "error", err.Error())
+	}
+}
+
+// Apply Mongo fault injection ahead of an operation. A broken Mongo fails
+// right away; otherwise a deliberately slow aggregation runs when the slow
+// query simulation picks it. With CHAOS_SLOW_QUERY_MONGO_MAX_TIME set below
+// the delay, the server aborts the aggregation and the error is returned.
+func (ch *Chaos) mongoFaults(ctx context.Context, db *mongo.Database) error {
+	if err := ch.mongoFault(); err != nil {
+		trace.SpanFromContext(ctx).AddEvent("chaos.mongo_unavailable")
+		return err
+	}
+
+	delay := ch.nextSlowQuery()
+	if delay == 0 {
+		return nil
+	}
+
+	trace.SpanFromContext(ctx).AddEvent("chaos.slow_query", trace.WithAttributes(
+		attribute.String("db.system", "mongodb"),
+		attribute.Float64("chaos.delay_seconds", delay.Seconds()),
+	))
+	logWithTrace(ctx, "INFO", "Chaos: injecting slow Mongo aggregation", "delay", delay.String())
+
+	pipeline := mongo.Pipeline{
+		{{Key: "$documents", Value: bson.A{bson.M{}}}},
+		{{Key: "$match", Value: bson.M{"$expr": bson.M{"$function": bson.M{
+			"body": "function(ms) { sleep(ms); return true; }",
+			"args": bson.A{delay.Milliseconds()},
+			"lang": "js",
+		}}}}},
+	}
+	opts := options.Aggregate()
+	if maxTime := ch.mongoMaxTime(); maxTime > 0 {
+		opts.SetMaxTime(maxTime)
+	}
+
+	cursor, err := db.Aggregate(ctx, pipeline, opts)
+	if err != nil {
+		logWithTrace(ctx, "WARN", "Slow query simulation failed", "db", "mongodb", "error", err.Error())
+		return err
+	}
+	return cursor.Close(ctx)
+}
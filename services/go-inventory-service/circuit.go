@@ -0,0 +1,371 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+var (
+	circuitState = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "circuit_breaker_state",
+			Help: "State of the circuit breaker of each downstream: 0 closed, 1 half-open, 2 open",
+		},
+		[]string{"circuit"},
+	)
+
+	circuitTransitions = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "circuit_breaker_transitions_total",
+			Help: "Circuit breaker state changes by circuit and the state changed to",
+		},
+		[]string{"circuit", "state"},
+	)
+
+	circuitFailures = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "circuit_breaker_failures_total",
+			Help: "Failed calls counted by the circuit breaker of each downstream",
+		},
+		[]string{"circuit"},
+	)
+
+	circuitRejections = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "circuit_breaker_rejections_total",
+			Help: "Calls not made because the downstream's circuit was open",
+		},
+		[]string{"circuit"},
+	)
+)
+
+var errCircuitOpen = errors.New("circuit breaker is open")
+
+const (
+	circuitClosed   = "closed"
+	circuitHalfOpen = "half_open"
+	circuitOpen     = "open"
+)
+
+// Values of circuit_breaker_state
+var circuitStateValues = map[string]float64{circuitClosed: 0, circuitHalfOpen: 1, circuitOpen: 2}
+
+// State changes kept per circuit for GET /admin/circuits
+const circuitTransitionHistory = 10
+
+// CircuitTransition is a state change of a circuit breaker
+type CircuitTransition struct {
+	From   string    `json:"from"`
+	To     string    `json:"to"`
+	At     time.Time `json:"at"`
+	Reason string    `json:"reason"`
+}
+
+// CircuitStatus is what GET /admin/circuits shows of a circuit breaker
+type CircuitStatus struct {
+	Name                string     `json:"name"`
+	State               string     `json:"state"`
+	FailureThreshold    int        `json:"failure_threshold"`
+	ConsecutiveFailures int        `json:"consecutive_failures"`
+	Successes           int64      `json:"successes"`
+	Failures            int64      `json:"failures"`
+	Rejected            int64      `json:"rejected"`
+	LastError           string     `json:"last_error,omitempty"`
+	LastFailureAt       *time.Time `json:"last_failure_at,omitempty"`
+	// When an open circuit lets a call through again
+	RetryAt     *time.Time          `json:"retry_at,omitempty"`
+	Transitions []CircuitTransition `json:"transitions"`
+}
+
+// CircuitBreaker stops calls to a downstream that keeps failing. After
+// FailureThreshold failures in a row the circuit opens and calls fail
+// right away with errCircuitOpen. After OpenDuration it's half open: one
+// call goes through, closing the circuit if it succeeds and opening it
+// again if not. A nil CircuitBreaker lets every call through.
+type CircuitBreaker struct {
+	name      string
+	threshold int
+	cooldown  time.Duration
+	clock     Clock
+
+	mu                  sync.Mutex
+	state               string
+	consecutiveFailures int
+	openedAt            time.Time
+	// A half open circuit's trial call is running
+	probing     bool
+	successes   int64
+	failures    int64
+	rejected    int64
+	lastError   string
+	lastFailure time.Time
+	transitions []CircuitTransition
+}
+
+func newCircuitBreaker(name string, cfg CircuitConfig, clock Clock) *CircuitBreaker {
+	circuitState.WithLabelValues(name).Set(circuitStateValues[circuitClosed])
+	return &CircuitBreaker{
+		name:      name,
+		threshold: cfg.FailureThreshold,
+		cooldown:  cfg.OpenDuration,
+		clock:     clock,
+		state:     circuitClosed,
+	}
+}
+
+// Allow returns errCircuitOpen if the call must not be made. A call that is
+// made reports how it went with Done, or with Release if the outcome says
+// nothing about the downstream, passing on whether it's the trial call of a
+// half open circuit.
+func (b *CircuitBreaker) Allow() (probe bool, err error) {
+	if b == nil {
+		return false, nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.state == circuitOpen {
+		if retryAt := b.openedAt.Add(b.cooldown); b.clock.Now().Before(retryAt) {
+			b.rejected++
+			circuitRejections.WithLabelValues(b.name).Inc()
+			return false, fmt.Errorf("%w: %s, retrying after %s", errCircuitOpen, b.name, retryAt.UTC().Format(time.RFC3339))
+		}
+		b.transition(circuitHalfOpen, fmt.Sprintf("open for %s", b.cooldown))
+	}
+	if b.state == circuitHalfOpen {
+		if b.probing {
+			b.rejected++
+			circuitRejections.WithLabelValues(b.name).Inc()
+			return false, fmt.Errorf("%w: %s, waiting for a trial call", errCircuitOpen, b.name)
+		}
+		b.probing = true
+		return true, nil
+	}
+	return false, nil
+}
+
+// Done records the outcome of an allowed call, nil for a success. Only the
+// trial call decides whether a half open circuit closes or opens again; a
+// call allowed before the circuit opened that finishes later is counted,
+// but doesn't change the state.
+func (b *CircuitBreaker) Done(probe bool, err error) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if probe {
+		b.probing = false
+	}
+	if err == nil {
+		b.successes++
+		b.consecutiveFailures = 0
+		if probe && b.state == circuitHalfOpen {
+			b.transition(circuitClosed, "trial call succeeded")
+		}
+		return
+	}
+
+	b.failures++
+	b.consecutiveFailures++
+	b.lastError = err.Error()
+	b.lastFailure = b.clock.Now()
+	circuitFailures.WithLabelValues(b.name).Inc()
+	switch {
+	case probe && b.state == circuitHalfOpen:
+		b.open("trial call failed: " + b.lastError)
+	case b.state == circuitClosed && b.consecutiveFailures >= b.threshold:
+		b.open(fmt.Sprintf("%d failures in a row, the last: %s", b.consecutiveFailures, b.lastError))
+	}
+}
+
+// Release gives up an allowed call without an outcome, e.g. when the
+// caller canceled it. A trial call given up makes way for the next one.
+func (b *CircuitBreaker) Release(probe bool) {
+	if b == nil || !probe {
+		return
+	}
+	b.mu.Lock()
+	b.probing = false
+	b.mu.Unlock()
+}
+
+func (b *CircuitBreaker) open(reason string) {
+	b.openedAt = b.clock.Now()
+	b.transition(circuitOpen, reason)
+}
+
+func (b *CircuitBreaker) transition(to, reason string) {
+	t := CircuitTransition{From: b.state, To: to, At: b.clock.Now(), Reason: reason}
+	b.state = to
+	if b.transitions = append(b.transitions, t); len(b.transitions) > circuitTransitionHistory {
+		b.transitions = b.transitions[1:]
+	}
+	circuitState.WithLabelValues(b.name).Set(circuitStateValues[to])
+	circuitTransitions.WithLabelValues(b.name, to).Inc()
+
+	level := "INFO"
+	if to == circuitOpen {
+		level = "WARN"
+	}
+	logWithTrace(context.Background(), level, "Circuit breaker state changed",
+		"circuit", b.name, "from", t.From, "to", to, "reason", reason)
+}
+
+func (b *CircuitBreaker) Status() CircuitStatus {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	s := CircuitStatus{
+		Name:                b.name,
+		State:               b.state,
+		FailureThreshold:    b.threshold,
+		ConsecutiveFailures: b.consecutiveFailures,
+		Successes:           b.successes,
+		Failures:            b.failures,
+		Rejected:            b.rejected,
+		LastError:           b.lastError,
+		Transitions:         append([]CircuitTransition{}, b.transitions...),
+	}
+	if !b.lastFailure.IsZero() {
+		at := b.lastFailure
+		s.LastFailureAt = &at
+	}
+	if b.state == circuitOpen {
+		at := b.openedAt.Add(b.cooldown)
+		s.RetryAt = &at
+	}
+	return s
+}
+
+// CircuitRegistry holds a circuit breaker per downstream, shared by the
+// clients calling it
+type CircuitRegistry struct {
+	mu       sync.Mutex
+	breakers map[string]*CircuitBreaker
+}
+
+// The circuit breakers of the service's downstreams
+var circuits = newCircuitRegistry()
+
+func newCircuitRegistry() *CircuitRegistry {
+	return &CircuitRegistry{breakers: map[string]*CircuitBreaker{}}
+}
+
+// Get the downstream's circuit breaker, creating it the first time. nil,
+// letting every call through, if circuit breaking is off.
+func (r *CircuitRegistry) Get(name string, cfg CircuitConfig) *CircuitBreaker {
+	if cfg.FailureThreshold <= 0 {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	b, ok := r.breakers[name]
+	if !ok {
+		b = newCircuitBreaker(name, cfg, systemClock{})
+		r.breakers[name] = b
+	}
+	return b
+}
+
+// Statuses of all circuit breakers, by name
+func (r *CircuitRegistry) Statuses() []CircuitStatus {
+	r.mu.Lock()
+	breakers := make([]*CircuitBreaker, 0, len(r.breakers))
+	for _, b := range r.breakers {
+		breakers = append(breakers, b)
+	}
+	r.mu.Unlock()
+
+	statuses := make([]CircuitStatus, 0, len(breakers))
+	for _, b := range breakers {
+		statuses = append(statuses, b.Status())
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Name < statuses[j].Name })
+	return statuses
+}
+
+// circuitStockStore is a StockStore behind the MongoDB circuit breaker.
+// Pings go straight through, so /health shows whether MongoDB is back.
+type circuitStockStore struct {
+	next    StockStore
+	breaker *CircuitBreaker
+}
+
+// Run a MongoDB call through the circuit breaker. Failures of the
+// request rather than of MongoDB aren't counted.
+func (s *circuitStockStore) call(ctx context.Context, fn func() error) error {
+	probe, err := s.breaker.Allow()
+	if err != nil {
+		return err
+	}
+	err = fn()
+	switch {
+	case err == nil || err == mongo.ErrNoDocuments || mongo.IsDuplicateKeyError(err):
+		s.breaker.Done(probe, nil)
+	case ctx.Err() != nil:
+		s.breaker.Release(probe)
+	default:
+		s.breaker.Done(probe, err)
+	}
+	return err
+}
+
+func (s *circuitStockStore) InsertStockLevel(ctx context.Context, level StockLevel) (id interface{}, err error) {
+	err = s.call(ctx, func() error {
+		id, err = s.next.InsertStockLevel(ctx, level)
+		return err
+	})
+	return id, err
+}
+
+func (s *circuitStockStore) UpsertStockLevel(ctx context.Context, level StockLevel) (id interface{}, inserted bool, err error) {
+	err = s.call(ctx, func() error {
+		id, inserted, err = s.next.UpsertStockLevel(ctx, level)
+		return err
+	})
+	return id, inserted, err
+}
+
+func (s *circuitStockStore) DeleteStockLevel(ctx context.Context, warehouse string, id interface{}) error {
+	return s.call(ctx, func() error {
+		return s.next.DeleteStockLevel(ctx, warehouse, id)
+	})
+}
+
+func (s *circuitStockStore) DeleteStockLevelsBySKU(ctx context.Context, warehouse string, skus []string) (n int64, err error) {
+	err = s.call(ctx, func() error {
+		n, err = s.next.DeleteStockLevelsBySKU(ctx, warehouse, skus)
+		return err
+	})
+	return n, err
+}
+
+func (s *circuitStockStore) ListStockLevels(ctx context.Context, warehouse string) (levels []StockLevel, err error) {
+	err = s.call(ctx, func() error {
+		levels, err = s.next.ListStockLevels(ctx, warehouse)
+		return err
+	})
+	return levels, err
+}
+
+func (s *circuitStockStore) Ping(ctx context.Context) error {
+	return s.next.Ping(ctx)
+}
+
+// The state of every circuit breaker, for operators watching a demo
+func (app *App) listCircuits(c *gin.Context) {
+	requestsTotal.WithLabelValues("GET", "/admin/circuits", "200").Inc()
+	c.JSON(http.StatusOK, gin.H{"circuits": app.circuits.Statuses()})
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"inventory-service/internal/testkit"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	clock := &fixedClock{now: time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)}
+	b := newCircuitBreaker("test", CircuitConfig{FailureThreshold: 3, OpenDuration: 30 * time.Second}, clock)
+	call := func(err error) error {
+		probe, allowErr := b.Allow()
+		if allowErr != nil {
+			return allowErr
+		}
+		b.Done(probe, err)
+		return nil
+	}
+	down := errors.New("connection refused")
+
+	// A success in between starts the count again
+	for _, err := range []error{down, down, nil, down, down} {
+		call(err)
+	}
+	if s := b.Status(); s.State != circuitClosed || s.ConsecutiveFailures != 2 || s.Failures != 4 {
+		t.Fatalf("got %+v, want closed after 2 failures in a row", s)
+	}
+	testkit.AssertCounterDelta(t, circuitRejections.WithLabelValues("test"), 1, func() {
+		call(down)
+		if err := call(nil); !errors.Is(err, errCircuitOpen) {
+			t.Errorf("got %v with the circuit open", err)
+		}
+	})
+	if s := b.Status(); s.State != circuitOpen || s.RetryAt == nil || !s.RetryAt.Equal(clock.now.Add(30*time.Second)) {
+		t.Fatalf("got %+v, want open until 30s from now", s)
+	}
+
+	// Half open: one trial call at a time; failing, it opens the circuit again
+	clock.now = clock.now.Add(30 * time.Second)
+	probe, err := b.Allow()
+	if err != nil || !probe {
+		t.Fatalf("trial call: %v", err)
+	}
+	if _, err := b.Allow(); !errors.Is(err, errCircuitOpen) {
+		t.Errorf("second call during the trial got %v", err)
+	}
+	b.Done(probe, down)
+	if s := b.Status(); s.State != circuitOpen {
+		t.Fatalf("got %s after the trial call failed, want open", s.State)
+	}
+
+	// A trial canceled by its caller makes way for the next one, which closes the circuit
+	clock.now = clock.now.Add(30 * time.Second)
+	probe, _ = b.Allow()
+	b.Release(probe)
+	if err := call(nil); err != nil {
+		t.Fatal(err)
+	}
+	s := b.Status()
+	if s.State != circuitClosed || s.ConsecutiveFailures != 0 || s.Rejected != 2 || s.LastError != "connection refused" {
+		t.Errorf("got %+v", s)
+	}
+	var states []string
+	for _, tr := range s.Transitions {
+		states = append(states, tr.To)
+	}
+	if want := []string{"open", "half_open", "open", "half_open", "closed"}; !reflect.DeepEqual(states, want) {
+		t.Errorf("got transitions %v, want %v", states, want)
+	}
+}
+
+func TestCircuitBreakerLateCall(t *testing.T) {
+	clock := &fixedClock{now: time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)}
+	b := newCircuitBreaker("late", CircuitConfig{FailureThreshold: 1, OpenDuration: 30 * time.Second}, clock)
+	down := errors.New("connection refused")
+
+	// A slow call allowed while closed, then another that opens the circuit
+	slow, err := b.Allow()
+	if err != nil || slow {
+		t.Fatalf("got probe %v and %v while closed", slow, err)
+	}
+	probe, _ := b.Allow()
+	b.Done(probe, down)
+
+	// The slow call finishing during the trial leaves the trial alone
+	clock.now = clock.now.Add(30 * time.Second)
+	probe, err = b.Allow()
+	if err != nil || !probe {
+		t.Fatalf("trial call: %v", err)
+	}
+	b.Done(slow, nil)
+	if _, err := b.Allow(); !errors.Is(err, errCircuitOpen) {
+		t.Errorf("second call during the trial got %v", err)
+	}
+	if s := b.Status(); s.State != circuitHalfOpen || s.Successes != 1 {
+		t.Fatalf("got %+v, want half open with the slow call counted", s)
+	}
+
+	// Giving up the slow call doesn't end the trial either
+	b.Release(slow)
+	if _, err := b.Allow(); !errors.Is(err, errCircuitOpen) {
+		t.Errorf("call after a release during the trial got %v", err)
+	}
+	b.Done(probe, down)
+	if s := b.Status(); s.State != circuitOpen {
+		t.Errorf("got %s after the trial call failed, want open", s.State)
+	}
+}
+
+func TestHTTPClientCircuitBreaker(t *testing.T) {
+	testkit.InstallTracing(t)
+	srv, calls := flakyServer(t, 100)
+	cfg := testHTTPClientConfig()
+	cfg.Retries = 1
+	cfg.circuits = CircuitConfig{FailureThreshold: 2, OpenDuration: time.Minute}
+	client := newHTTPClient("circuit-test", cfg, nil)
+
+	for i := 0; i < 2; i++ {
+		resp, err := client.Get(srv.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+	// Open after two calls of two failed attempts each, so the third call
+	// doesn't reach the server
+	if _, err := client.Get(srv.URL); !errors.Is(err, errCircuitOpen) {
+		t.Errorf("got %v, want the circuit open", err)
+	}
+	if calls.Load() != 4 {
+		t.Errorf("server got %d calls, want 4", calls.Load())
+	}
+}
+
+func TestCircuitStockStore(t *testing.T) {
+	breaker := newCircuitBreaker(dependencyMongo, CircuitConfig{FailureThreshold: 1, OpenDuration: time.Minute}, systemClock{})
+	stock := &fakeStockStore{err: errors.New("server selection timeout")}
+	app := newFakeApp(t, &fakeItemStore{}, stock, systemClock{})
+	app.stockStore = &circuitStockStore{next: stock, breaker: breaker}
+	app.circuits = newCircuitRegistry()
+	app.circuits.breakers[dependencyMongo] = breaker
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.GET("/api/stock-levels", app.getStockLevels)
+	router.GET("/admin/circuits", app.listCircuits)
+	get := func(path string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		return rec
+	}
+
+	if rec := get("/api/stock-levels"); rec.Code != http.StatusInternalServerError {
+		t.Errorf("got status %d while MongoDB fails, want 500", rec.Code)
+	}
+	if rec := get("/api/stock-levels"); rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("got status %d with the circuit open, want 503", rec.Code)
+	}
+	// Health checks still reach MongoDB
+	if err := app.stockStore.Ping(context.Background()); err != stock.err {
+		t.Errorf("ping got %v", err)
+	}
+
+	var body struct {
+		Circuits []CircuitStatus `json:"circuits"`
+	}
+	rec := get("/admin/circuits")
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+		t.Fatal(err)
+	}
+	if len(body.Circuits) != 1 {
+		t.Fatalf("got %s", rec.Body.String())
+	}
+	if c := body.Circuits[0]; c.Name != "mongodb" || c.State != circuitOpen || c.Failures != 1 || c.Rejected != 1 ||
+		c.LastError != "server selection timeout" || len(c.Transitions) != 1 {
+		t.Errorf("got %+v", c)
+	}
+}
@@ -0,0 +1,136 @@
+package inventory
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// Item is an inventory item
+type Item struct {
+	ID          int       `json:"id"`
+	ProductName string    `json:"product_name"`
+	SKU         string    `json:"sku"`
+	Quantity    int       `json:"quantity"`
+	Location    string    `json:"location"`
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+	// Unset until the item is given a price
+	UnitPrice *float64 `json:"unit_price,omitempty"`
+}
+
+// CreateItemRequest creates an item. Without a location, the service
+// allocates a warehouse, in the region if given.
+type CreateItemRequest struct {
+	ProductName string   `json:"product_name"`
+	SKU         string   `json:"sku"`
+	Quantity    int      `json:"quantity"`
+	Location    string   `json:"location,omitempty"`
+	Region      string   `json:"region,omitempty"`
+	UnitPrice   *float64 `json:"unit_price,omitempty"`
+}
+
+// StockLevel is the stock of a SKU in a warehouse
+type StockLevel struct {
+	ID         string    `json:"id"`
+	ProductSKU string    `json:"product_sku"`
+	Warehouse  string    `json:"warehouse"`
+	Available  int       `json:"available"`
+	Reserved   int       `json:"reserved"`
+	UpdatedAt  time.Time `json:"updated_at"`
+}
+
+// Reservation holds units of an item until it is confirmed, released or
+// expires
+type Reservation struct {
+	ID        int       `json:"id"`
+	ItemID    int       `json:"item_id"`
+	Quantity  int       `json:"quantity"`
+	Status    string    `json:"status"`
+	CreatedAt time.Time `json:"created_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+	TraceID   string    `json:"trace_id,omitempty"`
+}
+
+// CreateItem creates an item. It isn't retried, and fails with a conflict
+// (see IsConflict) if the SKU exists.
+func (c *Client) CreateItem(ctx context.Context, req CreateItemRequest) (Item, error) {
+	var item Item
+	err := c.do(ctx, "CreateItem", http.MethodPost, "/api/inventory", req, &item)
+	return item, err
+}
+
+// GetItem gets an item by ID
+func (c *Client) GetItem(ctx context.Context, id int) (Item, error) {
+	var item Item
+	err := c.do(ctx, "GetItem", http.MethodGet, fmt.Sprintf("/api/inventory/%d", id), nil, &item)
+	return item, err
+}
+
+// GetItemBySKU gets an item by SKU
+func (c *Client) GetItemBySKU(ctx context.Context, sku string) (Item, error) {
+	var item Item
+	err := c.do(ctx, "GetItemBySKU", http.MethodGet, "/api/inventory/sku/"+url.PathEscape(sku), nil, &item)
+	return item, err
+}
+
+// ListItems lists up to limit items, newest first, after skipping skip
+func (c *Client) ListItems(ctx context.Context, skip, limit int) ([]Item, error) {
+	var items []Item
+	err := c.do(ctx, "ListItems", http.MethodGet, fmt.Sprintf("/api/inventory?skip=%d&limit=%d", skip, limit), nil, &items)
+	return items, err
+}
+
+// SetPrice sets an item's unit price, returning the item
+func (c *Client) SetPrice(ctx context.Context, id int, price float64) (Item, error) {
+	var item Item
+	req := struct {
+		UnitPrice float64 `json:"unit_price"`
+	}{price}
+	err := c.do(ctx, "SetPrice", http.MethodPut, fmt.Sprintf("/api/inventory/%d/price", id), req, &item)
+	return item, err
+}
+
+// ListStockLevels lists the stock levels of all SKUs
+func (c *Client) ListStockLevels(ctx context.Context) ([]StockLevel, error) {
+	var levels []StockLevel
+	err := c.do(ctx, "ListStockLevels", http.MethodGet, "/api/stock-levels", nil, &levels)
+	return levels, err
+}
+
+// CreateReservation reserves quantity units of an item. It fails with a
+// conflict (see IsConflict) when not enough stock is left unreserved.
+func (c *Client) CreateReservation(ctx context.Context, itemID, quantity int) (Reservation, error) {
+	var r Reservation
+	req := struct {
+		ItemID   int `json:"item_id"`
+		Quantity int `json:"quantity"`
+	}{itemID, quantity}
+	err := c.do(ctx, "CreateReservation", http.MethodPost, "/api/reservations", req, &r)
+	return r, err
+}
+
+// GetReservation gets a reservation
+func (c *Client) GetReservation(ctx context.Context, id int) (Reservation, error) {
+	var r Reservation
+	err := c.do(ctx, "GetReservation", http.MethodGet, fmt.Sprintf("/api/reservations/%d", id), nil, &r)
+	return r, err
+}
+
+// ConfirmReservation confirms a held reservation, taking its units out of
+// the item's quantity
+func (c *Client) ConfirmReservation(ctx context.Context, id int) (Reservation, error) {
+	var r Reservation
+	err := c.do(ctx, "ConfirmReservation", http.MethodPost, fmt.Sprintf("/api/reservations/%d/confirm", id), nil, &r)
+	return r, err
+}
+
+// ReleaseReservation releases a held reservation. A retry after a lost
+// response fails with a conflict, the reservation being released already.
+func (c *Client) ReleaseReservation(ctx context.Context, id int) (Reservation, error) {
+	var r Reservation
+	err := c.do(ctx, "ReleaseReservation", http.MethodDelete, fmt.Sprintf("/api/reservations/%d", id), nil, &r)
+	return r, err
+}
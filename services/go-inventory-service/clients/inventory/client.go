@@ -0,0 +1,282 @@
+// Package inventory is the Go client of the inventory service API.
+//
+// Every call takes the caller's context, so its deadline bounds the call,
+// retries included, and its trace continues into the service. Calls get a
+// span of their own, and with the default HTTP client a client span per
+// attempt. Calls that are safe to repeat are retried on network errors and
+// on 429, 502, 503 and 504 responses, waiting a random time up to an
+// exponential backoff.
+package inventory
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const instrumentationName = "inventory-service/clients/inventory"
+
+const (
+	defaultTimeout = 10 * time.Second
+	defaultRetries = 2
+	defaultBackoff = 200 * time.Millisecond
+	// Longest wait between two attempts. A Retry-After longer than this
+	// isn't waited for, the error is returned instead.
+	maxBackoff = 5 * time.Second
+)
+
+// Client calls the inventory service. It is safe for concurrent use.
+type Client struct {
+	baseURL string
+	http    *http.Client
+	apiKey  string
+	token   string
+	retries int
+	backoff time.Duration
+	tracer  trace.Tracer
+}
+
+// Option configures a Client
+type Option func(*Client)
+
+// WithHTTPClient sends the requests through hc instead of the default
+// client. Its transport is used as is, so it should propagate the trace
+// context (e.g. an otelhttp transport) and not retry itself when the
+// Client retries.
+func WithHTTPClient(hc *http.Client) Option {
+	return func(c *Client) { c.http = hc }
+}
+
+// WithAPIKey authenticates with an API key, sent as X-API-Key
+func WithAPIKey(key string) Option {
+	return func(c *Client) { c.apiKey = key }
+}
+
+// WithBearerToken authenticates with a JWT, sent as a bearer token
+func WithBearerToken(token string) Option {
+	return func(c *Client) { c.token = token }
+}
+
+// WithRetries sets how many times a failed call is retried (0 turns retries
+// off) and the wait before the first retry, doubled for every next one
+func WithRetries(retries int, backoff time.Duration) Option {
+	return func(c *Client) { c.retries, c.backoff = retries, backoff }
+}
+
+// New returns a client of the service at baseURL, e.g.
+// http://inventory-service:8002
+func New(baseURL string, opts ...Option) *Client {
+	c := &Client{
+		baseURL: strings.TrimSuffix(baseURL, "/"),
+		http: &http.Client{
+			Transport: otelhttp.NewTransport(http.DefaultTransport,
+				otelhttp.WithSpanNameFormatter(func(_ string, r *http.Request) string {
+					return "inventory-service " + r.Method
+				}),
+			),
+			Timeout: defaultTimeout,
+		},
+		retries: defaultRetries,
+		backoff: defaultBackoff,
+		tracer:  otel.Tracer(instrumentationName),
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+// Error is a response with an error status
+type Error struct {
+	StatusCode int
+	// The "error" of the response, or the detail of a problem document
+	Message string
+	// From Retry-After, 0 without one
+	RetryAfter time.Duration
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("inventory: %d %s: %s", e.StatusCode, http.StatusText(e.StatusCode), e.Message)
+}
+
+// IsNotFound reports whether err is a 404 from the service
+func IsNotFound(err error) bool {
+	return hasStatus(err, http.StatusNotFound)
+}
+
+// IsConflict reports whether err is a 409 from the service, e.g. for a
+// duplicate SKU or a reservation that is no longer held
+func IsConflict(err error) bool {
+	return hasStatus(err, http.StatusConflict)
+}
+
+func hasStatus(err error, status int) bool {
+	var apiErr *Error
+	return errors.As(err, &apiErr) && apiErr.StatusCode == status
+}
+
+// Send a request to the API, decoding the response into out unless it's
+// nil. op names the call's span.
+func (c *Client) do(ctx context.Context, op, method, path string, in, out interface{}) error {
+	ctx, span := c.tracer.Start(ctx, "inventory."+op, trace.WithAttributes(
+		attribute.String("http.method", method),
+		attribute.String("inventory.path", path),
+	))
+	defer span.End()
+
+	var body []byte
+	if in != nil {
+		var err error
+		if body, err = json.Marshal(in); err != nil {
+			return err
+		}
+	}
+	// Creating twice would create two things
+	retries := c.retries
+	if method == http.MethodPost {
+		retries = 0
+	}
+
+	for attempt := 0; ; attempt++ {
+		err := c.attempt(ctx, method, path, body, out)
+		if err == nil {
+			return nil
+		}
+		wait, ok := c.retryWait(ctx, err, attempt)
+		if !ok || attempt >= retries {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+			return err
+		}
+		span.AddEvent("inventory.retry", trace.WithAttributes(
+			attribute.Int("inventory.retry.attempt", attempt+1),
+			attribute.String("inventory.retry.reason", err.Error()),
+		))
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// decodeError is a response that arrived but couldn't be read, which
+// isn't retried
+type decodeError struct{ err error }
+
+func (e *decodeError) Error() string { return "inventory: invalid response: " + e.err.Error() }
+func (e *decodeError) Unwrap() error { return e.err }
+
+func (c *Client) attempt(ctx context.Context, method, path string, body []byte, out interface{}) error {
+	var reqBody io.Reader
+	if body != nil {
+		reqBody = bytes.NewReader(body)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, c.baseURL+path, reqBody)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.apiKey != "" {
+		req.Header.Set("X-API-Key", c.apiKey)
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return responseError(resp)
+	}
+	if out == nil {
+		io.Copy(io.Discard, resp.Body)
+		return nil
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return &decodeError{err}
+	}
+	return nil
+}
+
+// The Error of a response with an error status
+func responseError(resp *http.Response) *Error {
+	apiErr := &Error{StatusCode: resp.StatusCode, Message: resp.Status}
+	if s, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && s > 0 {
+		apiErr.RetryAfter = time.Duration(s) * time.Second
+	}
+
+	var body struct {
+		Error  string `json:"error"`
+		Title  string `json:"title"`
+		Detail string `json:"detail"`
+	}
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	if json.Unmarshal(data, &body) == nil {
+		for _, msg := range []string{body.Error, body.Detail, body.Title} {
+			if msg != "" {
+				apiErr.Message = msg
+				break
+			}
+		}
+	}
+	return apiErr
+}
+
+// How long to wait before retrying after err, or false if it isn't worth
+// retrying
+func (c *Client) retryWait(ctx context.Context, err error, attempt int) (time.Duration, bool) {
+	if ctx.Err() != nil {
+		return 0, false
+	}
+	var decodeErr *decodeError
+	if errors.As(err, &decodeErr) {
+		return 0, false
+	}
+
+	// Full jitter, so clients don't retry in step
+	ceiling := c.backoff << attempt
+	if ceiling <= 0 || ceiling > maxBackoff {
+		ceiling = maxBackoff
+	}
+	d := time.Duration(rand.Int63n(int64(ceiling)))
+
+	var apiErr *Error
+	if !errors.As(err, &apiErr) {
+		// Didn't get a response
+		return d, true
+	}
+	switch apiErr.StatusCode {
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+	default:
+		return 0, false
+	}
+	if apiErr.RetryAfter > maxBackoff {
+		return 0, false
+	}
+	return max(d, apiErr.RetryAfter), true
+}
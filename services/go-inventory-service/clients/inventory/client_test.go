@@ -0,0 +1,114 @@
+package inventory
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+
+	"inventory-service/internal/testkit"
+)
+
+func TestGetItem(t *testing.T) {
+	tr := testkit.InstallTracing(t)
+
+	var traceparent, apiKey string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		traceparent, apiKey = r.Header.Get("traceparent"), r.Header.Get("X-API-Key")
+		if r.URL.Path != "/api/inventory/7" {
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(map[string]string{"error": "Item not found"})
+			return
+		}
+		json.NewEncoder(w).Encode(Item{ID: 7, SKU: "W-7", Quantity: 3})
+	}))
+	defer srv.Close()
+	c := New(srv.URL+"/", WithAPIKey("secret"))
+
+	ctx, parent := tr.Tracer("test").Start(context.Background(), "parent")
+	item, err := c.GetItem(ctx, 7)
+	parent.End()
+	if err != nil || item.SKU != "W-7" || item.Quantity != 3 {
+		t.Fatalf("got %+v, %v", item, err)
+	}
+	if apiKey != "secret" {
+		t.Errorf("got API key %q", apiKey)
+	}
+	if traceparent == "" {
+		t.Error("trace context not propagated")
+	}
+	span := tr.AssertSpan(t, "inventory.GetItem", attribute.String("inventory.path", "/api/inventory/7"))
+	testkit.AssertChildOf(t, span, tr.AssertSpan(t, "parent"))
+
+	_, err = c.GetItem(context.Background(), 8)
+	if !IsNotFound(err) || err.(*Error).Message != "Item not found" {
+		t.Errorf("got %v, want a not found error", err)
+	}
+}
+
+func TestRetries(t *testing.T) {
+	testkit.InstallTracing(t)
+
+	var calls atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := calls.Add(1)
+		switch r.URL.Path {
+		case "/api/stock-levels":
+			if n < 3 {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			w.Write([]byte(`[{"product_sku": "W-1", "available": 5}]`))
+		case "/api/inventory/1/price":
+			// Read-only mode: the wait is longer than worth retrying for
+			w.Header().Set("Retry-After", "300")
+			w.Header().Set("Content-Type", "application/problem+json")
+			w.WriteHeader(http.StatusServiceUnavailable)
+			w.Write([]byte(`{"title": "Service is read-only for maintenance", "detail": "Back soon"}`))
+		default:
+			w.WriteHeader(http.StatusBadGateway)
+		}
+	}))
+	defer srv.Close()
+	c := New(srv.URL, WithRetries(2, time.Millisecond))
+
+	levels, err := c.ListStockLevels(context.Background())
+	if err != nil || len(levels) != 1 || levels[0].Available != 5 {
+		t.Fatalf("got %+v, %v after two 503s", levels, err)
+	}
+
+	for _, tc := range []struct {
+		name string
+		call func() error
+		want int32
+	}{
+		{"create", func() error {
+			_, err := c.CreateItem(context.Background(), CreateItemRequest{SKU: "W-2"})
+			return err
+		}, 1},
+		{"long Retry-After", func() error {
+			_, err := c.SetPrice(context.Background(), 1, 9.5)
+			if e, ok := err.(*Error); !ok || e.Message != "Back soon" || e.RetryAfter != 5*time.Minute {
+				t.Errorf("got %#v, want the problem detail and Retry-After", err)
+			}
+			return err
+		}, 1},
+		{"retried", func() error {
+			_, err := c.GetReservation(context.Background(), 1)
+			return err
+		}, 3},
+	} {
+		calls.Store(0)
+		if err := tc.call(); err == nil {
+			t.Errorf("%s: want an error", tc.name)
+		}
+		if n := calls.Load(); n != tc.want {
+			t.Errorf("%s: got %d calls, want %d", tc.name, n, tc.want)
+		}
+	}
+}
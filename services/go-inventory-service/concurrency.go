@@ -0,0 +1,229 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var (
+	concurrencyInFlight = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "http_concurrency_in_flight",
+			Help: "Requests being handled by route group",
+		},
+		[]string{"group"},
+	)
+
+	concurrencyQueued = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "http_concurrency_queued",
+			Help: "Requests waiting for a concurrency slot by route group",
+		},
+		[]string{"group"},
+	)
+
+	concurrencyQueueWait = promauto.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "http_concurrency_queue_wait_seconds",
+			Help:    "Time requests waited for a concurrency slot by route group, priority and result",
+			Buckets: []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1},
+		},
+		[]string{"group", "priority", "result"},
+	)
+
+	requestsShed = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "http_requests_shed_total",
+			Help: "Requests rejected with 503 because the route group was at its concurrency limit, by priority",
+		},
+		[]string{"group", "priority"},
+	)
+)
+
+// Route groups with their own concurrency limit
+const (
+	limitGroupRead  = "read"
+	limitGroupWrite = "write"
+)
+
+// Request priorities, highest first. Waiting requests of a higher priority
+// get a free slot before any of a lower one.
+type priority int
+
+const (
+	// Health checks and confirmations of work already under way
+	priorityCritical priority = iota
+	priorityNormal
+	// Lists and exports, which can be retried later
+	priorityBulk
+	numPriorities
+)
+
+var priorityNames = [numPriorities]string{"critical", "normal", "bulk"}
+
+func (p priority) String() string { return priorityNames[p] }
+
+func parsePriority(s string) (priority, bool) {
+	for p, name := range priorityNames {
+		if s == name {
+			return priority(p), true
+		}
+	}
+	return 0, false
+}
+
+// ConcurrencyLimiter caps the requests handled at once per route group.
+// Requests over the limit wait in line for up to the queue timeout and are
+// then shed with 503 and Retry-After, so overload shows up as fast
+// rejections instead of ever longer queues in front of the databases. A
+// group without a limit only reports its requests in flight.
+type ConcurrencyLimiter struct {
+	groups       map[string]*concurrencyLimit
+	queueTimeout time.Duration
+	retryAfter   string
+	// Request header that overrides the route's priority, empty to ignore
+	// priorities sent by clients
+	priorityHeader string
+}
+
+func newConcurrencyLimiter(cfg ConcurrencyConfig) *ConcurrencyLimiter {
+	return &ConcurrencyLimiter{
+		groups: map[string]*concurrencyLimit{
+			limitGroupRead:  {limit: cfg.ReadLimit},
+			limitGroupWrite: {limit: cfg.WriteLimit},
+		},
+		queueTimeout: cfg.QueueTimeout,
+		retryAfter:   strconv.Itoa(int(math.Ceil(cfg.RetryAfter.Seconds()))),
+
+		priorityHeader: cfg.PriorityHeader,
+	}
+}
+
+// Middleware admits the group's requests within its limit, at the route's
+// priority unless the request sets the priority header. A request that
+// isn't admitted in time gets a 503.
+func (cl *ConcurrencyLimiter) Middleware(group string, routePriority priority) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if cl == nil {
+			c.Next()
+			return
+		}
+
+		l := cl.groups[group]
+		prio := routePriority
+		if cl.priorityHeader != "" {
+			if p, ok := parsePriority(c.GetHeader(cl.priorityHeader)); ok {
+				prio = p
+			}
+		}
+		span := trace.SpanFromContext(c.Request.Context())
+		span.SetAttributes(attribute.String("concurrency.group", group), attribute.String("request.priority", prio.String()))
+
+		wait, ok := l.acquire(c.Request.Context(), cl.queueTimeout, group, prio)
+		span.SetAttributes(attribute.Float64("concurrency.queue_wait_seconds", wait.Seconds()))
+		if !ok {
+			concurrencyQueueWait.WithLabelValues(group, prio.String(), "shed").Observe(wait.Seconds())
+			requestsShed.WithLabelValues(group, prio.String()).Inc()
+			requestsTotal.WithLabelValues(c.Request.Method, c.FullPath(), "503").Inc()
+			span.SetAttributes(attribute.Bool("concurrency.shed", true))
+			logWithTrace(c.Request.Context(), "WARN", "Request shed at the concurrency limit",
+				"group", group, "priority", prio.String(), "limit", l.limit, "queue_wait", wait.String())
+
+			c.Header("Retry-After", cl.retryAfter)
+			c.AbortWithStatusJSON(http.StatusServiceUnavailable, gin.H{"error": "Too many requests in flight, retry later"})
+			return
+		}
+		concurrencyQueueWait.WithLabelValues(group, prio.String(), "admitted").Observe(wait.Seconds())
+
+		concurrencyInFlight.WithLabelValues(group).Inc()
+		defer concurrencyInFlight.WithLabelValues(group).Dec()
+		defer l.release()
+		c.Next()
+	}
+}
+
+// The slots of one route group. A released slot goes straight to the next
+// waiter: the longest waiting one of the highest priority.
+type concurrencyLimit struct {
+	// 0 means no limit
+	limit int
+
+	mu       sync.Mutex
+	inFlight int
+	// By priority, of chan struct{} closed when the waiter got a slot
+	waiters [numPriorities]list.List
+}
+
+func (l *concurrencyLimit) waiting() int {
+	n := 0
+	for i := range l.waiters {
+		n += l.waiters[i].Len()
+	}
+	return n
+}
+
+// Wait for a slot for up to timeout, or until ctx ends. Returns how long it
+// waited and whether it got the slot.
+func (l *concurrencyLimit) acquire(ctx context.Context, timeout time.Duration, group string, prio priority) (time.Duration, bool) {
+	l.mu.Lock()
+	if l.limit == 0 || (l.inFlight < l.limit && l.waiting() == 0) {
+		l.inFlight++
+		l.mu.Unlock()
+		return 0, true
+	}
+	if timeout <= 0 {
+		l.mu.Unlock()
+		return 0, false
+	}
+	ready := make(chan struct{})
+	waiter := l.waiters[prio].PushBack(ready)
+	l.mu.Unlock()
+
+	start := time.Now()
+	concurrencyQueued.WithLabelValues(group).Inc()
+	defer concurrencyQueued.WithLabelValues(group).Dec()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-ready:
+		return time.Since(start), true
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	select {
+	case <-ready:
+		// Handed a slot just as the wait ended
+		return time.Since(start), true
+	default:
+		l.waiters[prio].Remove(waiter)
+		return time.Since(start), false
+	}
+}
+
+func (l *concurrencyLimit) release() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for i := range l.waiters {
+		if front := l.waiters[i].Front(); front != nil {
+			l.waiters[i].Remove(front)
+			close(front.Value.(chan struct{}))
+			return
+		}
+	}
+	l.inFlight--
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel/attribute"
+
+	"inventory-service/internal/testkit"
+)
+
+// A router whose handler blocks until release is closed
+func limitedRouter(cl *ConcurrencyLimiter, started chan<- struct{}, release <-chan struct{}) *gin.Engine {
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.GET("/api/inventory", cl.Middleware(limitGroupRead, priorityNormal), func(c *gin.Context) {
+		started <- struct{}{}
+		<-release
+		c.Status(http.StatusOK)
+	})
+	return router
+}
+
+func TestConcurrencyLimitSheds(t *testing.T) {
+	testkit.InstallTracing(t)
+	cl := newConcurrencyLimiter(ConcurrencyConfig{ReadLimit: 1, QueueTimeout: 20 * time.Millisecond, RetryAfter: 1500 * time.Millisecond})
+	started, release := make(chan struct{}, 2), make(chan struct{})
+	router := limitedRouter(cl, started, release)
+
+	first := httptest.NewRecorder()
+	done := make(chan struct{})
+	go func() {
+		router.ServeHTTP(first, httptest.NewRequest(http.MethodGet, "/api/inventory", nil))
+		close(done)
+	}()
+	<-started
+
+	rec := httptest.NewRecorder()
+	testkit.AssertCounterDelta(t, requestsShed.WithLabelValues(limitGroupRead, "normal"), 1, func() {
+		router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/inventory", nil))
+	})
+	if rec.Code != http.StatusServiceUnavailable || rec.Header().Get("Retry-After") != "2" {
+		t.Errorf("got status %d with Retry-After %q, want 503 with 2", rec.Code, rec.Header().Get("Retry-After"))
+	}
+
+	close(release)
+	<-done
+	if first.Code != http.StatusOK {
+		t.Errorf("admitted request got status %d", first.Code)
+	}
+}
+
+func TestConcurrencyLimitHandsSlotToWaiter(t *testing.T) {
+	testkit.InstallTracing(t)
+	cl := newConcurrencyLimiter(ConcurrencyConfig{ReadLimit: 1, QueueTimeout: time.Second, RetryAfter: time.Second})
+	started, release := make(chan struct{}, 2), make(chan struct{})
+	router := limitedRouter(cl, started, release)
+
+	codes := make(chan int, 2)
+	serve := func() {
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/inventory", nil))
+		codes <- rec.Code
+	}
+	go serve()
+	<-started
+	go serve()
+
+	// The second request waits for the first one's slot instead of failing
+	l := cl.groups[limitGroupRead]
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		l.mu.Lock()
+		waiting := l.waiting()
+		l.mu.Unlock()
+		if waiting == 1 {
+			break
+		}
+	}
+	close(release)
+	<-started
+	for i := 0; i < 2; i++ {
+		if code := <-codes; code != http.StatusOK {
+			t.Errorf("got status %d, want 200", code)
+		}
+	}
+	if l.inFlight != 0 || l.waiting() != 0 {
+		t.Errorf("%d in flight and %d waiting after all requests finished", l.inFlight, l.waiting())
+	}
+}
+
+func TestConcurrencyLimitGivesUpWithContext(t *testing.T) {
+	l := &concurrencyLimit{limit: 1}
+	if _, ok := l.acquire(context.Background(), 0, "test", priorityNormal); !ok {
+		t.Fatal("free slot not acquired")
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, ok := l.acquire(ctx, time.Second, "test", priorityNormal); ok {
+		t.Error("slot acquired beyond the limit")
+	}
+	if l.waiting() != 0 {
+		t.Error("abandoned waiter left in line")
+	}
+	l.release()
+	if _, ok := l.acquire(context.Background(), 0, "test", priorityNormal); !ok {
+		t.Error("released slot not acquired")
+	}
+}
+
+func TestConcurrencyLimitAdmitsByPriority(t *testing.T) {
+	l := &concurrencyLimit{limit: 1}
+	l.acquire(context.Background(), 0, "test", priorityNormal)
+
+	// A bulk request queues first, a critical one after it
+	admitted := make(chan priority, 2)
+	wait := func(p priority) {
+		if _, ok := l.acquire(context.Background(), time.Second, "test", p); ok {
+			admitted <- p
+		}
+	}
+	waitFor := func(n int) {
+		for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+			l.mu.Lock()
+			waiting := l.waiting()
+			l.mu.Unlock()
+			if waiting == n {
+				return
+			}
+		}
+		t.Fatalf("never got %d waiting requests", n)
+	}
+	go wait(priorityBulk)
+	waitFor(1)
+	go wait(priorityCritical)
+	waitFor(2)
+
+	l.release()
+	if p := <-admitted; p != priorityCritical {
+		t.Errorf("%s request admitted first, want critical", p)
+	}
+	l.release()
+	if p := <-admitted; p != priorityBulk {
+		t.Errorf("%s request admitted second, want bulk", p)
+	}
+}
+
+func TestRequestPriorityHeader(t *testing.T) {
+	tr := testkit.InstallTracing(t)
+	cl := newConcurrencyLimiter(ConcurrencyConfig{RetryAfter: time.Second, PriorityHeader: "X-Request-Priority"})
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.GET("/api/inventory", func(c *gin.Context) {
+		ctx, span := tr.Tracer("test").Start(c.Request.Context(), "server")
+		defer span.End()
+		c.Request = c.Request.WithContext(ctx)
+		c.Next()
+	}, cl.Middleware(limitGroupRead, priorityBulk), func(c *gin.Context) {})
+
+	for header, want := range map[string]string{"": "bulk", "critical": "critical", "urgent!": "bulk"} {
+		tr.Reset()
+		req := httptest.NewRequest(http.MethodGet, "/api/inventory", nil)
+		req.Header.Set("X-Request-Priority", header)
+		router.ServeHTTP(httptest.NewRecorder(), req)
+		tr.AssertSpan(t, "server", attribute.String("request.priority", want))
+	}
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeConfigFile(t *testing.T, content string) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("CONFIG_FILE", path)
+}
+
+func TestDefaultConfigIsValid(t *testing.T) {
+	if errs := defaultConfig().validate(); len(errs) > 0 {
+		t.Fatalf("default configuration is invalid: %v", errs)
+	}
+}
+
+func TestLoadConfigEnvOverridesFile(t *testing.T) {
+	writeConfigFile(t, `
+item_cache:
+  size: 50
+  ttl: 1m
+postgres:
+  max_open_conns: 20
+`)
+	t.Setenv("ITEM_CACHE_SIZE", "10")
+
+	cfg, err := loadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.ItemCache.Size != 10 || cfg.sources["ITEM_CACHE_SIZE"] != "env" {
+		t.Errorf("ITEM_CACHE_SIZE = %d from %s, want 10 from env", cfg.ItemCache.Size, cfg.sources["ITEM_CACHE_SIZE"])
+	}
+	if cfg.ItemCache.TTL != time.Minute || cfg.sources["ITEM_CACHE_TTL"] != "file" {
+		t.Errorf("ITEM_CACHE_TTL = %s from %s, want 1m from file", cfg.ItemCache.TTL, cfg.sources["ITEM_CACHE_TTL"])
+	}
+	if cfg.Postgres.MaxOpenConns != 20 {
+		t.Errorf("POSTGRES_MAX_OPEN_CONNS = %d, want 20", cfg.Postgres.MaxOpenConns)
+	}
+	if cfg.Postgres.MaxIdleConns != 2 || cfg.sources["POSTGRES_MAX_IDLE_CONNS"] != "default" {
+		t.Errorf("POSTGRES_MAX_IDLE_CONNS = %d, want the default 2", cfg.Postgres.MaxIdleConns)
+	}
+}
+
+func TestLoadConfigUnknownFileKey(t *testing.T) {
+	writeConfigFile(t, "item_cache:\n  sise: 50\n")
+
+	if _, err := loadConfig(); err == nil || !strings.Contains(err.Error(), "sise") {
+		t.Errorf("got %v, want an error naming the unknown key", err)
+	}
+}
+
+func TestLoadConfigReportsEveryError(t *testing.T) {
+	t.Setenv("VAULT_ADDR", "vault:8200")
+	t.Setenv("POSTGRES_MAX_OPEN_CONNS", "5")
+	t.Setenv("POSTGRES_MAX_IDLE_CONNS", "10")
+	t.Setenv("GOMEMLIMIT", "1GiB")
+	t.Setenv("GOMEMLIMIT_RATIO", "0.9")
+	t.Setenv("ITEM_CACHE_TTL", "soon")
+	t.Setenv("MONGODB_TLS_CA_FILE", "/etc/ca.pem")
+
+	_, err := loadConfig()
+	if err == nil {
+		t.Fatal("invalid configuration accepted")
+	}
+	for _, want := range []string{
+		`VAULT_ADDR (vault.addr): must be an http:// or https:// URL, got "vault:8200"`,
+		"VAULT_TOKEN (vault.token): or VAULT_K8S_ROLE is required with VAULT_ADDR",
+		"POSTGRES_MAX_IDLE_CONNS (postgres.max_idle_conns): 10 is more than POSTGRES_MAX_OPEN_CONNS 5",
+		"GOMEMLIMIT_RATIO (gc.memory_limit_ratio): conflicts with GOMEMLIMIT",
+		`invalid ITEM_CACHE_TTL "soon"`,
+		"MONGODB_TLS_CA_FILE (mongodb.tls_ca_file): has no effect without MONGODB_TLS=true",
+	} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("error does not contain %q:\n%v", want, err)
+		}
+	}
+}
+
+func TestLoadConfigPolicies(t *testing.T) {
+	writeConfigFile(t, `
+policies:
+  routes:
+    GET /api/inventory: {timeout: 2s}
+  clients:
+    object-store: {retries: 1, retry_budget: 0.1, hedge_after: 300ms}
+`)
+
+	cfg, err := loadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := cfg.Policies.Routes["GET /api/inventory"].Timeout; got != 2*time.Second {
+		t.Errorf("route timeout = %s, want 2s", got)
+	}
+	policy := cfg.HTTPClient.policies["object-store"]
+	if policy.Retries == nil || *policy.Retries != 1 || policy.RetryBudget != 0.1 || policy.HedgeAfter != 300*time.Millisecond {
+		t.Errorf("unexpected client policy %+v", policy)
+	}
+
+	writeConfigFile(t, `
+policies:
+  routes:
+    /api/inventory: {timeout: 0s}
+  clients:
+    s3: {retry_budget: 2}
+`)
+	_, err = loadConfig()
+	for _, want := range []string{
+		"policies.routes[/api/inventory]: must be METHOD /path",
+		"policies.routes[/api/inventory].timeout: must be positive",
+		"policies.clients.s3: unknown client",
+		"policies.clients.s3.retry_budget: must be between 0 and 1, got 2",
+	} {
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("error does not contain %q:\n%v", want, err)
+		}
+	}
+}
+
+func TestConfigRedactsSecrets(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.Postgres.URL = "postgresql://demo:hunter2@db:5432/demo"
+	cfg.Vault.Token = "s.hunter2"
+	cfg.Responses.RedisURL = "host=db password=hunter2"
+
+	for _, f := range cfg.fields() {
+		if s := f.String(); strings.Contains(s, "hunter2") {
+			t.Errorf("%s logged as %q", f.env, s)
+		}
+		if f.env == "DATABASE_URL" && f.String() != "postgresql://demo:xxxxx@db:5432/demo" {
+			t.Errorf("DATABASE_URL logged as %q, want only the password hidden", f.String())
+		}
+	}
+}
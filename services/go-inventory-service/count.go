@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// ItemPage is the listItems response with pagination metadata, returned
+// when the request asks for it with ?with_total=true
+type ItemPage struct {
+	Items []InventoryItem `json:"items"`
+	Skip  int             `json:"skip"`
+	Limit int             `json:"limit"`
+	Total int64           `json:"total"`
+	// False when Total is the planner's estimate rather than a COUNT(*)
+	TotalExact bool `json:"total_exact"`
+}
+
+// ItemCounter decides between exact and estimated row counts. COUNT(*)
+// scans the whole table, which gets slow past a few million rows, while
+// the planner's estimate in pg_class.reltuples is a single row lookup.
+type ItemCounter struct {
+	// exact, estimated or auto
+	mode string
+	// In auto mode, tables estimated at more rows than this are not counted
+	// exactly
+	threshold int64
+}
+
+// Create the counter for the COUNT_MODE exact, estimated or auto
+func newItemCounter(cfg CountConfig) *ItemCounter {
+	return &ItemCounter{mode: cfg.Mode, threshold: cfg.ExactThreshold}
+}
+
+// Count the inventory rows, returning whether the count is exact
+func (app *App) countItems(ctx context.Context) (int64, bool, error) {
+	span := trace.SpanFromContext(ctx)
+	span.SetAttributes(attribute.String("count.mode", app.counter.mode))
+
+	if app.counter.mode != "exact" {
+		estimate, err := app.itemStore.EstimateItems(ctx)
+		if err != nil {
+			return 0, false, err
+		}
+
+		// reltuples is -1 until the table has been vacuumed or analyzed
+		if estimate >= 0 && (app.counter.mode == "estimated" || estimate > app.counter.threshold) {
+			span.SetAttributes(attribute.Bool("count.exact", false))
+			return estimate, false, nil
+		}
+	}
+
+	count, err := app.itemStore.CountItems(ctx)
+	if err != nil {
+		return 0, false, err
+	}
+	span.SetAttributes(attribute.Bool("count.exact", true))
+	return count, true, nil
+}
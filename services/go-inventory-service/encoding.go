@@ -0,0 +1,47 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	jsoniter "github.com/json-iterator/go"
+)
+
+// jsonEncoder marshals the response bodies of the hot read endpoints, where
+// encoding/json dominates the CPU profile at high request rates
+type jsonEncoder interface {
+	Marshal(v interface{}) ([]byte, error)
+}
+
+type stdJSONEncoder struct{}
+
+func (stdJSONEncoder) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+// Available encoders by JSON_ENCODER name. Encoders that need special build
+// conditions register themselves from files behind a build tag.
+var jsonEncoders = map[string]jsonEncoder{
+	"std":      stdJSONEncoder{},
+	"jsoniter": jsoniter.ConfigCompatibleWithStandardLibrary,
+}
+
+// Pick the encoder named by JSON_ENCODER. The name was checked when the
+// configuration was loaded.
+func newJSONEncoder(name string) jsonEncoder {
+	log.Printf("Using %s JSON encoder for read endpoints", name)
+	return jsonEncoders[name]
+}
+
+// Write a JSON response with the configured encoder
+func (app *App) renderJSON(c *gin.Context, status int, v interface{}) {
+	data, err := app.json.Marshal(v)
+	if err != nil {
+		logWithTrace(c.Request.Context(), "ERROR", "Failed to encode response", "error", err.Error())
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to encode response"})
+		return
+	}
+	c.Data(status, "application/json; charset=utf-8", data)
+}
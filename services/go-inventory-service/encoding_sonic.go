@@ -0,0 +1,11 @@
+//go:build sonic
+
+package main
+
+import "github.com/bytedance/sonic"
+
+// sonic is JIT based and only supports amd64/arm64 with recent Go
+// versions, so it is only built in with -tags sonic
+func init() {
+	jsonEncoders["sonic"] = sonic.ConfigStd
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Response bodies shaped like listItems and getStockLevels at their default
+// page size
+func benchmarkPayloads() map[string]interface{} {
+	now := time.Now()
+
+	items := make([]InventoryItem, 100)
+	for i := range items {
+		items[i] = InventoryItem{
+			ID:          i + 1,
+			ProductName: fmt.Sprintf("Product %d", i),
+			SKU:         fmt.Sprintf("SKU-%06d", i),
+			Quantity:    i * 7 % 500,
+			Location:    fmt.Sprintf("Warehouse %d", i%3+1),
+			CreatedAt:   now.Add(-time.Duration(i) * time.Minute),
+		}
+	}
+
+	stockLevels := make([]StockLevel, 100)
+	for i := range stockLevels {
+		stockLevels[i] = StockLevel{
+			ID:         primitive.NewObjectID(),
+			ProductSKU: fmt.Sprintf("SKU-%06d", i),
+			Warehouse:  fmt.Sprintf("Warehouse %d", i%3+1),
+			Available:  i * 7 % 500,
+			Reserved:   i % 10,
+			UpdatedAt:  now,
+		}
+	}
+
+	return map[string]interface{}{"items": items, "stock_levels": stockLevels}
+}
+
+// Compare throughput of the available encoders:
+//
+//	go test -run '^$' -bench JSONEncoders -benchmem
+//	go test -run '^$' -bench JSONEncoders -benchmem -tags sonic
+func BenchmarkJSONEncoders(b *testing.B) {
+	payloads := benchmarkPayloads()
+
+	names := make([]string, 0, len(jsonEncoders))
+	for name := range jsonEncoders {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, payload := range []string{"items", "stock_levels"} {
+		for _, name := range names {
+			encoder := jsonEncoders[name]
+			b.Run(payload+"/"+name, func(b *testing.B) {
+				data, err := encoder.Marshal(payloads[payload])
+				if err != nil {
+					b.Fatal(err)
+				}
+				b.SetBytes(int64(len(data)))
+				b.ReportAllocs()
+				b.ResetTimer()
+
+				for i := 0; i < b.N; i++ {
+					if _, err := encoder.Marshal(payloads[payload]); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+var domainEvents = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "domain_events_total",
+		Help: "Domain events by type and result: recorded or failed",
+	},
+	[]string{"type", "result"},
+)
+
+// Domain event types
+const (
+	eventItemCreated          = "item.created"
+	eventItemPriceChanged     = "item.price_changed"
+	eventStockReserved        = "stock.reserved"
+	eventReservationConfirmed = "reservation.confirmed"
+	eventReservationReleased  = "reservation.released"
+	eventReservationExpired   = "reservation.expired"
+	// A stock level write that failed half way was cleaned up or caught up
+	eventStockLevelRepaired = "stock_level.repaired"
+	// An item went down to LOW_STOCK_THRESHOLD or below
+	eventStockLow = "stock.low"
+	// The janitor removed stale demo items, once per run
+	eventItemsCleanedUp = "items.cleaned_up"
+	// The inventory was replaced by a snapshot, in part if it failed
+	eventSnapshotRestored = "snapshot.restored"
+)
+
+// Log of what happened to the inventory, in words, for the activity feed.
+// Unlike the change log it's written by the service, which knows why a row
+// changed, and it keeps the trace of the request that did it.
+const createEventsQuery = `
+	CREATE TABLE IF NOT EXISTS domain_events (
+		seq BIGSERIAL PRIMARY KEY,
+		type VARCHAR(50) NOT NULL,
+		entity_type VARCHAR(50) NOT NULL,
+		entity_id VARCHAR(100) NOT NULL,
+		message TEXT NOT NULL,
+		data JSONB NOT NULL DEFAULT '{}',
+		occurred_at TIMESTAMP NOT NULL,
+		trace_id VARCHAR(32) NOT NULL DEFAULT '',
+		span_id VARCHAR(16) NOT NULL DEFAULT ''
+	);
+	CREATE INDEX IF NOT EXISTS domain_events_occurred_at ON domain_events (occurred_at);
+	CREATE INDEX IF NOT EXISTS domain_events_entity ON domain_events (entity_type, entity_id, seq);
+`
+
+// DomainEvent is something that happened to an item, a reservation or a
+// stock level, with the trace of the request or job that did it
+type DomainEvent struct {
+	Seq        int64  `json:"seq"`
+	Type       string `json:"type"`
+	EntityType string `json:"entity_type"`
+	EntityID   string `json:"entity_id"`
+	// Human-readable, e.g. "Reserved 2 of W-1"
+	Message    string                 `json:"message"`
+	Data       map[string]interface{} `json:"data,omitempty"`
+	OccurredAt time.Time              `json:"occurred_at"`
+	TraceID    string                 `json:"trace_id,omitempty"`
+	SpanID     string                 `json:"span_id,omitempty"`
+}
+
+// EventFilter selects domain events. Zero fields don't filter.
+type EventFilter struct {
+	Type       string
+	EntityType string
+	EntityID   string
+	From, To   time.Time
+	// Only events before this sequence number, for the next page
+	BeforeSeq int64
+	Limit     int
+}
+
+// EventStore keeps the domain events (PostgreSQL)
+type EventStore interface {
+	// Append the event, setting its sequence number
+	RecordEvent(ctx context.Context, e *DomainEvent) error
+	// The events matching the filter, newest first
+	ListEvents(ctx context.Context, f EventFilter) ([]DomainEvent, error)
+}
+
+// postgresEventStore is the EventStore on PostgreSQL. The events are read
+// from the replica, if there is one.
+type postgresEventStore struct {
+	db      func() *sql.DB
+	replica *ReadReplica
+	chaos   *Chaos
+}
+
+func (s *postgresEventStore) RecordEvent(ctx context.Context, e *DomainEvent) error {
+	start := time.Now()
+	defer observeQuery("postgres", "record_event", start)
+	s.chaos.slowPostgres(ctx, s.db())
+
+	data, err := json.Marshal(e.Data)
+	if err != nil {
+		return err
+	}
+	return s.db().QueryRowContext(ctx, `
+		INSERT INTO domain_events (type, entity_type, entity_id, message, data, occurred_at, trace_id, span_id)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+		RETURNING seq
+	`, e.Type, e.EntityType, e.EntityID, e.Message, data, e.OccurredAt, e.TraceID, e.SpanID).Scan(&e.Seq)
+}
+
+func (s *postgresEventStore) ListEvents(ctx context.Context, f EventFilter) ([]DomainEvent, error) {
+	var where []string
+	var args []interface{}
+	filter := func(cond string, arg interface{}) {
+		args = append(args, arg)
+		where = append(where, fmt.Sprintf(cond, len(args)))
+	}
+	if f.Type != "" {
+		filter("type = $%d", f.Type)
+	}
+	if f.EntityType != "" {
+		filter("entity_type = $%d", f.EntityType)
+	}
+	if f.EntityID != "" {
+		filter("entity_id = $%d", f.EntityID)
+	}
+	if !f.From.IsZero() {
+		filter("occurred_at >= $%d", f.From)
+	}
+	if !f.To.IsZero() {
+		filter("occurred_at < $%d", f.To)
+	}
+	if f.BeforeSeq > 0 {
+		filter("seq < $%d", f.BeforeSeq)
+	}
+	query := `SELECT seq, type, entity_type, entity_id, message, data, occurred_at, trace_id, span_id FROM domain_events`
+	if len(where) > 0 {
+		query += " WHERE " + strings.Join(where, " AND ")
+	}
+	args = append(args, f.Limit)
+	query += fmt.Sprintf(" ORDER BY seq DESC LIMIT $%d", len(args))
+
+	var events []DomainEvent
+	err := s.replica.Read(ctx, s.db(), func(db *sql.DB) error {
+		start := time.Now()
+		s.chaos.slowPostgres(ctx, db)
+		rows, err := db.QueryContext(ctx, query, args...)
+		observeQuery("postgres", "list_events", start)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		events = make([]DomainEvent, 0, f.Limit)
+		for rows.Next() {
+			var e DomainEvent
+			var data []byte
+			if err := rows.Scan(&e.Seq, &e.Type, &e.EntityType, &e.EntityID, &e.Message, &data,
+				&e.OccurredAt, &e.TraceID, &e.SpanID); err != nil {
+				return err
+			}
+			if err := json.Unmarshal(data, &e.Data); err != nil {
+				return err
+			}
+			events = append(events, e)
+		}
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		explainQuery(ctx, db, "list_events", query, args...)
+		return nil
+	})
+	return events, err
+}
+
+// Record a domain event in the trace of ctx and publish it on the bus. The
+// change it describes is already made, so failing to record it is logged
+// but not returned, and the event is published all the same.
+func (app *App) publishEvent(ctx context.Context, eventType, entityType string, entityID interface{}, message string, data map[string]interface{}) {
+	e := DomainEvent{
+		Type:       eventType,
+		EntityType: entityType,
+		EntityID:   fmt.Sprint(entityID),
+		Message:    message,
+		Data:       data,
+		OccurredAt: app.clock.Now(),
+	}
+	e.TraceID, e.SpanID = spanIDs(ctx)
+
+	// Recorded first, for the sequence number the subscribers pass on
+	if app.events != nil {
+		if err := app.events.RecordEvent(ctx, &e); err != nil {
+			domainEvents.WithLabelValues(eventType, "failed").Inc()
+			logWithTrace(ctx, "WARN", "Error recording domain event", "type", eventType,
+				"entity_type", entityType, "entity_id", e.EntityID, "error", err.Error())
+		} else {
+			domainEvents.WithLabelValues(eventType, "recorded").Inc()
+		}
+	}
+	app.bus.Publish(ctx, e)
+}
+
+// EventPage is a page of domain events, newest first. Cursor is passed
+// back as before to get the older ones.
+type EventPage struct {
+	Events  []DomainEvent `json:"events"`
+	Cursor  string        `json:"cursor,omitempty"`
+	HasMore bool          `json:"has_more"`
+}
+
+const (
+	defaultEventsLimit = 50
+	maxEventsLimit     = 500
+)
+
+// List the domain events, newest first: ?type=, ?entity_type=,
+// ?entity_id=, ?from= and ?to= (RFC 3339) filter them, ?limit= and
+// ?before= page through them
+func (app *App) listEvents(c *gin.Context) {
+	ctx := c.Request.Context()
+	ctx, span := app.tracer.Start(ctx, "listEvents")
+	defer span.End()
+
+	f := EventFilter{
+		Type:       c.Query("type"),
+		EntityType: c.Query("entity_type"),
+		EntityID:   c.Query("entity_id"),
+		Limit:      defaultEventsLimit,
+	}
+	var err error
+	for param, t := range map[string]*time.Time{"from": &f.From, "to": &f.To} {
+		if s := c.Query(param); s != "" {
+			if *t, err = time.Parse(time.RFC3339Nano, s); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": param + " must be an RFC 3339 timestamp"})
+				return
+			}
+			// The events are in the database's time zone, UTC
+			*t = t.UTC()
+		}
+	}
+	if !f.From.IsZero() && !f.To.IsZero() && !f.From.Before(f.To) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "from must be before to"})
+		return
+	}
+	if s := c.Query("before"); s != "" {
+		if f.BeforeSeq, err = strconv.ParseInt(s, 10, 64); err != nil || f.BeforeSeq < 1 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "before must be a cursor from a previous page"})
+			return
+		}
+	}
+	if s := c.Query("limit"); s != "" {
+		f.Limit, err = strconv.Atoi(s)
+		if err != nil || f.Limit < 1 || f.Limit > maxEventsLimit {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("limit must be between 1 and %d", maxEventsLimit)})
+			return
+		}
+	}
+	span.SetAttributes(
+		attribute.String("events.type", f.Type),
+		attribute.String("events.entity_type", f.EntityType),
+		attribute.String("events.entity_id", f.EntityID),
+		attribute.Int("events.limit", f.Limit),
+	)
+
+	// One more than asked for, to know whether there are more
+	limit := f.Limit
+	f.Limit++
+	events, err := app.events.ListEvents(ctx, f)
+	if err != nil {
+		logWithTrace(ctx, "ERROR", "Error listing domain events", "error", err.Error())
+		span.RecordError(err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list events"})
+		return
+	}
+
+	page := EventPage{Events: events}
+	if len(events) > limit {
+		page.Events, page.HasMore = events[:limit], true
+		page.Cursor = strconv.FormatInt(page.Events[limit-1].Seq, 10)
+	}
+	span.SetAttributes(attribute.Int("events.count", len(page.Events)))
+
+	requestsTotal.WithLabelValues("GET", "/api/events", "200").Inc()
+	logWithTrace(ctx, "INFO", "Domain events listed", "count", len(page.Events))
+
+	app.renderJSON(c, http.StatusOK, page)
+}
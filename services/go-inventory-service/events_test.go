@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// fakeEventStore keeps the domain events in memory, oldest first
+type fakeEventStore struct {
+	events []DomainEvent
+}
+
+func (s *fakeEventStore) RecordEvent(ctx context.Context, e *DomainEvent) error {
+	e.Seq = int64(len(s.events) + 1)
+	s.events = append(s.events, *e)
+	return nil
+}
+
+func (s *fakeEventStore) ListEvents(ctx context.Context, f EventFilter) ([]DomainEvent, error) {
+	events := []DomainEvent{}
+	for i := len(s.events) - 1; i >= 0 && len(events) < f.Limit; i-- {
+		e := s.events[i]
+		if (f.Type == "" || e.Type == f.Type) &&
+			(f.EntityType == "" || e.EntityType == f.EntityType) &&
+			(f.EntityID == "" || e.EntityID == f.EntityID) &&
+			(f.From.IsZero() || !e.OccurredAt.Before(f.From)) &&
+			(f.To.IsZero() || e.OccurredAt.Before(f.To)) &&
+			(f.BeforeSeq == 0 || e.Seq < f.BeforeSeq) {
+			events = append(events, e)
+		}
+	}
+	return events, nil
+}
+
+func getEvents(t *testing.T, app *App, query string) (*httptest.ResponseRecorder, EventPage) {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.GET("/api/events", app.listEvents)
+
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/events"+query, nil))
+	var page EventPage
+	if rec.Code == http.StatusOK {
+		if err := json.Unmarshal(rec.Body.Bytes(), &page); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return rec, page
+}
+
+func TestCreateItemRecordsEvent(t *testing.T) {
+	now := time.Date(2024, 6, 1, 9, 0, 0, 0, time.UTC)
+	events := &fakeEventStore{}
+	app := newFakeApp(t, &fakeItemStore{}, &fakeStockStore{}, &fixedClock{now})
+	app.events = events
+
+	if rec := postItem(app); rec.Code != http.StatusCreated {
+		t.Fatalf("got status %d, want 201", rec.Code)
+	}
+
+	if len(events.events) != 1 {
+		t.Fatalf("got events %+v, want one", events.events)
+	}
+	e := events.events[0]
+	if e.Type != eventItemCreated || e.EntityType != "item" || e.EntityID != "1" || !e.OccurredAt.Equal(now) {
+		t.Errorf("got event %+v", e)
+	}
+	if e.Message != "Created Widget (W-1) with 3 in Warehouse A" || e.Data["sku"] != "W-1" {
+		t.Errorf("got event %+v", e)
+	}
+
+	// A failed create cleaning up after itself is recorded as a repair
+	events.events = nil
+	app.itemStore = &fakeItemStore{err: context.DeadlineExceeded}
+	postItem(app)
+	if len(events.events) != 1 || events.events[0].Type != eventStockLevelRepaired || events.events[0].EntityID != "W-1" {
+		t.Errorf("got events %+v, want a stock level repair", events.events)
+	}
+}
+
+func TestListEvents(t *testing.T) {
+	start := time.Date(2024, 6, 1, 9, 0, 0, 0, time.UTC)
+	events := &fakeEventStore{}
+	for i, e := range []DomainEvent{
+		{Type: eventItemCreated, EntityType: "item", EntityID: "1"},
+		{Type: eventStockReserved, EntityType: "reservation", EntityID: "1"},
+		{Type: eventReservationConfirmed, EntityType: "reservation", EntityID: "1"},
+		{Type: eventItemCreated, EntityType: "item", EntityID: "2"},
+		{Type: eventStockReserved, EntityType: "reservation", EntityID: "2"},
+	} {
+		e.OccurredAt = start.Add(time.Duration(i) * time.Minute)
+		events.RecordEvent(context.Background(), &e)
+	}
+	app := newFakeApp(t, &fakeItemStore{}, &fakeStockStore{}, systemClock{})
+	app.json = jsonEncoders["std"]
+	app.events = events
+
+	// Newest first, following the cursor to the end
+	_, page := getEvents(t, app, "?limit=2")
+	if len(page.Events) != 2 || page.Events[0].Seq != 5 || !page.HasMore || page.Cursor != "4" {
+		t.Fatalf("first page: %+v", page)
+	}
+	_, page = getEvents(t, app, "?limit=2&before="+page.Cursor)
+	_, page = getEvents(t, app, "?limit=2&before="+page.Cursor)
+	if len(page.Events) != 1 || page.Events[0].Seq != 1 || page.HasMore || page.Cursor != "" {
+		t.Fatalf("last page: %+v", page)
+	}
+
+	for _, tc := range []struct {
+		query string
+		want  []int64
+	}{
+		{"?type=stock.reserved", []int64{5, 2}},
+		{"?entity_type=reservation&entity_id=1", []int64{3, 2}},
+		{"?from=2024-06-01T09:01:00Z&to=2024-06-01T09:03:00Z", []int64{3, 2}},
+		{"?from=2024-06-01T11:00:00%2B02:00", []int64{5, 4, 3, 2, 1}},
+	} {
+		_, page := getEvents(t, app, tc.query)
+		var got []int64
+		for _, e := range page.Events {
+			got = append(got, e.Seq)
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: got events %v, want %v", tc.query, got, tc.want)
+		}
+	}
+
+	for _, query := range []string{"?from=today", "?before=0", "?limit=0", "?limit=1000",
+		"?from=2024-06-01T10:00:00Z&to=2024-06-01T09:00:00Z"} {
+		if rec, _ := getEvents(t, app, query); rec.Code != http.StatusBadRequest {
+			t.Errorf("%s: got status %d, want 400", query, rec.Code)
+		}
+	}
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+var (
+	eventStreamClients = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "event_stream_clients",
+			Help: "Clients connected to GET /api/events/stream",
+		},
+	)
+
+	eventStreamSkipped = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "event_stream_skipped_total",
+			Help: "Domain events not sent to a stream client because it had fallen behind",
+		},
+	)
+)
+
+// Events waiting to be written to a client; a client further behind than
+// this misses the newer ones
+const eventStreamBuffer = 64
+
+type eventStreamClient struct {
+	events chan DomainEvent
+	// The event types it wants, nil for all of them
+	types map[string]bool
+}
+
+// EventStream broadcasts the domain events to the clients of
+// GET /api/events/stream as server-sent events. It's an event bus
+// subscriber, so a client only gets the events published on the replica
+// it's connected to.
+type EventStream struct {
+	cfg EventStreamConfig
+
+	mu      sync.Mutex
+	clients map[*eventStreamClient]bool
+	// Closed when the server shuts down, to end the streams
+	done   chan struct{}
+	closed bool
+}
+
+func newEventStream(cfg EventStreamConfig) *EventStream {
+	return &EventStream{
+		cfg:     cfg,
+		clients: map[*eventStreamClient]bool{},
+		done:    make(chan struct{}),
+	}
+}
+
+// Publish is the bus subscriber: it queues e for the clients that want it,
+// without waiting for any of them
+func (s *EventStream) Publish(ctx context.Context, e DomainEvent) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for client := range s.clients {
+		if client.types != nil && !client.types[e.Type] {
+			continue
+		}
+		select {
+		case client.events <- e:
+		default:
+			eventStreamSkipped.Inc()
+		}
+	}
+	return nil
+}
+
+// Add a client, unless there are EVENT_STREAM_MAX_CLIENTS already or the
+// server is shutting down
+func (s *EventStream) add(types []string) (*eventStreamClient, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed || len(s.clients) >= s.cfg.MaxClients {
+		return nil, false
+	}
+	client := &eventStreamClient{events: make(chan DomainEvent, eventStreamBuffer)}
+	if len(types) > 0 {
+		client.types = map[string]bool{}
+		for _, t := range types {
+			client.types[t] = true
+		}
+	}
+	s.clients[client] = true
+	eventStreamClients.Inc()
+	return client, true
+}
+
+func (s *EventStream) remove(client *eventStreamClient) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.clients, client)
+	eventStreamClients.Dec()
+}
+
+// Close ends the streams, which the server's shutdown would wait for
+// otherwise
+func (s *EventStream) Close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.closed {
+		s.closed = true
+		close(s.done)
+	}
+}
+
+// Write one server-sent event. The sequence number is the id, unless the
+// event failed to be recorded and has none.
+func writeServerSentEvent(w gin.ResponseWriter, e DomainEvent) error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	if e.Seq > 0 {
+		if _, err := fmt.Fprintf(w, "id: %d\n", e.Seq); err != nil {
+			return err
+		}
+	}
+	_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", e.Type, data)
+	return err
+}
+
+// Stream the domain events as they happen, as server-sent events with the
+// event type as their name; ?type= (repeated or comma-separated) picks the
+// types. The events from before the stream opened are at GET /api/events.
+func (app *App) streamEvents(c *gin.Context) {
+	ctx := c.Request.Context()
+	ctx, span := app.tracer.Start(ctx, "streamEvents")
+	defer span.End()
+
+	var types []string
+	for _, param := range c.QueryArray("type") {
+		for _, t := range strings.Split(param, ",") {
+			if t = strings.TrimSpace(t); t != "" {
+				types = append(types, t)
+			}
+		}
+	}
+	span.SetAttributes(attribute.StringSlice("events.types", types))
+
+	client, ok := app.stream.add(types)
+	if !ok {
+		requestsTotal.WithLabelValues("GET", "/api/events/stream", "503").Inc()
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Too many event streams open, try again later"})
+		return
+	}
+	defer app.stream.remove(client)
+
+	requestsTotal.WithLabelValues("GET", "/api/events/stream", "200").Inc()
+	logWithTrace(ctx, "INFO", "Event stream opened", "types", strings.Join(types, ","))
+
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	// Tells nginx not to buffer the stream
+	c.Header("X-Accel-Buffering", "no")
+	c.Status(http.StatusOK)
+	c.Writer.Flush()
+
+	heartbeat := time.NewTicker(app.stream.cfg.Heartbeat)
+	defer heartbeat.Stop()
+	sent := 0
+	defer func() {
+		span.SetAttributes(attribute.Int("events.sent", sent))
+		logWithTrace(ctx, "INFO", "Event stream closed", "sent", sent)
+	}()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-app.stream.done:
+			return
+		case <-heartbeat.C:
+			if _, err := fmt.Fprint(c.Writer, ": heartbeat\n\n"); err != nil {
+				return
+			}
+		case e := <-client.events:
+			if err := writeServerSentEvent(c.Writer, e); err != nil {
+				return
+			}
+			sent++
+		}
+		c.Writer.Flush()
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Read one server-sent event, skipping heartbeats
+func readServerSentEvent(t *testing.T, r *bufio.Reader) map[string]string {
+	t.Helper()
+	event := map[string]string{}
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatalf("stream ended: %v", err)
+		}
+		line = strings.TrimSuffix(line, "\n")
+		if line == "" {
+			if len(event) > 0 {
+				return event
+			}
+			continue
+		}
+		if field, value, ok := strings.Cut(line, ": "); ok && field != "" {
+			event[field] = value
+		}
+	}
+}
+
+func TestEventStream(t *testing.T) {
+	events := &fakeEventStore{}
+	app := newFakeApp(t, &fakeItemStore{}, &fakeStockStore{}, systemClock{})
+	app.events = events
+	app.stream = newEventStream(EventStreamConfig{MaxClients: 1, Heartbeat: 10 * time.Millisecond})
+	app.bus = newEventBus(nil)
+	app.bus.Subscribe("stream", app.stream.Publish)
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.GET("/api/events/stream", app.streamEvents)
+	srv := httptest.NewServer(router)
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + "/api/events/stream?type=" + eventStockReserved + "," + eventReservationExpired)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("got status %d and headers %v", resp.StatusCode, resp.Header)
+	}
+
+	// One stream at most
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/events/stream", nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("second stream got status %d, want 503", rec.Code)
+	}
+
+	ctx := context.Background()
+	app.publishEvent(ctx, eventItemCreated, "item", 1, "Created Widget", nil)
+	app.publishEvent(ctx, eventStockReserved, "reservation", 7, "Reserved 2 of W-1", map[string]interface{}{"sku": "W-1"})
+
+	r := bufio.NewReader(resp.Body)
+	e := readServerSentEvent(t, r)
+	if e["id"] != "2" || e["event"] != eventStockReserved || !strings.Contains(e["data"], `"message":"Reserved 2 of W-1"`) {
+		t.Errorf("got event %v, want the reservation only", e)
+	}
+
+	// Shutting down ends the stream
+	app.stream.Close()
+	if _, err := io.ReadAll(r); err != nil {
+		t.Fatal(err)
+	}
+	app.stream.mu.Lock()
+	defer app.stream.mu.Unlock()
+	if len(app.stream.clients) != 0 {
+		t.Errorf("got %d clients after close", len(app.stream.clients))
+	}
+}
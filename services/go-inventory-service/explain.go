@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// When read queries are explained (POSTGRES_EXPLAIN)
+const (
+	explainOff    = "off"
+	explainAdmin  = "admin"
+	explainAlways = "always"
+)
+
+// Header with which an admin asks for the plans of the request's queries
+const explainHeader = "X-Debug-Explain"
+
+type explainKey struct{}
+
+func withExplain(ctx context.Context) context.Context {
+	return context.WithValue(ctx, explainKey{}, true)
+}
+
+func explainRequested(ctx context.Context) bool {
+	explain, _ := ctx.Value(explainKey{}).(bool)
+	return explain
+}
+
+// Middleware that turns on EXPLAIN ANALYZE for the request's read queries:
+// for every request with POSTGRES_EXPLAIN=always, or for admins sending
+// X-Debug-Explain: true with POSTGRES_EXPLAIN=admin. Runs after
+// authenticate; without authentication configured everybody is an admin,
+// as for the /admin routes.
+func (app *App) debugExplain(c *gin.Context) {
+	explain := app.explain == explainAlways
+	if app.explain == explainAdmin && strings.EqualFold(c.GetHeader(explainHeader), "true") {
+		ctx := c.Request.Context()
+		principal, _ := principalFromContext(ctx)
+		explain = (app.jwt == nil && app.apiKeys == nil) || (principal != nil && principal.HasRole(roleAdmin))
+		if !explain && principal != nil {
+			logWithTrace(ctx, "WARN", "Ignoring "+explainHeader+" from a caller who isn't an admin", "caller", principal.Caller)
+		}
+	}
+	if explain {
+		c.Request = c.Request.WithContext(withExplain(c.Request.Context()))
+	}
+	c.Next()
+}
+
+// Top of the JSON output of EXPLAIN
+type explainOutput struct {
+	Plan          explainNode `json:"Plan"`
+	PlanningTime  float64     `json:"Planning Time"`
+	ExecutionTime float64     `json:"Execution Time"`
+}
+
+type explainNode struct {
+	NodeType     string        `json:"Node Type"`
+	RelationName string        `json:"Relation Name"`
+	IndexName    string        `json:"Index Name"`
+	TotalCost    float64       `json:"Total Cost"`
+	ActualRows   float64       `json:"Actual Rows"`
+	ActualTime   float64       `json:"Actual Total Time"`
+	Loops        float64       `json:"Actual Loops"`
+	Plans        []explainNode `json:"Plans"`
+}
+
+// One line per node, indented by depth, e.g.
+//
+//	Limit (rows=20 time=0.05ms)
+//	  Index Scan using inventory_pkey on inventory (rows=20 time=0.04ms)
+func (n explainNode) summary(b *strings.Builder, depth int) {
+	b.WriteString(strings.Repeat("  ", depth) + n.NodeType)
+	if n.IndexName != "" {
+		b.WriteString(" using " + n.IndexName)
+	}
+	if n.RelationName != "" {
+		b.WriteString(" on " + n.RelationName)
+	}
+	fmt.Fprintf(b, " (rows=%.0f time=%.2fms", n.ActualRows, n.ActualTime)
+	if n.Loops > 1 {
+		fmt.Fprintf(b, " loops=%.0f", n.Loops)
+	}
+	b.WriteString(")\n")
+	for _, child := range n.Plans {
+		child.summary(b, depth+1)
+	}
+}
+
+// Whether the plan reads a whole table
+func (n explainNode) seqScan() bool {
+	if n.NodeType == "Seq Scan" {
+		return true
+	}
+	for _, child := range n.Plans {
+		if child.seqScan() {
+			return true
+		}
+	}
+	return false
+}
+
+// Run EXPLAIN ANALYZE for a read query that just ran, when the request asked
+// for it, and attach the plan to the current span as a db.explain event and
+// to a DEBUG log line. ANALYZE executes the query a second time, in a
+// read-only transaction that is rolled back. A failure is logged, not
+// returned: the query itself succeeded.
+func explainQuery(ctx context.Context, db *sql.DB, operation, query string, args ...interface{}) {
+	if !explainRequested(ctx) {
+		return
+	}
+
+	plan, err := runExplain(ctx, db, query, args...)
+	if err != nil {
+		logWithTrace(ctx, "WARN", "EXPLAIN ANALYZE failed", "db.operation", operation, "error", err.Error())
+		return
+	}
+
+	var summary strings.Builder
+	plan.Plan.summary(&summary, 0)
+	text := strings.TrimSuffix(summary.String(), "\n")
+
+	trace.SpanFromContext(ctx).AddEvent("db.explain", trace.WithAttributes(
+		attribute.String("db.system", "postgresql"),
+		attribute.String("db.operation", operation),
+		attribute.String("db.plan", text),
+		attribute.String("db.plan.node", plan.Plan.NodeType),
+		attribute.Bool("db.plan.seq_scan", plan.Plan.seqScan()),
+		attribute.Float64("db.plan.total_cost", plan.Plan.TotalCost),
+		attribute.Float64("db.plan.planning_ms", plan.PlanningTime),
+		attribute.Float64("db.plan.execution_ms", plan.ExecutionTime),
+	))
+	logWithTrace(ctx, "DEBUG", "Query plan",
+		"db.operation", operation,
+		"plan", text,
+		"planning_ms", plan.PlanningTime,
+		"execution_ms", plan.ExecutionTime,
+	)
+}
+
+func runExplain(ctx context.Context, db *sql.DB, query string, args ...interface{}) (explainOutput, error) {
+	tx, err := db.BeginTx(ctx, &sql.TxOptions{ReadOnly: true})
+	if err != nil {
+		return explainOutput{}, err
+	}
+	defer tx.Rollback()
+
+	var raw []byte
+	if err := tx.QueryRowContext(ctx, "EXPLAIN (ANALYZE, FORMAT JSON) "+query, args...).Scan(&raw); err != nil {
+		return explainOutput{}, err
+	}
+	return parseExplain(raw)
+}
+
+func parseExplain(raw []byte) (explainOutput, error) {
+	var out []explainOutput
+	if err := json.Unmarshal(raw, &out); err != nil {
+		return explainOutput{}, fmt.Errorf("parse EXPLAIN output: %w", err)
+	}
+	if len(out) == 0 {
+		return explainOutput{}, fmt.Errorf("empty EXPLAIN output")
+	}
+	return out[0], nil
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"crypto/sha256"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestParseExplain(t *testing.T) {
+	raw := []byte(`[{
+		"Plan": {
+			"Node Type": "Limit", "Total Cost": 12.5, "Actual Rows": 20, "Actual Total Time": 0.412, "Actual Loops": 1,
+			"Plans": [{
+				"Node Type": "Sort", "Actual Rows": 20, "Actual Total Time": 0.401, "Actual Loops": 1,
+				"Plans": [{"Node Type": "Seq Scan", "Relation Name": "inventory", "Actual Rows": 500, "Actual Total Time": 0.2, "Actual Loops": 1}]
+			}]
+		},
+		"Planning Time": 0.08,
+		"Execution Time": 0.45
+	}]`)
+
+	plan, err := parseExplain(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if plan.ExecutionTime != 0.45 || plan.PlanningTime != 0.08 || plan.Plan.TotalCost != 12.5 {
+		t.Errorf("unexpected plan %+v", plan)
+	}
+	if !plan.Plan.seqScan() {
+		t.Error("sequential scan not found")
+	}
+
+	var summary strings.Builder
+	plan.Plan.summary(&summary, 0)
+	want := "Limit (rows=20 time=0.41ms)\n" +
+		"  Sort (rows=20 time=0.40ms)\n" +
+		"    Seq Scan on inventory (rows=500 time=0.20ms)\n"
+	if got := summary.String(); got != want {
+		t.Errorf("summary:\n%s\nwant:\n%s", got, want)
+	}
+
+	if _, err := parseExplain([]byte(`[]`)); err == nil {
+		t.Error("empty output was accepted")
+	}
+}
+
+func TestDebugExplain(t *testing.T) {
+	app := &App{
+		explain: explainAdmin,
+		apiKeys: &APIKeyStore{
+			identities: map[[sha256.Size]byte]string{
+				sha256.Sum256([]byte("reader-key")): "reader",
+				sha256.Sum256([]byte("admin-key")):  "operator",
+			},
+			roles: map[string][]string{"operator": {roleAdmin}},
+		},
+	}
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.GET("/api/inventory", app.authenticate, app.debugExplain, func(c *gin.Context) {
+		if explainRequested(c.Request.Context()) {
+			c.Status(http.StatusAccepted)
+			return
+		}
+		c.Status(http.StatusOK)
+	})
+
+	explained := func(key, header string) bool {
+		req := httptest.NewRequest(http.MethodGet, "/api/inventory", nil)
+		req.Header.Set("X-API-Key", key)
+		if header != "" {
+			req.Header.Set(explainHeader, header)
+		}
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		return rec.Code == http.StatusAccepted
+	}
+
+	if !explained("admin-key", "true") {
+		t.Error("admin request was not explained")
+	}
+	if explained("admin-key", "") {
+		t.Error("request without the header was explained")
+	}
+	if explained("reader-key", "true") {
+		t.Error("request of a reader was explained")
+	}
+
+	app.explain = explainOff
+	if explained("admin-key", "true") {
+		t.Error("request was explained with POSTGRES_EXPLAIN=off")
+	}
+	app.explain = explainAlways
+	if !explained("reader-key", "") {
+		t.Error("request was not explained with POSTGRES_EXPLAIN=always")
+	}
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"runtime/debug"
+	"runtime/metrics"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Heap ballast: a large allocation that is never touched, so its pages are
+// never backed by memory, but that counts towards the live heap and so
+// raises the heap size at which the next GC starts
+var (
+	ballastMu sync.Mutex
+	ballast   []byte
+)
+
+var (
+	_ = promauto.NewGaugeFunc(
+		prometheus.GaugeOpts{
+			Name: "runtime_gc_heap_goal_bytes",
+			Help: "Heap size at which the next garbage collection is started",
+		},
+		func() float64 { return readRuntimeMetric("/gc/heap/goal:bytes") },
+	)
+
+	_ = promauto.NewGaugeFunc(
+		prometheus.GaugeOpts{
+			Name: "runtime_gc_percent",
+			Help: "Current GOGC setting, -1 when the percentage based GC is off",
+		},
+		func() float64 { return readRuntimeMetric("/gc/gogc:percent") },
+	)
+
+	_ = promauto.NewGaugeFunc(
+		prometheus.GaugeOpts{
+			Name: "runtime_memory_limit_bytes",
+			Help: "Current GOMEMLIMIT setting",
+		},
+		func() float64 { return readRuntimeMetric("/gc/gomemlimit:bytes") },
+	)
+
+	_ = promauto.NewGaugeFunc(
+		prometheus.GaugeOpts{
+			Name: "runtime_gc_last_pause_seconds",
+			Help: "Stop-the-world pause time of the most recent garbage collection",
+		},
+		func() float64 {
+			var stats debug.GCStats
+			debug.ReadGCStats(&stats)
+			if len(stats.Pause) == 0 {
+				return 0
+			}
+			return stats.Pause[0].Seconds()
+		},
+	)
+
+	heapBallastBytes = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "runtime_heap_ballast_bytes",
+			Help: "Size of the heap ballast allocation",
+		},
+	)
+)
+
+func readRuntimeMetric(name string) float64 {
+	sample := []metrics.Sample{{Name: name}}
+	metrics.Read(sample)
+	switch sample[0].Value.Kind() {
+	case metrics.KindUint64:
+		v := sample[0].Value.Uint64()
+		if v == math.MaxInt64 {
+			// No memory limit
+			return math.Inf(1)
+		}
+		return float64(v)
+	case metrics.KindFloat64:
+		return sample[0].Value.Float64()
+	}
+	return 0
+}
+
+// Apply the GC settings. The runtime reads GOGC and GOMEMLIMIT itself; on
+// top of that:
+//
+//   - GOMEMLIMIT_RATIO sets the memory limit to a fraction (e.g. 0.9) of the
+//     container's cgroup memory limit
+//   - GC_BALLAST_SIZE allocates a heap ballast (e.g. 256MiB)
+func configureGC(cfg GCConfig) error {
+	if cfg.MemoryLimitRatio > 0 {
+		limit, err := cgroupMemoryLimit()
+		if err != nil {
+			return err
+		}
+		if limit > 0 {
+			debug.SetMemoryLimit(int64(float64(limit) * cfg.MemoryLimitRatio))
+		}
+	}
+
+	if cfg.Ballast != "" {
+		n, err := parseByteSize(cfg.Ballast)
+		if err != nil {
+			return fmt.Errorf("invalid GC_BALLAST_SIZE %q", cfg.Ballast)
+		}
+		setHeapBallast(n)
+	}
+
+	settings := currentGCSettings()
+	log.Printf("GC settings: GOGC=%v, memory limit=%v bytes, ballast=%v bytes",
+		settings["gc_percent"], settings["memory_limit"], settings["ballast"])
+	return nil
+}
+
+// Read the memory limit of the container from cgroup v2, or v1. Returns 0
+// when there is no limit.
+func cgroupMemoryLimit() (int64, error) {
+	for _, path := range []string{"/sys/fs/cgroup/memory.max", "/sys/fs/cgroup/memory/memory.limit_in_bytes"} {
+		data, err := os.ReadFile(path)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return 0, err
+		}
+		value := strings.TrimSpace(string(data))
+		if value == "max" {
+			return 0, nil
+		}
+		limit, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("failed to parse %s: %w", path, err)
+		}
+		// cgroup v1 reports a huge number for "no limit"
+		if limit >= math.MaxInt64/2 {
+			return 0, nil
+		}
+		return limit, nil
+	}
+	return 0, nil
+}
+
+// Parse a size such as 1048576, 512KiB, 256MiB or 1GiB
+func parseByteSize(s string) (int64, error) {
+	units := []struct {
+		suffix string
+		factor int64
+	}{{"GiB", 1 << 30}, {"MiB", 1 << 20}, {"KiB", 1 << 10}, {"B", 1}}
+
+	factor := int64(1)
+	for _, u := range units {
+		if strings.HasSuffix(s, u.suffix) {
+			s, factor = strings.TrimSuffix(s, u.suffix), u.factor
+			break
+		}
+	}
+	n, err := strconv.ParseInt(strings.TrimSpace(s), 10, 64)
+	if err != nil || n < 0 {
+		return 0, errors.New("invalid size")
+	}
+	return n * factor, nil
+}
+
+func setHeapBallast(size int64) {
+	ballastMu.Lock()
+	defer ballastMu.Unlock()
+	ballast = nil
+	if size > 0 {
+		ballast = make([]byte, size)
+	}
+	heapBallastBytes.Set(float64(size))
+}
+
+// GCSettings are the GC knobs that can be changed at runtime
+type GCSettings struct {
+	GCPercent   *int    `json:"gc_percent,omitempty"`
+	MemoryLimit *string `json:"memory_limit,omitempty"`
+	Ballast     *string `json:"ballast,omitempty"`
+}
+
+func currentGCSettings() gin.H {
+	ballastMu.Lock()
+	ballastSize := len(ballast)
+	ballastMu.Unlock()
+
+	return gin.H{
+		"gc_percent":      int(readRuntimeMetric("/gc/gogc:percent")),
+		"memory_limit":    debug.SetMemoryLimit(-1),
+		"ballast":         ballastSize,
+		"heap_goal_bytes": uint64(readRuntimeMetric("/gc/heap/goal:bytes")),
+	}
+}
+
+// Show the current GC settings
+func (app *App) gcStatus(c *gin.Context) {
+	c.JSON(http.StatusOK, currentGCSettings())
+}
+
+// Change GC settings at runtime, to show their effect under load. A
+// memory_limit of "off" removes the limit.
+func (app *App) updateGC(c *gin.Context) {
+	var req GCSettings
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var limit, ballastSize int64 = -1, -1
+	var err error
+	if req.MemoryLimit != nil {
+		if *req.MemoryLimit == "off" {
+			limit = math.MaxInt64
+		} else if limit, err = parseByteSize(*req.MemoryLimit); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid memory_limit"})
+			return
+		}
+	}
+	if req.Ballast != nil {
+		if ballastSize, err = parseByteSize(*req.Ballast); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid ballast"})
+			return
+		}
+	}
+
+	if req.GCPercent != nil {
+		debug.SetGCPercent(*req.GCPercent)
+	}
+	if limit >= 0 {
+		debug.SetMemoryLimit(limit)
+	}
+	if ballastSize >= 0 {
+		setHeapBallast(ballastSize)
+	}
+
+	settings := currentGCSettings()
+	logWithTrace(c.Request.Context(), "INFO", "GC settings changed",
+		"gc_percent", settings["gc_percent"],
+		"memory_limit", settings["memory_limit"],
+		"ballast", settings["ballast"],
+	)
+	c.JSON(http.StatusOK, settings)
+}
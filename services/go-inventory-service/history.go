@@ -0,0 +1,350 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Every version of every item, for the item history and point-in-time
+// reads. Like the change log it's written by a trigger, so no write path
+// can forget to. A version is valid from the write that made it until the
+// next one, by the database's clock rather than the item's updated_at, so a
+// restore or a skewed service clock can't write versions into the past. A
+// delete closes the last version and adds a "deleted" one that is never
+// valid. On first run the existing items get a version from their
+// updated_at on, what they looked like before that isn't known.
+const createHistoryQuery = `
+	SELECT pg_advisory_xact_lock(hashtext('inventory_history'));
+
+	CREATE TABLE IF NOT EXISTS inventory_history (
+		item_id INTEGER NOT NULL,
+		version INTEGER NOT NULL,
+		op VARCHAR(10) NOT NULL,
+		product_name VARCHAR(255) NOT NULL,
+		sku VARCHAR(100) NOT NULL,
+		quantity INTEGER NOT NULL,
+		location VARCHAR(255) NOT NULL,
+		unit_price NUMERIC(12, 2),
+		created_at TIMESTAMP NOT NULL,
+		updated_at TIMESTAMP NOT NULL,
+		valid_from TIMESTAMP NOT NULL,
+		valid_to TIMESTAMP,
+		trace_id VARCHAR(32) NOT NULL DEFAULT '',
+		PRIMARY KEY (item_id, version)
+	);
+	CREATE INDEX IF NOT EXISTS inventory_history_valid ON inventory_history (valid_from, valid_to);
+	CREATE INDEX IF NOT EXISTS inventory_history_sku ON inventory_history (sku, valid_from);
+
+	INSERT INTO inventory_history (item_id, version, op, product_name, sku, quantity, location,
+		unit_price, created_at, updated_at, valid_from, trace_id)
+	SELECT id, 1, 'created', product_name, sku, quantity, location,
+		unit_price, created_at, updated_at, updated_at, last_trace_id
+	FROM inventory
+	WHERE NOT EXISTS (SELECT 1 FROM inventory_history)
+	ORDER BY id;
+
+	CREATE OR REPLACE FUNCTION record_inventory_history() RETURNS trigger AS $$
+	DECLARE
+		item inventory%ROWTYPE;
+		next_version INTEGER;
+	BEGIN
+		IF TG_OP = 'DELETE' THEN
+			item := OLD;
+		ELSE
+			item := NEW;
+		END IF;
+		UPDATE inventory_history SET valid_to = CURRENT_TIMESTAMP
+		WHERE item_id = item.id AND valid_to IS NULL AND op <> 'deleted';
+		SELECT COALESCE(MAX(version), 0) + 1 INTO next_version
+		FROM inventory_history WHERE item_id = item.id;
+
+		INSERT INTO inventory_history (item_id, version, op, product_name, sku, quantity, location,
+			unit_price, created_at, updated_at, valid_from, valid_to, trace_id)
+		VALUES (item.id, next_version,
+			CASE TG_OP WHEN 'INSERT' THEN 'created' WHEN 'UPDATE' THEN 'updated' ELSE 'deleted' END,
+			item.product_name, item.sku, item.quantity, item.location,
+			item.unit_price, item.created_at, item.updated_at, CURRENT_TIMESTAMP,
+			CASE TG_OP WHEN 'DELETE' THEN CURRENT_TIMESTAMP END,
+			CASE TG_OP WHEN 'DELETE' THEN '' ELSE item.last_trace_id END);
+		RETURN item;
+	END;
+	$$ LANGUAGE plpgsql;
+
+	CREATE OR REPLACE TRIGGER inventory_history
+	AFTER INSERT OR UPDATE OR DELETE ON inventory
+	FOR EACH ROW EXECUTE FUNCTION record_inventory_history();
+`
+
+// ItemVersion is the item as one write left it
+type ItemVersion struct {
+	Version int `json:"version"`
+	// "created", "updated" or "deleted"
+	Op   string        `json:"op"`
+	Item InventoryItem `json:"item"`
+	// When the write was made, and when the next one replaced it, absent
+	// for the current version
+	ValidFrom time.Time  `json:"valid_from"`
+	ValidTo   *time.Time `json:"valid_to,omitempty"`
+	// The trace of the write, absent for deletes
+	TraceID string `json:"trace_id,omitempty"`
+}
+
+// HistoryStore reads the item versions (PostgreSQL)
+type HistoryStore interface {
+	// Up to limit versions of the item older than the before version, or
+	// from the newest when before is 0, newest first
+	ItemHistory(ctx context.Context, itemID, before, limit int) ([]ItemVersion, error)
+	// ListItems as of that time
+	ListItemsAsOf(ctx context.Context, asOf time.Time, skip, limit int) ([]InventoryItem, error)
+	CountItemsAsOf(ctx context.Context, asOf time.Time) (int64, error)
+	// FindItem as of that time. Returns sql.ErrNoRows if the item didn't
+	// exist then.
+	FindItemAsOf(ctx context.Context, column string, value interface{}, asOf time.Time) (InventoryItem, error)
+}
+
+// postgresHistoryStore is the HistoryStore on PostgreSQL. The versions are
+// read from the replica, if there is one.
+type postgresHistoryStore struct {
+	db      func() *sql.DB
+	replica *ReadReplica
+	chaos   *Chaos
+}
+
+// The versions valid at $1
+const historyAsOfCondition = `valid_from <= $1 AND (valid_to IS NULL OR valid_to > $1) AND op <> 'deleted'`
+
+func (s *postgresHistoryStore) ItemHistory(ctx context.Context, itemID, before, limit int) ([]ItemVersion, error) {
+	query := `
+		SELECT version, op, product_name, sku, quantity, location, unit_price,
+			created_at, updated_at, valid_from, valid_to, trace_id
+		FROM inventory_history
+		WHERE item_id = $1 AND ($2 = 0 OR version < $2)
+		ORDER BY version DESC
+		LIMIT $3
+	`
+
+	var versions []ItemVersion
+	err := s.replica.Read(ctx, s.db(), func(db *sql.DB) error {
+		start := time.Now()
+		s.chaos.slowPostgres(ctx, db)
+		rows, err := db.QueryContext(ctx, query, itemID, before, limit)
+		observeQuery("postgres", "item_history", start)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		versions = make([]ItemVersion, 0, min(limit, maxHistoryLimit))
+		for rows.Next() {
+			v := ItemVersion{Item: InventoryItem{ID: itemID}}
+			if err := rows.Scan(&v.Version, &v.Op, &v.Item.ProductName, &v.Item.SKU, &v.Item.Quantity,
+				&v.Item.Location, &v.Item.UnitPrice, &v.Item.CreatedAt, &v.Item.UpdatedAt,
+				&v.ValidFrom, &v.ValidTo, &v.TraceID); err != nil {
+				return err
+			}
+			versions = append(versions, v)
+		}
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		explainQuery(ctx, db, "item_history", query, itemID, before, limit)
+		return nil
+	})
+	return versions, err
+}
+
+func (s *postgresHistoryStore) ListItemsAsOf(ctx context.Context, asOf time.Time, skip, limit int) ([]InventoryItem, error) {
+	query := `
+		SELECT item_id, product_name, sku, quantity, location, created_at, updated_at, unit_price
+		FROM inventory_history
+		WHERE ` + historyAsOfCondition + `
+		ORDER BY created_at DESC
+		OFFSET $2 LIMIT $3
+	`
+
+	var items []InventoryItem
+	err := s.replica.Read(ctx, s.db(), func(db *sql.DB) error {
+		start := time.Now()
+		s.chaos.slowPostgres(ctx, db)
+		rows, err := db.QueryContext(ctx, query, asOf, skip, limit)
+		observeQuery("postgres", "list_items_as_of", start)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		if items, err = scanItems(rows, limit); err != nil {
+			return err
+		}
+		explainQuery(ctx, db, "list_items_as_of", query, asOf, skip, limit)
+		return nil
+	})
+	return items, err
+}
+
+func (s *postgresHistoryStore) CountItemsAsOf(ctx context.Context, asOf time.Time) (int64, error) {
+	query := `SELECT COUNT(*) FROM inventory_history WHERE ` + historyAsOfCondition
+
+	var count int64
+	err := s.replica.Read(ctx, s.db(), func(db *sql.DB) error {
+		start := time.Now()
+		s.chaos.slowPostgres(ctx, db)
+		err := db.QueryRowContext(ctx, query, asOf).Scan(&count)
+		observeQuery("postgres", "count_items_as_of", start)
+		if err != nil {
+			return err
+		}
+		explainQuery(ctx, db, "count_items_as_of", query, asOf)
+		return nil
+	})
+	return count, err
+}
+
+func (s *postgresHistoryStore) FindItemAsOf(ctx context.Context, column string, value interface{}, asOf time.Time) (InventoryItem, error) {
+	if column == "id" {
+		column = "item_id"
+	}
+	query := `
+		SELECT item_id, product_name, sku, quantity, location, created_at, updated_at, unit_price
+		FROM inventory_history
+		WHERE ` + historyAsOfCondition + ` AND ` + column + ` = $2
+	`
+
+	operation := "get_item_as_of"
+	if column != "item_id" {
+		operation = "get_item_by_" + column + "_as_of"
+	}
+
+	var item InventoryItem
+	err := s.replica.Read(ctx, s.db(), func(db *sql.DB) error {
+		start := time.Now()
+		s.chaos.slowPostgres(ctx, db)
+		err := db.QueryRowContext(ctx, query, asOf, value).Scan(
+			&item.ID, &item.ProductName, &item.SKU,
+			&item.Quantity, &item.Location, &item.CreatedAt, &item.UpdatedAt, &item.UnitPrice,
+		)
+		observeQuery("postgres", operation, start)
+		if err != nil {
+			return err
+		}
+		explainQuery(ctx, db, operation, query, asOf, value)
+		return nil
+	})
+	return item, err
+}
+
+// Parse ?as_of=, an RFC 3339 timestamp; zero when it isn't set
+func parseAsOf(c *gin.Context) (time.Time, error) {
+	s := c.Query("as_of")
+	if s == "" {
+		return time.Time{}, nil
+	}
+	t, err := time.Parse(time.RFC3339Nano, s)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("as_of must be an RFC 3339 timestamp")
+	}
+	// The history is in the database's time zone, UTC
+	return t.UTC(), nil
+}
+
+// Answer GET /api/inventory/{id} or /api/inventory/sku/{sku} with ?as_of=,
+// from the history rather than the item cache
+func (app *App) getItemAsOf(c *gin.Context, ctx context.Context, endpoint, column string, value interface{}, asOf time.Time) {
+	trace.SpanFromContext(ctx).SetAttributes(attribute.String("item.as_of", asOf.Format(time.RFC3339Nano)))
+
+	item, err := app.history.FindItemAsOf(ctx, column, value, asOf)
+	if err == sql.ErrNoRows {
+		logWithTrace(ctx, "WARN", "Inventory item not found", column, value, "as_of", asOf)
+		c.JSON(http.StatusNotFound, gin.H{"error": "Item not found at that time"})
+		return
+	}
+	if err != nil {
+		logWithTrace(ctx, "ERROR", "Error fetching inventory item version", "error", err.Error())
+		trace.SpanFromContext(ctx).RecordError(err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch item"})
+		return
+	}
+
+	itemsQueried.Inc()
+	requestsTotal.WithLabelValues("GET", endpoint, "200").Inc()
+	logWithTrace(ctx, "INFO", "Inventory item version retrieved", "item_id", item.ID, "as_of", asOf)
+
+	app.render(c, http.StatusOK, item)
+}
+
+// ItemHistory is a page of an item's versions, newest first. Cursor is
+// passed back as before to get the older ones.
+type ItemHistory struct {
+	ItemID   int           `json:"item_id"`
+	Versions []ItemVersion `json:"versions"`
+	Cursor   string        `json:"cursor,omitempty"`
+	HasMore  bool          `json:"has_more"`
+}
+
+const (
+	defaultHistoryLimit = 50
+	maxHistoryLimit     = 500
+)
+
+// List the versions of an item, newest first, including the deleted items;
+// ?limit= and ?before= page through them
+func (app *App) getItemHistory(c *gin.Context) {
+	ctx := c.Request.Context()
+	ctx, span := app.tracer.Start(ctx, "getItemHistory")
+	defer span.End()
+
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid item ID"})
+		return
+	}
+	before := 0
+	if s := c.Query("before"); s != "" {
+		if before, err = strconv.Atoi(s); err != nil || before < 1 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "before must be a cursor from a previous page"})
+			return
+		}
+	}
+	limit := defaultHistoryLimit
+	if s := c.Query("limit"); s != "" {
+		limit, err = strconv.Atoi(s)
+		if err != nil || limit < 1 || limit > maxHistoryLimit {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("limit must be between 1 and %d", maxHistoryLimit)})
+			return
+		}
+	}
+	span.SetAttributes(attribute.Int("item.id", id), attribute.Int("history.limit", limit))
+
+	// One more than asked for, to know whether there are more
+	versions, err := app.history.ItemHistory(ctx, id, before, limit+1)
+	if err != nil {
+		logWithTrace(ctx, "ERROR", "Error listing item history", "item_id", id, "error", err.Error())
+		span.RecordError(err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list item history"})
+		return
+	}
+	if len(versions) == 0 && before == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Item not found"})
+		return
+	}
+
+	page := ItemHistory{ItemID: id, Versions: versions}
+	if len(versions) > limit {
+		page.Versions, page.HasMore = versions[:limit], true
+		page.Cursor = strconv.Itoa(page.Versions[limit-1].Version)
+	}
+	span.SetAttributes(attribute.Int("history.count", len(page.Versions)))
+
+	requestsTotal.WithLabelValues("GET", "/api/inventory/:id/history", "200").Inc()
+	logWithTrace(ctx, "INFO", "Item history listed", "item_id", id, "count", len(page.Versions))
+
+	app.renderJSON(c, http.StatusOK, page)
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// fakeHistoryStore keeps the item versions in memory, oldest first
+type fakeHistoryStore struct {
+	versions []ItemVersion
+}
+
+// Record a new version of the item at t, closing the one before
+func (s *fakeHistoryStore) write(op string, item InventoryItem, t time.Time) {
+	version := 1
+	for i := range s.versions {
+		if v := &s.versions[i]; v.Item.ID == item.ID {
+			version = v.Version + 1
+			if v.ValidTo == nil && v.Op != "deleted" {
+				v.ValidTo = &t
+			}
+		}
+	}
+	v := ItemVersion{Version: version, Op: op, Item: item, ValidFrom: t}
+	if op == "deleted" {
+		v.ValidTo = &t
+	}
+	s.versions = append(s.versions, v)
+}
+
+func (s *fakeHistoryStore) validAt(v ItemVersion, asOf time.Time) bool {
+	return v.Op != "deleted" && !v.ValidFrom.After(asOf) && (v.ValidTo == nil || v.ValidTo.After(asOf))
+}
+
+func (s *fakeHistoryStore) ItemHistory(ctx context.Context, itemID, before, limit int) ([]ItemVersion, error) {
+	versions := []ItemVersion{}
+	for i := len(s.versions) - 1; i >= 0 && len(versions) < limit; i-- {
+		if v := s.versions[i]; v.Item.ID == itemID && (before == 0 || v.Version < before) {
+			versions = append(versions, v)
+		}
+	}
+	return versions, nil
+}
+
+func (s *fakeHistoryStore) ListItemsAsOf(ctx context.Context, asOf time.Time, skip, limit int) ([]InventoryItem, error) {
+	items := []InventoryItem{}
+	for _, v := range s.versions {
+		if s.validAt(v, asOf) {
+			items = append(items, v.Item)
+		}
+	}
+	return items, nil
+}
+
+func (s *fakeHistoryStore) CountItemsAsOf(ctx context.Context, asOf time.Time) (int64, error) {
+	items, _ := s.ListItemsAsOf(ctx, asOf, 0, 0)
+	return int64(len(items)), nil
+}
+
+func (s *fakeHistoryStore) FindItemAsOf(ctx context.Context, column string, value interface{}, asOf time.Time) (InventoryItem, error) {
+	for _, v := range s.versions {
+		if s.validAt(v, asOf) && (column == "id" && fmt.Sprint(v.Item.ID) == fmt.Sprint(value) || column == "sku" && v.Item.SKU == value) {
+			return v.Item, nil
+		}
+	}
+	return InventoryItem{}, sql.ErrNoRows
+}
+
+func TestReadsAsOf(t *testing.T) {
+	t0 := time.Date(2024, 6, 1, 9, 0, 0, 0, time.UTC)
+	items := &fakeItemStore{}
+	items.CreateItem(context.Background(), &InventoryItem{ProductName: "Widget", SKU: "W-1", Quantity: 1})
+	app := newFakeApp(t, items, &fakeStockStore{}, systemClock{})
+	history := &fakeHistoryStore{}
+	app.history = history
+	history.write("created", InventoryItem{ID: 1, ProductName: "Widget", SKU: "W-1", Quantity: 5}, t0)
+	history.write("updated", InventoryItem{ID: 1, ProductName: "Widget", SKU: "W-1", Quantity: 1}, t0.Add(time.Hour))
+	history.write("created", InventoryItem{ID: 2, ProductName: "Gadget", SKU: "G-1", Quantity: 2}, t0.Add(time.Minute))
+	history.write("deleted", InventoryItem{ID: 2, ProductName: "Gadget", SKU: "G-1", Quantity: 2}, t0.Add(2*time.Minute))
+	// The current item is cached, and an as_of read mustn't get it
+	app.items = newItemCache(ItemCacheConfig{Size: 10, TTL: time.Minute}, app.clock)
+	app.items.Add(items.items[0])
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.GET("/api/inventory", app.listItems)
+	router.GET("/api/inventory/:id", app.getItem)
+	router.GET("/api/inventory/sku/:sku", app.getItemBySKU)
+	get := func(path string, out interface{}) int {
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		if out != nil && rec.Code == http.StatusOK {
+			if err := json.Unmarshal(rec.Body.Bytes(), out); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return rec.Code
+	}
+
+	var item InventoryItem
+	if code := get("/api/inventory/1?as_of=2024-06-01T09:30:00Z", &item); code != http.StatusOK || item.Quantity != 5 {
+		t.Errorf("got status %d, item %+v, want the quantity of 5 before the update", code, item)
+	}
+	if code := get("/api/inventory/sku/W-1?as_of=2024-06-01T11:30:00%2B02:00", &item); code != http.StatusOK || item.Quantity != 5 {
+		t.Errorf("got status %d, item %+v, want the quantity at 9:30 UTC", code, item)
+	}
+	if code := get("/api/inventory/1", &item); code != http.StatusOK || item.Quantity != 1 {
+		t.Errorf("got status %d, item %+v, want the current item", code, item)
+	}
+	if code := get("/api/inventory/1?as_of=2024-05-01T00:00:00Z", nil); code != http.StatusNotFound {
+		t.Errorf("before the item existed: got status %d, want 404", code)
+	}
+	if code := get("/api/inventory/1?as_of=yesterday", nil); code != http.StatusBadRequest {
+		t.Errorf("got status %d, want 400", code)
+	}
+
+	// The gadget existed for a minute
+	var page ItemPage
+	if code := get("/api/inventory?with_total=true&as_of=2024-06-01T09:01:30Z", &page); code != http.StatusOK ||
+		page.Total != 2 || !page.TotalExact || len(page.Items) != 2 {
+		t.Errorf("got status %d, page %+v, want both items", code, page)
+	}
+	var list []InventoryItem
+	if code := get("/api/inventory?as_of=2024-06-01T09:02:00Z", &list); code != http.StatusOK || len(list) != 1 || list[0].SKU != "W-1" {
+		t.Errorf("got status %d, items %+v, want the widget only once the gadget is deleted", code, list)
+	}
+}
+
+func TestGetItemHistory(t *testing.T) {
+	t0 := time.Date(2024, 6, 1, 9, 0, 0, 0, time.UTC)
+	app := newFakeApp(t, &fakeItemStore{}, &fakeStockStore{}, systemClock{})
+	history := &fakeHistoryStore{}
+	app.history = history
+	for i := 0; i < 3; i++ {
+		history.write("updated", InventoryItem{ID: 1, Quantity: i}, t0.Add(time.Duration(i)*time.Minute))
+	}
+	history.write("deleted", InventoryItem{ID: 1, Quantity: 2}, t0.Add(time.Hour))
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.GET("/api/inventory/:id/history", app.getItemHistory)
+	get := func(path string) (int, ItemHistory) {
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		var page ItemHistory
+		if rec.Code == http.StatusOK {
+			if err := json.Unmarshal(rec.Body.Bytes(), &page); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return rec.Code, page
+	}
+
+	code, page := get("/api/inventory/1/history?limit=3")
+	if code != http.StatusOK || len(page.Versions) != 3 || !page.HasMore || page.Cursor != "2" {
+		t.Fatalf("got status %d, page %+v", code, page)
+	}
+	if v := page.Versions[0]; v.Op != "deleted" || v.Version != 4 {
+		t.Errorf("got newest version %+v, want the delete", v)
+	}
+	if v := page.Versions[1]; v.ValidTo == nil || !v.ValidTo.Equal(t0.Add(time.Hour)) {
+		t.Errorf("got version %+v, want it closed by the delete", v)
+	}
+
+	code, page = get("/api/inventory/1/history?limit=3&before=" + page.Cursor)
+	if code != http.StatusOK || len(page.Versions) != 1 || page.HasMore || page.Versions[0].Version != 1 {
+		t.Errorf("got status %d, page %+v, want the first version last", code, page)
+	}
+
+	for path, want := range map[string]int{
+		"/api/inventory/2/history":           http.StatusNotFound,
+		"/api/inventory/x/history":           http.StatusBadRequest,
+		"/api/inventory/1/history?limit=501": http.StatusBadRequest,
+		"/api/inventory/1/history?before=0":  http.StatusBadRequest,
+	} {
+		if code, _ := get(path); code != want {
+			t.Errorf("%s: got status %d, want %d", path, code, want)
+		}
+	}
+}
@@ -0,0 +1,461 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var (
+	httpClientRequests = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "http_client_requests_total",
+			Help: "Total number of outgoing HTTP request attempts by client, method and status",
+		},
+		[]string{"client", "method", "status"},
+	)
+
+	httpClientDuration = promauto.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "http_client_request_duration_seconds",
+			Help:    "Outgoing HTTP request attempt duration in seconds, until the response headers arrive",
+			Buckets: prometheus.DefBuckets,
+		},
+		[]string{"client", "method"},
+	)
+
+	httpClientRetries = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "http_client_retries_total",
+			Help: "Total number of outgoing HTTP requests retried by client and reason",
+		},
+		[]string{"client", "reason"},
+	)
+
+	httpClientRetriesDenied = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "http_client_retries_denied_total",
+			Help: "Total number of retries and hedges of outgoing HTTP requests not sent because the retry budget ran out, by client",
+		},
+		[]string{"client"},
+	)
+
+	httpClientHedges = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "http_client_hedges_total",
+			Help: "Total number of hedged outgoing HTTP requests by client and which attempt answered first (first or hedge)",
+		},
+		[]string{"client", "winner"},
+	)
+)
+
+// Names of the downstreams called over HTTP, for policies.clients
+var httpClientNames = []string{"low-stock-webhook", "object-store", "oidc", "scenario", "shadow", "vault"}
+
+// Build the client for outgoing calls to the downstream named name (e.g.
+// vault), which labels its spans and metrics. Every attempt gets its own
+// client span and the cfg.Timeout deadline; failed idempotent requests are
+// retried with jittered exponential backoff. The caller's context bounds
+// the whole call, retries included. The downstream's policy (see
+// PolicyConfig) can change the retries, cap them with a retry budget and
+// hedge slow requests. Calls to a downstream that keeps failing are cut
+// short by its circuit breaker. tlsConfig may be nil.
+func newHTTPClient(name string, cfg HTTPClientConfig, tlsConfig *tls.Config) *http.Client {
+	pool := &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   cfg.DialTimeout,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		TLSClientConfig:     tlsConfig,
+		TLSHandshakeTimeout: 10 * time.Second,
+		ForceAttemptHTTP2:   true,
+		MaxConnsPerHost:     cfg.MaxConnsPerHost,
+		MaxIdleConns:        cfg.MaxIdleConnsPerHost * 4,
+		MaxIdleConnsPerHost: cfg.MaxIdleConnsPerHost,
+		IdleConnTimeout:     cfg.IdleConnTimeout,
+	}
+
+	traced := otelhttp.NewTransport(&metricsTransport{name: name, next: pool},
+		otelhttp.WithSpanNameFormatter(func(_ string, r *http.Request) string {
+			return name + " " + r.Method
+		}),
+	)
+
+	policy := cfg.policies[name]
+	retries := cfg.Retries
+	if policy.Retries != nil {
+		retries = *policy.Retries
+	}
+	return &http.Client{Transport: &retryTransport{
+		name:       name,
+		cfg:        cfg,
+		retries:    retries,
+		hedgeAfter: policy.HedgeAfter,
+		budget:     newRetryBudget(policy.RetryBudget, policy.MinRetriesPerSecond),
+		breaker:    circuits.Get(name, cfg.circuits),
+		next:       traced,
+	}}
+}
+
+// Records the metrics of each attempt
+type metricsTransport struct {
+	name string
+	next http.RoundTripper
+}
+
+func (t *metricsTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	resp, err := t.next.RoundTrip(req)
+	httpClientDuration.WithLabelValues(t.name, req.Method).Observe(time.Since(start).Seconds())
+
+	status := "error"
+	if err == nil {
+		status = strconv.Itoa(resp.StatusCode)
+	}
+	httpClientRequests.WithLabelValues(t.name, req.Method, status).Inc()
+	return resp, err
+}
+
+// Applies the per-attempt timeout, retries failed attempts and hedges slow
+// ones
+type retryTransport struct {
+	name       string
+	cfg        HTTPClientConfig
+	retries    int
+	hedgeAfter time.Duration
+	// nil without a budget
+	budget *retryBudget
+	// nil without circuit breaking
+	breaker *CircuitBreaker
+	next    http.RoundTripper
+}
+
+// Longest wait between two attempts
+const maxRetryBackoff = 5 * time.Second
+
+// A call, retries included, counts once for the circuit breaker: as a
+// failure if it ended in an error or a 5xx or 429 response
+func (t *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx := req.Context()
+	probe, err := t.breaker.Allow()
+	if err != nil {
+		trace.SpanFromContext(ctx).AddEvent("circuit_breaker.rejected", trace.WithAttributes(
+			attribute.String("http.client", t.name),
+		))
+		return nil, err
+	}
+
+	resp, err := t.roundTrip(req)
+	switch {
+	case ctx.Err() != nil:
+		t.breaker.Release(probe)
+	case err != nil:
+		t.breaker.Done(probe, err)
+	case resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests:
+		t.breaker.Done(probe, fmt.Errorf("%s answered %s", t.name, resp.Status))
+	default:
+		t.breaker.Done(probe, nil)
+	}
+	return resp, err
+}
+
+func (t *retryTransport) roundTrip(req *http.Request) (*http.Response, error) {
+	ctx := req.Context()
+	retries := t.retries
+	// A body that can't be replayed can only be sent once
+	repeatable := isIdempotent(req) && (req.Body == nil || req.Body == http.NoBody || req.GetBody != nil)
+	if !repeatable {
+		retries = 0
+	}
+	t.budget.deposit()
+
+	for attempt := 0; ; attempt++ {
+		attemptReq := req
+		if attempt > 0 {
+			var err error
+			if attemptReq, err = replayRequest(req); err != nil {
+				return nil, err
+			}
+		}
+
+		var resp *http.Response
+		var err error
+		if repeatable && t.hedgeAfter > 0 {
+			resp, err = t.hedged(attemptReq)
+		} else {
+			resp, err = t.attempt(attemptReq)
+		}
+		reason := retryReason(ctx, resp, err)
+		if reason == "" || attempt >= retries {
+			return resp, err
+		}
+		if !t.budget.withdraw() {
+			t.denied(ctx, "retry", reason)
+			return resp, err
+		}
+		if resp != nil {
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+		}
+
+		httpClientRetries.WithLabelValues(t.name, reason).Inc()
+		trace.SpanFromContext(ctx).AddEvent("http.retry", trace.WithAttributes(
+			attribute.String("http.client", t.name),
+			attribute.Int("http.retry.attempt", attempt+1),
+			attribute.String("http.retry.reason", reason),
+		))
+		logWithTrace(ctx, "WARN", "Retrying outgoing HTTP request",
+			"client", t.name, "method", req.Method, "attempt", attempt+1, "reason", reason)
+
+		if err := sleepContext(ctx, t.backoff(attempt)); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// A copy of req to send again, with a fresh body
+func replayRequest(req *http.Request) (*http.Request, error) {
+	clone := req.Clone(req.Context())
+	if req.GetBody != nil {
+		body, err := req.GetBody()
+		if err != nil {
+			return nil, err
+		}
+		clone.Body = body
+	}
+	return clone, nil
+}
+
+// Record a retry or hedge that the budget didn't allow
+func (t *retryTransport) denied(ctx context.Context, kind, reason string) {
+	httpClientRetriesDenied.WithLabelValues(t.name).Inc()
+	trace.SpanFromContext(ctx).AddEvent("http.retry_budget.exhausted", trace.WithAttributes(
+		attribute.String("http.client", t.name),
+		attribute.String("http.retry_budget.denied", kind),
+		attribute.String("http.retry.reason", reason),
+	))
+	logWithTrace(ctx, "WARN", "Retry budget exhausted, not sending another attempt",
+		"client", t.name, "kind", kind, "reason", reason)
+}
+
+// Send the attempt, and a second copy of it when the first has no response
+// after hedgeAfter. Whichever answers first is returned and the other one
+// is canceled; a failed attempt waits for the other one if it's running.
+func (t *retryTransport) hedged(req *http.Request) (*http.Response, error) {
+	type result struct {
+		resp  *http.Response
+		err   error
+		hedge bool
+	}
+	ctx := req.Context()
+	results := make(chan result, 2)
+	var cancels []context.CancelFunc
+	send := func(r *http.Request, hedge bool) {
+		attemptCtx, cancel := context.WithCancel(ctx)
+		cancels = append(cancels, cancel)
+		go func() {
+			resp, err := t.attempt(r.WithContext(attemptCtx))
+			results <- result{resp: resp, err: err, hedge: hedge}
+		}()
+	}
+
+	send(req, false)
+	pending := 1
+	timer := time.NewTimer(t.hedgeAfter)
+	defer timer.Stop()
+	for {
+		select {
+		case <-timer.C:
+			if !t.budget.withdraw() {
+				t.denied(ctx, "hedge", "slow")
+				continue
+			}
+			hedgeReq, err := replayRequest(req)
+			if err != nil {
+				continue
+			}
+			trace.SpanFromContext(ctx).AddEvent("http.hedge", trace.WithAttributes(
+				attribute.String("http.client", t.name),
+				attribute.Int64("http.hedge.after_ms", t.hedgeAfter.Milliseconds()),
+			))
+			send(hedgeReq, true)
+			pending++
+
+		case r := <-results:
+			pending--
+			if r.err != nil && pending > 0 {
+				continue
+			}
+
+			// The winner's context lives until its body is closed
+			winner := 0
+			if r.hedge {
+				winner = 1
+			}
+			for i, cancel := range cancels {
+				if i != winner {
+					cancel()
+				}
+			}
+			if pending > 0 {
+				go func() {
+					if late := <-results; late.resp != nil {
+						late.resp.Body.Close()
+					}
+				}()
+			}
+			if len(cancels) > 1 {
+				name := "first"
+				if r.hedge {
+					name = "hedge"
+				}
+				httpClientHedges.WithLabelValues(t.name, name).Inc()
+				trace.SpanFromContext(ctx).SetAttributes(attribute.Bool("http.hedge.won", r.hedge))
+			}
+			if r.err != nil {
+				cancels[winner]()
+				return nil, r.err
+			}
+			r.resp.Body = &cancelOnClose{ReadCloser: r.resp.Body, cancel: cancels[winner]}
+			return r.resp, nil
+		}
+	}
+}
+
+// Send one attempt with its own deadline, which ends when the response
+// body is closed
+func (t *retryTransport) attempt(req *http.Request) (*http.Response, error) {
+	if t.cfg.Timeout <= 0 {
+		return t.next.RoundTrip(req)
+	}
+
+	ctx, cancel := context.WithTimeout(req.Context(), t.cfg.Timeout)
+	resp, err := t.next.RoundTrip(req.WithContext(ctx))
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	resp.Body = &cancelOnClose{ReadCloser: resp.Body, cancel: cancel}
+	return resp, nil
+}
+
+// Full jitter: a random wait up to the exponential backoff, so clients that
+// failed together don't retry together
+func (t *retryTransport) backoff(attempt int) time.Duration {
+	ceiling := t.cfg.RetryBackoff << attempt
+	if ceiling <= 0 || ceiling > maxRetryBackoff {
+		ceiling = maxRetryBackoff
+	}
+	return time.Duration(rand.Int63n(int64(ceiling)))
+}
+
+// Why an attempt should be retried, or "" when it shouldn't
+func retryReason(ctx context.Context, resp *http.Response, err error) string {
+	if ctx.Err() != nil {
+		// The caller gave up, not the attempt
+		return ""
+	}
+	if err != nil {
+		if errors.Is(err, context.DeadlineExceeded) {
+			return "timeout"
+		}
+		return "error"
+	}
+	switch resp.StatusCode {
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return strconv.Itoa(resp.StatusCode)
+	}
+	return ""
+}
+
+// GET, HEAD, OPTIONS, PUT and DELETE can be repeated safely. Other methods
+// are retried only when the caller sends an Idempotency-Key.
+func isIdempotent(req *http.Request) bool {
+	switch req.Method {
+	case "", http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodPut, http.MethodDelete:
+		return true
+	}
+	return req.Header.Get("Idempotency-Key") != ""
+}
+
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *cancelOnClose) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
+
+// retryBudget keeps the retries and hedges of a client to a fraction of its
+// requests, plus a floor per second, so a struggling downstream doesn't get
+// a retry storm on top of its load. Each request deposits ratio tokens and
+// each extra attempt takes one.
+type retryBudget struct {
+	ratio        float64
+	minPerSecond float64
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+// Most tokens saved up, so a quiet period doesn't allow a burst
+const maxRetryBudgetTokens = 10
+
+// nil, meaning no limit, when both are 0
+func newRetryBudget(ratio, minPerSecond float64) *retryBudget {
+	if ratio == 0 && minPerSecond == 0 {
+		return nil
+	}
+	return &retryBudget{ratio: ratio, minPerSecond: minPerSecond, last: time.Now()}
+}
+
+func (b *retryBudget) deposit() {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.add(b.ratio)
+}
+
+// Take a token for an extra attempt, if there is one
+func (b *retryBudget) withdraw() bool {
+	if b == nil {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.add(0)
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// Add n tokens and the floor accrued since the last call
+func (b *retryBudget) add(n float64) {
+	now := time.Now()
+	n += now.Sub(b.last).Seconds() * b.minPerSecond
+	b.last = now
+	b.tokens = min(b.tokens+n, max(maxRetryBudgetTokens, b.minPerSecond))
+}
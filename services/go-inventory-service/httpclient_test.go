@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+
+	"inventory-service/internal/testkit"
+)
+
+func testHTTPClientConfig() HTTPClientConfig {
+	cfg := defaultConfig().HTTPClient
+	cfg.RetryBackoff = time.Millisecond
+	return cfg
+}
+
+// A server that answers the first failures requests with 503
+func flakyServer(t *testing.T, failures int32) (*httptest.Server, *atomic.Int32) {
+	var calls atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if calls.Add(1) <= failures {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("ok"))
+	}))
+	t.Cleanup(srv.Close)
+	return srv, &calls
+}
+
+func TestHTTPClientRetries(t *testing.T) {
+	tr := testkit.InstallTracing(t)
+	srv, calls := flakyServer(t, 2)
+	client := newHTTPClient("test", testHTTPClientConfig(), nil)
+
+	ctx, parent := tr.Tracer("test").Start(context.Background(), "call")
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, srv.URL, nil)
+	testkit.AssertCounterDelta(t, httpClientRetries.WithLabelValues("test", "503"), 2, func() {
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("got status %d, want 200", resp.StatusCode)
+		}
+	})
+	parent.End()
+
+	if calls.Load() != 3 {
+		t.Errorf("server got %d calls, want 3", calls.Load())
+	}
+	// One client span per attempt, and the retries recorded on the caller's span
+	if n := len(tr.Spans()) - 1; n != 3 {
+		t.Errorf("got %d client spans, want 3", n)
+	}
+	testkit.AssertSpanEvent(t, tr.AssertSpan(t, "call"), "http.retry",
+		attribute.Int("http.retry.attempt", 2), attribute.String("http.retry.reason", "503"))
+}
+
+func TestHTTPClientGivesUp(t *testing.T) {
+	testkit.InstallTracing(t)
+	srv, calls := flakyServer(t, 10)
+	client := newHTTPClient("test", testHTTPClientConfig(), nil)
+
+	resp, err := client.Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable || calls.Load() != 3 {
+		t.Errorf("got status %d after %d calls, want 503 after 3", resp.StatusCode, calls.Load())
+	}
+}
+
+func TestHTTPClientDoesNotRetryPost(t *testing.T) {
+	testkit.InstallTracing(t)
+	client := newHTTPClient("test", testHTTPClientConfig(), nil)
+
+	srv, calls := flakyServer(t, 1)
+	resp, err := client.Post(srv.URL, "application/json", strings.NewReader("{}"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if calls.Load() != 1 {
+		t.Errorf("POST sent %d times, want once", calls.Load())
+	}
+
+	// unless it carries an idempotency key
+	srv, calls = flakyServer(t, 1)
+	req, _ := http.NewRequest(http.MethodPost, srv.URL, strings.NewReader("{}"))
+	req.Header.Set("Idempotency-Key", "abc")
+	resp, err = client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || calls.Load() != 2 {
+		t.Errorf("got status %d after %d calls, want 200 after 2", resp.StatusCode, calls.Load())
+	}
+}
+
+func TestHTTPClientAttemptTimeout(t *testing.T) {
+	testkit.InstallTracing(t)
+	var calls atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if calls.Add(1) == 1 {
+			select {
+			case <-r.Context().Done():
+			case <-time.After(time.Second):
+			}
+			return
+		}
+		w.Write([]byte("ok"))
+	}))
+	defer srv.Close()
+
+	cfg := testHTTPClientConfig()
+	cfg.Timeout = 50 * time.Millisecond
+	cfg.DialTimeout = cfg.Timeout
+	client := newHTTPClient("test", cfg, nil)
+
+	testkit.AssertCounterDelta(t, httpClientRetries.WithLabelValues("test", "timeout"), 1, func() {
+		resp, err := client.Get(srv.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("got status %d, want 200", resp.StatusCode)
+		}
+	})
+}
+
+func TestHTTPClientRetryBudget(t *testing.T) {
+	testkit.InstallTracing(t)
+	srv, calls := flakyServer(t, 100)
+	cfg := testHTTPClientConfig()
+	// One retry banked by the minimum, then a tenth of a retry per request
+	cfg.policies = map[string]ClientPolicy{"test": {RetryBudget: 0.1, MinRetriesPerSecond: 0.001}}
+	client := newHTTPClient("test", cfg, nil)
+	client.Transport.(*retryTransport).budget.tokens = 1
+
+	testkit.AssertCounterDelta(t, httpClientRetriesDenied.WithLabelValues("test"), 4, func() {
+		for i := 0; i < 4; i++ {
+			resp, err := client.Get(srv.URL)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+		}
+	})
+	// 4 requests, and the 1.4 tokens in the budget allow a single retry
+	if calls.Load() != 5 {
+		t.Errorf("server got %d calls, want 5", calls.Load())
+	}
+}
+
+func TestHTTPClientHedging(t *testing.T) {
+	tr := testkit.InstallTracing(t)
+	var calls atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if calls.Add(1) == 1 {
+			// The first attempt hangs until it's canceled
+			<-r.Context().Done()
+			return
+		}
+		w.Write([]byte("hedge"))
+	}))
+	defer srv.Close()
+
+	cfg := testHTTPClientConfig()
+	cfg.policies = map[string]ClientPolicy{"test": {HedgeAfter: 20 * time.Millisecond}}
+	client := newHTTPClient("test", cfg, nil)
+
+	ctx, parent := tr.Tracer("test").Start(context.Background(), "call")
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, srv.URL, nil)
+	testkit.AssertCounterDelta(t, httpClientHedges.WithLabelValues("test", "hedge"), 1, func() {
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(body) != "hedge" {
+			t.Errorf("got body %q, want the hedge's answer", body)
+		}
+	})
+	parent.End()
+
+	span := tr.AssertSpan(t, "call", attribute.Bool("http.hedge.won", true))
+	testkit.AssertSpanEvent(t, span, "http.hedge", attribute.Int64("http.hedge.after_ms", 20))
+}
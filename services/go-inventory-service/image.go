@@ -0,0 +1,302 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/lib/pq"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var (
+	imageUploads = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "item_image_uploads_total",
+			Help: "Item image uploads by result: stored, rejected or failed",
+		},
+		[]string{"result"},
+	)
+
+	imageUploadSize = promauto.NewHistogram(
+		prometheus.HistogramOpts{
+			Name:    "item_image_upload_bytes",
+			Help:    "Size of the item images stored",
+			Buckets: prometheus.ExponentialBuckets(16*1024, 4, 7),
+		},
+	)
+)
+
+// ItemImage is the metadata of an item's image. The image itself is in the
+// object store under Key.
+type ItemImage struct {
+	ItemID      int       `json:"item_id"`
+	Key         string    `json:"key"`
+	ContentType string    `json:"content_type"`
+	Size        int64     `json:"size"`
+	SHA256      string    `json:"sha256"`
+	UploadedAt  time.Time `json:"uploaded_at"`
+	// Where to download it: a signed URL of the bucket, valid until
+	// URLExpiresAt, or the service's own content route without a bucket
+	URL          string     `json:"url,omitempty"`
+	URLExpiresAt *time.Time `json:"url_expires_at,omitempty"`
+}
+
+// ImageStore holds the image metadata (PostgreSQL)
+type ImageStore interface {
+	// Insert the item's image or replace the one it has. Returns
+	// sql.ErrNoRows if the item doesn't exist.
+	PutImage(ctx context.Context, img ItemImage) error
+	// Returns sql.ErrNoRows if the item has no image
+	GetImage(ctx context.Context, itemID int) (ItemImage, error)
+}
+
+const createItemImagesQuery = `
+	CREATE TABLE IF NOT EXISTS item_images (
+		item_id INTEGER PRIMARY KEY REFERENCES inventory (id) ON DELETE CASCADE,
+		object_key VARCHAR(1024) NOT NULL,
+		content_type VARCHAR(255) NOT NULL,
+		size BIGINT NOT NULL,
+		sha256 CHAR(64) NOT NULL,
+		uploaded_at TIMESTAMP NOT NULL
+	);
+`
+
+// postgresImageStore is the ImageStore on PostgreSQL. It reads the primary,
+// so an image can be fetched right after its upload.
+type postgresImageStore struct {
+	db    func() *sql.DB
+	chaos *Chaos
+}
+
+func (s *postgresImageStore) PutImage(ctx context.Context, img ItemImage) error {
+	start := time.Now()
+	defer observeQuery("postgres", "put_item_image", start)
+	s.chaos.slowPostgres(ctx, s.db())
+
+	_, err := s.db().ExecContext(ctx, `
+		INSERT INTO item_images (item_id, object_key, content_type, size, sha256, uploaded_at)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		ON CONFLICT (item_id) DO UPDATE SET
+			object_key = EXCLUDED.object_key,
+			content_type = EXCLUDED.content_type,
+			size = EXCLUDED.size,
+			sha256 = EXCLUDED.sha256,
+			uploaded_at = EXCLUDED.uploaded_at
+	`, img.ItemID, img.Key, img.ContentType, img.Size, img.SHA256, img.UploadedAt)
+	// The item was deleted since the handler looked it up
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) && pqErr.Code == "23503" {
+		return sql.ErrNoRows
+	}
+	return err
+}
+
+func (s *postgresImageStore) GetImage(ctx context.Context, itemID int) (ItemImage, error) {
+	start := time.Now()
+	s.chaos.slowPostgres(ctx, s.db())
+	img := ItemImage{ItemID: itemID}
+	err := s.db().QueryRowContext(ctx, `
+		SELECT object_key, content_type, size, sha256, uploaded_at
+		FROM item_images
+		WHERE item_id = $1
+	`, itemID).Scan(&img.Key, &img.ContentType, &img.Size, &img.SHA256, &img.UploadedAt)
+	observeQuery("postgres", "get_item_image", start)
+	return img, err
+}
+
+// Upload an item's image (PUT /api/inventory/:id/image). The request body
+// is streamed to the object store as it arrives, so it needs a
+// Content-Length; the metadata goes to PostgreSQL once the upload is done.
+// Uploading again replaces the image.
+func (app *App) putItemImage(c *gin.Context) {
+	ctx := c.Request.Context()
+	ctx, span := app.tracer.Start(ctx, "putItemImage")
+	defer span.End()
+
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Item not found"})
+		return
+	}
+	contentType, _, _ := mime.ParseMediaType(c.GetHeader("Content-Type"))
+	size := c.Request.ContentLength
+	span.SetAttributes(
+		attribute.Int("item.id", id),
+		attribute.String("image.content_type", contentType),
+		attribute.Int64("image.size", size),
+	)
+
+	reject := func(status int, msg string) {
+		imageUploads.WithLabelValues("rejected").Inc()
+		c.JSON(status, gin.H{"error": msg})
+	}
+	switch {
+	case !strings.HasPrefix(contentType, "image/"):
+		reject(http.StatusUnsupportedMediaType, "Content-Type must be an image type, e.g. image/png")
+		return
+	case size < 0:
+		reject(http.StatusLengthRequired, "Content-Length is required")
+		return
+	case size == 0:
+		reject(http.StatusBadRequest, "Image is empty")
+		return
+	case size > app.imageCfg.MaxSize:
+		reject(http.StatusRequestEntityTooLarge, fmt.Sprintf("Image is larger than %d bytes", app.imageCfg.MaxSize))
+		return
+	}
+
+	// Checked first, so nothing is uploaded for a missing item
+	if _, err := app.itemStore.FindItem(ctx, "id", id); err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Item not found"})
+		return
+	} else if err != nil {
+		logWithTrace(ctx, "ERROR", "Error fetching inventory item", "item_id", id, "error", err.Error())
+		span.RecordError(err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch item"})
+		return
+	}
+
+	img := ItemImage{
+		ItemID:      id,
+		Key:         app.imageCfg.Prefix + strconv.Itoa(id),
+		ContentType: contentType,
+		Size:        size,
+	}
+	hash := sha256.New()
+	uploadCtx, uploadSpan := app.tracer.Start(ctx, "image.upload")
+	uploadSpan.SetAttributes(attribute.String("image.key", img.Key), attribute.Int64("image.size", size))
+	err = app.imageObjects.Put(uploadCtx, img.Key, io.TeeReader(c.Request.Body, hash), size, contentType)
+	if err != nil {
+		uploadSpan.RecordError(err)
+	}
+	uploadSpan.End()
+	if err != nil {
+		imageUploads.WithLabelValues("failed").Inc()
+		logWithTrace(ctx, "ERROR", "Error uploading item image", "item_id", id, "key", img.Key, "error", err.Error())
+		span.RecordError(err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to store the image"})
+		return
+	}
+	img.SHA256 = hex.EncodeToString(hash.Sum(nil))
+	img.UploadedAt = app.clock.Now()
+
+	err = app.images.PutImage(ctx, img)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Item not found"})
+		return
+	}
+	if err != nil {
+		imageUploads.WithLabelValues("failed").Inc()
+		logWithTrace(ctx, "ERROR", "Error saving item image", "item_id", id, "error", err.Error())
+		span.RecordError(err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save the image"})
+		return
+	}
+
+	imageUploads.WithLabelValues("stored").Inc()
+	imageUploadSize.Observe(float64(size))
+	requestsTotal.WithLabelValues("PUT", "/api/inventory/:id/image", "200").Inc()
+	logWithTrace(ctx, "INFO", "Item image stored", "item_id", id, "key", img.Key, "size", size, "sha256", img.SHA256)
+
+	app.renderImage(c, img)
+}
+
+// Get an item's image metadata with a URL to download it from
+func (app *App) getItemImage(c *gin.Context) {
+	ctx := c.Request.Context()
+	ctx, span := app.tracer.Start(ctx, "getItemImage")
+	defer span.End()
+
+	img, ok := app.findImage(ctx, c, span)
+	if !ok {
+		return
+	}
+	requestsTotal.WithLabelValues("GET", "/api/inventory/:id/image", "200").Inc()
+	app.renderImage(c, img)
+}
+
+// Stream an item's image from the object store, for stores without signed
+// URLs
+func (app *App) getItemImageContent(c *gin.Context) {
+	ctx := c.Request.Context()
+	ctx, span := app.tracer.Start(ctx, "getItemImageContent")
+	defer span.End()
+
+	img, ok := app.findImage(ctx, c, span)
+	if !ok {
+		return
+	}
+	body, err := app.imageObjects.Get(ctx, img.Key)
+	if errors.Is(err, errObjectNotFound) {
+		logWithTrace(ctx, "WARN", "Item image missing from the object store", "item_id", img.ItemID, "key", img.Key)
+		c.JSON(http.StatusNotFound, gin.H{"error": "Image not found"})
+		return
+	}
+	if err != nil {
+		logWithTrace(ctx, "ERROR", "Error downloading item image", "item_id", img.ItemID, "error", err.Error())
+		span.RecordError(err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch the image"})
+		return
+	}
+	defer body.Close()
+
+	requestsTotal.WithLabelValues("GET", "/api/inventory/:id/image/content", "200").Inc()
+	c.DataFromReader(http.StatusOK, img.Size, img.ContentType, body, map[string]string{
+		"ETag": `"` + img.SHA256 + `"`,
+	})
+}
+
+// Look up the image of the item in the path, writing the error response if
+// there is none
+func (app *App) findImage(ctx context.Context, c *gin.Context, span trace.Span) (ItemImage, bool) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Image not found"})
+		return ItemImage{}, false
+	}
+	span.SetAttributes(attribute.Int("item.id", id))
+
+	img, err := app.images.GetImage(ctx, id)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Image not found"})
+		return img, false
+	}
+	if err != nil {
+		logWithTrace(ctx, "ERROR", "Error fetching item image", "item_id", id, "error", err.Error())
+		span.RecordError(err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch the image"})
+		return img, false
+	}
+	return img, true
+}
+
+// Write the image metadata with its download URL
+func (app *App) renderImage(c *gin.Context, img ItemImage) {
+	url, err := app.imageObjects.SignedURL(img.Key, app.imageCfg.URLTTL)
+	if err != nil {
+		logWithTrace(c.Request.Context(), "ERROR", "Error signing image URL", "key", img.Key, "error", err.Error())
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to sign the image URL"})
+		return
+	}
+	if url == "" {
+		img.URL = fmt.Sprintf("/api/inventory/%d/image/content", img.ItemID)
+	} else {
+		expires := app.clock.Now().Add(app.imageCfg.URLTTL).UTC()
+		img.URL, img.URLExpiresAt = url, &expires
+	}
+	c.JSON(http.StatusOK, img)
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// fakeImageStore keeps the image metadata in memory
+type fakeImageStore struct {
+	images map[int]ItemImage
+}
+
+func (s *fakeImageStore) PutImage(ctx context.Context, img ItemImage) error {
+	s.images[img.ItemID] = img
+	return nil
+}
+
+func (s *fakeImageStore) GetImage(ctx context.Context, itemID int) (ItemImage, error) {
+	img, ok := s.images[itemID]
+	if !ok {
+		return ItemImage{}, sql.ErrNoRows
+	}
+	return img, nil
+}
+
+func TestItemImage(t *testing.T) {
+	items := &fakeItemStore{items: []InventoryItem{{ID: 1, SKU: "W-1"}}}
+	app := newFakeApp(t, items, &fakeStockStore{}, systemClock{})
+	app.images = &fakeImageStore{images: map[int]ItemImage{}}
+	app.imageObjects = &dirObjectStore{dir: t.TempDir()}
+	app.imageCfg = ImageConfig{Prefix: "images/", MaxSize: 16, URLTTL: 15 * time.Minute}
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.PUT("/api/inventory/:id/image", app.putItemImage)
+	router.GET("/api/inventory/:id/image", app.getItemImage)
+	router.GET("/api/inventory/:id/image/content", app.getItemImageContent)
+
+	put := func(id, contentType, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPut, "/api/inventory/"+id+"/image", strings.NewReader(body))
+		req.Header.Set("Content-Type", contentType)
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		return rec
+	}
+	for _, tc := range []struct {
+		name, id, contentType, body string
+		want                        int
+	}{
+		{"not an image", "1", "text/plain", "hello", http.StatusUnsupportedMediaType},
+		{"too large", "1", "image/png", strings.Repeat("x", 17), http.StatusRequestEntityTooLarge},
+		{"missing item", "2", "image/png", "png", http.StatusNotFound},
+	} {
+		if rec := put(tc.id, tc.contentType, tc.body); rec.Code != tc.want {
+			t.Errorf("%s: got status %d, want %d: %s", tc.name, rec.Code, tc.want, rec.Body.String())
+		}
+	}
+
+	rec := put("1", "image/png", "png bytes")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got status %d: %s", rec.Code, rec.Body.String())
+	}
+	var img ItemImage
+	json.Unmarshal(rec.Body.Bytes(), &img)
+	if img.Key != "images/1" || img.Size != 9 || len(img.SHA256) != 64 {
+		t.Errorf("unexpected metadata %+v", img)
+	}
+	// Without a bucket the service serves the image itself
+	if img.URL != "/api/inventory/1/image/content" || img.URLExpiresAt != nil {
+		t.Errorf("got URL %q expiring %v, want the content route", img.URL, img.URLExpiresAt)
+	}
+
+	rec = httptest.NewRecorder()
+	router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, img.URL, nil))
+	if rec.Body.String() != "png bytes" || rec.Header().Get("Content-Type") != "image/png" {
+		t.Errorf("got %q (%s), want the uploaded image", rec.Body.String(), rec.Header().Get("Content-Type"))
+	}
+
+	rec = httptest.NewRecorder()
+	router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/inventory/3/image", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("item without an image: got status %d, want 404", rec.Code)
+	}
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"math/rand"
+	"net/http"
+	"time"
+)
+
+// Clock tells the time. Timestamps written to the databases and cache
+// expiry go through it, so tests can use a fixed clock and the chaos
+// subsystem can skew it.
+type Clock interface {
+	Now() time.Time
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time { return time.Now() }
+
+// skewedClock is a clock that is off by the chaos clock skew
+type skewedClock struct {
+	base  Clock
+	chaos *Chaos
+}
+
+func (c skewedClock) Now() time.Time {
+	return c.base.Now().Add(c.chaos.clockSkew())
+}
+
+// randSource is the randomness behind the chaos decisions, replaceable with
+// a fixed sequence in tests
+type randSource interface {
+	// A number in [0.0, 1.0)
+	Float64() float64
+}
+
+// The math/rand top-level functions, which are safe for concurrent use
+type globalRand struct{}
+
+func (globalRand) Float64() float64 { return rand.Float64() }
+
+// httpDoer sends outgoing HTTP requests. *http.Client implements it; tests
+// put in fakes that time out or fail without a server.
+type httpDoer interface {
+	Do(req *http.Request) (*http.Response, error)
+}
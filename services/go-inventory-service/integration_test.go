@@ -0,0 +1,927 @@
+//go:build integration
+
+// Integration tests against real PostgreSQL and MongoDB containers. They
+// need Docker and run with:
+//
+//	go test -tags integration ./...
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/testcontainers/testcontainers-go"
+	"github.com/testcontainers/testcontainers-go/modules/mongodb"
+	"github.com/testcontainers/testcontainers-go/modules/postgres"
+	"github.com/testcontainers/testcontainers-go/wait"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.opentelemetry.io/otel/attribute"
+
+	"inventory-service/internal/testkit"
+)
+
+var (
+	testApp     *App
+	testRouter  *gin.Engine
+	testTracing *testkit.Tracing
+)
+
+func TestMain(m *testing.M) {
+	os.Exit(runIntegrationTests(m))
+}
+
+func runIntegrationTests(m *testing.M) int {
+	ctx := context.Background()
+
+	pgContainer, err := postgres.RunContainer(ctx,
+		testcontainers.WithImage("postgres:16-alpine"),
+		postgres.WithDatabase("demo"),
+		postgres.WithUsername("demo"),
+		postgres.WithPassword("demo123"),
+		testcontainers.WithWaitStrategy(
+			wait.ForLog("database system is ready to accept connections").
+				WithOccurrence(2).WithStartupTimeout(time.Minute)),
+	)
+	if err != nil {
+		log.Printf("Failed to start PostgreSQL container: %v", err)
+		return 1
+	}
+	defer pgContainer.Terminate(ctx)
+
+	mongoContainer, err := mongodb.RunContainer(ctx, testcontainers.WithImage("mongo:7"))
+	if err != nil {
+		log.Printf("Failed to start MongoDB container: %v", err)
+		return 1
+	}
+	defer mongoContainer.Terminate(ctx)
+
+	pgURL, err := pgContainer.ConnectionString(ctx, "sslmode=disable")
+	if err != nil {
+		log.Printf("Failed to get PostgreSQL connection string: %v", err)
+		return 1
+	}
+	mongoURI, err := mongoContainer.ConnectionString(ctx)
+	if err != nil {
+		log.Printf("Failed to get MongoDB connection string: %v", err)
+		return 1
+	}
+
+	testTracing = testkit.NewTracing()
+	defer testTracing.Restore()
+
+	cfg := defaultConfig()
+	testApp = &App{
+		tracer:      testTracing.Tracer("inventory-service"),
+		serviceName: "inventory-service",
+		chaos:       newChaos(cfg.Chaos),
+		json:        jsonEncoders["std"],
+		counter:     newItemCounter(cfg.Count),
+	}
+	testApp.scenarios = newScenarioRunner(testApp, cfg.Scenarios, cfg.HTTPClient)
+
+	db, err := connectPostgres(ctx, pgURL, cfg.Postgres)
+	if err != nil {
+		log.Print(err)
+		return 1
+	}
+	defer db.Close()
+	testApp.db.Store(db)
+	if err := createSchema(ctx, db); err != nil {
+		log.Printf("Failed to create schema: %v", err)
+		return 1
+	}
+
+	mongoClient, err := connectMongo(ctx, mongoURI, cfg.Mongo, nil)
+	if err != nil {
+		log.Print(err)
+		return 1
+	}
+	defer mongoClient.Disconnect(ctx)
+	testApp.mongoDB.Store(mongoClient.Database("demo"))
+	testApp.clock = skewedClock{base: systemClock{}, chaos: testApp.chaos}
+	testApp.items = newItemCache(cfg.ItemCache, testApp.clock)
+	testApp.itemStore = &postgresItemStore{db: testApp.postgres, chaos: testApp.chaos, clock: testApp.clock}
+	testApp.stockStore = &mongoStockStore{db: testApp.mongo, chaos: testApp.chaos}
+	testApp.warehouses = &postgresWarehouseStore{db: testApp.postgres, chaos: testApp.chaos}
+	testApp.reservations = &postgresReservationStore{db: testApp.postgres, chaos: testApp.chaos}
+	testApp.reservationCfg = cfg.Reservations
+	testApp.prices = &postgresPriceStore{db: testApp.postgres, chaos: testApp.chaos}
+	testApp.history = &postgresHistoryStore{db: testApp.postgres, chaos: testApp.chaos}
+	testApp.events = &postgresEventStore{db: testApp.postgres, chaos: testApp.chaos}
+	testApp.stockOutbox = &postgresStockOutboxStore{db: testApp.postgres, chaos: testApp.chaos}
+	testApp.stockSyncCfg = cfg.StockSync
+	testApp.janitor = &postgresJanitorStore{db: testApp.postgres, chaos: testApp.chaos}
+	testApp.janitorCfg = cfg.Janitor
+	testApp.explain = cfg.Postgres.Explain
+	testApp.bus = newEventBus(nil)
+	testApp.bus.Subscribe("cache", testApp.invalidateCaches, cacheEventTypes...)
+
+	snapshotDir, err := os.MkdirTemp("", "snapshots")
+	if err != nil {
+		log.Print(err)
+		return 1
+	}
+	defer os.RemoveAll(snapshotDir)
+	testApp.snapshots = &Snapshotter{
+		objects: &dirObjectStore{dir: snapshotDir},
+		prefix:  cfg.Snapshots.Prefix,
+		sources: []snapshotSource{
+			{db: "postgres", store: &postgresSnapshotStore{db: testApp.postgres, chaos: testApp.chaos}},
+			{db: "mongodb", store: &mongoSnapshotStore{db: testApp.mongo, chaos: testApp.chaos}},
+		},
+		tracer: testApp.tracer,
+		clock:  testApp.clock,
+	}
+
+	gin.SetMode(gin.TestMode)
+	testRouter = testApp.router()
+
+	return m.Run()
+}
+
+// Send a request through the router and decode the JSON response into out
+func doRequest(t *testing.T, method, path string, body interface{}, out interface{}) *httptest.ResponseRecorder {
+	t.Helper()
+
+	var reqBody bytes.Buffer
+	if body != nil {
+		if err := json.NewEncoder(&reqBody).Encode(body); err != nil {
+			t.Fatal(err)
+		}
+	}
+	req := httptest.NewRequest(method, path, &reqBody)
+	req.Header.Set("Content-Type", "application/json")
+
+	rec := httptest.NewRecorder()
+	testRouter.ServeHTTP(rec, req)
+
+	if out != nil && rec.Body.Len() > 0 {
+		if err := json.Unmarshal(rec.Body.Bytes(), out); err != nil {
+			t.Fatalf("failed to decode %s %s response %q: %v", method, path, rec.Body.String(), err)
+		}
+	}
+	return rec
+}
+
+// Create an item with a unique SKU
+func createTestItem(t *testing.T) InventoryItem {
+	t.Helper()
+
+	var item InventoryItem
+	rec := doRequest(t, http.MethodPost, "/api/inventory", CreateItemRequest{
+		ProductName: "Test Item",
+		SKU:         fmt.Sprintf("TEST-%d", time.Now().UnixNano()),
+		Quantity:    5,
+		Location:    "Warehouse A",
+	}, &item)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("create item: got status %d: %s", rec.Code, rec.Body.String())
+	}
+	return item
+}
+
+func TestHealthCheck(t *testing.T) {
+	var health map[string]string
+	rec := doRequest(t, http.MethodGet, "/health", nil, &health)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got status %d: %v", rec.Code, health)
+	}
+	if health["postgres"] != "connected" || health["mongodb"] != "connected" {
+		t.Errorf("unexpected health %v", health)
+	}
+}
+
+func TestHealthCheckMongoBroken(t *testing.T) {
+	testApp.chaos.SetMongoBroken(true)
+	defer testApp.chaos.SetMongoBroken(false)
+
+	var health map[string]string
+	rec := doRequest(t, http.MethodGet, "/health", nil, &health)
+	if rec.Code != http.StatusServiceUnavailable || health["mongodb"] != "error" {
+		t.Errorf("got status %d, health %v", rec.Code, health)
+	}
+}
+
+func TestCreateItem(t *testing.T) {
+	testTracing.Reset()
+	metrics := testkit.DefaultRegistry()
+	insertLabels := map[string]string{"db": "postgres", "operation": "insert_item"}
+
+	var item InventoryItem
+	metrics.AssertObservations(t, "db_query_duration_seconds", insertLabels, 1, func() {
+		testkit.AssertCounterDelta(t, itemsCreated, 1, func() {
+			item = createTestItem(t)
+		})
+	})
+	if item.ID == 0 || item.CreatedAt.IsZero() {
+		t.Errorf("created item has no ID or created_at: %+v", item)
+	}
+
+	// The two writes are siblings under createItem
+	parent := testTracing.AssertSpan(t, "createItem")
+	testkit.AssertChildOf(t, testTracing.AssertSpan(t, "postgres.insert_item"), parent)
+	testkit.AssertChildOf(t, testTracing.AssertSpan(t, "mongodb.insert_stock_level"), parent)
+}
+
+func TestCreateItemInvalid(t *testing.T) {
+	rec := doRequest(t, http.MethodPost, "/api/inventory", map[string]string{"sku": "NO-NAME"}, nil)
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("got status %d, want 400", rec.Code)
+	}
+}
+
+func TestCreateItemDuplicateSKU(t *testing.T) {
+	item := createTestItem(t)
+
+	rec := doRequest(t, http.MethodPost, "/api/inventory", CreateItemRequest{
+		ProductName: "Duplicate",
+		SKU:         item.SKU,
+		Quantity:    1,
+		Location:    "Warehouse B",
+	}, nil)
+	if rec.Code != http.StatusInternalServerError {
+		t.Errorf("got status %d, want 500", rec.Code)
+	}
+	// The first item keeps its stock level, and there is one per SKU
+	levels, err := testApp.stockStore.ListStockLevels(context.Background(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := 0
+	for _, level := range levels {
+		if level.ProductSKU == item.SKU {
+			n++
+		}
+	}
+	if n != 1 {
+		t.Errorf("got %d stock levels of %s, want 1", n, item.SKU)
+	}
+}
+
+func TestGetItem(t *testing.T) {
+	item := createTestItem(t)
+
+	for _, path := range []string{
+		fmt.Sprintf("/api/inventory/%d", item.ID),
+		"/api/inventory/sku/" + item.SKU,
+	} {
+		var got InventoryItem
+		rec := doRequest(t, http.MethodGet, path, nil, &got)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("GET %s: got status %d", path, rec.Code)
+		}
+		if got.ID != item.ID || got.SKU != item.SKU {
+			t.Errorf("GET %s: got %+v, want %+v", path, got, item)
+		}
+	}
+}
+
+func TestGetItemCached(t *testing.T) {
+	item := createTestItem(t)
+	path := fmt.Sprintf("/api/inventory/%d", item.ID)
+
+	doRequest(t, http.MethodGet, path, nil, nil)
+	testTracing.Reset()
+	testkit.AssertCounterDelta(t, cacheRequests.WithLabelValues("items_by_id", "hit"), 1, func() {
+		doRequest(t, http.MethodGet, path, nil, nil)
+	})
+
+	testTracing.AssertSpan(t, "getItem", attribute.Bool("cache.hit", true))
+}
+
+func TestGetItemExplain(t *testing.T) {
+	item := createTestItem(t)
+
+	req := httptest.NewRequest(http.MethodGet, "/api/inventory/sku/"+item.SKU, nil)
+	req.Header.Set(explainHeader, "true")
+	testTracing.Reset()
+	rec := httptest.NewRecorder()
+	testRouter.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got status %d", rec.Code)
+	}
+
+	span := testTracing.AssertSpan(t, "getItemBySKU")
+	testkit.AssertSpanEvent(t, span, "db.explain", attribute.String("db.operation", "get_item_by_sku"))
+}
+
+func TestGetItemNotFound(t *testing.T) {
+	for _, path := range []string{"/api/inventory/999999999", "/api/inventory/sku/NO-SUCH-SKU"} {
+		rec := doRequest(t, http.MethodGet, path, nil, nil)
+		if rec.Code != http.StatusNotFound {
+			t.Errorf("GET %s: got status %d, want 404", path, rec.Code)
+		}
+	}
+}
+
+func TestListItems(t *testing.T) {
+	createTestItem(t)
+	createTestItem(t)
+
+	var items []InventoryItem
+	rec := doRequest(t, http.MethodGet, "/api/inventory?limit=1", nil, &items)
+	if rec.Code != http.StatusOK || len(items) != 1 {
+		t.Fatalf("got status %d and %d items", rec.Code, len(items))
+	}
+
+	var page ItemPage
+	rec = doRequest(t, http.MethodGet, "/api/inventory?limit=1&with_total=true", nil, &page)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got status %d", rec.Code)
+	}
+	// A fresh table has no planner estimate, so the count is exact
+	if page.Total < 2 || !page.TotalExact || len(page.Items) != 1 {
+		t.Errorf("unexpected page %+v", page)
+	}
+}
+
+func TestListChanges(t *testing.T) {
+	var page ChangePage
+	doRequest(t, http.MethodGet, "/api/inventory/changes?limit=1000", nil, &page)
+	for page.HasMore {
+		doRequest(t, http.MethodGet, "/api/inventory/changes?limit=1000&since="+page.Cursor, nil, &page)
+	}
+
+	item := createTestItem(t)
+	rec := doRequest(t, http.MethodGet, "/api/inventory/changes?since="+page.Cursor, nil, &page)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got status %d: %s", rec.Code, rec.Body.String())
+	}
+	if len(page.Changes) != 1 {
+		t.Fatalf("got %d changes after creating an item, want 1", len(page.Changes))
+	}
+	if change := page.Changes[0]; change.Op != "created" || change.Item == nil || change.Item.SKU != item.SKU {
+		t.Errorf("unexpected change %+v", change)
+	}
+}
+
+func TestWarehouseCapacity(t *testing.T) {
+	name := fmt.Sprintf("test-warehouse-%d", time.Now().UnixNano())
+	region := fmt.Sprintf("test-%d", time.Now().UnixNano())
+	if rec := doRequest(t, http.MethodPut, "/admin/warehouses/"+name, map[string]interface{}{
+		"region": region, "capacity": 8,
+	}, nil); rec.Code != http.StatusOK {
+		t.Fatalf("put warehouse: got status %d: %s", rec.Code, rec.Body.String())
+	}
+
+	// Allocated to the only warehouse in the region, which then has room
+	// for 3 more units
+	create := func(quantity int) (InventoryItem, int) {
+		var item InventoryItem
+		rec := doRequest(t, http.MethodPost, "/api/inventory", CreateItemRequest{
+			ProductName: "Test Item",
+			SKU:         fmt.Sprintf("TEST-%d", time.Now().UnixNano()),
+			Quantity:    quantity,
+			Region:      region,
+		}, &item)
+		return item, rec.Code
+	}
+	if item, code := create(5); code != http.StatusCreated || item.Location != name {
+		t.Fatalf("got status %d and location %q, want 201 and %q", code, item.Location, name)
+	}
+	if _, code := create(4); code != http.StatusConflict {
+		t.Errorf("item over the free capacity: got status %d, want 409", code)
+	}
+
+	// The trigger also holds for an explicit location
+	rec := doRequest(t, http.MethodPost, "/api/inventory", CreateItemRequest{
+		ProductName: "Test Item",
+		SKU:         fmt.Sprintf("TEST-%d", time.Now().UnixNano()),
+		Quantity:    4,
+		Location:    name,
+	}, nil)
+	if rec.Code != http.StatusConflict {
+		t.Errorf("item into a full warehouse: got status %d, want 409", rec.Code)
+	}
+
+	var warehouses []WarehouseStatus
+	doRequest(t, http.MethodGet, "/api/warehouses", nil, &warehouses)
+	for _, w := range warehouses {
+		if w.Name == name && (w.Used != 5 || w.Free != 3) {
+			t.Errorf("got %d used and %d free, want 5 and 3", w.Used, w.Free)
+		}
+	}
+}
+
+func TestReservations(t *testing.T) {
+	item := createTestItem(t)
+
+	var held Reservation
+	rec := doRequest(t, http.MethodPost, "/api/reservations", CreateReservationRequest{ItemID: item.ID, Quantity: 3}, &held)
+	if rec.Code != http.StatusCreated || held.Status != reservationHeld {
+		t.Fatalf("got status %d: %s", rec.Code, rec.Body.String())
+	}
+	// 2 of the 5 units are left unreserved
+	rec = doRequest(t, http.MethodPost, "/api/reservations", CreateReservationRequest{ItemID: item.ID, Quantity: 3}, nil)
+	if rec.Code != http.StatusConflict {
+		t.Errorf("reserving more than is left: got status %d, want 409", rec.Code)
+	}
+
+	rec = doRequest(t, http.MethodPost, fmt.Sprintf("/api/reservations/%d/confirm", held.ID), nil, nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("confirm: got status %d: %s", rec.Code, rec.Body.String())
+	}
+	var got InventoryItem
+	doRequest(t, http.MethodGet, fmt.Sprintf("/api/inventory/%d", item.ID), nil, &got)
+	if got.Quantity != 2 {
+		t.Errorf("got quantity %d after confirming 3 of 5, want 2", got.Quantity)
+	}
+
+	// Expired reservations are released by the job
+	var stale Reservation
+	doRequest(t, http.MethodPost, "/api/reservations", CreateReservationRequest{ItemID: item.ID, Quantity: 2}, &stale)
+	testApp.chaos.SetClockSkew(time.Hour)
+	defer testApp.chaos.Reset()
+	if err := testApp.expireReservations(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	doRequest(t, http.MethodGet, fmt.Sprintf("/api/reservations/%d", stale.ID), nil, &stale)
+	if stale.Status != reservationExpired {
+		t.Errorf("got status %q after the TTL, want expired", stale.Status)
+	}
+}
+
+func TestSetPriceHistory(t *testing.T) {
+	item := createTestItem(t)
+	for _, price := range []float64{10, 12.5, 12.5} {
+		rec := doRequest(t, http.MethodPut, fmt.Sprintf("/api/inventory/%d/price", item.ID), SetPriceRequest{UnitPrice: &price}, nil)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("set price: got status %d: %s", rec.Code, rec.Body.String())
+		}
+	}
+
+	// Setting the same price again isn't a change
+	var history PriceHistory
+	rec := doRequest(t, http.MethodGet, fmt.Sprintf("/api/inventory/%d/price-history?bucket=24h", item.ID), nil, &history)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got status %d: %s", rec.Code, rec.Body.String())
+	}
+	changes := 0
+	for _, b := range history.Buckets {
+		changes += b.Changes
+	}
+	last := history.Buckets[len(history.Buckets)-1]
+	if changes != 2 || last.Close != 12.5 || last.Max != 12.5 {
+		t.Errorf("got buckets %+v, want 2 changes ending at 12.5", history.Buckets)
+	}
+}
+
+func TestItemHistory(t *testing.T) {
+	item := createTestItem(t)
+	// The history is by the database's clock, which may be a little off
+	// from the test's
+	time.Sleep(50 * time.Millisecond)
+	beforePrice := time.Now().UTC()
+	time.Sleep(50 * time.Millisecond)
+	price := 9.5
+	doRequest(t, http.MethodPut, fmt.Sprintf("/api/inventory/%d/price", item.ID), SetPriceRequest{UnitPrice: &price}, nil)
+
+	var history ItemHistory
+	rec := doRequest(t, http.MethodGet, fmt.Sprintf("/api/inventory/%d/history", item.ID), nil, &history)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got status %d: %s", rec.Code, rec.Body.String())
+	}
+	if len(history.Versions) != 2 || history.Versions[0].Op != "updated" || history.Versions[1].Op != "created" ||
+		history.Versions[1].ValidTo == nil || history.Versions[0].TraceID == "" {
+		t.Fatalf("got versions %+v, want the creation and the price change", history.Versions)
+	}
+
+	var then InventoryItem
+	asOf := beforePrice.Format(time.RFC3339Nano)
+	rec = doRequest(t, http.MethodGet, fmt.Sprintf("/api/inventory/sku/%s?as_of=%s", item.SKU, asOf), nil, &then)
+	if rec.Code != http.StatusOK || then.UnitPrice != nil {
+		t.Errorf("got status %d, item %+v, want it without a price", rec.Code, then)
+	}
+	var page ItemPage
+	rec = doRequest(t, http.MethodGet, "/api/inventory?with_total=true&limit=1000&as_of="+asOf, nil, &page)
+	found := false
+	for _, i := range page.Items {
+		found = found || i.ID == item.ID
+	}
+	if rec.Code != http.StatusOK || !found || !page.TotalExact {
+		t.Errorf("got status %d, page %+v, want the item in it", rec.Code, page)
+	}
+}
+
+func TestDomainEvents(t *testing.T) {
+	item := createTestItem(t)
+	var r Reservation
+	doRequest(t, http.MethodPost, "/api/reservations", CreateReservationRequest{ItemID: item.ID, Quantity: 1}, &r)
+	doRequest(t, http.MethodDelete, fmt.Sprintf("/api/reservations/%d", r.ID), nil, nil)
+
+	var page EventPage
+	rec := doRequest(t, http.MethodGet, fmt.Sprintf("/api/events?entity_type=reservation&entity_id=%d", r.ID), nil, &page)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got status %d: %s", rec.Code, rec.Body.String())
+	}
+	if len(page.Events) != 2 || page.Events[0].Type != eventReservationReleased || page.Events[1].Type != eventStockReserved {
+		t.Fatalf("got events %+v, want the reservation and its release", page.Events)
+	}
+	if page.Events[1].Data["item_id"] != float64(item.ID) {
+		t.Errorf("got data %v", page.Events[1].Data)
+	}
+
+	rec = doRequest(t, http.MethodGet, "/api/events?type=item.created&limit=1", nil, &page)
+	if rec.Code != http.StatusOK || len(page.Events) != 1 || page.Events[0].EntityID != fmt.Sprint(item.ID) {
+		t.Errorf("got status %d, events %+v, want the item just created", rec.Code, page.Events)
+	}
+}
+
+func TestStockLevelOutboxSync(t *testing.T) {
+	testApp.chaos.SetMongoBroken(true)
+	defer testApp.chaos.Reset()
+	item := createTestItem(t)
+	if n, err := testApp.stockOutbox.CountStockLevelEntries(context.Background()); err != nil || n != 1 {
+		t.Fatalf("got %d outbox entries, %v, want the stock level of the new item", n, err)
+	}
+
+	// MongoDB is back, and the entry is due
+	testApp.chaos.SetMongoBroken(false)
+	testApp.chaos.SetClockSkew(time.Minute)
+	if err := testApp.syncStockLevels(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if n, _ := testApp.stockOutbox.CountStockLevelEntries(context.Background()); n != 0 {
+		t.Errorf("got %d outbox entries after the sync, want 0", n)
+	}
+	var levels []StockLevel
+	doRequest(t, http.MethodGet, "/api/stock-levels", nil, &levels)
+	synced := 0
+	for _, level := range levels {
+		if level.ProductSKU == item.SKU {
+			synced++
+		}
+	}
+	if synced != 1 {
+		t.Errorf("got %d stock levels of %s, want 1", synced, item.SKU)
+	}
+}
+
+func TestJanitor(t *testing.T) {
+	ctx := context.Background()
+	stale := createTestItem(t)
+	fresh := createTestItem(t)
+	if _, err := testApp.postgres().ExecContext(ctx,
+		`UPDATE inventory SET updated_at = '2000-01-01' WHERE id = $1`, stale.ID); err != nil {
+		t.Fatal(err)
+	}
+	var total int
+	if err := testApp.postgres().QueryRowContext(ctx, `SELECT COUNT(*) FROM inventory`).Scan(&total); err != nil {
+		t.Fatal(err)
+	}
+
+	// Keeping all but one, only the stalest goes
+	removed, err := testApp.janitor.RemoveStaleItems(ctx, time.Now().Add(-time.Hour), total-1, 10, true, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(removed) != 1 || removed[0].ID != stale.ID {
+		t.Fatalf("got %+v, want item %d removed", removed, stale.ID)
+	}
+	if rec := doRequest(t, http.MethodGet, fmt.Sprintf("/api/inventory/%d", stale.ID), nil, nil); rec.Code != http.StatusNotFound {
+		t.Errorf("removed item: got status %d, want 404", rec.Code)
+	}
+	if rec := doRequest(t, http.MethodGet, fmt.Sprintf("/api/inventory/%d", fresh.ID), nil, nil); rec.Code != http.StatusOK {
+		t.Errorf("fresh item: got status %d, want 200", rec.Code)
+	}
+	var sku string
+	err = testApp.postgres().QueryRowContext(ctx, `SELECT sku FROM inventory_archive WHERE item_id = $1`, stale.ID).Scan(&sku)
+	if err != nil || sku != stale.SKU {
+		t.Errorf("archived SKU %q, %v, want %q", sku, err, stale.SKU)
+	}
+
+	// Nothing below the floor
+	if removed, err := testApp.janitor.RemoveStaleItems(ctx, time.Now().Add(time.Hour), total, 10, false, time.Now()); err != nil || len(removed) != 0 {
+		t.Errorf("got %d removed, %v, want none with the count at the floor", len(removed), err)
+	}
+}
+
+func TestSnapshotRestore(t *testing.T) {
+	kept := createTestItem(t)
+	var info SnapshotInfo
+	if rec := doRequest(t, http.MethodPost, "/admin/snapshot?name=integration", nil, &info); rec.Code != http.StatusCreated {
+		t.Fatalf("snapshot: got status %d: %s", rec.Code, rec.Body.String())
+	}
+	dropped := createTestItem(t)
+
+	if rec := doRequest(t, http.MethodPost, "/admin/restore?name=integration", nil, &info); rec.Code != http.StatusOK {
+		t.Fatalf("restore: got status %d: %s", rec.Code, rec.Body.String())
+	}
+	if rec := doRequest(t, http.MethodGet, fmt.Sprintf("/api/inventory/%d", kept.ID), nil, nil); rec.Code != http.StatusOK {
+		t.Errorf("item in the snapshot: got status %d, want 200", rec.Code)
+	}
+	if rec := doRequest(t, http.MethodGet, fmt.Sprintf("/api/inventory/%d", dropped.ID), nil, nil); rec.Code != http.StatusNotFound {
+		t.Errorf("item created after the snapshot: got status %d, want 404", rec.Code)
+	}
+	var levels []StockLevel
+	doRequest(t, http.MethodGet, "/api/stock-levels", nil, &levels)
+	if len(levels) != info.Records["mongodb"] {
+		t.Errorf("got %d stock levels, want the %d of the snapshot", len(levels), info.Records["mongodb"])
+	}
+	for _, level := range levels {
+		if level.ProductSKU == dropped.SKU {
+			t.Errorf("stock level of %s created after the snapshot survived the restore", dropped.SKU)
+		}
+	}
+
+	// New items continue after the restored IDs
+	if item := createTestItem(t); item.ID <= kept.ID {
+		t.Errorf("new item got ID %d, not after the restored %d", item.ID, kept.ID)
+	}
+}
+
+func TestGetStockLevels(t *testing.T) {
+	item := createTestItem(t)
+
+	var levels []StockLevel
+	rec := doRequest(t, http.MethodGet, "/api/stock-levels", nil, &levels)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got status %d", rec.Code)
+	}
+	for _, level := range levels {
+		if level.ProductSKU == item.SKU && level.Available == item.Quantity {
+			return
+		}
+	}
+	t.Errorf("no stock level for %s", item.SKU)
+}
+
+func TestGetStockLevelsMongoBroken(t *testing.T) {
+	testApp.chaos.SetMongoBroken(true)
+	defer testApp.chaos.SetMongoBroken(false)
+
+	rec := doRequest(t, http.MethodGet, "/api/stock-levels", nil, nil)
+	if rec.Code != http.StatusInternalServerError {
+		t.Errorf("got status %d, want 500", rec.Code)
+	}
+}
+
+// A database of its own, dropped after the test
+func scratchMongo(tb testing.TB, name string) func() *mongo.Database {
+	tb.Helper()
+	db := testApp.mongo().Client().Database(name)
+	if err := db.Drop(context.Background()); err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() { db.Drop(context.Background()) })
+	return func() *mongo.Database { return db }
+}
+
+func TestStockLevelMigration(t *testing.T) {
+	ctx := context.Background()
+	db := scratchMongo(t, "stock_level_migration")
+	single := &mongoStockStore{db: db, chaos: testApp.chaos}
+	ids := map[string]interface{}{}
+	for i := 0; i < 5; i++ {
+		sku := fmt.Sprintf("MIG-%d", i)
+		id, err := single.InsertStockLevel(ctx, StockLevel{ProductSKU: sku, Warehouse: fmt.Sprintf("Warehouse %c", 'A'+i%2), Available: i})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids[sku] = id
+	}
+
+	sharded := &shardedStockStore{db: db, chaos: testApp.chaos, batch: 2}
+	// A replica that isn't the leader, and doesn't migrate
+	follower := &shardedStockStore{db: db, chaos: testApp.chaos, batch: 2}
+	if _, err := sharded.InsertStockLevel(ctx, StockLevel{ProductSKU: "MIG-5", Warehouse: "Warehouse A"}); err != nil {
+		t.Fatal(err)
+	}
+	// Half way through, the stock levels are found in either collection
+	if err := sharded.Migrate(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if levels, err := sharded.ListStockLevels(ctx, "Warehouse A"); err != nil || len(levels) != 4 {
+		t.Errorf("got %d stock levels of Warehouse A, %v, want 4", len(levels), err)
+	}
+	if id, inserted, err := sharded.UpsertStockLevel(ctx, StockLevel{ProductSKU: "MIG-4", Warehouse: "Warehouse A"}); err != nil || inserted || id != ids["MIG-4"] {
+		t.Errorf("upsert of a stock level not moved yet got %v, %v, %v, want %v", id, inserted, err, ids["MIG-4"])
+	}
+
+	if err := follower.CheckMigrated(ctx); err != nil || follower.migrated.Load() {
+		t.Fatalf("follower found the stock levels migrated half way: %v", err)
+	}
+
+	for i := 0; i < 5 && !sharded.migrated.Load(); i++ {
+		if err := sharded.Migrate(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !sharded.migrated.Load() {
+		t.Fatal("stock levels not migrated")
+	}
+	if err := follower.CheckMigrated(ctx); err != nil || !follower.migrated.Load() {
+		t.Errorf("follower didn't find the stock levels migrated: %v", err)
+	}
+	if n, _ := db().Collection(stockLevelsCollection).CountDocuments(ctx, bson.M{}); n != 0 {
+		t.Errorf("%d stock levels left in %s", n, stockLevelsCollection)
+	}
+	if n, _ := db().Collection("stock_levels.warehouse_b").CountDocuments(ctx, bson.M{}); n != 2 {
+		t.Errorf("got %d stock levels in the collection of Warehouse B, want 2", n)
+	}
+	if levels, err := sharded.ListStockLevels(ctx, ""); err != nil || len(levels) != 6 {
+		t.Errorf("got %d stock levels, %v, want 6", len(levels), err)
+	}
+	if id, inserted, err := sharded.UpsertStockLevel(ctx, StockLevel{ProductSKU: "MIG-1", Warehouse: "Warehouse B"}); err != nil || inserted || id != ids["MIG-1"] {
+		t.Errorf("upsert of a moved stock level got %v, %v, %v, want %v", id, inserted, err, ids["MIG-1"])
+	}
+}
+
+// Stock levels seeded for BenchmarkStockLevelLayouts
+const (
+	benchStockLevels = 1_000_000
+	benchWarehouses  = 50
+)
+
+// Compares listing one warehouse's stock levels, and upserting one, with
+// all of them in one collection and with a collection per warehouse. The
+// migration from the one to the other is timed in between. Seeding takes
+// a while, run it on its own:
+//
+//	go test -tags integration -run '^$' -bench StockLevelLayouts -benchtime 20x
+func BenchmarkStockLevelLayouts(b *testing.B) {
+	if testing.Short() {
+		b.Skip("seeds a million stock levels")
+	}
+	ctx := context.Background()
+	db := scratchMongo(b, "stock_level_bench")
+
+	const seedBatch = 10_000
+	batch := make([]interface{}, 0, seedBatch)
+	for i := 0; i < benchStockLevels; i++ {
+		batch = append(batch, StockLevel{
+			ProductSKU: fmt.Sprintf("BENCH-%07d", i),
+			Warehouse:  fmt.Sprintf("Warehouse %02d", i%benchWarehouses),
+			Available:  i % 100,
+			UpdatedAt:  time.Now(),
+		})
+		if len(batch) == seedBatch {
+			if _, err := db().Collection(stockLevelsCollection).InsertMany(ctx, batch); err != nil {
+				b.Fatal(err)
+			}
+			batch = batch[:0]
+		}
+	}
+
+	layouts := []struct {
+		name  string
+		store StockStore
+	}{
+		{stockLayoutSingle, &mongoStockStore{db: db, chaos: testApp.chaos}},
+		{stockLayoutPerWarehouse, &shardedStockStore{db: db, chaos: testApp.chaos, batch: seedBatch}},
+	}
+	for _, layout := range layouts {
+		if sharded, ok := layout.store.(*shardedStockStore); ok {
+			start := time.Now()
+			for !sharded.migrated.Load() {
+				if err := sharded.Migrate(ctx); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.Logf("migrated %d stock levels in %s", benchStockLevels, time.Since(start))
+		}
+
+		b.Run(layout.name+"/list_warehouse", func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				levels, err := layout.store.ListStockLevels(ctx, fmt.Sprintf("Warehouse %02d", i%benchWarehouses))
+				if err != nil || len(levels) != benchStockLevels/benchWarehouses {
+					b.Fatalf("got %d stock levels, %v", len(levels), err)
+				}
+			}
+		})
+		b.Run(layout.name+"/upsert", func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				n := i * 7919 % benchStockLevels
+				level := StockLevel{ProductSKU: fmt.Sprintf("BENCH-%07d", n), Warehouse: fmt.Sprintf("Warehouse %02d", n%benchWarehouses)}
+				if _, _, err := layout.store.UpsertStockLevel(ctx, level); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestAdminEndpoints(t *testing.T) {
+	rec := doRequest(t, http.MethodGet, "/admin/scenario", nil, nil)
+	if rec.Code != http.StatusOK && rec.Code != http.StatusNotFound {
+		t.Errorf("GET /admin/scenario: got status %d", rec.Code)
+	}
+
+	rec = doRequest(t, http.MethodPost, "/admin/scenario/no-such-scenario", nil, nil)
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("POST /admin/scenario/no-such-scenario: got status %d, want 404", rec.Code)
+	}
+
+	var gc map[string]interface{}
+	rec = doRequest(t, http.MethodGet, "/admin/gc", nil, &gc)
+	if rec.Code != http.StatusOK || gc["gc_percent"] == nil {
+		t.Errorf("GET /admin/gc: got status %d, %v", rec.Code, gc)
+	}
+
+	rec = doRequest(t, http.MethodDelete, "/admin/cache", nil, nil)
+	if rec.Code != http.StatusNoContent {
+		t.Errorf("DELETE /admin/cache: got status %d, want 204", rec.Code)
+	}
+}
+
+func TestUpdateGC(t *testing.T) {
+	type gcSettings struct {
+		GCPercent   int   `json:"gc_percent"`
+		MemoryLimit int64 `json:"memory_limit"`
+		Ballast     int   `json:"ballast"`
+	}
+	var before gcSettings
+	doRequest(t, http.MethodGet, "/admin/gc", nil, &before)
+	defer doRequest(t, http.MethodPut, "/admin/gc", gin.H{
+		"gc_percent":   before.GCPercent,
+		"memory_limit": fmt.Sprint(before.MemoryLimit),
+		"ballast":      "0",
+	}, nil)
+
+	var gc gcSettings
+	rec := doRequest(t, http.MethodPut, "/admin/gc", gin.H{"gc_percent": 50, "memory_limit": "512MiB", "ballast": "1MiB"}, &gc)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got status %d: %s", rec.Code, rec.Body.String())
+	}
+	if gc.GCPercent != 50 || gc.MemoryLimit != 512<<20 || gc.Ballast != 1<<20 {
+		t.Errorf("got %+v", gc)
+	}
+
+	// A setting left out stays as it is
+	rec = doRequest(t, http.MethodPut, "/admin/gc", gin.H{"memory_limit": "off"}, &gc)
+	if rec.Code != http.StatusOK || gc.GCPercent != 50 || gc.MemoryLimit != math.MaxInt64 {
+		t.Errorf("got status %d, %+v", rec.Code, gc)
+	}
+
+	for _, body := range []gin.H{{"memory_limit": "lots"}, {"ballast": "-1MiB"}} {
+		if rec := doRequest(t, http.MethodPut, "/admin/gc", body, nil); rec.Code != http.StatusBadRequest {
+			t.Errorf("%v: got status %d, want 400", body, rec.Code)
+		}
+	}
+	// Nothing of a request turned away is applied
+	doRequest(t, http.MethodGet, "/admin/gc", nil, &gc)
+	if gc.GCPercent != 50 || gc.Ballast != 1<<20 {
+		t.Errorf("got %+v after the invalid requests", gc)
+	}
+}
+
+func TestStopScenario(t *testing.T) {
+	if rec := doRequest(t, http.MethodDelete, "/admin/scenario", nil, nil); rec.Code != http.StatusNotFound {
+		t.Errorf("got status %d with no scenario running, want 404", rec.Code)
+	}
+
+	dir := t.TempDir()
+	scenario := "steps:\n  - action: wait\n    duration: 1m\n"
+	if err := os.WriteFile(filepath.Join(dir, "long-wait.yaml"), []byte(scenario), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	defer func(dir string) { testApp.scenarios.dir = dir }(testApp.scenarios.dir)
+	testApp.scenarios.dir = dir
+
+	if rec := doRequest(t, http.MethodPost, "/admin/scenario/long-wait", nil, nil); rec.Code != http.StatusAccepted {
+		t.Fatalf("start: got status %d: %s", rec.Code, rec.Body.String())
+	}
+	if rec := doRequest(t, http.MethodDelete, "/admin/scenario", nil, nil); rec.Code != http.StatusAccepted {
+		t.Fatalf("got status %d with a scenario running, want 202", rec.Code)
+	}
+
+	var run ScenarioRun
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		doRequest(t, http.MethodGet, "/admin/scenario", nil, &run)
+		if run.State != "running" {
+			break
+		}
+	}
+	if run.State != "aborted" || run.FinishedAt == nil {
+		t.Fatalf("got %+v, want the scenario aborted", run)
+	}
+	if rec := doRequest(t, http.MethodDelete, "/admin/scenario", nil, nil); rec.Code != http.StatusNotFound {
+		t.Errorf("got status %d once aborted, want 404", rec.Code)
+	}
+}
+
+func TestMetricsEndpoint(t *testing.T) {
+	createTestItem(t)
+
+	rec := doRequest(t, http.MethodGet, "/metrics", nil, nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got status %d", rec.Code)
+	}
+	for _, name := range []string{"inventory_items_created_total", "db_query_duration_seconds"} {
+		if !bytes.Contains(rec.Body.Bytes(), []byte(name)) {
+			t.Errorf("metrics have no %s", name)
+		}
+	}
+}
@@ -0,0 +1,116 @@
+package testkit
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// Registry is a Prometheus registry for a test. The service registers its
+// metrics with the default registry at init, so tests either register
+// their own collectors here or read the default one with DefaultRegistry.
+type Registry struct {
+	gatherer prometheus.Gatherer
+}
+
+// NewRegistry returns a registry holding only the collectors
+func NewRegistry(t testing.TB, collectors ...prometheus.Collector) *Registry {
+	t.Helper()
+	reg := prometheus.NewPedanticRegistry()
+	for _, c := range collectors {
+		if err := reg.Register(c); err != nil {
+			t.Fatalf("failed to register collector: %v", err)
+		}
+	}
+	return &Registry{gatherer: reg}
+}
+
+// DefaultRegistry reads the global registry the service's metrics are in
+func DefaultRegistry() *Registry {
+	return &Registry{gatherer: prometheus.DefaultGatherer}
+}
+
+// Value returns the value of the series with exactly the labels: the value
+// of a counter or gauge, or the sample count of a histogram or summary.
+// Returns false if there is no such series.
+func (r *Registry) Value(t testing.TB, name string, labels map[string]string) (float64, bool) {
+	t.Helper()
+
+	families, err := r.gatherer.Gather()
+	if err != nil {
+		t.Fatalf("failed to gather metrics: %v", err)
+	}
+	for _, family := range families {
+		if family.GetName() != name {
+			continue
+		}
+		for _, m := range family.GetMetric() {
+			if !labelsMatch(m.GetLabel(), labels) {
+				continue
+			}
+			switch {
+			case m.Counter != nil:
+				return m.Counter.GetValue(), true
+			case m.Gauge != nil:
+				return m.Gauge.GetValue(), true
+			case m.Histogram != nil:
+				return float64(m.Histogram.GetSampleCount()), true
+			case m.Summary != nil:
+				return float64(m.Summary.GetSampleCount()), true
+			case m.Untyped != nil:
+				return m.Untyped.GetValue(), true
+			}
+		}
+	}
+	return 0, false
+}
+
+// AssertMetric fails the test unless the series has the value
+func (r *Registry) AssertMetric(t testing.TB, name string, labels map[string]string, want float64) {
+	t.Helper()
+	got, ok := r.Value(t, name, labels)
+	if !ok {
+		t.Fatalf("no series %s%v", name, labels)
+	}
+	if got != want {
+		t.Fatalf("%s%v = %v, want %v", name, labels, got, want)
+	}
+}
+
+// AssertCounterDelta fails the test unless running f changes the counter
+// (or gauge) by exactly delta. Pass a single series, such as
+// vec.WithLabelValues(...).
+func AssertCounterDelta(t testing.TB, c prometheus.Collector, delta float64, f func()) {
+	t.Helper()
+	before := testutil.ToFloat64(c)
+	f()
+	if got := testutil.ToFloat64(c) - before; got != delta {
+		t.Fatalf("counter changed by %v, want %v", got, delta)
+	}
+}
+
+// AssertObservations fails the test unless running f adds exactly n
+// observations to the histogram series with the labels
+func (r *Registry) AssertObservations(t testing.TB, name string, labels map[string]string, n uint64, f func()) {
+	t.Helper()
+	before, _ := r.Value(t, name, labels)
+	f()
+	after, _ := r.Value(t, name, labels)
+	if got := uint64(after - before); got != n {
+		t.Fatalf("%s%v got %d observations, want %d", name, labels, got, n)
+	}
+}
+
+func labelsMatch(have []*dto.LabelPair, want map[string]string) bool {
+	if len(have) != len(want) {
+		return false
+	}
+	for _, pair := range have {
+		if v, ok := want[pair.GetName()]; !ok || v != pair.GetValue() {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,51 @@
+package testkit
+
+import (
+	"context"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestTracing(t *testing.T) {
+	tr := InstallTracing(t)
+
+	ctx, parent := otel.Tracer("test").Start(context.Background(), "parent")
+	_, child := tr.Tracer("test").Start(ctx, "child", trace.WithAttributes(attribute.Bool("cache.hit", true)))
+	child.AddEvent("authz.decision", trace.WithAttributes(attribute.String("authz.decision", "allow")))
+	child.End()
+	parent.End()
+
+	childSpan := tr.AssertSpan(t, "child", attribute.Bool("cache.hit", true))
+	AssertChildOf(t, childSpan, tr.AssertSpan(t, "parent"))
+	AssertSpanEvent(t, childSpan, "authz.decision", attribute.String("authz.decision", "allow"))
+	tr.AssertNoSpan(t, "other")
+
+	tr.Reset()
+	tr.AssertNoSpan(t, "child")
+}
+
+func TestRegistry(t *testing.T) {
+	counter := prometheus.NewCounterVec(prometheus.CounterOpts{Name: "test_total", Help: "Test counter"}, []string{"result"})
+	histogram := prometheus.NewHistogramVec(prometheus.HistogramOpts{Name: "test_seconds", Help: "Test histogram"}, []string{"op"})
+	reg := NewRegistry(t, counter, histogram)
+
+	AssertCounterDelta(t, counter.WithLabelValues("hit"), 2, func() {
+		counter.WithLabelValues("hit").Add(2)
+		counter.WithLabelValues("miss").Inc()
+	})
+	reg.AssertMetric(t, "test_total", map[string]string{"result": "miss"}, 1)
+
+	reg.AssertObservations(t, "test_seconds", map[string]string{"op": "get"}, 3, func() {
+		for i := 0; i < 3; i++ {
+			histogram.WithLabelValues("get").Observe(0.1)
+		}
+	})
+
+	if _, ok := reg.Value(t, "test_total", map[string]string{"result": "error"}); ok {
+		t.Error("found a series that was never created")
+	}
+}
@@ -0,0 +1,159 @@
+// Package testkit helps tests check the observability output of the
+// service: the spans it records and the metrics it exports.
+package testkit
+
+import (
+	"context"
+	"testing"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Tracing is an SDK tracer provider that keeps ended spans in memory
+type Tracing struct {
+	Provider *sdktrace.TracerProvider
+	exporter *tracetest.InMemoryExporter
+
+	prevProvider   trace.TracerProvider
+	prevPropagator propagation.TextMapPropagator
+}
+
+// NewTracing installs an in-memory tracer provider as the global one, which
+// is also what otelgin uses. Restore puts the previous provider back. Use it
+// from TestMain; tests use InstallTracing.
+func NewTracing() *Tracing {
+	exporter := tracetest.NewInMemoryExporter()
+	tr := &Tracing{
+		// Synchronous, so spans are visible as soon as they end
+		Provider:       sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter)),
+		exporter:       exporter,
+		prevProvider:   otel.GetTracerProvider(),
+		prevPropagator: otel.GetTextMapPropagator(),
+	}
+	otel.SetTracerProvider(tr.Provider)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(
+		propagation.TraceContext{}, propagation.Baggage{}))
+	return tr
+}
+
+// InstallTracing is NewTracing for a single test
+func InstallTracing(t testing.TB) *Tracing {
+	t.Helper()
+	tr := NewTracing()
+	t.Cleanup(tr.Restore)
+	return tr
+}
+
+// Restore shuts the provider down and reinstalls the previous global one
+func (tr *Tracing) Restore() {
+	tr.Provider.Shutdown(context.Background())
+	otel.SetTracerProvider(tr.prevProvider)
+	otel.SetTextMapPropagator(tr.prevPropagator)
+}
+
+// Tracer returns a tracer of the in-memory provider
+func (tr *Tracing) Tracer(name string) trace.Tracer {
+	return tr.Provider.Tracer(name)
+}
+
+// Reset forgets the spans ended so far
+func (tr *Tracing) Reset() {
+	tr.exporter.Reset()
+}
+
+// Spans returns the spans ended so far, oldest first
+func (tr *Tracing) Spans() tracetest.SpanStubs {
+	return tr.exporter.GetSpans()
+}
+
+// FindSpan returns the most recent ended span with the name
+func (tr *Tracing) FindSpan(name string) (tracetest.SpanStub, bool) {
+	spans := tr.Spans()
+	for i := len(spans) - 1; i >= 0; i-- {
+		if spans[i].Name == name {
+			return spans[i], true
+		}
+	}
+	return tracetest.SpanStub{}, false
+}
+
+// AssertSpan fails the test unless a span with the name ended and has all
+// of the attributes. Returns the most recent matching span.
+func (tr *Tracing) AssertSpan(t testing.TB, name string, attrs ...attribute.KeyValue) tracetest.SpanStub {
+	t.Helper()
+
+	spans := tr.Spans()
+	found := false
+	for i := len(spans) - 1; i >= 0; i-- {
+		if spans[i].Name != name {
+			continue
+		}
+		found = true
+		if hasAttributes(spans[i].Attributes, attrs) {
+			return spans[i]
+		}
+	}
+
+	if !found {
+		t.Fatalf("no span named %q among %v", name, spanNames(spans))
+	}
+	t.Fatalf("no span named %q has attributes %v", name, attrs)
+	return tracetest.SpanStub{}
+}
+
+// AssertNoSpan fails the test if a span with the name ended
+func (tr *Tracing) AssertNoSpan(t testing.TB, name string) {
+	t.Helper()
+	if _, ok := tr.FindSpan(name); ok {
+		t.Fatalf("unexpected span %q", name)
+	}
+}
+
+// AssertSpanEvent fails the test unless the span has an event with the name
+// and attributes
+func AssertSpanEvent(t testing.TB, span tracetest.SpanStub, name string, attrs ...attribute.KeyValue) {
+	t.Helper()
+	for _, event := range span.Events {
+		if event.Name == name && hasAttributes(event.Attributes, attrs) {
+			return
+		}
+	}
+	t.Fatalf("span %q has no event %q with attributes %v", span.Name, name, attrs)
+}
+
+// AssertChildOf fails the test unless child's parent is parent
+func AssertChildOf(t testing.TB, child, parent tracetest.SpanStub) {
+	t.Helper()
+	if child.Parent.SpanID() != parent.SpanContext.SpanID() {
+		t.Fatalf("span %q is not a child of %q", child.Name, parent.Name)
+	}
+}
+
+func hasAttributes(have, want []attribute.KeyValue) bool {
+	for _, w := range want {
+		found := false
+		for _, h := range have {
+			if h.Key == w.Key && h.Value == w.Value {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+func spanNames(spans tracetest.SpanStubs) []string {
+	names := make([]string, len(spans))
+	for i, span := range spans {
+		names[i] = span.Name
+	}
+	return names
+}
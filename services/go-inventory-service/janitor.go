@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+var (
+	janitorItemsRemoved = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "janitor_items_removed_total",
+			Help: "Stale demo items removed by the janitor, by mode: delete or archive",
+		},
+		[]string{"mode"},
+	)
+
+	janitorStockLevelsRemoved = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "janitor_stock_levels_removed_total",
+			Help: "Stock levels of the removed items deleted from MongoDB by the janitor",
+		},
+	)
+
+	janitorRunDuration = promauto.NewHistogram(
+		prometheus.HistogramOpts{
+			Name:    "janitor_run_duration_seconds",
+			Help:    "Duration of the janitor runs",
+			Buckets: prometheus.ExponentialBuckets(0.01, 4, 8),
+		},
+	)
+
+	janitorLastRun = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "janitor_last_run_timestamp_seconds",
+			Help: "When the janitor last finished a run, as a Unix timestamp",
+		},
+	)
+)
+
+// What the janitor does with stale items (JANITOR_MODE)
+const (
+	janitorDelete  = "delete"
+	janitorArchive = "archive"
+)
+
+// Stale items removed by the janitor when archiving, as they were when
+// removed. Their change log and history entries stay where they are.
+const createArchiveQuery = `
+	CREATE TABLE IF NOT EXISTS inventory_archive (
+		archive_id BIGSERIAL PRIMARY KEY,
+		item_id INTEGER NOT NULL,
+		product_name VARCHAR(255) NOT NULL,
+		sku VARCHAR(100) NOT NULL,
+		quantity INTEGER NOT NULL,
+		location VARCHAR(255) NOT NULL,
+		unit_price NUMERIC(12, 2),
+		created_at TIMESTAMP NOT NULL,
+		updated_at TIMESTAMP NOT NULL,
+		archived_at TIMESTAMP NOT NULL
+	);
+	CREATE INDEX IF NOT EXISTS inventory_archive_archived_at ON inventory_archive (archived_at);
+`
+
+// JanitorStore removes stale items (PostgreSQL)
+type JanitorStore interface {
+	// Remove up to limit items not updated since before, the least
+	// recently updated first, leaving at least keep items. Archived items
+	// are copied to inventory_archive first. Returns the removed items.
+	RemoveStaleItems(ctx context.Context, before time.Time, keep, limit int, archive bool, now time.Time) ([]InventoryItem, error)
+}
+
+// postgresJanitorStore is the JanitorStore on PostgreSQL
+type postgresJanitorStore struct {
+	db    func() *sql.DB
+	chaos *Chaos
+}
+
+func (s *postgresJanitorStore) RemoveStaleItems(ctx context.Context, before time.Time, keep, limit int, archive bool, now time.Time) ([]InventoryItem, error) {
+	// SKIP LOCKED leaves the items being written right now alone. Deleting
+	// goes through the triggers, so delta sync clients see the items go.
+	query := `
+		WITH stale AS (
+			SELECT id FROM inventory
+			WHERE updated_at < $1
+			ORDER BY updated_at, id
+			LIMIT LEAST($3, GREATEST((SELECT COUNT(*) FROM inventory) - $2, 0))
+			FOR UPDATE SKIP LOCKED
+		), removed AS (
+			DELETE FROM inventory WHERE id IN (SELECT id FROM stale)
+			RETURNING id, product_name, sku, quantity, location, created_at, updated_at, unit_price
+		), archived AS (
+			INSERT INTO inventory_archive (item_id, product_name, sku, quantity, location, unit_price, created_at, updated_at, archived_at)
+			SELECT id, product_name, sku, quantity, location, unit_price, created_at, updated_at, $5
+			FROM removed WHERE $4
+		)
+		SELECT id, product_name, sku, quantity, location, created_at, updated_at, unit_price
+		FROM removed
+		ORDER BY updated_at, id
+	`
+
+	start := time.Now()
+	s.chaos.slowPostgres(ctx, s.db())
+	rows, err := s.db().QueryContext(ctx, query, before, keep, limit, archive, now)
+	observeQuery("postgres", "remove_stale_items", start)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	return scanItems(rows, limit)
+}
+
+// Remove the demo items nobody updated for JANITOR_MAX_AGE, in batches,
+// so the items of a long running demo don't grow without bound.
+// JANITOR_KEEP_ITEMS stay however old they are, so the counts on the
+// dashboards stay comparable. The removed items' stock levels go as well.
+// Runs on the leader only.
+func (app *App) cleanUpItems(ctx context.Context) error {
+	cfg := app.janitorCfg
+	start := time.Now()
+	ctx, span := app.tracer.Start(ctx, "janitor.clean_up")
+	defer span.End()
+
+	now := app.clock.Now()
+	before := now.Add(-cfg.MaxAge)
+	span.SetAttributes(
+		attribute.String("janitor.mode", cfg.Mode),
+		attribute.String("janitor.before", before.UTC().Format(time.RFC3339)),
+	)
+
+	var removed, stockLevels int
+	var err error
+	for {
+		var items []InventoryItem
+		items, err = app.janitor.RemoveStaleItems(ctx, before, cfg.KeepItems, cfg.Batch, cfg.Mode == janitorArchive, now)
+		if err != nil {
+			break
+		}
+		removed += len(items)
+		janitorItemsRemoved.WithLabelValues(cfg.Mode).Add(float64(len(items)))
+		stockLevels += app.removeStockLevels(ctx, items)
+		if len(items) < cfg.Batch {
+			break
+		}
+	}
+
+	took := time.Since(start)
+	janitorRunDuration.Observe(took.Seconds())
+	span.SetAttributes(attribute.Int("janitor.items_removed", removed), attribute.Int("janitor.stock_levels_removed", stockLevels))
+	if removed > 0 {
+		app.publishEvent(ctx, eventItemsCleanedUp, "janitor", before.UTC().Format(time.RFC3339),
+			fmt.Sprintf("Removed %d demo items not updated since %s (%s)", removed, before.UTC().Format(time.RFC3339), cfg.Mode),
+			map[string]interface{}{"items": removed, "stock_levels": stockLevels, "mode": cfg.Mode})
+		logWithTrace(ctx, "INFO", "Removed stale demo items", "mode", cfg.Mode, "items", removed,
+			"stock_levels", stockLevels, "updated_before", before.Format(time.RFC3339), "took_ms", took.Milliseconds())
+	}
+	if err != nil {
+		span.RecordError(err)
+		return fmt.Errorf("removing stale items: %w", err)
+	}
+	janitorLastRun.Set(float64(time.Now().Unix()))
+	return nil
+}
+
+// Delete the stock levels of removed items, returning how many went. A
+// stock level MongoDB didn't let go of is only logged: it's for an item
+// that is gone either way.
+func (app *App) removeStockLevels(ctx context.Context, items []InventoryItem) int {
+	skus := map[string][]string{}
+	for _, item := range items {
+		skus[item.Location] = append(skus[item.Location], item.SKU)
+	}
+	removed := 0
+	for warehouse, batch := range skus {
+		n, err := app.stockStore.DeleteStockLevelsBySKU(ctx, warehouse, batch)
+		if err != nil {
+			logWithTrace(ctx, "WARN", "Failed to delete the stock levels of stale items",
+				"warehouse", warehouse, "items", len(batch), "error", err.Error())
+			continue
+		}
+		removed += int(n)
+	}
+	janitorStockLevelsRemoved.Add(float64(removed))
+	return removed
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"testing"
+	"time"
+
+	"inventory-service/internal/testkit"
+)
+
+// fakeJanitorStore removes stale items from a fakeItemStore the way the
+// PostgreSQL query does
+type fakeJanitorStore struct {
+	items    *fakeItemStore
+	archived []InventoryItem
+	calls    int
+	err      error
+}
+
+func (s *fakeJanitorStore) RemoveStaleItems(ctx context.Context, before time.Time, keep, limit int, archive bool, now time.Time) ([]InventoryItem, error) {
+	s.calls++
+	if s.err != nil {
+		return nil, s.err
+	}
+	items := append([]InventoryItem{}, s.items.items...)
+	sort.Slice(items, func(i, j int) bool { return items[i].UpdatedAt.Before(items[j].UpdatedAt) })
+	var removed []InventoryItem
+	for _, item := range items {
+		if len(removed) == min(limit, max(len(s.items.items)-keep, 0)) || !item.UpdatedAt.Before(before) {
+			break
+		}
+		removed = append(removed, item)
+	}
+
+	kept := s.items.items[:0]
+	for _, item := range s.items.items {
+		if !containsItem(removed, item.ID) {
+			kept = append(kept, item)
+		}
+	}
+	s.items.items = kept
+	if archive {
+		s.archived = append(s.archived, removed...)
+	}
+	return removed, nil
+}
+
+func containsItem(items []InventoryItem, id int) bool {
+	for _, item := range items {
+		if item.ID == id {
+			return true
+		}
+	}
+	return false
+}
+
+func TestCleanUpItems(t *testing.T) {
+	now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	items := &fakeItemStore{}
+	stock := &fakeStockStore{}
+	for i := 0; i < 10; i++ {
+		item := InventoryItem{ID: i + 1, SKU: "OLD-" + string(rune('A'+i)), Location: "Warehouse A", UpdatedAt: now.Add(-time.Duration(10-i) * 24 * time.Hour)}
+		if i >= 7 {
+			item.Location = "Warehouse B"
+		}
+		items.items = append(items.items, item)
+		stock.levels = append(stock.levels, StockLevel{ProductSKU: item.SKU, Warehouse: item.Location})
+	}
+	// Updated 10 to 1 days ago, the six older than 4 days are stale
+	app := newFakeApp(t, items, stock, &fixedClock{now})
+	janitor := &fakeJanitorStore{items: items}
+	app.janitor = janitor
+	app.janitorCfg = JanitorConfig{MaxAge: 4 * 24 * time.Hour, KeepItems: 2, Mode: janitorArchive, Batch: 2}
+
+	testkit.AssertCounterDelta(t, janitorItemsRemoved.WithLabelValues(janitorArchive), 6, func() {
+		if err := app.cleanUpItems(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	})
+	// Full batches of 2 until one comes back empty
+	if janitor.calls != 4 {
+		t.Errorf("got %d batches, want 4", janitor.calls)
+	}
+	if len(items.items) != 4 || len(janitor.archived) != 6 {
+		t.Errorf("got %d items left and %d archived, want 4 and 6", len(items.items), len(janitor.archived))
+	}
+	if len(stock.levels) != 4 || stock.levels[0].ProductSKU != "OLD-G" {
+		t.Errorf("got stock levels %+v, want those of the items left", stock.levels)
+	}
+
+	// Ten days later everything is stale, but the newest items are kept
+	app.clock = &fixedClock{now.Add(10 * 24 * time.Hour)}
+	app.janitorCfg.Mode = janitorDelete
+	if err := app.cleanUpItems(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if len(items.items) != 2 || len(janitor.archived) != 6 || items.items[0].SKU != "OLD-I" {
+		t.Errorf("got items %+v, want the 2 newest kept", items.items)
+	}
+}
+
+func TestCleanUpItemsFails(t *testing.T) {
+	stock := &fakeStockStore{err: errors.New("connection refused")}
+	items := &fakeItemStore{items: []InventoryItem{{ID: 1, SKU: "OLD-1"}}}
+	app := newFakeApp(t, items, stock, systemClock{})
+	app.janitorCfg = JanitorConfig{MaxAge: time.Hour, Mode: janitorDelete, Batch: 10}
+
+	// Stock levels MongoDB keeps don't stop the janitor
+	app.janitor = &fakeJanitorStore{items: items}
+	if err := app.cleanUpItems(context.Background()); err != nil || len(items.items) != 0 {
+		t.Errorf("got %v with %d items left", err, len(items.items))
+	}
+
+	app.janitor = &fakeJanitorStore{items: items, err: errors.New("deadlock detected")}
+	if err := app.cleanUpItems(context.Background()); err == nil {
+		t.Error("got no error")
+	}
+}
@@ -0,0 +1,392 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	leaderElectionLeader = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "leader_election_leader",
+			Help: "1 while this replica holds the lease and runs the singleton jobs, 0 otherwise",
+		},
+		[]string{"lease"},
+	)
+
+	leaderElectionTransitions = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "leader_election_transitions_total",
+			Help: "Total number of times this replica acquired or lost the lease",
+		},
+		[]string{"lease", "event"},
+	)
+
+	leaderElectionErrors = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "leader_election_errors_total",
+			Help: "Total number of failed attempts to read, acquire or renew the lease",
+		},
+		[]string{"lease"},
+	)
+)
+
+const serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+// LeaderElector elects one replica through a Kubernetes Lease, the same
+// protocol as client-go's leaderelection package: the leader renews the
+// lease every retry period, and the others take it over once it hasn't been
+// renewed for the lease duration. A nil LeaderElector (election off) is
+// always the leader, for a single replica outside Kubernetes.
+type LeaderElector struct {
+	cfg      LeaderConfig
+	identity string
+	kube     *kubeClient
+	clock    Clock
+
+	mu     sync.Mutex
+	leader bool
+	// Last lease seen and when it was first seen with this content. Expiry
+	// is judged on the local clock, not the holder's renewTime, so clock
+	// skew between nodes doesn't matter.
+	observed    leaseSpec
+	observedAt  time.Time
+	lastRenewed time.Time
+	lastHolder  string
+}
+
+// Create the leader elector. Returns nil when LEADER_ELECTION is off.
+func newLeaderElector(cfg LeaderConfig) (*LeaderElector, error) {
+	if !cfg.Enabled {
+		return nil, nil
+	}
+
+	kube, err := newInClusterClient()
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Namespace == "" {
+		ns, err := os.ReadFile(serviceAccountDir + "/namespace")
+		if err != nil {
+			return nil, fmt.Errorf("failed to read the pod namespace: %w", err)
+		}
+		cfg.Namespace = strings.TrimSpace(string(ns))
+	}
+	identity := cfg.Identity
+	if identity == "" {
+		identity, _ = os.Hostname()
+	}
+
+	log.Printf("Leader election enabled (lease %s/%s, identity %s)", cfg.Namespace, cfg.LeaseName, identity)
+	return &LeaderElector{cfg: cfg, identity: identity, kube: kube, clock: systemClock{}}, nil
+}
+
+// IsLeader reports whether this replica should run the singleton jobs
+func (e *LeaderElector) IsLeader() bool {
+	if e == nil {
+		return true
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.leader
+}
+
+// Run takes part in the election until ctx is done. It doesn't release the
+// lease; call Release once the singleton jobs have stopped.
+func (e *LeaderElector) Run(ctx context.Context) {
+	leaderElectionLeader.WithLabelValues(e.cfg.LeaseName).Set(0)
+	ticker := time.NewTicker(e.cfg.RetryPeriod)
+	defer ticker.Stop()
+	for {
+		e.tryAcquireOrRenew(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (e *LeaderElector) tryAcquireOrRenew(ctx context.Context) {
+	ctx, cancel := context.WithTimeout(ctx, e.cfg.RetryPeriod)
+	defer cancel()
+
+	err := e.acquireOrRenew(ctx)
+	if err == nil {
+		return
+	}
+	if ctx.Err() == nil {
+		leaderElectionErrors.WithLabelValues(e.cfg.LeaseName).Inc()
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	// A leader that can't renew in time must assume another replica took
+	// over, and stop the singleton jobs before the lease expires
+	if e.leader && e.clock.Now().Sub(e.lastRenewed) >= e.cfg.RenewDeadline {
+		e.setLeader(false, fmt.Sprintf("renewal failing for %s: %v", e.cfg.RenewDeadline, err))
+	} else if !errors.Is(err, errLeaseHeld) {
+		log.Printf("Leader election: %v", err)
+	}
+}
+
+var errLeaseHeld = errors.New("lease is held by another replica")
+
+func (e *LeaderElector) acquireOrRenew(ctx context.Context) error {
+	lease, err := e.kube.getLease(ctx, e.cfg.Namespace, e.cfg.LeaseName)
+	now := e.clock.Now()
+	if errors.Is(err, errKubeNotFound) {
+		lease = &kubeLease{Spec: e.holderSpec(leaseSpec{}, now)}
+		lease.Metadata.Name = e.cfg.LeaseName
+		lease.Metadata.Namespace = e.cfg.Namespace
+		if _, err := e.kube.createLease(ctx, lease); err != nil {
+			return err
+		}
+		e.renewed(lease.Spec, now)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	e.mu.Lock()
+	if lease.Spec != e.observed {
+		e.observed = lease.Spec
+		e.observedAt = now
+	}
+	holder := lease.Spec.HolderIdentity
+	if holder != e.lastHolder && holder != e.identity && holder != "" {
+		log.Printf("Leader election: %s is the leader of %s", holder, e.cfg.LeaseName)
+	}
+	e.lastHolder = holder
+	expired := holder == "" || now.After(e.observedAt.Add(time.Duration(lease.Spec.LeaseDurationSeconds)*time.Second))
+	if holder != e.identity && !expired {
+		if e.leader {
+			e.setLeader(false, "lease taken over by "+holder)
+		}
+		e.mu.Unlock()
+		return errLeaseHeld
+	}
+	e.mu.Unlock()
+
+	// Renew our lease or take over the expired one. The resourceVersion
+	// makes the update fail if another replica got there first.
+	lease.Spec = e.holderSpec(lease.Spec, now)
+	if _, err := e.kube.updateLease(ctx, lease); err != nil {
+		return err
+	}
+	e.renewed(lease.Spec, now)
+	return nil
+}
+
+// The lease spec with this replica as the holder, renewed at now
+func (e *LeaderElector) holderSpec(spec leaseSpec, now time.Time) leaseSpec {
+	renewTime := now.UTC().Format(kubeMicroTime)
+	if spec.HolderIdentity != e.identity {
+		if spec.HolderIdentity != "" || spec.AcquireTime != "" {
+			spec.LeaseTransitions++
+		}
+		spec.HolderIdentity = e.identity
+		spec.AcquireTime = renewTime
+	}
+	spec.RenewTime = renewTime
+	spec.LeaseDurationSeconds = int(e.cfg.LeaseDuration / time.Second)
+	return spec
+}
+
+func (e *LeaderElector) renewed(spec leaseSpec, now time.Time) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.observed = spec
+	e.observedAt = now
+	e.lastRenewed = now
+	e.lastHolder = e.identity
+	if !e.leader {
+		e.setLeader(true, fmt.Sprintf("lease transitions: %d", spec.LeaseTransitions))
+	}
+}
+
+// Called with e.mu held
+func (e *LeaderElector) setLeader(leader bool, reason string) {
+	e.leader = leader
+	if leader {
+		leaderElectionLeader.WithLabelValues(e.cfg.LeaseName).Set(1)
+		leaderElectionTransitions.WithLabelValues(e.cfg.LeaseName, "acquired").Inc()
+		log.Printf("Leader election: %s became the leader of %s (%s)", e.identity, e.cfg.LeaseName, reason)
+		return
+	}
+	leaderElectionLeader.WithLabelValues(e.cfg.LeaseName).Set(0)
+	leaderElectionTransitions.WithLabelValues(e.cfg.LeaseName, "lost").Inc()
+	log.Printf("Leader election: %s is no longer the leader of %s (%s)", e.identity, e.cfg.LeaseName, reason)
+}
+
+// Release gives the lease up on shutdown, so another replica takes over
+// right away instead of waiting for it to expire
+func (e *LeaderElector) Release(ctx context.Context) error {
+	if e == nil || !e.IsLeader() {
+		return nil
+	}
+
+	lease, err := e.kube.getLease(ctx, e.cfg.Namespace, e.cfg.LeaseName)
+	if err != nil {
+		return err
+	}
+	if lease.Spec.HolderIdentity != e.identity {
+		return nil
+	}
+	lease.Spec.HolderIdentity = ""
+	lease.Spec.LeaseDurationSeconds = 1
+	if _, err := e.kube.updateLease(ctx, lease); err != nil {
+		return err
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.setLeader(false, "released on shutdown")
+	return nil
+}
+
+// Kubernetes MicroTime, as used by Lease timestamps
+const kubeMicroTime = "2006-01-02T15:04:05.000000Z07:00"
+
+type leaseSpec struct {
+	HolderIdentity       string `json:"holderIdentity,omitempty"`
+	LeaseDurationSeconds int    `json:"leaseDurationSeconds,omitempty"`
+	AcquireTime          string `json:"acquireTime,omitempty"`
+	RenewTime            string `json:"renewTime,omitempty"`
+	LeaseTransitions     int    `json:"leaseTransitions,omitempty"`
+}
+
+type kubeLease struct {
+	APIVersion string `json:"apiVersion"`
+	Kind       string `json:"kind"`
+	Metadata   struct {
+		Name            string `json:"name"`
+		Namespace       string `json:"namespace"`
+		ResourceVersion string `json:"resourceVersion,omitempty"`
+	} `json:"metadata"`
+	Spec leaseSpec `json:"spec"`
+}
+
+var errKubeNotFound = errors.New("not found")
+
+// kubeClient is just enough of the Kubernetes API for leases. Its calls are
+// not traced: renewals every few seconds would flood the traces.
+type kubeClient struct {
+	baseURL   string
+	tokenPath string
+	client    httpDoer
+}
+
+// Connect to the API server of the cluster the pod runs in, with the pod's
+// service account
+func newInClusterClient() (*kubeClient, error) {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, errors.New("leader election needs to run in Kubernetes (KUBERNETES_SERVICE_HOST is not set)")
+	}
+	pool, err := loadCertPool(serviceAccountDir + "/ca.crt")
+	if err != nil {
+		return nil, fmt.Errorf("failed to load the cluster CA: %w", err)
+	}
+	return &kubeClient{
+		baseURL:   "https://" + strings.Trim(host, "[]") + ":" + port,
+		tokenPath: serviceAccountDir + "/token",
+		client: &http.Client{
+			Timeout:   10 * time.Second,
+			Transport: &http.Transport{TLSClientConfig: &tls.Config{MinVersion: tls.VersionTLS12, RootCAs: pool}},
+		},
+	}, nil
+}
+
+func (k *kubeClient) leasePath(namespace, name string) string {
+	path := "/apis/coordination.k8s.io/v1/namespaces/" + namespace + "/leases"
+	if name != "" {
+		path += "/" + name
+	}
+	return path
+}
+
+func (k *kubeClient) getLease(ctx context.Context, namespace, name string) (*kubeLease, error) {
+	var lease kubeLease
+	if err := k.do(ctx, http.MethodGet, k.leasePath(namespace, name), nil, &lease); err != nil {
+		return nil, err
+	}
+	return &lease, nil
+}
+
+func (k *kubeClient) createLease(ctx context.Context, lease *kubeLease) (*kubeLease, error) {
+	var created kubeLease
+	err := k.do(ctx, http.MethodPost, k.leasePath(lease.Metadata.Namespace, ""), lease, &created)
+	return &created, err
+}
+
+func (k *kubeClient) updateLease(ctx context.Context, lease *kubeLease) (*kubeLease, error) {
+	var updated kubeLease
+	err := k.do(ctx, http.MethodPut, k.leasePath(lease.Metadata.Namespace, lease.Metadata.Name), lease, &updated)
+	return &updated, err
+}
+
+func (k *kubeClient) do(ctx context.Context, method, path string, in, out interface{}) error {
+	var body *bytes.Reader
+	if in != nil {
+		if l, ok := in.(*kubeLease); ok {
+			l.APIVersion, l.Kind = "coordination.k8s.io/v1", "Lease"
+		}
+		data, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(data)
+	} else {
+		body = bytes.NewReader(nil)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, k.baseURL+path, body)
+	if err != nil {
+		return err
+	}
+	// Read on every call, projected service account tokens are rotated
+	if k.tokenPath != "" {
+		token, err := os.ReadFile(k.tokenPath)
+		if err != nil {
+			return fmt.Errorf("failed to read service account token: %w", err)
+		}
+		req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := k.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return errKubeNotFound
+	case resp.StatusCode == http.StatusConflict:
+		return errLeaseHeld
+	case resp.StatusCode >= 300:
+		var status struct {
+			Message string `json:"message"`
+		}
+		json.NewDecoder(resp.Body).Decode(&status)
+		return fmt.Errorf("kubernetes API returned %d for %s %s: %s", resp.StatusCode, method, path, status.Message)
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeLeaseAPI is the Kubernetes leases API for one lease, with
+// resourceVersion conflicts
+type fakeLeaseAPI struct {
+	mu      sync.Mutex
+	lease   *kubeLease
+	version int
+}
+
+func (f *fakeLeaseAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	switch r.Method {
+	case http.MethodGet:
+		if f.lease == nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		json.NewEncoder(w).Encode(f.lease)
+	case http.MethodPost, http.MethodPut:
+		var lease kubeLease
+		json.NewDecoder(r.Body).Decode(&lease)
+		if (r.Method == http.MethodPost) != (f.lease == nil) ||
+			(f.lease != nil && lease.Metadata.ResourceVersion != f.lease.Metadata.ResourceVersion) {
+			w.WriteHeader(http.StatusConflict)
+			return
+		}
+		f.version++
+		lease.Metadata.ResourceVersion = strconv.Itoa(f.version)
+		f.lease = &lease
+		json.NewEncoder(w).Encode(f.lease)
+	}
+}
+
+func (f *fakeLeaseAPI) holder() string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.lease == nil {
+		return ""
+	}
+	return f.lease.Spec.HolderIdentity
+}
+
+func newTestElector(srv *httptest.Server, identity string, clock Clock) *LeaderElector {
+	cfg := defaultConfig().Leader
+	cfg.Namespace = "demo"
+	return &LeaderElector{
+		cfg:      cfg,
+		identity: identity,
+		kube:     &kubeClient{baseURL: srv.URL, client: srv.Client()},
+		clock:    clock,
+	}
+}
+
+func TestLeaderElection(t *testing.T) {
+	api := &fakeLeaseAPI{}
+	srv := httptest.NewServer(api)
+	defer srv.Close()
+
+	clock := &fixedClock{now: time.Now()}
+	a := newTestElector(srv, "pod-a", clock)
+	b := newTestElector(srv, "pod-b", clock)
+	ctx := context.Background()
+
+	a.tryAcquireOrRenew(ctx)
+	b.tryAcquireOrRenew(ctx)
+	if !a.IsLeader() || b.IsLeader() || api.holder() != "pod-a" {
+		t.Fatalf("first replica not elected alone: a=%v b=%v holder=%q", a.IsLeader(), b.IsLeader(), api.holder())
+	}
+
+	// The leader keeps the lease as long as it renews it
+	for i := 0; i < 10; i++ {
+		clock.now = clock.now.Add(2 * time.Second)
+		a.tryAcquireOrRenew(ctx)
+		b.tryAcquireOrRenew(ctx)
+	}
+	if !a.IsLeader() || b.IsLeader() {
+		t.Fatal("leadership changed while the leader was renewing")
+	}
+
+	// The leader loses the API server: it steps down after the renew
+	// deadline, and the other replica takes over once the lease expired
+	a.kube.baseURL = "http://127.0.0.1:1"
+	clock.now = clock.now.Add(11 * time.Second)
+	a.tryAcquireOrRenew(ctx)
+	if a.IsLeader() {
+		t.Error("leader that can't renew past the renew deadline still leads")
+	}
+	b.tryAcquireOrRenew(ctx)
+	if b.IsLeader() {
+		t.Error("lease taken over before it expired")
+	}
+	clock.now = clock.now.Add(16 * time.Second)
+	b.tryAcquireOrRenew(ctx)
+	if !b.IsLeader() || api.holder() != "pod-b" {
+		t.Fatalf("expired lease not taken over: holder=%q", api.holder())
+	}
+	if n := api.lease.Spec.LeaseTransitions; n != 1 {
+		t.Errorf("got %d lease transitions, want 1", n)
+	}
+}
+
+func TestLeaderRelease(t *testing.T) {
+	api := &fakeLeaseAPI{}
+	srv := httptest.NewServer(api)
+	defer srv.Close()
+
+	clock := &fixedClock{now: time.Now()}
+	a := newTestElector(srv, "pod-a", clock)
+	b := newTestElector(srv, "pod-b", clock)
+	ctx := context.Background()
+
+	a.tryAcquireOrRenew(ctx)
+	b.tryAcquireOrRenew(ctx)
+	if err := a.Release(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if a.IsLeader() {
+		t.Error("still leader after releasing the lease")
+	}
+
+	// A released lease is taken over right away
+	b.tryAcquireOrRenew(ctx)
+	if !b.IsLeader() {
+		t.Error("released lease not taken over")
+	}
+}
+
+func TestNilLeaderElectorLeads(t *testing.T) {
+	var e *LeaderElector
+	if !e.IsLeader() {
+		t.Error("without leader election the replica must run the singleton jobs")
+	}
+	if err := e.Release(context.Background()); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,337 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var (
+	lowStockItems = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "inventory_low_stock_items",
+			Help: "Items at or below LOW_STOCK_THRESHOLD, as of the last check",
+		},
+	)
+
+	lowStockAlerts = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "low_stock_alerts_total",
+			Help: "Low stock alerts by result: sent, failed, or logged when there is no webhook",
+		},
+		[]string{"result"},
+	)
+)
+
+// LowStockItem is an item that went low on stock, with the write that took
+// it there
+type LowStockItem struct {
+	ItemID      int    `json:"item_id"`
+	SKU         string `json:"sku"`
+	ProductName string `json:"product_name"`
+	Location    string `json:"location"`
+	Quantity    int    `json:"quantity"`
+	TraceID     string `json:"trace_id"`
+	SpanID      string `json:"-"`
+}
+
+// The span context of the write that made the item low, invalid if it
+// wasn't traced
+func (i LowStockItem) origin() trace.SpanContext {
+	traceID, _ := trace.TraceIDFromHex(i.TraceID)
+	spanID, _ := trace.SpanIDFromHex(i.SpanID)
+	return trace.NewSpanContext(trace.SpanContextConfig{
+		TraceID: traceID, SpanID: spanID, TraceFlags: trace.FlagsSampled, Remote: true,
+	})
+}
+
+// LowStockStore keeps track of the items alerted on (PostgreSQL). An item
+// is alerted on once when it goes low, and again only after it was
+// restocked above the threshold in between.
+type LowStockStore interface {
+	// Items at or below threshold
+	CountLowStock(ctx context.Context, threshold int) (int, error)
+	// Claim up to limit items at or below threshold that haven't been
+	// alerted on yet
+	ClaimLowStock(ctx context.Context, threshold, limit int, now time.Time) ([]LowStockItem, error)
+	// Give back the claim on an item whose alert couldn't be sent, so the
+	// next check tries again
+	UnclaimLowStock(ctx context.Context, itemID int) error
+	// Forget the alerts of the items back above threshold
+	ClearRestocked(ctx context.Context, threshold int) (int, error)
+}
+
+const createLowStockAlertsQuery = `
+	CREATE TABLE IF NOT EXISTS low_stock_alerts (
+		item_id INTEGER PRIMARY KEY REFERENCES inventory (id) ON DELETE CASCADE,
+		quantity INTEGER NOT NULL,
+		alerted_at TIMESTAMP NOT NULL
+	);
+`
+
+// postgresLowStockStore is the LowStockStore on PostgreSQL
+type postgresLowStockStore struct {
+	db    func() *sql.DB
+	chaos *Chaos
+}
+
+func (s *postgresLowStockStore) CountLowStock(ctx context.Context, threshold int) (int, error) {
+	start := time.Now()
+	var n int
+	err := s.db().QueryRowContext(ctx, `SELECT COUNT(*) FROM inventory WHERE quantity <= $1`, threshold).Scan(&n)
+	observeQuery("postgres", "count_low_stock", start)
+	return n, err
+}
+
+func (s *postgresLowStockStore) ClaimLowStock(ctx context.Context, threshold, limit int, now time.Time) ([]LowStockItem, error) {
+	start := time.Now()
+	defer observeQuery("postgres", "claim_low_stock", start)
+	s.chaos.slowPostgres(ctx, s.db())
+
+	rows, err := s.db().QueryContext(ctx, `
+		WITH claimed AS (
+			INSERT INTO low_stock_alerts (item_id, quantity, alerted_at)
+			SELECT id, quantity, $3 FROM inventory i
+			WHERE quantity <= $1
+				AND NOT EXISTS (SELECT 1 FROM low_stock_alerts a WHERE a.item_id = i.id)
+			ORDER BY id
+			LIMIT $2
+			ON CONFLICT (item_id) DO NOTHING
+			RETURNING item_id
+		)
+		SELECT i.id, i.sku, i.product_name, i.location, i.quantity, i.last_trace_id, i.last_span_id
+		FROM claimed c JOIN inventory i ON i.id = c.item_id
+		ORDER BY i.id
+	`, threshold, limit, now)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var items []LowStockItem
+	for rows.Next() {
+		var i LowStockItem
+		if err := rows.Scan(&i.ItemID, &i.SKU, &i.ProductName, &i.Location, &i.Quantity, &i.TraceID, &i.SpanID); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	return items, rows.Err()
+}
+
+func (s *postgresLowStockStore) UnclaimLowStock(ctx context.Context, itemID int) error {
+	start := time.Now()
+	_, err := s.db().ExecContext(ctx, `DELETE FROM low_stock_alerts WHERE item_id = $1`, itemID)
+	observeQuery("postgres", "unclaim_low_stock", start)
+	return err
+}
+
+func (s *postgresLowStockStore) ClearRestocked(ctx context.Context, threshold int) (int, error) {
+	start := time.Now()
+	res, err := s.db().ExecContext(ctx, `
+		DELETE FROM low_stock_alerts a USING inventory i
+		WHERE a.item_id = i.id AND i.quantity > $1
+	`, threshold)
+	observeQuery("postgres", "clear_restocked", start)
+	if err != nil {
+		return 0, err
+	}
+	n, err := res.RowsAffected()
+	return int(n), err
+}
+
+// Most alerts sent per check, so turning the monitor on for a database
+// full of low items doesn't flood the channel
+const lowStockAlertBatch = 20
+
+// LowStockMonitor alerts through a webhook when an item goes low on stock,
+// linking to the trace of the write that did it. The check runs on the
+// leader only and publishes a stock.low event per item; Alert, subscribed
+// to them, sends the webhook.
+type LowStockMonitor struct {
+	store   LowStockStore
+	cfg     LowStockConfig
+	client  httpDoer
+	tracer  trace.Tracer
+	clock   Clock
+	publish func(ctx context.Context, eventType, entityType string, entityID interface{}, message string, data map[string]interface{})
+}
+
+func newLowStockMonitor(store LowStockStore, cfg LowStockConfig, clientCfg HTTPClientConfig, tracer trace.Tracer, clock Clock,
+	publish func(ctx context.Context, eventType, entityType string, entityID interface{}, message string, data map[string]interface{})) *LowStockMonitor {
+	return &LowStockMonitor{
+		store:   store,
+		cfg:     cfg,
+		client:  newHTTPClient("low-stock-webhook", clientCfg, nil),
+		tracer:  tracer,
+		clock:   clock,
+		publish: publish,
+	}
+}
+
+// Check the stock and publish the items that went low since the last
+// check
+func (m *LowStockMonitor) Check(ctx context.Context) error {
+	if m.cfg.Threshold == 0 {
+		return nil
+	}
+	if _, err := m.store.ClearRestocked(ctx, m.cfg.Threshold); err != nil {
+		return err
+	}
+	n, err := m.store.CountLowStock(ctx, m.cfg.Threshold)
+	if err != nil {
+		return err
+	}
+	lowStockItems.Set(float64(n))
+
+	items, err := m.store.ClaimLowStock(ctx, m.cfg.Threshold, lowStockAlertBatch, m.clock.Now())
+	if err != nil {
+		return err
+	}
+	for _, item := range items {
+		m.publish(ctx, eventStockLow, "item", item.ItemID,
+			fmt.Sprintf("%s (%s) is low on stock: %d left in %s", item.ProductName, item.SKU, item.Quantity, item.Location),
+			map[string]interface{}{
+				"sku": item.SKU, "product_name": item.ProductName, "location": item.Location, "quantity": item.Quantity,
+				"threshold": m.cfg.Threshold, "origin_trace_id": item.TraceID, "origin_span_id": item.SpanID,
+			})
+	}
+	return nil
+}
+
+// Alert is the event bus subscriber sending the alert of a stock.low event.
+// An alert that fails to send gives back the item's claim, so the next
+// check tries again; so does one the bus drops, see Dropped.
+func (m *LowStockMonitor) Alert(ctx context.Context, e DomainEvent) error {
+	itemID, err := strconv.Atoi(e.EntityID)
+	if err != nil {
+		return fmt.Errorf("item ID %q: %w", e.EntityID, err)
+	}
+	item := LowStockItem{ItemID: itemID}
+	item.SKU, _ = e.Data["sku"].(string)
+	item.ProductName, _ = e.Data["product_name"].(string)
+	item.Location, _ = e.Data["location"].(string)
+	item.Quantity, _ = e.Data["quantity"].(int)
+	item.TraceID, _ = e.Data["origin_trace_id"].(string)
+	item.SpanID, _ = e.Data["origin_span_id"].(string)
+
+	if err := m.alert(ctx, item); err != nil {
+		if err := m.store.UnclaimLowStock(ctx, item.ItemID); err != nil {
+			return err
+		}
+		return err
+	}
+	return nil
+}
+
+// Dropped gives back the claim of a stock.low event the bus couldn't hand
+// to Alert, so the next check tries again
+func (m *LowStockMonitor) Dropped(ctx context.Context, e DomainEvent) error {
+	itemID, err := strconv.Atoi(e.EntityID)
+	if err != nil {
+		return fmt.Errorf("item ID %q: %w", e.EntityID, err)
+	}
+	return m.store.UnclaimLowStock(ctx, itemID)
+}
+
+// Send one alert, in a span linked to the write that made the item low
+func (m *LowStockMonitor) alert(ctx context.Context, item LowStockItem) error {
+	var opts []trace.SpanStartOption
+	if origin := item.origin(); origin.IsValid() {
+		opts = append(opts, trace.WithLinks(trace.Link{SpanContext: origin}))
+	}
+	opts = append(opts, trace.WithAttributes(
+		attribute.Int("item.id", item.ItemID),
+		attribute.String("item.sku", item.SKU),
+		attribute.Int("item.quantity", item.Quantity),
+		attribute.Int("low_stock.threshold", m.cfg.Threshold),
+		attribute.String("low_stock.origin_trace_id", item.TraceID),
+	))
+	ctx, span := m.tracer.Start(ctx, "low_stock.alert", opts...)
+	defer span.End()
+
+	fields := []interface{}{"item_id", item.ItemID, "sku", item.SKU, "quantity", item.Quantity,
+		"threshold", m.cfg.Threshold, "origin_trace_id", item.TraceID}
+	if m.cfg.WebhookURL == "" {
+		lowStockAlerts.WithLabelValues("logged").Inc()
+		logWithTrace(ctx, "WARN", "Item is low on stock", fields...)
+		return nil
+	}
+	if err := m.post(ctx, item); err != nil {
+		span.RecordError(err)
+		lowStockAlerts.WithLabelValues("failed").Inc()
+		logWithTrace(ctx, "ERROR", "Failed to send low stock alert", append(fields, "error", err.Error())...)
+		return err
+	}
+	lowStockAlerts.WithLabelValues("sent").Inc()
+	logWithTrace(ctx, "INFO", "Low stock alert sent", fields...)
+	return nil
+}
+
+// The link to the trace of the write, empty if it wasn't traced
+func (m *LowStockMonitor) traceURL(item LowStockItem) string {
+	if item.TraceID == "" {
+		return ""
+	}
+	return strings.ReplaceAll(m.cfg.TraceURL, "{trace_id}", item.TraceID)
+}
+
+// Post the alert in the configured format
+func (m *LowStockMonitor) post(ctx context.Context, item LowStockItem) error {
+	var payload interface{}
+	traceURL := m.traceURL(item)
+	if m.cfg.WebhookFormat == "slack" {
+		text := fmt.Sprintf(":warning: *%s* (SKU %s) is low on stock: %d left in %s (threshold %d)",
+			item.ProductName, item.SKU, item.Quantity, item.Location, m.cfg.Threshold)
+		if traceURL != "" {
+			text += fmt.Sprintf("\n<%s|View the trace of the change>", traceURL)
+		}
+		payload = map[string]string{"text": text}
+	} else {
+		payload = struct {
+			Event string `json:"event"`
+			LowStockItem
+			Threshold int    `json:"threshold"`
+			TraceURL  string `json:"trace_url,omitempty"`
+		}{"low_stock", item, m.cfg.Threshold, traceURL}
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, m.cfg.WebhookURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := m.client.Do(req)
+	if err != nil {
+		// Without the URL, which holds Slack's secret
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			return urlErr.Err
+		}
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("webhook returned %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
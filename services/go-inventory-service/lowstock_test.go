@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+
+	"inventory-service/internal/testkit"
+)
+
+// fakeLowStockStore has a fixed set of low items, each claimed once
+type fakeLowStockStore struct {
+	low     []LowStockItem
+	claimed map[int]bool
+}
+
+func (s *fakeLowStockStore) CountLowStock(ctx context.Context, threshold int) (int, error) {
+	return len(s.low), nil
+}
+
+func (s *fakeLowStockStore) ClaimLowStock(ctx context.Context, threshold, limit int, now time.Time) ([]LowStockItem, error) {
+	var items []LowStockItem
+	for _, item := range s.low {
+		if !s.claimed[item.ItemID] && len(items) < limit {
+			s.claimed[item.ItemID] = true
+			items = append(items, item)
+		}
+	}
+	return items, nil
+}
+
+func (s *fakeLowStockStore) UnclaimLowStock(ctx context.Context, itemID int) error {
+	delete(s.claimed, itemID)
+	return nil
+}
+
+func (s *fakeLowStockStore) ClearRestocked(ctx context.Context, threshold int) (int, error) {
+	return 0, nil
+}
+
+func TestLowStockMonitor(t *testing.T) {
+	tr := testkit.InstallTracing(t)
+	var texts []string
+	status := http.StatusOK
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var msg struct{ Text string }
+		json.NewDecoder(r.Body).Decode(&msg)
+		texts = append(texts, msg.Text)
+		w.WriteHeader(status)
+	}))
+	defer srv.Close()
+
+	traceID := "4bf92f3577b34da6a3ce929d0e0e4736"
+	store := &fakeLowStockStore{
+		low:     []LowStockItem{{ItemID: 7, SKU: "W-7", ProductName: "Widget", Quantity: 2, TraceID: traceID, SpanID: "00f067aa0ba902b7"}},
+		claimed: map[int]bool{},
+	}
+	cfg := LowStockConfig{Threshold: 5, WebhookURL: srv.URL, WebhookFormat: "slack", TraceURL: "http://grafana/trace/{trace_id}"}
+	app := newFakeApp(t, &fakeItemStore{}, &fakeStockStore{}, systemClock{})
+	app.tracer = tr.Tracer("test")
+	monitor := newLowStockMonitor(store, cfg, testHTTPClientConfig(), app.tracer, systemClock{}, app.publishEvent)
+	// Delivered right away rather than as a background job
+	app.bus = newEventBus(nil)
+	app.bus.Subscribe("low_stock_webhook", monitor.Alert, eventStockLow)
+
+	// A failed alert is tried again on the next check
+	status = http.StatusInternalServerError
+	testkit.AssertCounterDelta(t, lowStockAlerts.WithLabelValues("failed"), 1, func() {
+		if err := monitor.Check(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	})
+	status = http.StatusOK
+	testkit.AssertCounterDelta(t, lowStockAlerts.WithLabelValues("sent"), 1, func() {
+		monitor.Check(context.Background())
+		// Already alerted on
+		monitor.Check(context.Background())
+	})
+
+	if len(texts) != 2 || !strings.Contains(texts[1], "<http://grafana/trace/"+traceID+"|") || !strings.Contains(texts[1], "*Widget* (SKU W-7)") {
+		t.Errorf("alert doesn't link the trace of the change: %q", texts)
+	}
+	span := tr.AssertSpan(t, "low_stock.alert", attribute.String("low_stock.origin_trace_id", traceID))
+	if len(span.Links) != 1 || span.Links[0].SpanContext.TraceID().String() != traceID {
+		t.Errorf("alert span not linked to the change: %+v", span.Links)
+	}
+}
+
+func TestLowStockAlertDropped(t *testing.T) {
+	store := &fakeLowStockStore{
+		low:     []LowStockItem{{ItemID: 7, SKU: "W-7", ProductName: "Widget", Quantity: 2}},
+		claimed: map[int]bool{},
+	}
+	app := newFakeApp(t, &fakeItemStore{}, &fakeStockStore{}, systemClock{})
+	monitor := newLowStockMonitor(store, LowStockConfig{Threshold: 5}, testHTTPClientConfig(), app.tracer, systemClock{}, app.publishEvent)
+	// The worker queue takes no more jobs
+	pool := newWorkerPool(app.tracer, WorkerConfig{Size: 1, QueueSize: 1})
+	pool.Shutdown(context.Background())
+	app.bus = newEventBus(pool)
+	app.bus.SubscribeAsync("low_stock_webhook", monitor.Alert, monitor.Dropped, eventStockLow)
+
+	if err := monitor.Check(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if store.claimed[7] {
+		t.Error("dropped alert still claimed, the next check won't retry it")
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+// fakeRows yields n identical inventory rows without a database
+type fakeRows struct {
+	n, next int
+	now     time.Time
+}
+
+func (r *fakeRows) Next() bool {
+	r.next++
+	return r.next <= r.n
+}
+
+func (r *fakeRows) Scan(dest ...interface{}) error {
+	if len(dest) != 8 {
+		return fmt.Errorf("expected 8 destinations, got %d", len(dest))
+	}
+	*dest[0].(*int) = r.next
+	*dest[1].(*string) = "Product"
+	*dest[2].(*string) = "SKU-000001"
+	*dest[3].(*int) = 42
+	*dest[4].(*string) = "Warehouse A"
+	*dest[5].(*time.Time) = r.now
+	*dest[6].(*time.Time) = r.now
+	*dest[7].(**float64) = nil
+	return nil
+}
+
+func (r *fakeRows) Err() error { return nil }
+
+// The scanning loop listItems used before scanItems, as a baseline
+func scanItemsAppend(rows rowScanner) []InventoryItem {
+	items := []InventoryItem{}
+	for rows.Next() {
+		var item InventoryItem
+		if err := rows.Scan(&item.ID, &item.ProductName, &item.SKU,
+			&item.Quantity, &item.Location, &item.CreatedAt, &item.UpdatedAt, &item.UnitPrice); err != nil {
+			continue
+		}
+		items = append(items, item)
+	}
+	return items
+}
+
+func BenchmarkScanItems(b *testing.B) {
+	const limit = 10000
+	now := time.Now()
+
+	b.Run("append", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			items := scanItemsAppend(&fakeRows{n: limit, now: now})
+			if len(items) != limit {
+				b.Fatalf("scanned %d rows", len(items))
+			}
+		}
+	})
+
+	b.Run("prealloc", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			items, err := scanItems(&fakeRows{n: limit, now: now}, limit)
+			if err != nil || len(items) != limit {
+				b.Fatalf("scanned %d rows: %v", len(items), err)
+			}
+		}
+	})
+}
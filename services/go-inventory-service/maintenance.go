@@ -0,0 +1,164 @@
+package main
+
+import (
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var (
+	readOnlyEnabled = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "read_only_mode",
+			Help: "1 while writes are turned away for maintenance",
+		},
+	)
+
+	readOnlyRejections = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "read_only_rejections_total",
+			Help: "Writes turned away in read-only mode by route",
+		},
+		[]string{"route"},
+	)
+)
+
+// The problem type of the rejections, see RFC 9457
+const readOnlyProblemType = "urn:inventory-service:problem:read-only"
+
+// ReadOnlyMode turns writes away with a 503 during maintenance, while reads
+// are still served. It starts out as READ_ONLY says and is switched at
+// runtime through the admin API or a scenario, on this replica only.
+type ReadOnlyMode struct {
+	mu      sync.RWMutex
+	enabled bool
+	message string
+	since   time.Time
+
+	defaultMessage string
+	retryAfter     string
+}
+
+// ReadOnlyStatus is whether writes are turned away, and since when
+type ReadOnlyStatus struct {
+	ReadOnly bool       `json:"read_only"`
+	Message  string     `json:"message,omitempty"`
+	Since    *time.Time `json:"since,omitempty"`
+}
+
+func newReadOnlyMode(cfg MaintenanceConfig, clock Clock) *ReadOnlyMode {
+	m := &ReadOnlyMode{
+		defaultMessage: cfg.Message,
+		retryAfter:     strconv.Itoa(int(math.Ceil(cfg.RetryAfter.Seconds()))),
+	}
+	if cfg.ReadOnly {
+		m.Set(true, "", clock.Now())
+		log.Printf("Starting in read-only mode: %s", cfg.Message)
+	}
+	return m
+}
+
+// Switch read-only mode on or off. An empty message means READ_ONLY_MESSAGE.
+func (m *ReadOnlyMode) Set(enabled bool, message string, now time.Time) ReadOnlyStatus {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if message == "" {
+		message = m.defaultMessage
+	}
+	if enabled && !m.enabled {
+		m.since = now
+	}
+	m.enabled, m.message = enabled, message
+	if enabled {
+		readOnlyEnabled.Set(1)
+	} else {
+		readOnlyEnabled.Set(0)
+	}
+	return m.status()
+}
+
+func (m *ReadOnlyMode) Status() ReadOnlyStatus {
+	if m == nil {
+		return ReadOnlyStatus{}
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.status()
+}
+
+func (m *ReadOnlyMode) status() ReadOnlyStatus {
+	if !m.enabled {
+		return ReadOnlyStatus{}
+	}
+	since := m.since.UTC()
+	return ReadOnlyStatus{ReadOnly: true, Message: m.message, Since: &since}
+}
+
+// Middleware for the /api routes: in read-only mode, everything but reads
+// gets a 503 problem document with Retry-After
+func (m *ReadOnlyMode) Middleware(c *gin.Context) {
+	switch c.Request.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		c.Next()
+		return
+	}
+	status := m.Status()
+	if !status.ReadOnly {
+		c.Next()
+		return
+	}
+
+	ctx := c.Request.Context()
+	trace.SpanFromContext(ctx).SetAttributes(attribute.Bool("maintenance.read_only", true))
+	readOnlyRejections.WithLabelValues(c.FullPath()).Inc()
+	requestsTotal.WithLabelValues(c.Request.Method, c.FullPath(), "503").Inc()
+	logWithTrace(ctx, "INFO", "Write turned away in read-only mode", "method", c.Request.Method, "path", c.Request.URL.Path)
+
+	c.Header("Retry-After", m.retryAfter)
+	c.Header("Content-Type", "application/problem+json")
+	c.AbortWithStatusJSON(http.StatusServiceUnavailable, gin.H{
+		"type":            readOnlyProblemType,
+		"title":           "Service is read-only for maintenance",
+		"status":          http.StatusServiceUnavailable,
+		"detail":          status.Message,
+		"instance":        c.Request.URL.Path,
+		"read_only_since": status.Since,
+	})
+}
+
+// Show whether the service is read-only
+func (app *App) readOnlyStatus(c *gin.Context) {
+	c.JSON(http.StatusOK, app.readOnly.Status())
+}
+
+// ReadOnlyRequest switches read-only mode, with the message for the clients
+type ReadOnlyRequest struct {
+	ReadOnly *bool  `json:"read_only" binding:"required"`
+	Message  string `json:"message"`
+}
+
+// Switch read-only mode on or off at runtime
+func (app *App) updateReadOnly(c *gin.Context) {
+	var req ReadOnlyRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	status := app.readOnly.Set(*req.ReadOnly, req.Message, app.clock.Now())
+	if status.ReadOnly {
+		logWithTrace(c.Request.Context(), "WARN", "Read-only mode on", "message", status.Message)
+	} else {
+		logWithTrace(c.Request.Context(), "INFO", "Read-only mode off")
+	}
+	c.JSON(http.StatusOK, status)
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestReadOnlyMode(t *testing.T) {
+	clock := &fixedClock{now: time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)}
+	items := &fakeItemStore{items: []InventoryItem{{ID: 1, SKU: "W-1"}}}
+	app := newFakeApp(t, items, &fakeStockStore{}, clock)
+	app.readOnly = newReadOnlyMode(MaintenanceConfig{Message: "Back soon", RetryAfter: 90 * time.Second}, clock)
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	api := router.Group("/api", app.readOnly.Middleware)
+	api.POST("/inventory", app.createItem)
+	api.GET("/inventory/sku/:sku", app.getItemBySKU)
+	router.PUT("/admin/read-only", app.updateReadOnly)
+
+	send := func(method, path, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		return rec
+	}
+	item := `{"product_name": "Widget", "sku": "W-2", "quantity": 3, "location": "Warehouse A"}`
+
+	rec := send(http.MethodPut, "/admin/read-only", `{"read_only": true}`)
+	var status ReadOnlyStatus
+	json.Unmarshal(rec.Body.Bytes(), &status)
+	if !status.ReadOnly || status.Message != "Back soon" || status.Since == nil || !status.Since.Equal(clock.now) {
+		t.Fatalf("got status %+v after switching read-only mode on", status)
+	}
+
+	rec = send(http.MethodPost, "/api/inventory", item)
+	if rec.Code != http.StatusServiceUnavailable || rec.Header().Get("Retry-After") != "90" {
+		t.Fatalf("write: got status %d with Retry-After %q, want 503 with 90", rec.Code, rec.Header().Get("Retry-After"))
+	}
+	if ct := rec.Header().Get("Content-Type"); ct != "application/problem+json" {
+		t.Errorf("got Content-Type %q, want application/problem+json", ct)
+	}
+	var problem map[string]interface{}
+	json.Unmarshal(rec.Body.Bytes(), &problem)
+	if problem["type"] != readOnlyProblemType || problem["detail"] != "Back soon" || problem["instance"] != "/api/inventory" {
+		t.Errorf("unexpected problem document %v", problem)
+	}
+	if len(items.items) != 1 {
+		t.Errorf("item created in read-only mode")
+	}
+
+	if rec := send(http.MethodGet, "/api/inventory/sku/W-1", ""); rec.Code != http.StatusOK {
+		t.Errorf("read: got status %d, want 200", rec.Code)
+	}
+
+	if rec := send(http.MethodPut, "/admin/read-only", `{"message": "no flag"}`); rec.Code != http.StatusBadRequest {
+		t.Errorf("without read_only: got status %d, want 400", rec.Code)
+	}
+	send(http.MethodPut, "/admin/read-only", `{"read_only": false}`)
+	if rec := send(http.MethodPost, "/api/inventory", item); rec.Code != http.StatusCreated {
+		t.Errorf("write after read-only mode: got status %d: %s", rec.Code, rec.Body.String())
+	}
+}
@@ -0,0 +1,322 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var errObjectNotFound = errors.New("object not found")
+
+// ObjectStore keeps blobs by key, in an S3-compatible bucket or a local
+// directory
+type ObjectStore interface {
+	// Store size bytes of body under key, replacing any object there. A
+	// body that is an io.Seeker is read from the start again if the upload
+	// is retried; any other body is streamed once, without retries.
+	Put(ctx context.Context, key string, body io.Reader, size int64, contentType string) error
+	// Read the object, or errObjectNotFound. The caller closes it.
+	Get(ctx context.Context, key string) (io.ReadCloser, error)
+	// A URL that downloads the object without credentials until ttl runs
+	// out, or "" if the store has no URLs
+	SignedURL(key string, ttl time.Duration) (string, error)
+}
+
+// Create the object store: the bucket when an endpoint is configured, the
+// directory dir otherwise
+func newObjectStore(cfg ObjectStoreConfig, clientCfg HTTPClientConfig, dir string) ObjectStore {
+	if cfg.Endpoint == "" {
+		return &dirObjectStore{dir: dir}
+	}
+	// Objects are larger than API responses; give each attempt more time
+	clientCfg.Timeout = cfg.Timeout
+	publicEndpoint := cfg.PublicEndpoint
+	if publicEndpoint == "" {
+		publicEndpoint = cfg.Endpoint
+	}
+	return &s3ObjectStore{
+		endpoint:       strings.TrimSuffix(cfg.Endpoint, "/"),
+		publicEndpoint: strings.TrimSuffix(publicEndpoint, "/"),
+		bucket:         cfg.Bucket,
+		region:         cfg.Region,
+		accessKey:      cfg.AccessKey,
+		secretKey:      cfg.SecretKey,
+		client:         newHTTPClient("object-store", clientCfg, nil),
+		clock:          systemClock{},
+	}
+}
+
+// dirObjectStore keeps the objects as files, e.g. on a mounted volume
+type dirObjectStore struct {
+	dir string
+}
+
+func (s *dirObjectStore) path(key string) string {
+	return filepath.Join(s.dir, filepath.FromSlash(key))
+}
+
+func (s *dirObjectStore) Put(ctx context.Context, key string, body io.Reader, size int64, contentType string) error {
+	if seeker, ok := body.(io.Seeker); ok {
+		if _, err := seeker.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+	}
+	path := s.path(key)
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	// Written next to the final name and renamed, so a reader never sees
+	// half an object
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".upload-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := io.Copy(tmp, body); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+func (s *dirObjectStore) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	f, err := os.Open(s.path(key))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, errObjectNotFound
+	}
+	return f, err
+}
+
+// Files have no URLs; they are served by the service itself
+func (s *dirObjectStore) SignedURL(key string, ttl time.Duration) (string, error) {
+	return "", nil
+}
+
+// s3ObjectStore talks to an S3-compatible API (AWS S3, MinIO) with path
+// style URLs and Signature Version 4
+type s3ObjectStore struct {
+	endpoint string
+	// For the signed URLs, which clients outside the cluster open
+	publicEndpoint string
+	bucket         string
+	region         string
+	accessKey      string
+	secretKey      string
+	client         httpDoer
+	clock          Clock
+}
+
+func (s *s3ObjectStore) objectURL(key string) string {
+	return s.endpoint + "/" + s.bucket + "/" + awsURIEncode(key, false)
+}
+
+func (s *s3ObjectStore) Put(ctx context.Context, key string, body io.Reader, size int64, contentType string) error {
+	seeker, replayable := body.(io.Seeker)
+	if replayable {
+		if _, err := seeker.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, s.objectURL(key), io.NopCloser(body))
+	if err != nil {
+		return err
+	}
+	req.ContentLength = size
+	if replayable {
+		req.GetBody = func() (io.ReadCloser, error) {
+			_, err := seeker.Seek(0, io.SeekStart)
+			return io.NopCloser(body), err
+		}
+	}
+	req.Header.Set("Content-Type", contentType)
+
+	resp, err := s.do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (s *s3ObjectStore) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.objectURL(key), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := s.do(req)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+func (s *s3ObjectStore) SignedURL(key string, ttl time.Duration) (string, error) {
+	u, err := url.Parse(s.publicEndpoint + "/" + s.bucket + "/" + awsURIEncode(key, false))
+	if err != nil {
+		return "", err
+	}
+	presignV4(u, s.accessKey, s.secretKey, s.region, s.clock.Now(), ttl)
+	return u.String(), nil
+}
+
+// Sign and send the request. Returns errObjectNotFound for a 404 and an
+// error with S3's message for any other failure.
+func (s *s3ObjectStore) do(req *http.Request) (*http.Response, error) {
+	signV4(req, unsignedPayload, s.accessKey, s.secretKey, s.region, s.clock.Now())
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 300 {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, errObjectNotFound
+	}
+	msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	return nil, fmt.Errorf("object store %s %s: %s: %s", req.Method, req.URL.Path, resp.Status, strings.TrimSpace(string(msg)))
+}
+
+// Payload hash for bodies that aren't part of the signature, so uploads
+// are streamed rather than hashed first
+const unsignedPayload = "UNSIGNED-PAYLOAD"
+
+// Sign the request with AWS Signature Version 4 for S3. The host and every
+// header already set are signed.
+func signV4(req *http.Request, payloadHash, accessKey, secretKey, region string, now time.Time) {
+	now = now.UTC()
+	amzDate := now.Format("20060102T150405Z")
+	day := now.Format("20060102")
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(strings.Join(values, ","))
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		canonicalQuery(req.URL.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := day + "/" + region + "/s3/aws4_request"
+	signature := signatureV4(canonicalRequest, secretKey, region, amzDate, scope)
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		accessKey, scope, signedHeaders, signature))
+}
+
+// Turn u into a presigned GET URL, valid for ttl from now. Only the host is
+// signed, so the URL works from any client.
+func presignV4(u *url.URL, accessKey, secretKey, region string, now time.Time, ttl time.Duration) {
+	now = now.UTC()
+	amzDate := now.Format("20060102T150405Z")
+	scope := now.Format("20060102") + "/" + region + "/s3/aws4_request"
+
+	query := u.Query()
+	query.Set("X-Amz-Algorithm", "AWS4-HMAC-SHA256")
+	query.Set("X-Amz-Credential", accessKey+"/"+scope)
+	query.Set("X-Amz-Date", amzDate)
+	query.Set("X-Amz-Expires", strconv.Itoa(int(ttl.Seconds())))
+	query.Set("X-Amz-SignedHeaders", "host")
+
+	canonicalRequest := strings.Join([]string{
+		http.MethodGet,
+		u.EscapedPath(),
+		canonicalQuery(query),
+		"host:" + u.Host + "\n",
+		"host",
+		unsignedPayload,
+	}, "\n")
+	signature := signatureV4(canonicalRequest, secretKey, region, amzDate, scope)
+	u.RawQuery = canonicalQuery(query) + "&X-Amz-Signature=" + signature
+}
+
+// Sign the canonical request with the key derived for the day and region
+// of scope
+func signatureV4(canonicalRequest, secretKey, region, amzDate, scope string) string {
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hexSHA256(canonicalRequest)
+
+	key := hmacSHA256([]byte("AWS4"+secretKey), amzDate[:8])
+	for _, part := range []string{region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	return hex.EncodeToString(hmacSHA256(key, stringToSign))
+}
+
+func canonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var parts []string
+	for _, k := range keys {
+		values := query[k]
+		sort.Strings(values)
+		for _, v := range values {
+			parts = append(parts, awsURIEncode(k, true)+"="+awsURIEncode(v, true))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+// Percent-encode everything but the unreserved characters, and slashes
+// unless encodeSlash
+func awsURIEncode(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~', c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+func hexSHA256(data string) string {
+	sum := sha256.Sum256([]byte(data))
+	return hex.EncodeToString(sum[:])
+}
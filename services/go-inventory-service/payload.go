@@ -0,0 +1,78 @@
+package main
+
+import (
+	"io"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// 64B to 16MB, a factor of 4 apart
+var payloadSizeBuckets = prometheus.ExponentialBuckets(64, 4, 10)
+
+var (
+	requestSize = promauto.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "http_request_size_bytes",
+			Help:    "Size of the HTTP request bodies by method and endpoint",
+			Buckets: payloadSizeBuckets,
+		},
+		[]string{"method", "endpoint"},
+	)
+
+	responseSize = promauto.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "http_response_size_bytes",
+			Help:    "Size of the HTTP response bodies by method and endpoint",
+			Buckets: payloadSizeBuckets,
+		},
+		[]string{"method", "endpoint"},
+	)
+
+	bytesSent = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "http_response_bytes_sent_total",
+			Help: "Total HTTP response body bytes sent by method and endpoint",
+		},
+		[]string{"method", "endpoint"},
+	)
+)
+
+// countingBody counts the bytes read from a request body
+type countingBody struct {
+	io.ReadCloser
+	n int64
+}
+
+func (b *countingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.n += int64(n)
+	return n, err
+}
+
+// Middleware that measures the request and response bodies of every
+// route. Requests without a Content-Length (chunked uploads) are measured
+// by what the handler read of them.
+func observePayloadSizes(c *gin.Context) {
+	var body *countingBody
+	if c.Request.ContentLength < 0 && c.Request.Body != nil {
+		body = &countingBody{ReadCloser: c.Request.Body}
+		c.Request.Body = body
+	}
+
+	c.Next()
+
+	in := c.Request.ContentLength
+	if body != nil {
+		in = body.n
+	}
+	out := int64(c.Writer.Size())
+	if out < 0 {
+		out = 0
+	}
+	method, endpoint := c.Request.Method, c.FullPath()
+	requestSize.WithLabelValues(method, endpoint).Observe(float64(in))
+	responseSize.WithLabelValues(method, endpoint).Observe(float64(out))
+	bytesSent.WithLabelValues(method, endpoint).Add(float64(out))
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+
+	"inventory-service/internal/testkit"
+)
+
+// The sum of the sizes observed by a histogram series
+func observedBytes(t *testing.T, h prometheus.Observer) float64 {
+	var m dto.Metric
+	if err := h.(prometheus.Metric).Write(&m); err != nil {
+		t.Fatal(err)
+	}
+	return m.GetHistogram().GetSampleSum()
+}
+
+func TestObservePayloadSizes(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.Use(observePayloadSizes)
+	router.POST("/api/echo/:n", func(c *gin.Context) {
+		body, _ := io.ReadAll(c.Request.Body)
+		c.Data(http.StatusOK, "text/plain", append(body, body...))
+	})
+
+	metrics := testkit.DefaultRegistry()
+	labels := map[string]string{"method": http.MethodPost, "endpoint": "/api/echo/:n"}
+	requests := requestSize.WithLabelValues(http.MethodPost, "/api/echo/:n")
+	before := observedBytes(t, requests)
+	testkit.AssertCounterDelta(t, bytesSent.WithLabelValues(http.MethodPost, "/api/echo/:n"), 2000, func() {
+		metrics.AssertObservations(t, "http_response_size_bytes", labels, 2, func() {
+			req := httptest.NewRequest(http.MethodPost, "/api/echo/1", strings.NewReader(strings.Repeat("a", 600)))
+			router.ServeHTTP(httptest.NewRecorder(), req)
+
+			// Chunked, without a Content-Length
+			req = httptest.NewRequest(http.MethodPost, "/api/echo/2", io.NopCloser(strings.NewReader(strings.Repeat("b", 400))))
+			req.ContentLength = -1
+			router.ServeHTTP(httptest.NewRecorder(), req)
+		})
+	})
+	if got := observedBytes(t, requests) - before; got != 1000 {
+		t.Errorf("got %v request bytes observed, want 1000", got)
+	}
+}
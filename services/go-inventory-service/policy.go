@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var routeTimeouts = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "http_request_timeouts_total",
+		Help: "Total number of requests that ran past the timeout of their route policy, by method and endpoint",
+	},
+	[]string{"method", "endpoint"},
+)
+
+// Middleware that applies the route's policy: the request context gets the
+// route's deadline. The policy is recorded on the request span, so a
+// request that was cut short can be told apart in the trace. A handler
+// that hasn't responded by the deadline gets a 504 written for it.
+func (app *App) routePolicy(c *gin.Context) {
+	route := c.Request.Method + " " + c.FullPath()
+	policy, ok := app.routePolicies[route]
+	if !ok {
+		c.Next()
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), policy.Timeout)
+	defer cancel()
+	span := trace.SpanFromContext(ctx)
+	span.SetAttributes(
+		attribute.String("policy.route", route),
+		attribute.Int64("policy.timeout_ms", policy.Timeout.Milliseconds()),
+	)
+	c.Request = c.Request.WithContext(ctx)
+
+	c.Next()
+
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		span.SetAttributes(attribute.Bool("policy.timeout_exceeded", true))
+		routeTimeouts.WithLabelValues(c.Request.Method, c.FullPath()).Inc()
+		if !c.Writer.Written() {
+			c.AbortWithStatusJSON(http.StatusGatewayTimeout, gin.H{"error": "Request timed out"})
+		}
+	}
+}
+
+// Warn about route policies that match no route, which are most likely
+// typos in the path
+func (app *App) checkRoutePolicies(router *gin.Engine) {
+	routes := map[string]bool{}
+	for _, r := range router.Routes() {
+		routes[r.Method+" "+r.Path] = true
+	}
+	for route := range app.routePolicies {
+		if !routes[route] {
+			log.Printf("Route policy %q matches no route", route)
+		}
+	}
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+	"time"
+)
+
+// Create the internal listener. It serves the pprof endpoints on
+// INTERNAL_ADDR (default :6060), a port that is not part of the Kubernetes
+// Service and is only reached with kubectl port-forward. Returns nil when
+// INTERNAL_ADDR is "off". Either way it sets the block and mutex profile
+// rates, which are off by default in Go and also apply to the continuous
+// profiler. The defaults, a blocking event about every 10µs spent blocked
+// and 1 in 100 mutex contention events, are cheap enough to leave on in
+// production.
+func newInternalServer(cfg ProfilingConfig) *http.Server {
+	runtime.SetBlockProfileRate(cfg.BlockProfileRate)
+	runtime.SetMutexProfileFraction(cfg.MutexProfileFraction)
+	log.Printf("Profiling: block profile rate %d ns, mutex profile fraction 1/%d",
+		cfg.BlockProfileRate, cfg.MutexProfileFraction)
+
+	if cfg.InternalAddr == "off" {
+		return nil
+	}
+
+	mux := http.NewServeMux()
+	// Index also serves the named profiles: heap, goroutine, block, mutex,
+	// allocs and threadcreate
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+
+	return &http.Server{
+		Addr:              cfg.InternalAddr,
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+}
@@ -0,0 +1,312 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+var priceChanges = promauto.NewCounter(
+	prometheus.CounterOpts{
+		Name: "inventory_price_changes_total",
+		Help: "Total number of unit price changes made through the API",
+	},
+)
+
+// Price history of the items. Like the change log, it's written by a
+// trigger, so a price set on creation, through the API or by a restore is
+// recorded the same way. Changes take the item's updated_at, so they follow
+// the service's clock.
+const createPriceHistoryQuery = `
+	CREATE TABLE IF NOT EXISTS price_history (
+		id BIGSERIAL PRIMARY KEY,
+		item_id INTEGER NOT NULL REFERENCES inventory (id) ON DELETE CASCADE,
+		unit_price NUMERIC(12, 2) NOT NULL,
+		changed_at TIMESTAMP NOT NULL,
+		trace_id VARCHAR(32) NOT NULL DEFAULT ''
+	);
+	CREATE INDEX IF NOT EXISTS price_history_item ON price_history (item_id, changed_at);
+
+	CREATE OR REPLACE FUNCTION record_price_change() RETURNS trigger AS $$
+	BEGIN
+		IF NEW.unit_price IS NOT NULL AND (TG_OP = 'INSERT' OR NEW.unit_price IS DISTINCT FROM OLD.unit_price) THEN
+			INSERT INTO price_history (item_id, unit_price, changed_at, trace_id)
+			VALUES (NEW.id, NEW.unit_price, NEW.updated_at, NEW.last_trace_id);
+		END IF;
+		RETURN NEW;
+	END;
+	$$ LANGUAGE plpgsql;
+
+	CREATE OR REPLACE TRIGGER price_history
+	AFTER INSERT OR UPDATE OF unit_price ON inventory
+	FOR EACH ROW EXECUTE FUNCTION record_price_change();
+`
+
+// PriceChange is a new unit price of an item, with the request that set it
+type PriceChange struct {
+	UnitPrice float64   `json:"unit_price"`
+	ChangedAt time.Time `json:"changed_at"`
+	TraceID   string    `json:"trace_id,omitempty"`
+}
+
+// PriceStore sets the item prices and reads their history (PostgreSQL)
+type PriceStore interface {
+	// Set the item's unit price, returning the item. Returns sql.ErrNoRows
+	// if there is no such item.
+	SetPrice(ctx context.Context, itemID int, price float64, now time.Time) (InventoryItem, error)
+	// The item's price changes from from until to, in order, after the
+	// last change before from if there is one
+	ListPriceChanges(ctx context.Context, itemID int, from, to time.Time) ([]PriceChange, error)
+}
+
+// postgresPriceStore is the PriceStore on PostgreSQL. The history is read
+// from the replica, if there is one.
+type postgresPriceStore struct {
+	db      func() *sql.DB
+	replica *ReadReplica
+	chaos   *Chaos
+}
+
+func (s *postgresPriceStore) SetPrice(ctx context.Context, itemID int, price float64, now time.Time) (InventoryItem, error) {
+	start := time.Now()
+	defer observeQuery("postgres", "set_price", start)
+	s.chaos.slowPostgres(ctx, s.db())
+
+	traceID, spanID := spanIDs(ctx)
+	var item InventoryItem
+	err := s.db().QueryRowContext(ctx, `
+		UPDATE inventory SET unit_price = $2, updated_at = $3, last_trace_id = $4, last_span_id = $5
+		WHERE id = $1
+		RETURNING id, product_name, sku, quantity, location, created_at, updated_at, unit_price
+	`, itemID, price, now, traceID, spanID).Scan(
+		&item.ID, &item.ProductName, &item.SKU,
+		&item.Quantity, &item.Location, &item.CreatedAt, &item.UpdatedAt, &item.UnitPrice,
+	)
+	return item, err
+}
+
+func (s *postgresPriceStore) ListPriceChanges(ctx context.Context, itemID int, from, to time.Time) ([]PriceChange, error) {
+	query := `
+		(SELECT unit_price, changed_at, trace_id FROM price_history
+		WHERE item_id = $1 AND changed_at < $2
+		ORDER BY changed_at DESC, id DESC
+		LIMIT 1)
+		UNION ALL
+		(SELECT unit_price, changed_at, trace_id FROM price_history
+		WHERE item_id = $1 AND changed_at >= $2 AND changed_at < $3
+		ORDER BY changed_at, id)
+	`
+
+	var changes []PriceChange
+	err := s.replica.Read(ctx, s.db(), func(db *sql.DB) error {
+		start := time.Now()
+		s.chaos.slowPostgres(ctx, db)
+		rows, err := db.QueryContext(ctx, query, itemID, from, to)
+		observeQuery("postgres", "list_price_changes", start)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		changes = nil
+		for rows.Next() {
+			var change PriceChange
+			if err := rows.Scan(&change.UnitPrice, &change.ChangedAt, &change.TraceID); err != nil {
+				return err
+			}
+			changes = append(changes, change)
+		}
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		explainQuery(ctx, db, "list_price_changes", query, itemID, from, to)
+		return nil
+	})
+	return changes, err
+}
+
+// SetPriceRequest changes an item's unit price
+type SetPriceRequest struct {
+	UnitPrice *float64 `json:"unit_price" binding:"required,gte=0"`
+}
+
+// Set an item's unit price (PostgreSQL)
+func (app *App) setPrice(c *gin.Context) {
+	ctx := c.Request.Context()
+	ctx, span := app.tracer.Start(ctx, "setPrice")
+	defer span.End()
+
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Item not found"})
+		return
+	}
+	var req SetPriceRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	span.SetAttributes(attribute.Int("item.id", id), attribute.Float64("item.unit_price", *req.UnitPrice))
+
+	item, err := app.prices.SetPrice(ctx, id, *req.UnitPrice, app.clock.Now())
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Item not found"})
+		return
+	}
+	if err != nil {
+		logWithTrace(ctx, "ERROR", "Error setting item price", "item_id", id, "error", err.Error())
+		span.RecordError(err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to set the price"})
+		return
+	}
+	priceChanges.Inc()
+	app.publishEvent(ctx, eventItemPriceChanged, "item", item.ID,
+		fmt.Sprintf("Set the price of %s to %.2f", item.SKU, *req.UnitPrice),
+		map[string]interface{}{"sku": item.SKU, "unit_price": *req.UnitPrice})
+	requestsTotal.WithLabelValues("PUT", "/api/inventory/:id/price", "200").Inc()
+	logWithTrace(ctx, "INFO", "Item price set", "item_id", id, "unit_price", *req.UnitPrice)
+
+	c.JSON(http.StatusOK, item)
+}
+
+// PriceBucket sums up an item's price over one bucket of time. Open is the
+// price in effect at Start, Close the one at the end.
+type PriceBucket struct {
+	Start   time.Time `json:"start"`
+	Open    float64   `json:"open"`
+	Close   float64   `json:"close"`
+	Min     float64   `json:"min"`
+	Max     float64   `json:"max"`
+	Changes int       `json:"changes"`
+}
+
+// PriceHistory is an item's price over time, in buckets of Bucket
+type PriceHistory struct {
+	ItemID  int           `json:"item_id"`
+	From    time.Time     `json:"from"`
+	To      time.Time     `json:"to"`
+	Bucket  string        `json:"bucket"`
+	Buckets []PriceBucket `json:"buckets"`
+}
+
+const (
+	defaultPriceHistoryRange = 24 * time.Hour
+	maxPriceHistoryBuckets   = 1000
+)
+
+// Get an item's price history in buckets: ?from=&to= (RFC 3339, the last
+// 24 hours by default) and ?bucket= (a duration, 1h by default)
+func (app *App) getPriceHistory(c *gin.Context) {
+	ctx := c.Request.Context()
+	ctx, span := app.tracer.Start(ctx, "getPriceHistory")
+	defer span.End()
+
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Item not found"})
+		return
+	}
+
+	bucket, err := time.ParseDuration(c.DefaultQuery("bucket", "1h"))
+	if err != nil || bucket < time.Second {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "bucket must be a duration of at least 1s, e.g. 15m"})
+		return
+	}
+	to := app.clock.Now()
+	if s := c.Query("to"); s != "" {
+		if to, err = time.Parse(time.RFC3339Nano, s); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "to must be an RFC 3339 timestamp"})
+			return
+		}
+	}
+	from := to.Add(-defaultPriceHistoryRange)
+	if s := c.Query("from"); s != "" {
+		if from, err = time.Parse(time.RFC3339Nano, s); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "from must be an RFC 3339 timestamp"})
+			return
+		}
+	}
+	// Buckets start on multiples of their size, e.g. on the hour
+	from, to = from.UTC().Truncate(bucket), to.UTC()
+	if !from.Before(to) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "from must be before to"})
+		return
+	}
+	if n := to.Sub(from) / bucket; n >= maxPriceHistoryBuckets {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("at most %d buckets, use a larger bucket or a shorter range", maxPriceHistoryBuckets)})
+		return
+	}
+	span.SetAttributes(
+		attribute.Int("item.id", id),
+		attribute.String("price_history.from", from.Format(time.RFC3339)),
+		attribute.String("price_history.to", to.Format(time.RFC3339)),
+		attribute.String("price_history.bucket", bucket.String()),
+	)
+
+	if _, err := app.itemStore.FindItem(ctx, "id", id); err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Item not found"})
+		return
+	} else if err != nil {
+		logWithTrace(ctx, "ERROR", "Error fetching inventory item", "item_id", id, "error", err.Error())
+		span.RecordError(err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch item"})
+		return
+	}
+	changes, err := app.prices.ListPriceChanges(ctx, id, from, to)
+	if err != nil {
+		logWithTrace(ctx, "ERROR", "Error listing price changes", "item_id", id, "error", err.Error())
+		span.RecordError(err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch the price history"})
+		return
+	}
+	span.SetAttributes(attribute.Int("price_history.changes", len(changes)))
+
+	requestsTotal.WithLabelValues("GET", "/api/inventory/:id/price-history", "200").Inc()
+	app.renderJSON(c, http.StatusOK, PriceHistory{
+		ItemID:  id,
+		From:    from,
+		To:      to,
+		Bucket:  bucket.String(),
+		Buckets: bucketPrices(changes, from, to, bucket),
+	})
+}
+
+// Sum up the price changes, in order, into buckets from from until to.
+// Buckets before the first known price are left out.
+func bucketPrices(changes []PriceChange, from, to time.Time, bucket time.Duration) []PriceBucket {
+	buckets := []PriceBucket{}
+	var price float64
+	known := false
+	i := 0
+	for start := from; start.Before(to); start = start.Add(bucket) {
+		end := start.Add(bucket)
+		for ; i < len(changes) && changes[i].ChangedAt.Before(start); i++ {
+			price, known = changes[i].UnitPrice, true
+		}
+
+		b := PriceBucket{Start: start, Open: price, Min: price, Max: price}
+		for ; i < len(changes) && changes[i].ChangedAt.Before(end); i++ {
+			price = changes[i].UnitPrice
+			if !known {
+				b.Open, b.Min, b.Max = price, price, price
+				known = true
+			}
+			b.Min, b.Max = min(b.Min, price), max(b.Max, price)
+			b.Changes++
+		}
+		if !known {
+			continue
+		}
+		b.Close = price
+		buckets = append(buckets, b)
+	}
+	return buckets
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// fakePriceStore keeps the price changes in memory, as the trigger would
+type fakePriceStore struct {
+	items   map[int]*InventoryItem
+	changes map[int][]PriceChange
+}
+
+func (s *fakePriceStore) SetPrice(ctx context.Context, itemID int, price float64, now time.Time) (InventoryItem, error) {
+	item, ok := s.items[itemID]
+	if !ok {
+		return InventoryItem{}, sql.ErrNoRows
+	}
+	if item.UnitPrice == nil || *item.UnitPrice != price {
+		s.changes[itemID] = append(s.changes[itemID], PriceChange{UnitPrice: price, ChangedAt: now})
+	}
+	item.UnitPrice, item.UpdatedAt = &price, now
+	return *item, nil
+}
+
+func (s *fakePriceStore) ListPriceChanges(ctx context.Context, itemID int, from, to time.Time) ([]PriceChange, error) {
+	var before, changes []PriceChange
+	for _, change := range s.changes[itemID] {
+		if change.ChangedAt.Before(from) {
+			before = []PriceChange{change}
+		} else if change.ChangedAt.Before(to) {
+			changes = append(changes, change)
+		}
+	}
+	return append(before, changes...), nil
+}
+
+func TestBucketPrices(t *testing.T) {
+	t0 := time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)
+	at := func(d time.Duration, price float64) PriceChange {
+		return PriceChange{UnitPrice: price, ChangedAt: t0.Add(d)}
+	}
+
+	for _, tc := range []struct {
+		name    string
+		changes []PriceChange
+		want    []PriceBucket
+	}{
+		{"no price", nil, []PriceBucket{}},
+		{
+			"price set before the range",
+			[]PriceChange{at(-time.Hour, 5)},
+			[]PriceBucket{
+				{Start: t0, Open: 5, Close: 5, Min: 5, Max: 5},
+				{Start: t0.Add(time.Hour), Open: 5, Close: 5, Min: 5, Max: 5},
+				{Start: t0.Add(2 * time.Hour), Open: 5, Close: 5, Min: 5, Max: 5},
+			},
+		},
+		{
+			"first price within the range",
+			[]PriceChange{at(70*time.Minute, 4), at(80*time.Minute, 9), at(90*time.Minute, 6)},
+			[]PriceBucket{
+				{Start: t0.Add(time.Hour), Open: 4, Close: 6, Min: 4, Max: 9, Changes: 3},
+				{Start: t0.Add(2 * time.Hour), Open: 6, Close: 6, Min: 6, Max: 6},
+			},
+		},
+		{
+			"changes carry over",
+			[]PriceChange{at(-time.Minute, 5), at(0, 3), at(2*time.Hour+time.Minute, 7)},
+			[]PriceBucket{
+				{Start: t0, Open: 5, Close: 3, Min: 3, Max: 5, Changes: 1},
+				{Start: t0.Add(time.Hour), Open: 3, Close: 3, Min: 3, Max: 3},
+				{Start: t0.Add(2 * time.Hour), Open: 3, Close: 7, Min: 3, Max: 7, Changes: 1},
+			},
+		},
+	} {
+		got := bucketPrices(tc.changes, t0, t0.Add(3*time.Hour), time.Hour)
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: got %+v, want %+v", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestPriceHistory(t *testing.T) {
+	clock := &fixedClock{now: time.Date(2024, 5, 1, 9, 30, 0, 0, time.UTC)}
+	items := &fakeItemStore{items: []InventoryItem{{ID: 1, SKU: "W-1"}}}
+	app := newFakeApp(t, items, &fakeStockStore{}, clock)
+	app.json = jsonEncoders["std"]
+	app.prices = &fakePriceStore{
+		items:   map[int]*InventoryItem{1: {ID: 1, SKU: "W-1"}},
+		changes: map[int][]PriceChange{},
+	}
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.PUT("/api/inventory/:id/price", app.setPrice)
+	router.GET("/api/inventory/:id/price-history", app.getPriceHistory)
+
+	setPrice := func(id, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPut, "/api/inventory/"+id+"/price", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		return rec
+	}
+	for _, tc := range []struct {
+		name, id, body string
+		want           int
+	}{
+		{"negative price", "1", `{"unit_price": -1}`, http.StatusBadRequest},
+		{"no price", "1", `{}`, http.StatusBadRequest},
+		{"missing item", "2", `{"unit_price": 1}`, http.StatusNotFound},
+	} {
+		if rec := setPrice(tc.id, tc.body); rec.Code != tc.want {
+			t.Errorf("%s: got status %d, want %d: %s", tc.name, rec.Code, tc.want, rec.Body.String())
+		}
+	}
+
+	if rec := setPrice("1", `{"unit_price": 0}`); rec.Code != http.StatusOK {
+		t.Fatalf("got status %d: %s", rec.Code, rec.Body.String())
+	}
+	clock.now = clock.now.Add(time.Hour)
+	rec := setPrice("1", `{"unit_price": 12.5}`)
+	var item InventoryItem
+	json.Unmarshal(rec.Body.Bytes(), &item)
+	if item.UnitPrice == nil || *item.UnitPrice != 12.5 {
+		t.Errorf("got unit price %v, want 12.5", item.UnitPrice)
+	}
+
+	get := func(query string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/inventory/1/price-history"+query, nil))
+		return rec
+	}
+	rec = get("?bucket=30m&from=2024-05-01T09:00:00Z&to=2024-05-01T11:00:00Z")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got status %d: %s", rec.Code, rec.Body.String())
+	}
+	var history PriceHistory
+	json.Unmarshal(rec.Body.Bytes(), &history)
+	// Nothing before the first price, at 09:30
+	want := []PriceBucket{
+		{Start: clock.now.Add(-time.Hour), Open: 0, Close: 0, Min: 0, Max: 0, Changes: 1},
+		{Start: clock.now.Add(-30 * time.Minute), Open: 0, Close: 0, Min: 0, Max: 0},
+		{Start: clock.now, Open: 0, Close: 12.5, Min: 0, Max: 12.5, Changes: 1},
+	}
+	if history.Bucket != "30m0s" || !reflect.DeepEqual(history.Buckets, want) {
+		t.Errorf("got %s buckets %+v, want %+v", history.Bucket, history.Buckets, want)
+	}
+
+	for _, tc := range []struct {
+		name, query string
+		want        int
+	}{
+		{"bad bucket", "?bucket=soon", http.StatusBadRequest},
+		{"bad from", "?from=yesterday", http.StatusBadRequest},
+		{"from after to", "?from=2024-05-02T00:00:00Z", http.StatusBadRequest},
+		{"too many buckets", "?bucket=1m&from=2024-04-01T00:00:00Z", http.StatusBadRequest},
+	} {
+		if rec := get(tc.query); rec.Code != tc.want {
+			t.Errorf("%s: got status %d, want %d: %s", tc.name, rec.Code, tc.want, rec.Body.String())
+		}
+	}
+
+	rec = httptest.NewRecorder()
+	router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/inventory/2/price-history", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("missing item: got status %d, want 404", rec.Code)
+	}
+}
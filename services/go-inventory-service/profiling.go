@@ -0,0 +1,54 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/grafana/pyroscope-go"
+)
+
+// Start pushing profiles to Pyroscope if PYROSCOPE_SERVER_ADDRESS is set.
+// Profiles are labeled with the same service name and version as the trace
+// resource, and the tracer provider wrapped by otelpyroscope adds the span
+// ID to CPU samples, so Grafana can jump from a span to its flame graph.
+// Returns nil when continuous profiling is off.
+func startProfiler(cfg ProfilingConfig, serviceName string) (*pyroscope.Profiler, error) {
+	if cfg.PyroscopeAddr == "" {
+		return nil, nil
+	}
+
+	hostname, _ := os.Hostname()
+	profiler, err := pyroscope.Start(pyroscope.Config{
+		ApplicationName:   serviceName,
+		ServerAddress:     cfg.PyroscopeAddr,
+		BasicAuthUser:     cfg.PyroscopeUser,
+		BasicAuthPassword: cfg.PyroscopePassword,
+		TenantID:          cfg.PyroscopeTenantID,
+		UploadRate:        cfg.PyroscopeUploadRate,
+		Tags: map[string]string{
+			"service_version": currentBuild.Version,
+			"git_sha":         currentBuild.GitSHA,
+			"pod":             hostname,
+		},
+		// Block and mutex profiles use the rates set for pprof
+		ProfileTypes: []pyroscope.ProfileType{
+			pyroscope.ProfileCPU,
+			pyroscope.ProfileAllocObjects,
+			pyroscope.ProfileAllocSpace,
+			pyroscope.ProfileInuseObjects,
+			pyroscope.ProfileInuseSpace,
+			pyroscope.ProfileGoroutines,
+			pyroscope.ProfileBlockCount,
+			pyroscope.ProfileBlockDuration,
+			pyroscope.ProfileMutexCount,
+			pyroscope.ProfileMutexDuration,
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to start profiler: %w", err)
+	}
+
+	log.Printf("Continuous profiling: pushing to %s every %s", cfg.PyroscopeAddr, cfg.PyroscopeUploadRate)
+	return profiler, nil
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"math"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+var responseBytes = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "http_response_bytes_by_format_total",
+		Help: "Bytes of the read responses that can be JSON or protobuf, by endpoint and format",
+	},
+	[]string{"endpoint", "format"},
+)
+
+// Response formats of the read endpoints
+const (
+	formatJSON     = "json"
+	formatProtobuf = "protobuf"
+)
+
+// The format the client asked for: protobuf if Accept names
+// application/x-protobuf ahead of JSON, JSON otherwise
+func responseFormat(c *gin.Context) string {
+	if c.NegotiateFormat(binding.MIMEJSON, binding.MIMEPROTOBUF) == binding.MIMEPROTOBUF {
+		return formatProtobuf
+	}
+	return formatJSON
+}
+
+// protoMessage is a response with a protobuf encoding, the message of
+// proto/inventory/v1/inventory.proto it's named after
+type protoMessage interface {
+	appendProto(b []byte) []byte
+}
+
+// Write a read response as protobuf if the client accepts it, as JSON with
+// the configured encoder otherwise
+func (app *App) render(c *gin.Context, status int, v protoMessage) {
+	// The response depends on Accept, for caches on the way
+	c.Header("Vary", "Accept")
+	format := responseFormat(c)
+	trace.SpanFromContext(c.Request.Context()).SetAttributes(attribute.String("http.response_format", format))
+	if format == formatJSON {
+		app.renderJSON(c, status, v)
+		responseBytes.WithLabelValues(c.FullPath(), format).Add(float64(c.Writer.Size()))
+		return
+	}
+	data := v.appendProto(nil)
+	responseBytes.WithLabelValues(c.FullPath(), format).Add(float64(len(data)))
+	c.Data(status, binding.MIMEPROTOBUF, data)
+}
+
+// Proto3 leaves out fields with their zero value
+
+func appendProtoInt(b []byte, num protowire.Number, v int64) []byte {
+	if v == 0 {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.VarintType)
+	return protowire.AppendVarint(b, uint64(v))
+}
+
+func appendProtoBool(b []byte, num protowire.Number, v bool) []byte {
+	if !v {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.VarintType)
+	return protowire.AppendVarint(b, 1)
+}
+
+func appendProtoString(b []byte, num protowire.Number, v string) []byte {
+	if v == "" {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendString(b, v)
+}
+
+// An optional field is written when set, even to zero
+func appendProtoOptionalDouble(b []byte, num protowire.Number, v *float64) []byte {
+	if v == nil {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.Fixed64Type)
+	return protowire.AppendFixed64(b, math.Float64bits(*v))
+}
+
+// A google.protobuf.Timestamp; the zero time is left out
+func appendProtoTime(b []byte, num protowire.Number, t time.Time) []byte {
+	if t.IsZero() {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return appendProtoLengthPrefixed(b, func(b []byte) []byte {
+		b = appendProtoInt(b, 1, t.Unix())
+		return appendProtoInt(b, 2, int64(t.Nanosecond()))
+	})
+}
+
+// An embedded message, for repeated fields: written even when empty
+func appendProtoMessage(b []byte, num protowire.Number, m protoMessage) []byte {
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return appendProtoLengthPrefixed(b, m.appendProto)
+}
+
+// Append what appendBody appends, prefixed with its length. The body is
+// written in place and moved along for the prefix, rather than built in a
+// buffer of its own, which saves an allocation per message.
+func appendProtoLengthPrefixed(b []byte, appendBody func([]byte) []byte) []byte {
+	start := len(b)
+	b = appendBody(b)
+	n := len(b) - start
+	prefix := protowire.SizeVarint(uint64(n))
+	for i := 0; i < prefix; i++ {
+		b = append(b, 0)
+	}
+	copy(b[start+prefix:], b[start:start+n])
+	protowire.AppendVarint(b[:start], uint64(n))
+	return b
+}
+
+// inventory.v1.Item
+func (item InventoryItem) appendProto(b []byte) []byte {
+	b = appendProtoInt(b, 1, int64(item.ID))
+	b = appendProtoString(b, 2, item.ProductName)
+	b = appendProtoString(b, 3, item.SKU)
+	b = appendProtoInt(b, 4, int64(item.Quantity))
+	b = appendProtoString(b, 5, item.Location)
+	b = appendProtoTime(b, 6, item.CreatedAt)
+	b = appendProtoTime(b, 7, item.UpdatedAt)
+	return appendProtoOptionalDouble(b, 8, item.UnitPrice)
+}
+
+// itemList is inventory.v1.ItemList, and a plain array in JSON
+type itemList []InventoryItem
+
+func (l itemList) appendProto(b []byte) []byte {
+	for _, item := range l {
+		b = appendProtoMessage(b, 1, item)
+	}
+	return b
+}
+
+// inventory.v1.ItemPage
+func (p ItemPage) appendProto(b []byte) []byte {
+	for _, item := range p.Items {
+		b = appendProtoMessage(b, 1, item)
+	}
+	b = appendProtoInt(b, 2, int64(p.Skip))
+	b = appendProtoInt(b, 3, int64(p.Limit))
+	b = appendProtoInt(b, 4, p.Total)
+	return appendProtoBool(b, 5, p.TotalExact)
+}
+
+// inventory.v1.StockLevel
+func (level StockLevel) appendProto(b []byte) []byte {
+	if !level.ID.IsZero() {
+		b = appendProtoString(b, 1, level.ID.Hex())
+	}
+	b = appendProtoString(b, 2, level.ProductSKU)
+	b = appendProtoString(b, 3, level.Warehouse)
+	b = appendProtoInt(b, 4, int64(level.Available))
+	b = appendProtoInt(b, 5, int64(level.Reserved))
+	return appendProtoTime(b, 6, level.UpdatedAt)
+}
+
+// stockLevelList is inventory.v1.StockLevelList, and a plain array in JSON
+type stockLevelList []StockLevel
+
+func (l stockLevelList) appendProto(b []byte) []byte {
+	for _, level := range l {
+		b = appendProtoMessage(b, 1, level)
+	}
+	return b
+}
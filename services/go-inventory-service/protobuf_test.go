@@ -0,0 +1,239 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+	_ "google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// The messages of proto/inventory/v1/inventory.proto, to decode the
+// responses with the protobuf library rather than the encoder under test
+func inventoryProtoFile(t *testing.T) protoreflect.FileDescriptor {
+	t.Helper()
+	field := func(name string, num int32, typ descriptorpb.FieldDescriptorProto_Type, typeName string) *descriptorpb.FieldDescriptorProto {
+		f := &descriptorpb.FieldDescriptorProto{
+			Name:     proto.String(name),
+			JsonName: proto.String(name),
+			Number:   proto.Int32(num),
+			Type:     typ.Enum(),
+			Label:    descriptorpb.FieldDescriptorProto_LABEL_OPTIONAL.Enum(),
+		}
+		if typeName != "" {
+			f.TypeName = proto.String(typeName)
+		}
+		return f
+	}
+	repeated := func(f *descriptorpb.FieldDescriptorProto) *descriptorpb.FieldDescriptorProto {
+		f.Label = descriptorpb.FieldDescriptorProto_LABEL_REPEATED.Enum()
+		return f
+	}
+	const (
+		i64    = descriptorpb.FieldDescriptorProto_TYPE_INT64
+		str    = descriptorpb.FieldDescriptorProto_TYPE_STRING
+		double = descriptorpb.FieldDescriptorProto_TYPE_DOUBLE
+		boolT  = descriptorpb.FieldDescriptorProto_TYPE_BOOL
+		msg    = descriptorpb.FieldDescriptorProto_TYPE_MESSAGE
+	)
+	unitPrice := field("unit_price", 8, double, "")
+	unitPrice.Proto3Optional, unitPrice.OneofIndex = proto.Bool(true), proto.Int32(0)
+
+	fd, err := protodesc.NewFile(&descriptorpb.FileDescriptorProto{
+		Name:       proto.String("inventory/v1/inventory.proto"),
+		Package:    proto.String("inventory.v1"),
+		Syntax:     proto.String("proto3"),
+		Dependency: []string{"google/protobuf/timestamp.proto"},
+		MessageType: []*descriptorpb.DescriptorProto{
+			{
+				Name: proto.String("Item"),
+				Field: []*descriptorpb.FieldDescriptorProto{
+					field("id", 1, i64, ""), field("product_name", 2, str, ""), field("sku", 3, str, ""),
+					field("quantity", 4, i64, ""), field("location", 5, str, ""),
+					field("created_at", 6, msg, ".google.protobuf.Timestamp"),
+					field("updated_at", 7, msg, ".google.protobuf.Timestamp"),
+					unitPrice,
+				},
+				OneofDecl: []*descriptorpb.OneofDescriptorProto{{Name: proto.String("_unit_price")}},
+			},
+			{
+				Name:  proto.String("ItemList"),
+				Field: []*descriptorpb.FieldDescriptorProto{repeated(field("items", 1, msg, ".inventory.v1.Item"))},
+			},
+			{
+				Name: proto.String("ItemPage"),
+				Field: []*descriptorpb.FieldDescriptorProto{
+					repeated(field("items", 1, msg, ".inventory.v1.Item")),
+					field("skip", 2, i64, ""), field("limit", 3, i64, ""), field("total", 4, i64, ""),
+					field("total_exact", 5, boolT, ""),
+				},
+			},
+			{
+				Name: proto.String("StockLevel"),
+				Field: []*descriptorpb.FieldDescriptorProto{
+					field("id", 1, str, ""), field("product_sku", 2, str, ""), field("warehouse", 3, str, ""),
+					field("available", 4, i64, ""), field("reserved", 5, i64, ""),
+					field("updated_at", 6, msg, ".google.protobuf.Timestamp"),
+				},
+			},
+			{
+				Name: proto.String("StockLevelList"),
+				Field: []*descriptorpb.FieldDescriptorProto{
+					repeated(field("stock_levels", 1, msg, ".inventory.v1.StockLevel")),
+				},
+			},
+		},
+	}, protoregistry.GlobalFiles)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fd
+}
+
+func decodeProto(t *testing.T, fd protoreflect.FileDescriptor, name string, data []byte) *dynamicpb.Message {
+	t.Helper()
+	m := dynamicpb.NewMessage(fd.Messages().ByName(protoreflect.Name(name)))
+	if err := proto.Unmarshal(data, m); err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func TestProtobufEncoding(t *testing.T) {
+	fd := inventoryProtoFile(t)
+	created := time.Date(2024, 6, 1, 9, 30, 0, 500, time.UTC)
+	price := 0.0
+
+	page := ItemPage{
+		Items: []InventoryItem{
+			{ID: 7, ProductName: "Widget", SKU: "W-7", Quantity: 3, Location: "Warehouse A", CreatedAt: created, UpdatedAt: created, UnitPrice: &price},
+			// An item without a quantity is still in the list
+			{ID: 8, SKU: "W-8"},
+		},
+		Limit: 100, Total: 2, TotalExact: true,
+	}
+	m := decodeProto(t, fd, "ItemPage", page.appendProto(nil))
+	items := m.Get(m.Descriptor().Fields().ByName("items")).List()
+	if items.Len() != 2 || m.Get(m.Descriptor().Fields().ByName("total")).Int() != 2 ||
+		!m.Get(m.Descriptor().Fields().ByName("total_exact")).Bool() {
+		t.Fatalf("got page %v", m)
+	}
+
+	item := items.Get(0).Message()
+	get := func(name string) protoreflect.Value {
+		return item.Get(item.Descriptor().Fields().ByName(protoreflect.Name(name)))
+	}
+	if get("id").Int() != 7 || get("sku").String() != "W-7" || get("quantity").Int() != 3 || get("location").String() != "Warehouse A" {
+		t.Errorf("got item %v", item)
+	}
+	ts := get("created_at").Message()
+	if ts.Get(ts.Descriptor().Fields().ByName("seconds")).Int() != created.Unix() ||
+		ts.Get(ts.Descriptor().Fields().ByName("nanos")).Int() != 500 {
+		t.Errorf("got created_at %v", ts)
+	}
+	// A price of 0 is set, unlike no price
+	if !item.Has(item.Descriptor().Fields().ByName("unit_price")) {
+		t.Error("unit_price of 0 not set")
+	}
+	other := items.Get(1).Message()
+	if other.Has(other.Descriptor().Fields().ByName("unit_price")) || other.Has(other.Descriptor().Fields().ByName("created_at")) {
+		t.Errorf("unset fields written: %v", other)
+	}
+
+	id := primitive.NewObjectID()
+	levels := stockLevelList{{ID: id, ProductSKU: "W-7", Warehouse: "Warehouse A", Available: 3, Reserved: 1, UpdatedAt: created}}
+	m = decodeProto(t, fd, "StockLevelList", levels.appendProto(nil))
+	level := m.Get(m.Descriptor().Fields().ByName("stock_levels")).List().Get(0).Message()
+	if level.Get(level.Descriptor().Fields().ByName("id")).String() != id.Hex() ||
+		level.Get(level.Descriptor().Fields().ByName("reserved")).Int() != 1 {
+		t.Errorf("got stock level %v", level)
+	}
+}
+
+func TestProtobufNegotiation(t *testing.T) {
+	fd := inventoryProtoFile(t)
+	items := &fakeItemStore{}
+	items.CreateItem(context.Background(), &InventoryItem{ProductName: "Widget", SKU: "W-1", Quantity: 3})
+	app := newFakeApp(t, items, &fakeStockStore{}, systemClock{})
+	app.responses = &ResponseCache{store: newMemoryResponseStore(10, app.clock), ttl: time.Minute}
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.GET("/api/inventory", app.responses.Middleware(cacheGroupItems), app.listItems)
+	router.GET("/api/inventory/sku/:sku", app.getItemBySKU)
+	get := func(path, accept string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		if accept != "" {
+			req.Header.Set("Accept", accept)
+		}
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		return rec
+	}
+
+	for _, accept := range []string{"application/x-protobuf", "application/x-protobuf, application/json;q=0.5"} {
+		rec := get("/api/inventory/sku/W-1", accept)
+		if rec.Header().Get("Content-Type") != "application/x-protobuf" || rec.Header().Get("Vary") != "Accept" {
+			t.Fatalf("%s: got headers %v", accept, rec.Header())
+		}
+		m := decodeProto(t, fd, "Item", rec.Body.Bytes())
+		if m.Get(m.Descriptor().Fields().ByName("sku")).String() != "W-1" {
+			t.Errorf("%s: got item %v", accept, m)
+		}
+	}
+	for _, accept := range []string{"", "*/*", "application/json", "application/json, application/x-protobuf"} {
+		var item InventoryItem
+		rec := get("/api/inventory/sku/W-1", accept)
+		if err := json.Unmarshal(rec.Body.Bytes(), &item); err != nil || item.SKU != "W-1" {
+			t.Errorf("%q: got %s, want JSON", accept, rec.Body.String())
+		}
+	}
+
+	// The response cache keeps the formats apart
+	if rec := get("/api/inventory", "application/x-protobuf"); rec.Header().Get("X-Cache") != "MISS" {
+		t.Fatalf("got X-Cache %q, want MISS", rec.Header().Get("X-Cache"))
+	}
+	rec := get("/api/inventory", "application/json")
+	var list []InventoryItem
+	if rec.Header().Get("X-Cache") != "MISS" || json.Unmarshal(rec.Body.Bytes(), &list) != nil || len(list) != 1 {
+		t.Errorf("JSON after protobuf: got X-Cache %q, body %q", rec.Header().Get("X-Cache"), rec.Body.String())
+	}
+	rec = get("/api/inventory", "application/x-protobuf")
+	m := decodeProto(t, fd, "ItemList", rec.Body.Bytes())
+	if rec.Header().Get("X-Cache") != "HIT" || rec.Header().Get("Content-Type") != "application/x-protobuf" ||
+		m.Get(m.Descriptor().Fields().ByName("items")).List().Len() != 1 {
+		t.Errorf("cached protobuf: got headers %v", rec.Header())
+	}
+}
+
+// Protobuf against the JSON encoders, on the same payloads:
+//
+//	go test -run '^$' -bench 'JSONEncoders|Protobuf' -benchmem
+func BenchmarkProtobuf(b *testing.B) {
+	payloads := benchmarkPayloads()
+	for name, msg := range map[string]protoMessage{
+		"items":        itemList(payloads["items"].([]InventoryItem)),
+		"stock_levels": stockLevelList(payloads["stock_levels"].([]StockLevel)),
+	} {
+		b.Run(name, func(b *testing.B) {
+			b.SetBytes(int64(len(msg.appendProto(nil))))
+			b.ReportAllocs()
+			b.ResetTimer()
+
+			for i := 0; i < b.N; i++ {
+				msg.appendProto(nil)
+			}
+		})
+	}
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	roleWriter = "writer"
+	roleAdmin  = "admin"
+)
+
+var (
+	authzDecisions = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "authz_decisions_total",
+			Help: "Total number of authorization decisions by required role and decision",
+		},
+		[]string{"role", "decision"},
+	)
+
+	authzDenied = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "authz_denied_total",
+			Help: "Total number of requests rejected with 403 by caller and endpoint",
+		},
+		[]string{"caller", "method", "endpoint"},
+	)
+)
+
+// Roles from a JWT claim. The path (AUTH_ROLES_CLAIM) names the claim, with
+// dots for nested claims (e.g. realm_access.roles for Keycloak). The claim
+// may be a list of strings or a space separated string.
+func rolesFromClaims(claims map[string]interface{}, path string) []string {
+	var value interface{} = claims
+	for _, part := range strings.Split(path, ".") {
+		m, ok := value.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		value = m[part]
+	}
+
+	switch v := value.(type) {
+	case string:
+		return strings.Fields(v)
+	case []interface{}:
+		roles := make([]string, 0, len(v))
+		for _, r := range v {
+			if s, ok := r.(string); ok {
+				roles = append(roles, s)
+			}
+		}
+		return roles
+	}
+	return nil
+}
+
+// Parse API_KEY_ROLES, which assigns roles to API key clients:
+//
+//	API_KEY_ROLES=order-service=writer,demo-operator=writer|admin
+func parseAPIKeyRoles(s string) (map[string][]string, error) {
+	roles := map[string][]string{}
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		client, list, ok := strings.Cut(entry, "=")
+		if !ok || client == "" || list == "" {
+			return nil, fmt.Errorf("invalid API_KEY_ROLES entry %q", entry)
+		}
+		roles[client] = strings.Split(list, "|")
+	}
+	return roles, nil
+}
+
+// HasRole reports whether the principal has the role. Admins have every role.
+func (p *Principal) HasRole(role string) bool {
+	for _, r := range p.Roles {
+		if r == role || r == roleAdmin {
+			return true
+		}
+	}
+	return false
+}
+
+// Authorization middleware for the /api routes: reads are open to every
+// authenticated caller, writes need the writer role
+func (app *App) authorizeWrites(c *gin.Context) {
+	switch c.Request.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		c.Next()
+	default:
+		app.requireRole(roleWriter)(c)
+	}
+}
+
+// Middleware that only lets callers with the role through. Without any
+// authentication configured there is nobody to authorize, so everything
+// is allowed.
+func (app *App) requireRole(role string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if app.jwt == nil && app.apiKeys == nil {
+			c.Next()
+			return
+		}
+
+		ctx := c.Request.Context()
+		// authenticate has already rejected requests without a principal
+		principal, _ := principalFromContext(ctx)
+		allowed := principal != nil && principal.HasRole(role)
+
+		decision := "allow"
+		if !allowed {
+			decision = "deny"
+		}
+		authzDecisions.WithLabelValues(role, decision).Inc()
+
+		attrs := []attribute.KeyValue{
+			attribute.String("authz.required_role", role),
+			attribute.String("authz.decision", decision),
+		}
+		if principal != nil {
+			attrs = append(attrs, attribute.StringSlice("authz.roles", principal.Roles))
+		}
+		trace.SpanFromContext(ctx).AddEvent("authz.decision", trace.WithAttributes(attrs...))
+
+		if allowed {
+			c.Next()
+			return
+		}
+
+		caller := "anonymous"
+		if principal != nil {
+			caller = principal.Caller
+		}
+		authzDenied.WithLabelValues(caller, c.Request.Method, c.FullPath()).Inc()
+		recordSecurityEvent(c, securityEventForbidden, caller, http.StatusForbidden, "required_role", role)
+
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "Forbidden"})
+	}
+}
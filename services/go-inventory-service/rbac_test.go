@@ -0,0 +1,52 @@
+package main
+
+import (
+	"crypto/sha256"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/contrib/instrumentation/github.com/gin-gonic/gin/otelgin"
+	"go.opentelemetry.io/otel/attribute"
+
+	"inventory-service/internal/testkit"
+)
+
+func TestRequireRoleDenied(t *testing.T) {
+	tr := testkit.InstallTracing(t)
+
+	app := &App{
+		tracer: tr.Tracer("test"),
+		apiKeys: &APIKeyStore{
+			identities: map[[sha256.Size]byte]string{sha256.Sum256([]byte("reader-key")): "reader"},
+			roles:      map[string][]string{},
+		},
+	}
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.Use(otelgin.Middleware("test"))
+	router.GET("/admin/gc", app.authenticate, app.requireRole(roleAdmin), func(c *gin.Context) {
+		c.Status(http.StatusOK)
+	})
+
+	req := httptest.NewRequest(http.MethodGet, "/admin/gc", nil)
+	req.Header.Set("X-API-Key", "reader-key")
+	rec := httptest.NewRecorder()
+
+	testkit.AssertCounterDelta(t, authzDenied.WithLabelValues("reader", http.MethodGet, "/admin/gc"), 1, func() {
+		testkit.AssertCounterDelta(t, securityEventsTotal.WithLabelValues(securityEventForbidden, "reader"), 1, func() {
+			router.ServeHTTP(rec, req)
+		})
+	})
+	if rec.Code != http.StatusForbidden {
+		t.Fatalf("got status %d, want 403", rec.Code)
+	}
+
+	span := tr.AssertSpan(t, "/admin/gc", attribute.String("auth.caller", "reader"))
+	testkit.AssertSpanEvent(t, span, "authz.decision",
+		attribute.String("authz.required_role", roleAdmin),
+		attribute.String("authz.decision", "deny"),
+	)
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var (
+	replicaLag = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "postgres_replica_lag_seconds",
+			Help: "How far the PostgreSQL read replica is behind the primary, as of the last check",
+		},
+	)
+
+	replicaUp = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "postgres_replica_up",
+			Help: "1 while the PostgreSQL read replica takes reads, 0 while they go to the primary",
+		},
+	)
+
+	replicaReads = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "postgres_reads_total",
+			Help: "Total number of read-only PostgreSQL queries by the server that answered them (replica or primary)",
+		},
+		[]string{"target"},
+	)
+
+	replicaFallbacks = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "postgres_replica_fallbacks_total",
+			Help: "Total number of reads sent to the primary instead of the replica, by reason (unavailable, lag or error)",
+		},
+		[]string{"reason"},
+	)
+)
+
+var errReplicaUnavailable = errors.New("chaos: postgres replica is unavailable")
+
+// Lag of a streaming replica: none when it has replayed everything it
+// received, or when the URL points at a primary
+const replicaLagQuery = `
+	SELECT CASE
+		WHEN NOT pg_is_in_recovery() THEN 0
+		WHEN pg_last_wal_receive_lsn() = pg_last_wal_replay_lsn() THEN 0
+		ELSE COALESCE(EXTRACT(EPOCH FROM now() - pg_last_xact_replay_timestamp()), 0)
+	END
+`
+
+// ReadReplica routes read-only queries to a streaming replica of the
+// PostgreSQL primary. While the replica is down or more than maxLag behind,
+// reads go to the primary, and a read that fails on the replica is retried
+// there. A nil ReadReplica sends every read to the primary.
+type ReadReplica struct {
+	// Swapped for a new pool when Vault rotates the credentials
+	db     atomic.Pointer[sql.DB]
+	maxLag time.Duration
+	chaos  *Chaos
+
+	mu sync.Mutex
+	// Why reads skip the replica, empty while it takes them
+	skipReason string
+	lag        time.Duration
+}
+
+// Create the replica router, or nil without DATABASE_REPLICA_URL. Reads go
+// to the primary until a pool is swapped in and a lag check passes.
+func newReadReplica(cfg PostgresConfig, chaos *Chaos) *ReadReplica {
+	if cfg.ReplicaURL == "" {
+		return nil
+	}
+	return &ReadReplica{maxLag: cfg.ReplicaMaxLag, chaos: chaos, skipReason: "unavailable"}
+}
+
+// Read runs fn against the replica when it takes reads, and against the
+// primary otherwise or when it fails on the replica. The current span gets
+// db.replica set to where the read was answered.
+func (r *ReadReplica) Read(ctx context.Context, primary *sql.DB, fn func(db *sql.DB) error) error {
+	if r == nil {
+		return fn(primary)
+	}
+
+	reason, lag := r.state()
+	if reason != "" {
+		r.fallback(ctx, reason)
+		return fn(primary)
+	}
+
+	err := r.chaos.replicaFault()
+	if err == nil {
+		err = fn(r.db.Load())
+	}
+	if err == nil || errors.Is(err, sql.ErrNoRows) || ctx.Err() != nil {
+		trace.SpanFromContext(ctx).SetAttributes(
+			attribute.Bool("db.replica", true),
+			attribute.Float64("db.replica.lag_seconds", lag.Seconds()),
+		)
+		replicaReads.WithLabelValues("replica").Inc()
+		return err
+	}
+
+	logWithTrace(ctx, "WARN", "Read failed on the replica, retrying on the primary", "error", err.Error())
+	r.fallback(ctx, "error")
+	return fn(primary)
+}
+
+func (r *ReadReplica) fallback(ctx context.Context, reason string) {
+	span := trace.SpanFromContext(ctx)
+	span.SetAttributes(attribute.Bool("db.replica", false))
+	span.AddEvent("db.replica.fallback", trace.WithAttributes(attribute.String("db.replica.fallback_reason", reason)))
+	replicaFallbacks.WithLabelValues(reason).Inc()
+	replicaReads.WithLabelValues("primary").Inc()
+}
+
+func (r *ReadReplica) state() (string, time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.skipReason, r.lag
+}
+
+// Status for the health check: connected, lagging or unavailable
+func (r *ReadReplica) Status() string {
+	switch reason, _ := r.state(); reason {
+	case "":
+		return "connected"
+	case "lag":
+		return "lagging"
+	default:
+		return reason
+	}
+}
+
+// Swap in a new pool, returning the old one
+func (r *ReadReplica) Swap(db *sql.DB) *sql.DB {
+	return r.db.Swap(db)
+}
+
+// CheckLag measures the replica's lag and decides whether it takes reads.
+// Run periodically; a replica that can't be reached counts as unavailable
+// until the next check that reaches it.
+func (r *ReadReplica) CheckLag(ctx context.Context) error {
+	var seconds float64
+	err := r.chaos.replicaFault()
+	if db := r.db.Load(); err == nil && db == nil {
+		err = errors.New("replica not connected")
+	} else if err == nil {
+		err = db.QueryRowContext(ctx, replicaLagQuery).Scan(&seconds)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	previous := r.skipReason
+	switch {
+	case err != nil:
+		r.skipReason = "unavailable"
+	default:
+		r.lag = time.Duration(seconds * float64(time.Second))
+		replicaLag.Set(seconds)
+		r.skipReason = ""
+		if r.maxLag > 0 && r.lag > r.maxLag {
+			r.skipReason = "lag"
+		}
+	}
+
+	if r.skipReason == "" {
+		replicaUp.Set(1)
+	} else {
+		replicaUp.Set(0)
+	}
+	if r.skipReason != previous {
+		if r.skipReason == "" {
+			log.Printf("Read replica takes reads again (lag %s)", r.lag)
+		} else {
+			log.Printf("Reads go to the primary: replica %s (lag %s, max %s)", r.skipReason, r.lag, r.maxLag)
+		}
+	}
+	return err
+}
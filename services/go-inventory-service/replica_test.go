@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"testing"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+
+	"inventory-service/internal/testkit"
+)
+
+// Pools that are never connected: the tests only check which one a read
+// was given
+func newTestReplica(t *testing.T, chaos *Chaos) (*ReadReplica, *sql.DB, *sql.DB) {
+	t.Helper()
+	primary, _ := sql.Open("postgres", "postgres://primary/inventory")
+	replicaDB, _ := sql.Open("postgres", "postgres://replica/inventory")
+	t.Cleanup(func() { primary.Close(); replicaDB.Close() })
+
+	r := newReadReplica(PostgresConfig{ReplicaURL: "postgres://replica/inventory", ReplicaMaxLag: 10 * time.Second}, chaos)
+	r.Swap(replicaDB)
+	r.skipReason = ""
+	return r, primary, replicaDB
+}
+
+func TestReadReplicaRouting(t *testing.T) {
+	tr := testkit.InstallTracing(t)
+	tracer := tr.Tracer("test")
+	chaos := newChaos(ChaosConfig{})
+	r, primary, replicaDB := newTestReplica(t, chaos)
+
+	read := func(name string, fail error) *sql.DB {
+		var used *sql.DB
+		ctx, span := tracer.Start(context.Background(), name)
+		r.Read(ctx, primary, func(db *sql.DB) error {
+			used = db
+			if db == replicaDB {
+				return fail
+			}
+			return nil
+		})
+		span.End()
+		return used
+	}
+
+	if got := read("replica", nil); got != replicaDB {
+		t.Error("read did not go to the replica")
+	}
+	tr.AssertSpan(t, "replica", attribute.Bool("db.replica", true))
+
+	if got := read("not found", sql.ErrNoRows); got != replicaDB {
+		t.Error("no rows on the replica was retried on the primary")
+	}
+
+	testkit.AssertCounterDelta(t, replicaFallbacks.WithLabelValues("error"), 1, func() {
+		if got := read("error", errors.New("connection refused")); got != primary {
+			t.Error("failed read was not retried on the primary")
+		}
+	})
+	span := tr.AssertSpan(t, "error", attribute.Bool("db.replica", false))
+	testkit.AssertSpanEvent(t, span, "db.replica.fallback", attribute.String("db.replica.fallback_reason", "error"))
+
+	r.skipReason = "lag"
+	if got := read("lagging", nil); got != primary {
+		t.Error("read went to a lagging replica")
+	}
+	span = tr.AssertSpan(t, "lagging", attribute.Bool("db.replica", false))
+	testkit.AssertSpanEvent(t, span, "db.replica.fallback", attribute.String("db.replica.fallback_reason", "lag"))
+	r.skipReason = ""
+
+	chaos.SetReplicaBroken(true)
+	if got := read("broken", nil); got != primary {
+		t.Error("read was not failed over from a broken replica")
+	}
+}
+
+func TestReadReplicaNil(t *testing.T) {
+	if r := newReadReplica(PostgresConfig{}, newChaos(ChaosConfig{})); r != nil {
+		t.Fatal("replica created without DATABASE_REPLICA_URL")
+	}
+	var r *ReadReplica
+	primary, _ := sql.Open("postgres", "postgres://primary/inventory")
+	defer primary.Close()
+
+	var used *sql.DB
+	r.Read(context.Background(), primary, func(db *sql.DB) error {
+		used = db
+		return nil
+	})
+	if used != primary {
+		t.Error("read without a replica did not go to the primary")
+	}
+}
+
+func TestReadReplicaCheckLag(t *testing.T) {
+	chaos := newChaos(ChaosConfig{})
+	r := newReadReplica(PostgresConfig{ReplicaURL: "postgres://replica/inventory"}, chaos)
+	if got := r.Status(); got != "unavailable" {
+		t.Errorf("status before connecting = %q, want unavailable", got)
+	}
+	if err := r.CheckLag(context.Background()); err == nil {
+		t.Error("lag check passed without a pool")
+	}
+
+	r, _, _ = newTestReplica(t, chaos)
+	chaos.SetReplicaBroken(true)
+	if err := r.CheckLag(context.Background()); !errors.Is(err, errReplicaUnavailable) {
+		t.Errorf("lag check error = %v, want %v", err, errReplicaUnavailable)
+	}
+	if got := r.Status(); got != "unavailable" {
+		t.Errorf("status of a broken replica = %q, want unavailable", got)
+	}
+}
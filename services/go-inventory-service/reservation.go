@@ -0,0 +1,425 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var (
+	reservationEvents = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "reservations_total",
+			Help: "Reservations by event: created, rejected, confirmed, released or expired",
+		},
+		[]string{"event"},
+	)
+
+	reservationHoldDuration = promauto.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "reservation_hold_duration_seconds",
+			Help:    "Time from a reservation's creation until it was confirmed, released or expired",
+			Buckets: []float64{1, 5, 15, 30, 60, 120, 300, 600, 900, 1800, 3600},
+		},
+		[]string{"outcome"},
+	)
+)
+
+var (
+	// The item doesn't have that many units that aren't reserved
+	errInsufficientStock = errors.New("not enough unreserved stock")
+	// The reservation was already confirmed, released or expired
+	errReservationNotHeld = errors.New("reservation is not held")
+)
+
+// Reservation statuses
+const (
+	reservationHeld      = "held"
+	reservationConfirmed = "confirmed"
+	reservationReleased  = "released"
+	reservationExpired   = "expired"
+)
+
+// Reservation holds units of an item for an order until it is confirmed,
+// released, or expires. Confirming takes the units out of the item's
+// quantity; until then they only count as unavailable.
+type Reservation struct {
+	ID        int       `json:"id"`
+	ItemID    int       `json:"item_id"`
+	Quantity  int       `json:"quantity"`
+	Status    string    `json:"status"`
+	CreatedAt time.Time `json:"created_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+	// The request that created it, to find its trace from an expiry
+	TraceID string `json:"trace_id,omitempty"`
+	SpanID  string `json:"-"`
+}
+
+// The span context of the request that created the reservation, invalid if
+// it wasn't traced
+func (r Reservation) origin() trace.SpanContext {
+	traceID, _ := trace.TraceIDFromHex(r.TraceID)
+	spanID, _ := trace.SpanIDFromHex(r.SpanID)
+	return trace.NewSpanContext(trace.SpanContextConfig{
+		TraceID: traceID, SpanID: spanID, TraceFlags: trace.FlagsSampled, Remote: true,
+	})
+}
+
+// ReservationStore holds the reservations (PostgreSQL)
+type ReservationStore interface {
+	// Insert the reservation, setting its ID. Returns sql.ErrNoRows if the
+	// item doesn't exist, errInsufficientStock if too much of it is held.
+	CreateReservation(ctx context.Context, r *Reservation) error
+	// Returns sql.ErrNoRows if there is no such reservation
+	GetReservation(ctx context.Context, id int) (Reservation, error)
+	// Move a held, unexpired reservation to status (confirmed or released).
+	// Returns errReservationNotHeld, with the reservation, otherwise.
+	FinishReservation(ctx context.Context, id int, status string, now time.Time) (Reservation, error)
+	// Expire up to limit held reservations that expired by now
+	ExpireReservations(ctx context.Context, now time.Time, limit int) ([]Reservation, error)
+}
+
+const createReservationsQuery = `
+	CREATE TABLE IF NOT EXISTS reservations (
+		id SERIAL PRIMARY KEY,
+		item_id INTEGER NOT NULL REFERENCES inventory (id) ON DELETE CASCADE,
+		quantity INTEGER NOT NULL CHECK (quantity > 0),
+		status VARCHAR(20) NOT NULL,
+		created_at TIMESTAMP NOT NULL,
+		expires_at TIMESTAMP NOT NULL,
+		trace_id VARCHAR(32) NOT NULL DEFAULT '',
+		span_id VARCHAR(16) NOT NULL DEFAULT ''
+	);
+	CREATE INDEX IF NOT EXISTS reservations_held ON reservations (item_id, expires_at) WHERE status = 'held';
+`
+
+const reservationColumns = `id, item_id, quantity, status, created_at, expires_at, trace_id, span_id`
+
+func scanReservation(row interface{ Scan(...interface{}) error }) (Reservation, error) {
+	var r Reservation
+	err := row.Scan(&r.ID, &r.ItemID, &r.Quantity, &r.Status, &r.CreatedAt, &r.ExpiresAt, &r.TraceID, &r.SpanID)
+	return r, err
+}
+
+// postgresReservationStore is the ReservationStore on PostgreSQL
+type postgresReservationStore struct {
+	db    func() *sql.DB
+	chaos *Chaos
+}
+
+func (s *postgresReservationStore) CreateReservation(ctx context.Context, r *Reservation) error {
+	start := time.Now()
+	defer observeQuery("postgres", "create_reservation", start)
+	s.chaos.slowPostgres(ctx, s.db())
+
+	tx, err := s.db().BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// Locking the item makes concurrent reservations of it check in turn
+	var quantity, held int
+	if err := tx.QueryRowContext(ctx, `SELECT quantity FROM inventory WHERE id = $1 FOR UPDATE`, r.ItemID).Scan(&quantity); err != nil {
+		return err
+	}
+	// Expired holds free their units even before the expiry job runs
+	if err := tx.QueryRowContext(ctx, `
+		SELECT COALESCE(SUM(quantity), 0) FROM reservations
+		WHERE item_id = $1 AND status = 'held' AND expires_at > $2
+	`, r.ItemID, r.CreatedAt).Scan(&held); err != nil {
+		return err
+	}
+	if quantity-held < r.Quantity {
+		return fmt.Errorf("%w: %d of %d units available", errInsufficientStock, quantity-held, quantity)
+	}
+
+	if err := tx.QueryRowContext(ctx, `
+		INSERT INTO reservations (item_id, quantity, status, created_at, expires_at, trace_id, span_id)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		RETURNING id
+	`, r.ItemID, r.Quantity, r.Status, r.CreatedAt, r.ExpiresAt, r.TraceID, r.SpanID).Scan(&r.ID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *postgresReservationStore) GetReservation(ctx context.Context, id int) (Reservation, error) {
+	start := time.Now()
+	s.chaos.slowPostgres(ctx, s.db())
+	r, err := scanReservation(s.db().QueryRowContext(ctx,
+		`SELECT `+reservationColumns+` FROM reservations WHERE id = $1`, id))
+	observeQuery("postgres", "get_reservation", start)
+	return r, err
+}
+
+func (s *postgresReservationStore) FinishReservation(ctx context.Context, id int, status string, now time.Time) (Reservation, error) {
+	start := time.Now()
+	defer observeQuery("postgres", "finish_reservation", start)
+	s.chaos.slowPostgres(ctx, s.db())
+
+	tx, err := s.db().BeginTx(ctx, nil)
+	if err != nil {
+		return Reservation{}, err
+	}
+	defer tx.Rollback()
+
+	r, err := scanReservation(tx.QueryRowContext(ctx, `
+		UPDATE reservations SET status = $2
+		WHERE id = $1 AND status = 'held' AND expires_at > $3
+		RETURNING `+reservationColumns, id, status, now))
+	if err == sql.ErrNoRows {
+		// Missing, or no longer held
+		r, err = scanReservation(tx.QueryRowContext(ctx,
+			`SELECT `+reservationColumns+` FROM reservations WHERE id = $1`, id))
+		if err != nil {
+			return Reservation{}, err
+		}
+		return r, errReservationNotHeld
+	}
+	if err != nil {
+		return Reservation{}, err
+	}
+
+	// Only the item's quantity changes, the MongoDB stock level isn't
+	// authoritative and keeps what it had at creation
+	if status == reservationConfirmed {
+		traceID, spanID := spanIDs(ctx)
+		if _, err := tx.ExecContext(ctx, `
+			UPDATE inventory SET quantity = quantity - $1, updated_at = $2, last_trace_id = $4, last_span_id = $5
+			WHERE id = $3
+		`, r.Quantity, now, r.ItemID, traceID, spanID); err != nil {
+			return Reservation{}, err
+		}
+	}
+	return r, tx.Commit()
+}
+
+func (s *postgresReservationStore) ExpireReservations(ctx context.Context, now time.Time, limit int) ([]Reservation, error) {
+	// SKIP LOCKED leaves the reservations being confirmed right now alone
+	query := `
+		UPDATE reservations SET status = 'expired'
+		WHERE id IN (
+			SELECT id FROM reservations
+			WHERE status = 'held' AND expires_at <= $1
+			ORDER BY expires_at
+			LIMIT $2
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING ` + reservationColumns
+
+	start := time.Now()
+	rows, err := s.db().QueryContext(ctx, query, now, limit)
+	observeQuery("postgres", "expire_reservations", start)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var expired []Reservation
+	for rows.Next() {
+		r, err := scanReservation(rows)
+		if err != nil {
+			return nil, err
+		}
+		expired = append(expired, r)
+	}
+	return expired, rows.Err()
+}
+
+// Release the held reservations past their expiry, in batches. Each expiry
+// gets a span linked to the request that made the reservation, and a log
+// line with that request's trace ID. Runs on the leader only.
+func (app *App) expireReservations(ctx context.Context) error {
+	for {
+		now := app.clock.Now()
+		expired, err := app.reservations.ExpireReservations(ctx, now, app.reservationCfg.ExpiryBatch)
+		if err != nil {
+			return err
+		}
+		for _, r := range expired {
+			app.recordExpiry(ctx, r, now)
+		}
+		if len(expired) < app.reservationCfg.ExpiryBatch {
+			return nil
+		}
+	}
+}
+
+func (app *App) recordExpiry(ctx context.Context, r Reservation, now time.Time) {
+	var opts []trace.SpanStartOption
+	if origin := r.origin(); origin.IsValid() {
+		opts = append(opts, trace.WithLinks(trace.Link{SpanContext: origin}))
+	}
+	opts = append(opts, trace.WithAttributes(
+		attribute.Int("reservation.id", r.ID),
+		attribute.Int("item.id", r.ItemID),
+		attribute.Int("reservation.quantity", r.Quantity),
+	))
+	ctx, span := app.tracer.Start(ctx, "reservation.expire", opts...)
+	defer span.End()
+
+	reservationEvents.WithLabelValues(reservationExpired).Inc()
+	app.publishEvent(ctx, eventReservationExpired, "reservation", r.ID,
+		fmt.Sprintf("Reservation of %d of item %d expired", r.Quantity, r.ItemID),
+		map[string]interface{}{"item_id": r.ItemID, "quantity": r.Quantity, "origin_trace_id": r.TraceID})
+	reservationHoldDuration.WithLabelValues(reservationExpired).Observe(now.Sub(r.CreatedAt).Seconds())
+	logWithTrace(ctx, "INFO", "Reservation expired",
+		"reservation_id", r.ID, "item_id", r.ItemID, "quantity", r.Quantity,
+		"expired_at", r.ExpiresAt.Format(time.RFC3339), "origin_trace_id", r.TraceID)
+}
+
+// CreateReservationRequest holds units of an item
+type CreateReservationRequest struct {
+	ItemID   int `json:"item_id" binding:"required"`
+	Quantity int `json:"quantity" binding:"required,min=1"`
+}
+
+// Reserve units of an item for RESERVATION_TTL (PostgreSQL)
+func (app *App) createReservation(c *gin.Context) {
+	ctx := c.Request.Context()
+	ctx, span := app.tracer.Start(ctx, "createReservation")
+	defer span.End()
+
+	var req CreateReservationRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	span.SetAttributes(attribute.Int("item.id", req.ItemID), attribute.Int("reservation.quantity", req.Quantity))
+
+	now := app.clock.Now()
+	r := Reservation{
+		ItemID:    req.ItemID,
+		Quantity:  req.Quantity,
+		Status:    reservationHeld,
+		CreatedAt: now,
+		ExpiresAt: now.Add(app.reservationCfg.TTL),
+	}
+	if sc := span.SpanContext(); sc.IsValid() {
+		r.TraceID, r.SpanID = sc.TraceID().String(), sc.SpanID().String()
+	}
+
+	err := app.reservations.CreateReservation(ctx, &r)
+	switch {
+	case err == sql.ErrNoRows:
+		c.JSON(http.StatusNotFound, gin.H{"error": "Item not found"})
+		return
+	case errors.Is(err, errInsufficientStock):
+		reservationEvents.WithLabelValues("rejected").Inc()
+		logWithTrace(ctx, "WARN", "Reservation rejected", "item_id", r.ItemID, "error", err.Error())
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	case err != nil:
+		logWithTrace(ctx, "ERROR", "Error creating reservation", "error", err.Error())
+		span.RecordError(err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create reservation"})
+		return
+	}
+
+	span.SetAttributes(attribute.Int("reservation.id", r.ID))
+	reservationEvents.WithLabelValues("created").Inc()
+	app.publishEvent(ctx, eventStockReserved, "reservation", r.ID,
+		fmt.Sprintf("Reserved %d of item %d until %s", r.Quantity, r.ItemID, r.ExpiresAt.Format(time.RFC3339)),
+		map[string]interface{}{"item_id": r.ItemID, "quantity": r.Quantity})
+	requestsTotal.WithLabelValues("POST", "/api/reservations", "201").Inc()
+	logWithTrace(ctx, "INFO", "Reservation created", "reservation_id", r.ID, "item_id", r.ItemID,
+		"quantity", r.Quantity, "expires_at", r.ExpiresAt.Format(time.RFC3339))
+
+	c.JSON(http.StatusCreated, r)
+}
+
+// Get a reservation by ID (PostgreSQL)
+func (app *App) getReservation(c *gin.Context) {
+	ctx := c.Request.Context()
+	ctx, span := app.tracer.Start(ctx, "getReservation")
+	defer span.End()
+
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Reservation not found"})
+		return
+	}
+	span.SetAttributes(attribute.Int("reservation.id", id))
+
+	r, err := app.reservations.GetReservation(ctx, id)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Reservation not found"})
+		return
+	}
+	if err != nil {
+		logWithTrace(ctx, "ERROR", "Error fetching reservation", "error", err.Error())
+		span.RecordError(err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch reservation"})
+		return
+	}
+	c.JSON(http.StatusOK, r)
+}
+
+// Confirm a held reservation, taking its units out of the item's quantity
+func (app *App) confirmReservation(c *gin.Context) {
+	app.finishReservation(c, "confirmReservation", reservationConfirmed)
+}
+
+// Release a held reservation, making its units available again
+func (app *App) releaseReservation(c *gin.Context) {
+	app.finishReservation(c, "releaseReservation", reservationReleased)
+}
+
+func (app *App) finishReservation(c *gin.Context, spanName, status string) {
+	ctx := c.Request.Context()
+	ctx, span := app.tracer.Start(ctx, spanName)
+	defer span.End()
+
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Reservation not found"})
+		return
+	}
+	span.SetAttributes(attribute.Int("reservation.id", id))
+
+	now := app.clock.Now()
+	r, err := app.reservations.FinishReservation(ctx, id, status, now)
+	switch {
+	case err == sql.ErrNoRows:
+		c.JSON(http.StatusNotFound, gin.H{"error": "Reservation not found"})
+		return
+	case errors.Is(err, errReservationNotHeld):
+		// Includes a held reservation past its expiry the job hasn't
+		// caught up with
+		state := r.Status
+		if state == reservationHeld {
+			state = reservationExpired
+		}
+		c.JSON(http.StatusConflict, gin.H{"error": "Reservation is " + state})
+		return
+	case err != nil:
+		logWithTrace(ctx, "ERROR", "Error updating reservation", "reservation_id", id, "error", err.Error())
+		span.RecordError(err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update reservation"})
+		return
+	}
+
+	reservationEvents.WithLabelValues(status).Inc()
+	eventType := eventReservationConfirmed
+	if status == reservationReleased {
+		eventType = eventReservationReleased
+	}
+	app.publishEvent(ctx, eventType, "reservation", r.ID,
+		fmt.Sprintf("Reservation of %d of item %d %s", r.Quantity, r.ItemID, status),
+		map[string]interface{}{"item_id": r.ItemID, "quantity": r.Quantity})
+	reservationHoldDuration.WithLabelValues(status).Observe(now.Sub(r.CreatedAt).Seconds())
+	logWithTrace(ctx, "INFO", "Reservation "+status, "reservation_id", r.ID, "item_id", r.ItemID, "quantity", r.Quantity)
+
+	c.JSON(http.StatusOK, r)
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel/attribute"
+
+	"inventory-service/internal/testkit"
+)
+
+// fakeReservationStore keeps reservations in memory. Items have unlimited
+// stock unless listed in available.
+type fakeReservationStore struct {
+	reservations []Reservation
+	available    map[int]int
+}
+
+func (s *fakeReservationStore) CreateReservation(ctx context.Context, r *Reservation) error {
+	if n, ok := s.available[r.ItemID]; ok && n < r.Quantity {
+		return errInsufficientStock
+	}
+	r.ID = len(s.reservations) + 1
+	s.reservations = append(s.reservations, *r)
+	return nil
+}
+
+func (s *fakeReservationStore) GetReservation(ctx context.Context, id int) (Reservation, error) {
+	return s.reservations[id-1], nil
+}
+
+func (s *fakeReservationStore) FinishReservation(ctx context.Context, id int, status string, now time.Time) (Reservation, error) {
+	r := &s.reservations[id-1]
+	if r.Status != reservationHeld || !r.ExpiresAt.After(now) {
+		return *r, errReservationNotHeld
+	}
+	r.Status = status
+	return *r, nil
+}
+
+func (s *fakeReservationStore) ExpireReservations(ctx context.Context, now time.Time, limit int) ([]Reservation, error) {
+	var expired []Reservation
+	for i := range s.reservations {
+		r := &s.reservations[i]
+		if r.Status == reservationHeld && !r.ExpiresAt.After(now) && len(expired) < limit {
+			r.Status = reservationExpired
+			expired = append(expired, *r)
+		}
+	}
+	return expired, nil
+}
+
+func newReservationApp(t *testing.T, clock Clock) (*App, *fakeReservationStore, *gin.Engine) {
+	app := newFakeApp(t, &fakeItemStore{}, &fakeStockStore{}, clock)
+	store := &fakeReservationStore{}
+	app.reservations = store
+	app.reservationCfg = ReservationConfig{TTL: time.Minute, ExpiryBatch: 2}
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.POST("/api/reservations", app.createReservation)
+	router.POST("/api/reservations/:id/confirm", app.confirmReservation)
+	return app, store, router
+}
+
+func reserve(router *gin.Engine, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, "/api/reservations", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestReservationExpiry(t *testing.T) {
+	clock := &fixedClock{now: time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)}
+	app, store, router := newReservationApp(t, clock)
+	tr := testkit.InstallTracing(t)
+	app.tracer = tr.Tracer("test")
+
+	for i := 0; i < 3; i++ {
+		if rec := reserve(router, `{"item_id": 1, "quantity": 2}`); rec.Code != http.StatusCreated {
+			t.Fatalf("got status %d: %s", rec.Code, rec.Body.String())
+		}
+	}
+	origin := store.reservations[0].TraceID
+	found := false
+	for _, span := range tr.Spans() {
+		found = found || (span.Name == "createReservation" && span.SpanContext.TraceID().String() == origin)
+	}
+	if !found {
+		t.Error("reservation doesn't record the trace that created it")
+	}
+
+	// Nothing expires before the TTL
+	clock.now = clock.now.Add(59 * time.Second)
+	app.expireReservations(context.Background())
+	if store.reservations[0].Status != reservationHeld {
+		t.Fatal("reservation expired before its TTL")
+	}
+
+	// All of them expire, over several batches
+	clock.now = clock.now.Add(time.Second)
+	tr.Reset()
+	testkit.AssertCounterDelta(t, reservationEvents.WithLabelValues(reservationExpired), 3, func() {
+		if err := app.expireReservations(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	})
+	span := tr.AssertSpan(t, "reservation.expire", attribute.Int("reservation.id", 1))
+	if len(span.Links) != 1 || span.Links[0].SpanContext.TraceID().String() != origin {
+		t.Errorf("expiry span not linked to the request that made the reservation: %+v", span.Links)
+	}
+
+	// An expired reservation can't be confirmed
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/api/reservations/1/confirm", nil))
+	if rec.Code != http.StatusConflict || !strings.Contains(rec.Body.String(), "expired") {
+		t.Errorf("confirming an expired reservation: got status %d: %s", rec.Code, rec.Body.String())
+	}
+}
+
+func TestReservationInsufficientStock(t *testing.T) {
+	_, store, router := newReservationApp(t, systemClock{})
+	store.available = map[int]int{1: 3}
+
+	testkit.AssertCounterDelta(t, reservationEvents.WithLabelValues("rejected"), 1, func() {
+		if rec := reserve(router, `{"item_id": 1, "quantity": 5}`); rec.Code != http.StatusConflict {
+			t.Errorf("got status %d, want 409", rec.Code)
+		}
+	})
+}
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/redis/go-redis/v9"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var (
+	responseCacheRequests = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "response_cache_requests_total",
+			Help: "Total number of cacheable requests by endpoint and cache status (HIT, MISS, BYPASS, ERROR)",
+		},
+		[]string{"endpoint", "status"},
+	)
+
+	responseCacheInvalidations = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "response_cache_invalidations_total",
+			Help: "Total number of response cache invalidations by group and reason",
+		},
+		[]string{"group", "reason"},
+	)
+)
+
+// Groups of cached responses that are invalidated together
+const (
+	cacheGroupItems       = "items"
+	cacheGroupStockLevels = "stock_levels"
+)
+
+// responseStore is where cached responses live. Every group of responses
+// has a generation that is part of their keys, so bumping it invalidates
+// the whole group at once.
+type responseStore interface {
+	Get(ctx context.Context, key string) ([]byte, bool, error)
+	Set(ctx context.Context, key string, body []byte, ttl time.Duration) error
+	Generation(ctx context.Context, group string) (int64, error)
+	Bump(ctx context.Context, group string) error
+}
+
+// ResponseCache caches successful GET responses, keyed by path, query
+// parameters and response format. A nil cache is valid and caches nothing.
+type ResponseCache struct {
+	store   responseStore
+	backend string
+	ttl     time.Duration
+}
+
+// Create the response cache with the memory or redis backend. Returns nil
+// when the backend is off.
+func newResponseCache(cfg ResponseConfig, clock Clock) (*ResponseCache, error) {
+	var store responseStore
+	switch cfg.Backend {
+	case "off":
+		return nil, nil
+	case "memory":
+		store = newMemoryResponseStore(cfg.Size, clock)
+	case "redis":
+		var err error
+		store, err = newRedisResponseStore(cfg.RedisURL)
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("invalid RESPONSE_CACHE %q", cfg.Backend)
+	}
+
+	log.Printf("Response cache enabled (%s, TTL %s)", cfg.Backend, cfg.TTL)
+	return &ResponseCache{store: store, backend: cfg.Backend, ttl: cfg.TTL}, nil
+}
+
+// Ping checks that Redis is reachable; the memory backend always is
+func (rc *ResponseCache) Ping(ctx context.Context) error {
+	if s, ok := rc.store.(*redisResponseStore); ok {
+		return s.client.Ping(ctx).Err()
+	}
+	return nil
+}
+
+// Middleware serves GET responses of the group from the cache and stores
+// successful ones. The X-Cache response header tells whether the response
+// was a HIT, a MISS, or bypassed the cache (BYPASS) because the request
+// asked for a fresh response with Cache-Control: no-cache.
+func (rc *ResponseCache) Middleware(group string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if rc == nil {
+			c.Next()
+			return
+		}
+
+		ctx := c.Request.Context()
+		span := trace.SpanFromContext(ctx)
+		endpoint := c.FullPath()
+
+		status := func(s string) {
+			c.Header("X-Cache", s)
+			span.SetAttributes(attribute.String("http.cache_status", s))
+			responseCacheRequests.WithLabelValues(endpoint, s).Inc()
+		}
+
+		if c.GetHeader("Cache-Control") == "no-cache" {
+			status("BYPASS")
+			c.Next()
+			return
+		}
+
+		gen, err := rc.store.Generation(ctx, group)
+		if err != nil {
+			// Serve from the database while the cache is unavailable
+			log.Printf("Response cache unavailable: %v", err)
+			status("ERROR")
+			c.Next()
+			return
+		}
+		// The cached endpoints answer in JSON or protobuf
+		format := responseFormat(c)
+		key := fmt.Sprintf("%s:%d:%s:%s?%s", group, gen, format, c.Request.URL.Path, c.Request.URL.Query().Encode())
+
+		if body, ok, err := rc.store.Get(ctx, key); err == nil && ok {
+			status("HIT")
+			requestsTotal.WithLabelValues(c.Request.Method, endpoint, "200").Inc()
+			contentType := "application/json; charset=utf-8"
+			if format == formatProtobuf {
+				contentType = binding.MIMEPROTOBUF
+			}
+			c.Header("Vary", "Accept")
+			c.Data(http.StatusOK, contentType, body)
+			c.Abort()
+			return
+		}
+
+		status("MISS")
+		w := &capturingWriter{ResponseWriter: c.Writer}
+		c.Writer = w
+		c.Next()
+
+		if w.Status() == http.StatusOK {
+			if err := rc.store.Set(ctx, key, w.body.Bytes(), rc.ttl); err != nil {
+				log.Printf("Failed to store response in cache: %v", err)
+			}
+		}
+	}
+}
+
+// Invalidate drops the cached responses of the groups. Called by the cache
+// subscriber for the domain events of changes, and by DELETE /admin/cache.
+func (rc *ResponseCache) Invalidate(ctx context.Context, reason string, groups ...string) {
+	if rc == nil {
+		return
+	}
+	for _, group := range groups {
+		if err := rc.store.Bump(ctx, group); err != nil {
+			logWithTrace(ctx, "WARN", "Failed to invalidate response cache", "group", group, "error", err.Error())
+			continue
+		}
+		responseCacheInvalidations.WithLabelValues(group, reason).Inc()
+	}
+}
+
+// Drop all cached responses
+func (app *App) invalidateResponseCache(c *gin.Context) {
+	app.responses.Invalidate(c.Request.Context(), "admin", cacheGroupItems, cacheGroupStockLevels)
+	c.Status(http.StatusNoContent)
+}
+
+// capturingWriter keeps a copy of the response body for the cache
+type capturingWriter struct {
+	gin.ResponseWriter
+	body bytes.Buffer
+}
+
+func (w *capturingWriter) Write(data []byte) (int, error) {
+	w.body.Write(data)
+	return w.ResponseWriter.Write(data)
+}
+
+func (w *capturingWriter) WriteString(s string) (int, error) {
+	w.body.WriteString(s)
+	return w.ResponseWriter.WriteString(s)
+}
+
+// memoryResponseStore keeps responses in process. Invalidations only reach
+// this replica; other replicas serve their copy until the TTL expires.
+type memoryResponseStore struct {
+	entries *lruCache[string, memoryResponse]
+	clock   Clock
+
+	mu          sync.Mutex
+	generations map[string]int64
+}
+
+type memoryResponse struct {
+	body      []byte
+	expiresAt time.Time
+}
+
+func newMemoryResponseStore(size int, clock Clock) *memoryResponseStore {
+	return &memoryResponseStore{
+		// The LRU's own TTL is an upper bound, entries carry their own expiry
+		entries:     newLRUCache[string, memoryResponse]("responses", size, 24*time.Hour, clock),
+		clock:       clock,
+		generations: map[string]int64{},
+	}
+}
+
+func (s *memoryResponseStore) Get(ctx context.Context, key string) ([]byte, bool, error) {
+	resp, ok := s.entries.Get(key)
+	if !ok || s.clock.Now().After(resp.expiresAt) {
+		return nil, false, nil
+	}
+	return resp.body, true, nil
+}
+
+func (s *memoryResponseStore) Set(ctx context.Context, key string, body []byte, ttl time.Duration) error {
+	s.entries.Add(key, memoryResponse{body: bytes.Clone(body), expiresAt: s.clock.Now().Add(ttl)})
+	return nil
+}
+
+func (s *memoryResponseStore) Generation(ctx context.Context, group string) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.generations[group], nil
+}
+
+func (s *memoryResponseStore) Bump(ctx context.Context, group string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.generations[group]++
+	return nil
+}
+
+// redisResponseStore shares cached responses and generations between all
+// replicas, so a write on one replica invalidates the cache for all of them
+type redisResponseStore struct {
+	client *redis.Client
+}
+
+const redisKeyPrefix = "inventory:"
+
+// Create the Redis store without connecting yet; the startup checks find
+// out whether Redis is reachable
+func newRedisResponseStore(redisURL string) (*redisResponseStore, error) {
+	opts, err := redis.ParseURL(redisURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid REDIS_URL: %w", err)
+	}
+	return &redisResponseStore{client: redis.NewClient(opts)}, nil
+}
+
+func (s *redisResponseStore) Get(ctx context.Context, key string) ([]byte, bool, error) {
+	body, err := s.client.Get(ctx, redisKeyPrefix+"response:"+key).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	return body, true, nil
+}
+
+func (s *redisResponseStore) Set(ctx context.Context, key string, body []byte, ttl time.Duration) error {
+	return s.client.Set(ctx, redisKeyPrefix+"response:"+key, body, ttl).Err()
+}
+
+func (s *redisResponseStore) Generation(ctx context.Context, group string) (int64, error) {
+	gen, err := s.client.Get(ctx, redisKeyPrefix+"generation:"+group).Int64()
+	if errors.Is(err, redis.Nil) {
+		return 0, nil
+	}
+	return gen, err
+}
+
+func (s *redisResponseStore) Bump(ctx context.Context, group string) error {
+	return s.client.Incr(ctx, redisKeyPrefix+"generation:"+group).Err()
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"inventory-service/internal/testkit"
+)
+
+// failingResponseStore is a cache backend that can't be reached
+type failingResponseStore struct{ *memoryResponseStore }
+
+func (s *failingResponseStore) Generation(ctx context.Context, group string) (int64, error) {
+	return 0, errors.New("dial tcp: connection refused")
+}
+
+func TestResponseCache(t *testing.T) {
+	clock := &fixedClock{now: time.Now()}
+	rc := &ResponseCache{store: newMemoryResponseStore(10, clock), ttl: time.Minute}
+
+	calls := 0
+	status := http.StatusOK
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.GET("/api/inventory", rc.Middleware(cacheGroupItems), func(c *gin.Context) {
+		calls++
+		c.JSON(status, gin.H{"calls": calls})
+	})
+	get := func(path string, header ...string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		for i := 0; i < len(header); i += 2 {
+			req.Header.Set(header[i], header[i+1])
+		}
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		return rec
+	}
+	expect := func(rec *httptest.ResponseRecorder, cache, body string) {
+		t.Helper()
+		if got := rec.Header().Get("X-Cache"); got != cache || rec.Body.String() != body {
+			t.Errorf("got X-Cache %q and %s, want %s and %s", got, rec.Body.String(), cache, body)
+		}
+	}
+
+	testkit.AssertCounterDelta(t, responseCacheRequests.WithLabelValues("/api/inventory", "HIT"), 2, func() {
+		expect(get("/api/inventory?limit=10&skip=0"), "MISS", `{"calls":1}`)
+		expect(get("/api/inventory?limit=10&skip=0"), "HIT", `{"calls":1}`)
+		// The same query in another order
+		expect(get("/api/inventory?skip=0&limit=10"), "HIT", `{"calls":1}`)
+	})
+	// Another query is another entry
+	expect(get("/api/inventory?limit=5"), "MISS", `{"calls":2}`)
+	// A fresh response was asked for, and isn't stored
+	expect(get("/api/inventory?limit=10&skip=0", "Cache-Control", "no-cache"), "BYPASS", `{"calls":3}`)
+	expect(get("/api/inventory?limit=10&skip=0"), "HIT", `{"calls":1}`)
+
+	// Invalidating another group leaves the entries alone
+	rc.Invalidate(context.Background(), "test", cacheGroupStockLevels)
+	expect(get("/api/inventory?limit=10&skip=0"), "HIT", `{"calls":1}`)
+	testkit.AssertCounterDelta(t, responseCacheInvalidations.WithLabelValues(cacheGroupItems, "test"), 1, func() {
+		rc.Invalidate(context.Background(), "test", cacheGroupItems)
+	})
+	expect(get("/api/inventory?limit=10&skip=0"), "MISS", `{"calls":4}`)
+	expect(get("/api/inventory?limit=10&skip=0"), "HIT", `{"calls":4}`)
+
+	// Entries expire after the TTL
+	clock.now = clock.now.Add(59 * time.Second)
+	expect(get("/api/inventory?limit=10&skip=0"), "HIT", `{"calls":4}`)
+	clock.now = clock.now.Add(2 * time.Second)
+	expect(get("/api/inventory?limit=10&skip=0"), "MISS", `{"calls":5}`)
+
+	// Failed responses aren't stored
+	status = http.StatusInternalServerError
+	expect(get("/api/inventory?limit=1"), "MISS", `{"calls":6}`)
+	status = http.StatusOK
+	expect(get("/api/inventory?limit=1"), "MISS", `{"calls":7}`)
+}
+
+func TestResponseCacheUnavailable(t *testing.T) {
+	rc := &ResponseCache{store: &failingResponseStore{newMemoryResponseStore(10, systemClock{})}, ttl: time.Minute}
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.GET("/api/stock-levels", rc.Middleware(cacheGroupStockLevels), func(c *gin.Context) {
+		c.JSON(http.StatusOK, gin.H{})
+	})
+
+	// Served by the handler while the cache is down
+	for i := 0; i < 2; i++ {
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/stock-levels", nil))
+		if rec.Code != http.StatusOK || rec.Header().Get("X-Cache") != "ERROR" {
+			t.Errorf("got status %d, X-Cache %q", rec.Code, rec.Header().Get("X-Cache"))
+		}
+	}
+}
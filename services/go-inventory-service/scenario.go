@@ -0,0 +1,545 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"gopkg.in/yaml.v3"
+
+	"inventory-service/clients/inventory"
+)
+
+var (
+	scenarioRunning = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "scenario_running",
+			Help: "Whether a demo scenario is currently running (1) or not (0)",
+		},
+		[]string{"scenario"},
+	)
+
+	scenarioCurrentStep = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "scenario_current_step",
+			Help: "Index (1-based) of the step the running scenario is executing",
+		},
+		[]string{"scenario"},
+	)
+
+	scenarioStepsCompleted = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "scenario_steps_completed_total",
+			Help: "Total number of completed scenario steps",
+		},
+		[]string{"scenario", "action"},
+	)
+
+	scenarioRuns = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "scenario_runs_total",
+			Help: "Total number of finished scenario runs by result",
+		},
+		[]string{"scenario", "result"},
+	)
+)
+
+// Scenario is a scripted sequence of load and fault injection steps,
+// loaded from <SCENARIOS_DIR>/<name>.yaml
+type Scenario struct {
+	Name        string         `yaml:"name"`
+	Description string         `yaml:"description"`
+	Steps       []ScenarioStep `yaml:"steps"`
+}
+
+// ScenarioStep is a single step of a scenario. Which fields apply depends on
+// the action:
+//
+//	load             generate HTTP load, ramping from rate to to_rate req/s over duration
+//	slow_queries     slow down percent% of database queries by delay
+//	break_mongo      make every MongoDB operation fail
+//	break_replica    make the PostgreSQL read replica fail
+//	leak_goroutines  leak rate goroutines per second
+//	clock_skew       shift the service's clock by offset
+//	wait             do nothing for duration
+//	recover          turn all fault injection off and release leaked goroutines
+//	read_only        turn writes away as in a maintenance window
+//	read_write       take writes again
+type ScenarioStep struct {
+	Name     string        `yaml:"name"`
+	Action   string        `yaml:"action"`
+	Duration time.Duration `yaml:"duration"`
+	Rate     float64       `yaml:"rate"`
+	ToRate   float64       `yaml:"to_rate"`
+	Percent  float64       `yaml:"percent"`
+	Delay    time.Duration `yaml:"delay"`
+	Offset   time.Duration `yaml:"offset"`
+}
+
+func (s ScenarioStep) label() string {
+	if s.Name != "" {
+		return s.Name
+	}
+	return s.Action
+}
+
+// Validate checks that every step has a known action and the fields it needs
+func (s *Scenario) Validate() error {
+	if len(s.Steps) == 0 {
+		return errors.New("scenario has no steps")
+	}
+	for i, step := range s.Steps {
+		var err error
+		switch step.Action {
+		case "load":
+			if step.Duration <= 0 || step.Rate <= 0 {
+				err = errors.New("load needs a positive duration and rate")
+			} else if step.ToRate < 0 {
+				err = errors.New("load to_rate must not be negative")
+			}
+		case "slow_queries":
+			if step.Percent < 0 || step.Percent > 100 {
+				err = errors.New("slow_queries percent must be between 0 and 100")
+			}
+		case "leak_goroutines":
+			if step.Rate <= 0 {
+				err = errors.New("leak_goroutines needs a positive rate")
+			}
+		case "wait":
+			if step.Duration <= 0 {
+				err = errors.New("wait needs a positive duration")
+			}
+		case "clock_skew":
+			if step.Offset == 0 {
+				err = errors.New("clock_skew needs a non-zero offset")
+			}
+		case "break_mongo", "break_replica", "recover", "read_only", "read_write":
+		default:
+			err = fmt.Errorf("unknown action %q", step.Action)
+		}
+		if err != nil {
+			return fmt.Errorf("step %d (%s): %w", i+1, step.label(), err)
+		}
+	}
+	return nil
+}
+
+// ScenarioRun is the status of a started scenario
+type ScenarioRun struct {
+	Scenario    string     `json:"scenario"`
+	State       string     `json:"state"`
+	CurrentStep int        `json:"current_step"`
+	TotalSteps  int        `json:"total_steps"`
+	StartedAt   time.Time  `json:"started_at"`
+	FinishedAt  *time.Time `json:"finished_at,omitempty"`
+	Error       string     `json:"error,omitempty"`
+	TraceID     string     `json:"trace_id"`
+}
+
+// ScenarioRunner executes one scenario at a time in the background
+type ScenarioRunner struct {
+	app *App
+	dir string
+	api *inventory.Client
+
+	// Item IDs for reads, zipfian so a few hot items get most of the traffic
+	zipfMu sync.Mutex
+	zipf   *rand.Zipf
+
+	mu     sync.Mutex
+	run    *ScenarioRun
+	cancel context.CancelFunc
+}
+
+var scenarioNamePattern = regexp.MustCompile(`^[a-zA-Z0-9_-]+$`)
+
+func newScenarioRunner(app *App, cfg ScenarioConfig, clientCfg HTTPClientConfig) *ScenarioRunner {
+	// Retrying, or cutting calls short, would change the load the scenario
+	// generates
+	clientCfg.Retries = 0
+	clientCfg.circuits = CircuitConfig{}
+	var tlsConfig *tls.Config
+	targetURL := cfg.TargetURL
+	if app.certs != nil {
+		tlsConfig = app.certs.ClientConfig()
+		if targetURL == "" {
+			targetURL = "https://localhost:8002"
+		}
+	}
+	if targetURL == "" {
+		targetURL = "http://localhost:8002"
+	}
+
+	return &ScenarioRunner{
+		app: app,
+		dir: cfg.Dir,
+		api: inventory.New(targetURL,
+			inventory.WithHTTPClient(newHTTPClient("scenario", clientCfg, tlsConfig)),
+			inventory.WithAPIKey(cfg.APIKey),
+			inventory.WithRetries(0, 0),
+		),
+		zipf: rand.NewZipf(rand.New(rand.NewSource(time.Now().UnixNano())), 1.2, 1, 999),
+	}
+}
+
+// Load and validate a scenario file
+func (r *ScenarioRunner) load(name string) (*Scenario, error) {
+	if !scenarioNamePattern.MatchString(name) {
+		return nil, fmt.Errorf("invalid scenario name %q", name)
+	}
+
+	data, err := os.ReadFile(filepath.Join(r.dir, name+".yaml"))
+	if err != nil {
+		return nil, err
+	}
+
+	var scenario Scenario
+	if err := yaml.Unmarshal(data, &scenario); err != nil {
+		return nil, fmt.Errorf("failed to parse scenario: %w", err)
+	}
+	if scenario.Name == "" {
+		scenario.Name = name
+	}
+	if err := scenario.Validate(); err != nil {
+		return nil, err
+	}
+	return &scenario, nil
+}
+
+// Start runs the scenario in the background. The run gets its own trace,
+// linked to the span of the request that started it.
+func (r *ScenarioRunner) Start(ctx context.Context, scenario *Scenario) (ScenarioRun, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.run != nil && r.run.State == "running" {
+		return *r.run, fmt.Errorf("scenario %q is already running", r.run.Scenario)
+	}
+
+	runCtx, cancel := context.WithCancel(context.Background())
+	runCtx, span := r.app.tracer.Start(runCtx, "scenario "+scenario.Name,
+		trace.WithNewRoot(),
+		trace.WithLinks(trace.LinkFromContext(ctx)),
+		trace.WithAttributes(
+			attribute.String("scenario.name", scenario.Name),
+			attribute.Int("scenario.steps", len(scenario.Steps)),
+		),
+	)
+
+	r.run = &ScenarioRun{
+		Scenario:   scenario.Name,
+		State:      "running",
+		TotalSteps: len(scenario.Steps),
+		StartedAt:  r.app.clock.Now(),
+		TraceID:    span.SpanContext().TraceID().String(),
+	}
+	r.cancel = cancel
+
+	go r.execute(runCtx, span, scenario)
+
+	return *r.run, nil
+}
+
+// Stop aborts the running scenario, if any
+func (r *ScenarioRunner) Stop() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.run == nil || r.run.State != "running" {
+		return false
+	}
+	r.cancel()
+	return true
+}
+
+// Status returns the current or last scenario run
+func (r *ScenarioRunner) Status() (ScenarioRun, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.run == nil {
+		return ScenarioRun{}, false
+	}
+	return *r.run, true
+}
+
+func (r *ScenarioRunner) setStep(step int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.run.CurrentStep = step
+}
+
+func (r *ScenarioRunner) finish(state string, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := r.app.clock.Now()
+	r.run.State = state
+	r.run.FinishedAt = &now
+	if err != nil {
+		r.run.Error = err.Error()
+	}
+	r.cancel()
+}
+
+// Undo the faults of a scenario that didn't get to its recover step, so an
+// aborted or failed run doesn't leave the service broken
+func (r *ScenarioRunner) undoFaults(readOnly bool) {
+	r.app.chaos.Reset()
+	if readOnly {
+		r.app.readOnly.Set(false, "", r.app.clock.Now())
+	}
+}
+
+func (r *ScenarioRunner) execute(ctx context.Context, span trace.Span, scenario *Scenario) {
+	defer span.End()
+
+	scenarioRunning.WithLabelValues(scenario.Name).Set(1)
+	defer scenarioRunning.WithLabelValues(scenario.Name).Set(0)
+	defer scenarioCurrentStep.WithLabelValues(scenario.Name).Set(0)
+
+	logWithTrace(ctx, "INFO", "Scenario started", "scenario", scenario.Name, "steps", len(scenario.Steps))
+
+	// Whether the scenario left the service in read-only mode
+	readOnly := false
+	for i, step := range scenario.Steps {
+		r.setStep(i + 1)
+		scenarioCurrentStep.WithLabelValues(scenario.Name).Set(float64(i + 1))
+		span.AddEvent("scenario.step", trace.WithAttributes(
+			attribute.Int("scenario.step", i+1),
+			attribute.String("scenario.action", step.Action),
+		))
+		logWithTrace(ctx, "INFO", "Scenario step started",
+			"scenario", scenario.Name, "step", i+1, "name", step.label(), "action", step.Action)
+
+		if err := r.executeStep(ctx, step); err != nil {
+			state, result := "failed", "failed"
+			if errors.Is(err, context.Canceled) {
+				state, result = "aborted", "aborted"
+			}
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+			logWithTrace(ctx, "WARN", "Scenario "+state,
+				"scenario", scenario.Name, "step", i+1, "error", err.Error())
+			scenarioRuns.WithLabelValues(scenario.Name, result).Inc()
+			r.undoFaults(readOnly)
+			r.finish(state, err)
+			return
+		}
+		switch step.Action {
+		case "read_only":
+			readOnly = true
+		case "read_write":
+			readOnly = false
+		}
+
+		scenarioStepsCompleted.WithLabelValues(scenario.Name, step.Action).Inc()
+	}
+
+	logWithTrace(ctx, "INFO", "Scenario completed", "scenario", scenario.Name)
+	scenarioRuns.WithLabelValues(scenario.Name, "completed").Inc()
+	r.finish("completed", nil)
+}
+
+func (r *ScenarioRunner) executeStep(ctx context.Context, step ScenarioStep) error {
+	ctx, span := r.app.tracer.Start(ctx, "scenario.step "+step.label(),
+		trace.WithAttributes(attribute.String("scenario.action", step.Action)),
+	)
+	defer span.End()
+
+	switch step.Action {
+	case "load":
+		return r.generateLoad(ctx, step)
+	case "slow_queries":
+		r.app.chaos.SetSlowQueries(step.Percent, step.Delay)
+	case "break_mongo":
+		r.app.chaos.SetMongoBroken(true)
+	case "break_replica":
+		r.app.chaos.SetReplicaBroken(true)
+	case "leak_goroutines":
+		r.app.chaos.SetGoroutineLeak(step.Rate)
+	case "clock_skew":
+		r.app.chaos.SetClockSkew(step.Offset)
+	case "recover":
+		r.app.chaos.Reset()
+	case "read_only":
+		r.app.readOnly.Set(true, "", r.app.clock.Now())
+	case "read_write":
+		r.app.readOnly.Set(false, "", r.app.clock.Now())
+	case "wait":
+		return sleepContext(ctx, step.Duration)
+	}
+	return nil
+}
+
+// Send requests against the service's own API, ramping linearly from
+// step.Rate to step.ToRate requests per second over step.Duration
+func (r *ScenarioRunner) generateLoad(ctx context.Context, step ScenarioStep) error {
+	const maxInFlight = 64
+
+	toRate := step.ToRate
+	if toRate == 0 {
+		toRate = step.Rate
+	}
+
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	inFlight := make(chan struct{}, maxInFlight)
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+
+	start := time.Now()
+	pending := 0.0
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case now := <-ticker.C:
+			elapsed := now.Sub(start)
+			if elapsed >= step.Duration {
+				return nil
+			}
+
+			progress := elapsed.Seconds() / step.Duration.Seconds()
+			rate := step.Rate + (toRate-step.Rate)*progress
+			pending += rate / 10
+			for ; pending >= 1; pending-- {
+				select {
+				case inFlight <- struct{}{}:
+				default:
+					// Too many requests outstanding, drop this one
+					continue
+				}
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					defer func() { <-inFlight }()
+					r.sendLoadRequest(ctx)
+				}()
+			}
+		}
+	}
+}
+
+// Send one request of the load mix: mostly reads, some item creations
+func (r *ScenarioRunner) sendLoadRequest(ctx context.Context) {
+	method := http.MethodGet
+	var call func(ctx context.Context) error
+
+	switch n := rand.Intn(10); {
+	case n < 3:
+		call = func(ctx context.Context) error {
+			_, err := r.api.ListItems(ctx, 0, 20)
+			return err
+		}
+	case n < 6:
+		r.zipfMu.Lock()
+		id := int(r.zipf.Uint64() + 1)
+		r.zipfMu.Unlock()
+		call = func(ctx context.Context) error {
+			_, err := r.api.GetItem(ctx, id)
+			return err
+		}
+	case n < 9:
+		call = func(ctx context.Context) error {
+			_, err := r.api.ListStockLevels(ctx)
+			return err
+		}
+	default:
+		method = http.MethodPost
+		call = func(ctx context.Context) error {
+			_, err := r.api.CreateItem(ctx, inventory.CreateItemRequest{
+				ProductName: "Scenario Item",
+				SKU:         fmt.Sprintf("SCN-%d-%04d", time.Now().UnixNano(), rand.Intn(10000)),
+				Quantity:    1 + rand.Intn(100),
+				Location:    "Warehouse A",
+			})
+			return err
+		}
+	}
+
+	ctx, span := r.app.tracer.Start(ctx, "scenario.load "+method)
+	defer span.End()
+
+	err := call(ctx)
+	var apiErr *inventory.Error
+	switch {
+	case errors.As(err, &apiErr):
+		span.SetAttributes(attribute.Int("http.status_code", apiErr.StatusCode))
+		if apiErr.StatusCode >= 500 {
+			span.SetStatus(codes.Error, apiErr.Error())
+		}
+	case err != nil && !errors.Is(err, context.Canceled):
+		span.RecordError(err)
+	}
+}
+
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// Start a scenario: POST /admin/scenario/:name
+func (app *App) startScenario(c *gin.Context) {
+	ctx := c.Request.Context()
+	name := c.Param("name")
+
+	scenario, err := app.scenarios.load(name)
+	if errors.Is(err, os.ErrNotExist) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Scenario not found"})
+		return
+	}
+	if err != nil {
+		logWithTrace(ctx, "WARN", "Invalid scenario", "scenario", name, "error", err.Error())
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	run, err := app.scenarios.Start(ctx, scenario)
+	if err != nil {
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error(), "run": run})
+		return
+	}
+
+	logWithTrace(ctx, "INFO", "Scenario accepted", "scenario", name, "scenario_trace_id", run.TraceID)
+	c.JSON(http.StatusAccepted, run)
+}
+
+// Status of the current or last scenario: GET /admin/scenario
+func (app *App) scenarioStatus(c *gin.Context) {
+	run, ok := app.scenarios.Status()
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "No scenario has been started"})
+		return
+	}
+	c.JSON(http.StatusOK, run)
+}
+
+// Abort the running scenario: DELETE /admin/scenario
+func (app *App) stopScenario(c *gin.Context) {
+	if !app.scenarios.Stop() {
+		c.JSON(http.StatusNotFound, gin.H{"error": "No scenario is running"})
+		return
+	}
+	log.Printf("Scenario abort requested")
+	c.JSON(http.StatusAccepted, gin.H{"status": "aborting"})
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func waitForScenario(t *testing.T, runner *ScenarioRunner, done func(ScenarioRun) bool) ScenarioRun {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		run, _ := runner.Status()
+		if done(run) {
+			return run
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("scenario didn't get there, status %+v", run)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestAbortedScenarioUndoesFaults(t *testing.T) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	clock := &fixedClock{now: now}
+	app := newFakeApp(t, &fakeItemStore{}, &fakeStockStore{}, clock)
+	app.readOnly = newReadOnlyMode(MaintenanceConfig{}, app.clock)
+	runner := &ScenarioRunner{app: app}
+
+	scenario := &Scenario{Name: "outage", Steps: []ScenarioStep{
+		{Action: "read_only"},
+		{Action: "break_mongo"},
+		{Action: "wait", Duration: time.Hour},
+		{Action: "recover"},
+	}}
+	if _, err := runner.Start(context.Background(), scenario); err != nil {
+		t.Fatal(err)
+	}
+
+	waitForScenario(t, runner, func(run ScenarioRun) bool { return run.CurrentStep == 3 })
+	if app.chaos.mongoFault() == nil || !app.readOnly.Status().ReadOnly {
+		t.Fatal("scenario didn't break mongo and switch to read-only")
+	}
+
+	if !runner.Stop() {
+		t.Fatal("no scenario running")
+	}
+	run := waitForScenario(t, runner, func(run ScenarioRun) bool { return run.State != "running" })
+
+	if run.State != "aborted" {
+		t.Errorf("got state %q, want aborted", run.State)
+	}
+	if run.FinishedAt == nil || !run.FinishedAt.Equal(now) {
+		t.Errorf("got finished at %v, want %v from the app's clock", run.FinishedAt, now)
+	}
+	if err := app.chaos.mongoFault(); err != nil {
+		t.Errorf("mongo still broken after abort: %v", err)
+	}
+	if app.readOnly.Status().ReadOnly {
+		t.Error("still read-only after abort")
+	}
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Security event types
+const (
+	securityEventAuthFailed  = "auth_failed"
+	securityEventForbidden   = "forbidden"
+	securityEventRateLimited = "rate_limited"
+)
+
+var securityEventsTotal = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "security_events_total",
+		Help: "Total number of security events by event type and caller",
+	},
+	[]string{"event", "caller"},
+)
+
+// Record a security event for a request: it is counted by type and caller
+// and logged with "log_stream": "security", so a security dashboard can
+// select the events in Loki without matching on messages. Callers that
+// couldn't be identified are reported as "anonymous".
+func recordSecurityEvent(c *gin.Context, event, caller string, status int, fields ...interface{}) {
+	if caller == "" {
+		caller = "anonymous"
+	}
+	securityEventsTotal.WithLabelValues(event, caller).Inc()
+
+	fields = append([]interface{}{
+		"log_stream", "security",
+		"log_type", "audit",
+		"event", event,
+		"caller", caller,
+		"client_ip", c.ClientIP(),
+		"user_agent", c.Request.UserAgent(),
+		"method", c.Request.Method,
+		"path", c.FullPath(),
+		"status", status,
+	}, fields...)
+	logWithTrace(c.Request.Context(), "WARN", "Security event: "+event, fields...)
+}
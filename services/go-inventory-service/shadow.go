@@ -0,0 +1,208 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var (
+	shadowRequests = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "shadow_requests_total",
+			Help: "Requests mirrored to SHADOW_URL by route and result: match, status_mismatch, slow, error or dropped",
+		},
+		[]string{"route", "result"},
+	)
+
+	shadowDuration = promauto.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "shadow_request_duration_seconds",
+			Help:    "Duration of the mirrored requests by route and target: primary (this service) or shadow",
+			Buckets: prometheus.DefBuckets,
+		},
+		[]string{"route", "target"},
+	)
+)
+
+// Set on mirrored requests, so a target that mirrors too doesn't mirror them
+// again
+const shadowHeader = "X-Shadow-Request"
+
+// Request headers copied to the mirrored request, so it is authorized and
+// negotiated like the original
+var shadowHeaders = []string{"Accept", "Authorization", "X-API-Key"}
+
+// Shadower mirrors a share of the read traffic to a second deployment, such
+// as a canary, after the request was answered. The mirrored response is
+// compared with the original by status and latency, and thrown away.
+type Shadower struct {
+	target    string
+	percent   float64
+	tolerance time.Duration
+	client    httpDoer
+	tracer    trace.Tracer
+	rand      randSource
+	// One slot per mirrored request in flight
+	slots    chan struct{}
+	inFlight sync.WaitGroup
+}
+
+// nil when SHADOW_URL is unset. tlsConfig may be nil.
+func newShadower(cfg ShadowConfig, clientCfg HTTPClientConfig, tlsConfig *tls.Config, tracer trace.Tracer) *Shadower {
+	if cfg.URL == "" {
+		return nil
+	}
+	// A retry would skew the comparison
+	clientCfg.Retries = 0
+	return &Shadower{
+		target:    strings.TrimSuffix(cfg.URL, "/"),
+		percent:   cfg.Percent,
+		tolerance: cfg.LatencyTolerance,
+		client:    newHTTPClient("shadow", clientCfg, tlsConfig),
+		tracer:    tracer,
+		rand:      globalRand{},
+		slots:     make(chan struct{}, cfg.MaxInFlight),
+	}
+}
+
+// The primary's answer to a mirrored request
+type shadowPrimary struct {
+	status   int
+	duration time.Duration
+	// The request's span, linked from the shadow span
+	span trace.SpanContext
+}
+
+// Middleware for the /api routes: mirrors SHADOW_PERCENT of the GET
+// requests once they are answered
+func (s *Shadower) Middleware(c *gin.Context) {
+	if s == nil || c.Request.Method != http.MethodGet || c.GetHeader(shadowHeader) != "" ||
+		s.rand.Float64()*100 >= s.percent {
+		c.Next()
+		return
+	}
+
+	start := time.Now()
+	c.Next()
+	// A stream ends when its client leaves, the mirrored one wouldn't
+	if strings.HasPrefix(c.Writer.Header().Get("Content-Type"), "text/event-stream") {
+		return
+	}
+	primary := shadowPrimary{
+		status:   c.Writer.Status(),
+		duration: time.Since(start),
+		span:     trace.SpanContextFromContext(c.Request.Context()),
+	}
+	route := c.FullPath()
+
+	select {
+	case s.slots <- struct{}{}:
+	default:
+		shadowRequests.WithLabelValues(route, "dropped").Inc()
+		return
+	}
+	// Built here, the gin context is reused once the handler returns
+	req, err := http.NewRequest(http.MethodGet, s.target+c.Request.URL.RequestURI(), nil)
+	if err != nil {
+		<-s.slots
+		shadowRequests.WithLabelValues(route, "error").Inc()
+		return
+	}
+	for _, h := range shadowHeaders {
+		if v := c.GetHeader(h); v != "" {
+			req.Header.Set(h, v)
+		}
+	}
+	req.Header.Set(shadowHeader, "true")
+
+	s.inFlight.Add(1)
+	go func() {
+		defer s.inFlight.Done()
+		defer func() { <-s.slots }()
+		s.mirror(req, route, primary)
+	}()
+}
+
+// Send the mirrored request and compare its response with the primary's.
+// It gets a trace of its own, linked to the original request.
+func (s *Shadower) mirror(req *http.Request, route string, primary shadowPrimary) {
+	ctx, span := s.tracer.Start(context.Background(), "shadow "+route,
+		trace.WithLinks(trace.Link{SpanContext: primary.span}),
+		trace.WithAttributes(
+			attribute.String("http.route", route),
+			attribute.String("shadow.target", s.target),
+			attribute.Int("shadow.primary.status_code", primary.status),
+			attribute.Float64("shadow.primary.duration_seconds", primary.duration.Seconds()),
+		),
+	)
+	defer span.End()
+
+	start := time.Now()
+	resp, err := s.client.Do(req.WithContext(ctx))
+	if err == nil {
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+	}
+	duration := time.Since(start)
+
+	shadowDuration.WithLabelValues(route, "primary").Observe(primary.duration.Seconds())
+	fields := []interface{}{"route", route, "primary_status", primary.status, "primary_duration", primary.duration.String(),
+		"origin_trace_id", primary.span.TraceID().String()}
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		shadowRequests.WithLabelValues(route, "error").Inc()
+		logWithTrace(ctx, "WARN", "Shadow request failed", append(fields, "error", err.Error())...)
+		return
+	}
+	shadowDuration.WithLabelValues(route, "shadow").Observe(duration.Seconds())
+
+	result := "match"
+	switch {
+	case resp.StatusCode != primary.status:
+		result = "status_mismatch"
+	case duration-primary.duration > s.tolerance:
+		result = "slow"
+	}
+	span.SetAttributes(
+		attribute.Int("shadow.status_code", resp.StatusCode),
+		attribute.Float64("shadow.duration_seconds", duration.Seconds()),
+		attribute.String("shadow.result", result),
+	)
+	shadowRequests.WithLabelValues(route, result).Inc()
+	if result != "match" {
+		logWithTrace(ctx, "WARN", "Shadow response differs",
+			append(fields, "result", result, "shadow_status", resp.StatusCode, "shadow_duration", duration.String())...)
+	}
+}
+
+// Wait for the mirrored requests in flight, at shutdown
+func (s *Shadower) Wait(ctx context.Context) error {
+	if s == nil {
+		return nil
+	}
+	done := make(chan struct{})
+	go func() {
+		s.inFlight.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("shadow requests did not finish in time: %w", ctx.Err())
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel/attribute"
+
+	"inventory-service/internal/testkit"
+)
+
+func TestShadower(t *testing.T) {
+	tr := testkit.InstallTracing(t)
+
+	// The canary is slow on one route, and lost one item
+	var mirrored http.Header
+	canary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mirrored = r.Header
+		switch r.URL.Path {
+		case "/api/inventory/2":
+			w.WriteHeader(http.StatusNotFound)
+		case "/api/stock-levels":
+			time.Sleep(50 * time.Millisecond)
+		}
+	}))
+	defer canary.Close()
+
+	s := &Shadower{
+		target:    canary.URL,
+		percent:   50,
+		tolerance: 20 * time.Millisecond,
+		client:    canary.Client(),
+		tracer:    tr.Tracer("test"),
+		rand:      fixedRand(0.25),
+		slots:     make(chan struct{}, 1),
+	}
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	api := router.Group("/api", s.Middleware)
+	ok := func(c *gin.Context) { c.Status(http.StatusOK) }
+	api.GET("/inventory/:id", ok)
+	api.GET("/stock-levels", ok)
+	api.POST("/inventory", ok)
+
+	send := func(method, path string, header http.Header) {
+		req := httptest.NewRequest(method, path, nil)
+		for k, v := range header {
+			req.Header[k] = v
+		}
+		router.ServeHTTP(httptest.NewRecorder(), req)
+		if err := s.Wait(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, tc := range []struct {
+		path, route, result string
+	}{
+		{"/api/inventory/1", "/api/inventory/:id", "match"},
+		{"/api/inventory/2", "/api/inventory/:id", "status_mismatch"},
+		{"/api/stock-levels", "/api/stock-levels", "slow"},
+	} {
+		testkit.AssertCounterDelta(t, shadowRequests.WithLabelValues(tc.route, tc.result), 1, func() {
+			send(http.MethodGet, tc.path, http.Header{"X-Api-Key": {"secret"}})
+		})
+	}
+	if mirrored.Get("X-API-Key") != "secret" || mirrored.Get(shadowHeader) != "true" {
+		t.Errorf("got mirrored headers %v", mirrored)
+	}
+	tr.AssertSpan(t, "shadow /api/inventory/:id", attribute.String("shadow.result", "status_mismatch"))
+
+	// Writes, requests mirrored already and those outside the sample aren't
+	// mirrored
+	mirrored = nil
+	send(http.MethodPost, "/api/inventory", nil)
+	send(http.MethodGet, "/api/inventory/1", http.Header{"X-Shadow-Request": {"true"}})
+	s.rand = fixedRand(0.5)
+	send(http.MethodGet, "/api/inventory/1", nil)
+	if mirrored != nil {
+		t.Errorf("request mirrored with headers %v", mirrored)
+	}
+
+	// Dropped without a free slot
+	s.rand = fixedRand(0.25)
+	s.slots <- struct{}{}
+	testkit.AssertCounterDelta(t, shadowRequests.WithLabelValues("/api/inventory/:id", "dropped"), 1, func() {
+		send(http.MethodGet, "/api/inventory/1", nil)
+	})
+}
@@ -0,0 +1,616 @@
+package main
+
+import (
+	"compress/gzip"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var (
+	snapshotOperations = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "snapshot_operations_total",
+			Help: "Total number of snapshots taken and restored by operation and result",
+		},
+		[]string{"operation", "result"},
+	)
+
+	snapshotDuration = promauto.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "snapshot_duration_seconds",
+			Help:    "Time to take or restore a snapshot in seconds, by operation",
+			Buckets: []float64{.1, .25, .5, 1, 2.5, 5, 10, 30, 60, 120, 300},
+		},
+		[]string{"operation"},
+	)
+
+	snapshotSize = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "snapshot_size_bytes",
+			Help: "Compressed size of the last snapshot taken",
+		},
+	)
+)
+
+var (
+	errInvalidSnapshot = errors.New("invalid snapshot")
+	// Only one snapshot or restore runs at a time per replica
+	errSnapshotRunning = errors.New("a snapshot or restore is already running")
+)
+
+// Version of the snapshot format, in the header of every snapshot
+const snapshotFormat = 1
+
+// A snapshot is a gzipped stream of JSON lines: the header, then the
+// records of each database in turn.
+type snapshotHeader struct {
+	Format    int       `json:"format"`
+	Name      string    `json:"name"`
+	CreatedAt time.Time `json:"created_at"`
+	Service   string    `json:"service"`
+	Version   string    `json:"version"`
+	// The request that took it
+	TraceID string `json:"trace_id"`
+}
+
+// snapshotRecord is a row or document of one of the databases
+type snapshotRecord struct {
+	DB   string          `json:"db"`
+	Kind string          `json:"kind"`
+	Data json.RawMessage `json:"data"`
+}
+
+// SnapshotStore reads and replaces the contents of one database for the
+// snapshots
+type SnapshotStore interface {
+	// Call fn with every record, all of them from the same point in time.
+	// data is marshaled to JSON.
+	Dump(ctx context.Context, fn func(kind string, data interface{}) error) error
+	// Replace the contents with the records next returns, until it returns
+	// io.EOF. Returns the number of records loaded.
+	Restore(ctx context.Context, next func() (snapshotRecord, error)) (int, error)
+}
+
+// A database in the snapshots, by the name its records carry
+type snapshotSource struct {
+	db    string
+	store SnapshotStore
+}
+
+// Snapshotter captures the inventory in PostgreSQL and MongoDB to the
+// object store and loads it back, so a demo state can be replayed on
+// another cluster. The databases are captured one after the other, so a
+// write between the two can show up in one and not the other.
+type Snapshotter struct {
+	objects ObjectStore
+	prefix  string
+	// In the order they are written and restored
+	sources []snapshotSource
+	tracer  trace.Tracer
+	clock   Clock
+
+	running sync.Mutex
+}
+
+// SnapshotInfo describes a snapshot taken or restored
+type SnapshotInfo struct {
+	Name      string    `json:"name"`
+	Key       string    `json:"key"`
+	CreatedAt time.Time `json:"created_at"`
+	// Compressed size, only for a snapshot taken
+	Size int64 `json:"size,omitempty"`
+	// Records by database
+	Records map[string]int `json:"records"`
+}
+
+func (s *Snapshotter) key(name string) string {
+	return s.prefix + name + ".jsonl.gz"
+}
+
+// Take a snapshot named name. It is written to a temporary file first, as
+// uploads need their size up front.
+func (s *Snapshotter) Create(ctx context.Context, name string) (SnapshotInfo, error) {
+	if !s.running.TryLock() {
+		return SnapshotInfo{}, errSnapshotRunning
+	}
+	defer s.running.Unlock()
+
+	info := SnapshotInfo{Name: name, Key: s.key(name), CreatedAt: s.clock.Now().UTC(), Records: map[string]int{}}
+	tmp, err := os.CreateTemp("", "snapshot-*.jsonl.gz")
+	if err != nil {
+		return info, err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	gz := gzip.NewWriter(tmp)
+	enc := json.NewEncoder(gz)
+	header := snapshotHeader{
+		Format:    snapshotFormat,
+		Name:      name,
+		CreatedAt: info.CreatedAt,
+		Service:   "inventory-service",
+		Version:   currentBuild.Version,
+		TraceID:   trace.SpanFromContext(ctx).SpanContext().TraceID().String(),
+	}
+	if err := enc.Encode(header); err != nil {
+		return info, err
+	}
+
+	for _, src := range s.sources {
+		dumpCtx, span := s.tracer.Start(ctx, "snapshot.dump "+src.db)
+		err := src.store.Dump(dumpCtx, func(kind string, data interface{}) error {
+			raw, err := json.Marshal(data)
+			if err != nil {
+				return err
+			}
+			info.Records[src.db]++
+			return enc.Encode(snapshotRecord{DB: src.db, Kind: kind, Data: raw})
+		})
+		span.SetAttributes(attribute.Int("snapshot.records", info.Records[src.db]))
+		if err != nil {
+			span.RecordError(err)
+			span.End()
+			return info, fmt.Errorf("failed to dump %s: %w", src.db, err)
+		}
+		span.End()
+	}
+	if err := gz.Close(); err != nil {
+		return info, err
+	}
+
+	if info.Size, err = tmp.Seek(0, io.SeekEnd); err != nil {
+		return info, err
+	}
+	uploadCtx, span := s.tracer.Start(ctx, "snapshot.upload")
+	defer span.End()
+	span.SetAttributes(attribute.String("snapshot.key", info.Key), attribute.Int64("snapshot.size", info.Size))
+	if err := s.objects.Put(uploadCtx, info.Key, tmp, info.Size, "application/gzip"); err != nil {
+		span.RecordError(err)
+		return info, fmt.Errorf("failed to upload snapshot: %w", err)
+	}
+	return info, nil
+}
+
+// Replace the contents of the databases with the snapshot named name,
+// streamed from the object store. Each database is replaced in one go, but
+// if a later one fails the earlier ones stay restored.
+func (s *Snapshotter) Restore(ctx context.Context, name string) (SnapshotInfo, error) {
+	if !s.running.TryLock() {
+		return SnapshotInfo{}, errSnapshotRunning
+	}
+	defer s.running.Unlock()
+
+	info := SnapshotInfo{Name: name, Key: s.key(name), Records: map[string]int{}}
+	body, err := s.objects.Get(ctx, info.Key)
+	if err != nil {
+		return info, err
+	}
+	defer body.Close()
+
+	gz, err := gzip.NewReader(body)
+	if err != nil {
+		return info, fmt.Errorf("%w: %v", errInvalidSnapshot, err)
+	}
+	r := &snapshotReader{dec: json.NewDecoder(gz)}
+	var header snapshotHeader
+	if err := r.dec.Decode(&header); err != nil {
+		return info, fmt.Errorf("%w: no header: %v", errInvalidSnapshot, err)
+	}
+	if header.Format != snapshotFormat {
+		return info, fmt.Errorf("%w: format %d, want %d", errInvalidSnapshot, header.Format, snapshotFormat)
+	}
+	info.CreatedAt = header.CreatedAt
+
+	for _, src := range s.sources {
+		restoreCtx, span := s.tracer.Start(ctx, "snapshot.restore "+src.db)
+		n, err := src.store.Restore(restoreCtx, func() (snapshotRecord, error) { return r.next(src.db) })
+		info.Records[src.db] = n
+		span.SetAttributes(attribute.Int("snapshot.records", n))
+		if err != nil {
+			span.RecordError(err)
+			span.End()
+			return info, fmt.Errorf("failed to restore %s: %w", src.db, err)
+		}
+		span.End()
+	}
+	if rec, err := r.peek(); err != nil {
+		return info, err
+	} else if rec != nil {
+		return info, fmt.Errorf("%w: records of unknown database %q", errInvalidSnapshot, rec.DB)
+	}
+	return info, nil
+}
+
+// Reads the records of a snapshot, one database after the other
+type snapshotReader struct {
+	dec     *json.Decoder
+	pending *snapshotRecord
+}
+
+// The next record without consuming it, nil at the end
+func (r *snapshotReader) peek() (*snapshotRecord, error) {
+	if r.pending != nil {
+		return r.pending, nil
+	}
+	var rec snapshotRecord
+	if err := r.dec.Decode(&rec); err == io.EOF {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("%w: %v", errInvalidSnapshot, err)
+	}
+	r.pending = &rec
+	return r.pending, nil
+}
+
+// The next record of db, or io.EOF once its records are done
+func (r *snapshotReader) next(db string) (snapshotRecord, error) {
+	rec, err := r.peek()
+	if err != nil {
+		return snapshotRecord{}, err
+	}
+	if rec == nil || rec.DB != db {
+		return snapshotRecord{}, io.EOF
+	}
+	r.pending = nil
+	return *rec, nil
+}
+
+// postgresSnapshotStore dumps and restores the warehouses and items
+type postgresSnapshotStore struct {
+	db    func() *sql.DB
+	chaos *Chaos
+}
+
+func (s *postgresSnapshotStore) Dump(ctx context.Context, fn func(kind string, data interface{}) error) error {
+	start := time.Now()
+	defer observeQuery("postgres", "dump_snapshot", start)
+	s.chaos.slowPostgres(ctx, s.db())
+
+	// One snapshot of the database for both tables
+	tx, err := s.db().BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.QueryContext(ctx, `SELECT name, region, capacity FROM warehouses ORDER BY name`)
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		var w Warehouse
+		if err := rows.Scan(&w.Name, &w.Region, &w.Capacity); err != nil {
+			rows.Close()
+			return err
+		}
+		if err := fn("warehouse", w); err != nil {
+			rows.Close()
+			return err
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	rows, err = tx.QueryContext(ctx, `
+		SELECT id, product_name, sku, quantity, location, created_at, updated_at, unit_price
+		FROM inventory
+		ORDER BY id
+	`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var item InventoryItem
+		if err := rows.Scan(&item.ID, &item.ProductName, &item.SKU,
+			&item.Quantity, &item.Location, &item.CreatedAt, &item.UpdatedAt, &item.UnitPrice); err != nil {
+			return err
+		}
+		if err := fn("item", item); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// Replace the warehouses and items in one transaction. The deletes and
+// inserts go through the triggers, so the change log shows the restore to
+// delta-sync clients. Reservations go with the items they were for.
+func (s *postgresSnapshotStore) Restore(ctx context.Context, next func() (snapshotRecord, error)) (int, error) {
+	start := time.Now()
+	defer observeQuery("postgres", "restore_snapshot", start)
+	s.chaos.slowPostgres(ctx, s.db())
+
+	tx, err := s.db().BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, `DELETE FROM inventory; DELETE FROM warehouses`); err != nil {
+		return 0, err
+	}
+	insertWarehouse, err := tx.PrepareContext(ctx, `INSERT INTO warehouses (name, region, capacity) VALUES ($1, $2, $3)`)
+	if err != nil {
+		return 0, err
+	}
+	insertItem, err := tx.PrepareContext(ctx, `
+		INSERT INTO inventory (id, product_name, sku, quantity, location, created_at, updated_at, unit_price)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+	`)
+	if err != nil {
+		return 0, err
+	}
+
+	n := 0
+	for ; ; n++ {
+		rec, err := next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return n, err
+		}
+		switch rec.Kind {
+		case "warehouse":
+			var w Warehouse
+			if err := json.Unmarshal(rec.Data, &w); err != nil {
+				return n, fmt.Errorf("%w: warehouse: %v", errInvalidSnapshot, err)
+			}
+			_, err = insertWarehouse.ExecContext(ctx, w.Name, w.Region, w.Capacity)
+		case "item":
+			var item InventoryItem
+			if err := json.Unmarshal(rec.Data, &item); err != nil {
+				return n, fmt.Errorf("%w: item: %v", errInvalidSnapshot, err)
+			}
+			_, err = insertItem.ExecContext(ctx, item.ID, item.ProductName, item.SKU,
+				item.Quantity, item.Location, item.CreatedAt, item.UpdatedAt, item.UnitPrice)
+		default:
+			return n, fmt.Errorf("%w: unknown postgres record %q", errInvalidSnapshot, rec.Kind)
+		}
+		if err != nil {
+			return n, warehouseError(err)
+		}
+	}
+
+	// New items get IDs after the restored ones
+	if _, err := tx.ExecContext(ctx,
+		`SELECT setval(pg_get_serial_sequence('inventory', 'id'), COALESCE(MAX(id), 0) + 1, false) FROM inventory`,
+	); err != nil {
+		return n, err
+	}
+	return n, tx.Commit()
+}
+
+// mongoSnapshotStore dumps and restores the stock levels, as canonical
+// extended JSON so every BSON type survives the round trip. Dumps take the
+// stock levels of either layout; restores lay them out as layout says, so a
+// snapshot also moves the stock levels from one layout to the other.
+type mongoSnapshotStore struct {
+	db     func() *mongo.Database
+	chaos  *Chaos
+	layout string
+}
+
+// Documents per insert when restoring
+const snapshotInsertBatch = 500
+
+// The collections holding stock levels
+func (s *mongoSnapshotStore) collections(ctx context.Context) ([]string, error) {
+	names, err := warehouseStockCollections(ctx, s.db())
+	if err != nil {
+		return nil, err
+	}
+	return append([]string{stockLevelsCollection}, names...), nil
+}
+
+func (s *mongoSnapshotStore) Dump(ctx context.Context, fn func(kind string, data interface{}) error) error {
+	start := time.Now()
+	defer observeQuery("mongodb", "dump_snapshot", start)
+
+	if err := s.chaos.mongoFaults(ctx, s.db()); err != nil {
+		return err
+	}
+	names, err := s.collections(ctx)
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		if err := s.dumpCollection(ctx, name, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *mongoSnapshotStore) dumpCollection(ctx context.Context, name string, fn func(kind string, data interface{}) error) error {
+	cursor, err := s.db().Collection(name).Find(ctx, bson.M{}, options.Find().SetSort(bson.D{{Key: "_id", Value: 1}}))
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(ctx)
+
+	for cursor.Next(ctx) {
+		doc, err := bson.MarshalExtJSON(cursor.Current, true, false)
+		if err != nil {
+			return err
+		}
+		if err := fn("stock_level", json.RawMessage(doc)); err != nil {
+			return err
+		}
+	}
+	return cursor.Err()
+}
+
+func (s *mongoSnapshotStore) Restore(ctx context.Context, next func() (snapshotRecord, error)) (int, error) {
+	start := time.Now()
+	defer observeQuery("mongodb", "restore_snapshot", start)
+
+	if err := s.chaos.mongoFaults(ctx, s.db()); err != nil {
+		return 0, err
+	}
+	names, err := s.collections(ctx)
+	if err != nil {
+		return 0, err
+	}
+	for _, name := range names {
+		if _, err := s.db().Collection(name).DeleteMany(ctx, bson.M{}); err != nil {
+			return 0, err
+		}
+	}
+
+	n := 0
+	batches := map[string][]interface{}{}
+	flush := func(name string) error {
+		batch := batches[name]
+		if len(batch) == 0 {
+			return nil
+		}
+		_, err := s.db().Collection(name).InsertMany(ctx, batch)
+		n += len(batch)
+		batches[name] = batch[:0]
+		return err
+	}
+	for {
+		rec, err := next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return n, err
+		}
+		if rec.Kind != "stock_level" {
+			return n, fmt.Errorf("%w: unknown mongodb record %q", errInvalidSnapshot, rec.Kind)
+		}
+		var doc bson.D
+		if err := bson.UnmarshalExtJSON(rec.Data, true, &doc); err != nil {
+			return n, fmt.Errorf("%w: stock level: %v", errInvalidSnapshot, err)
+		}
+		name := stockLevelsCollection
+		if s.layout == stockLayoutPerWarehouse {
+			name = warehouseStockCollection(documentWarehouse(doc))
+		}
+		if batches[name] = append(batches[name], doc); len(batches[name]) == snapshotInsertBatch {
+			if err := flush(name); err != nil {
+				return n, err
+			}
+		}
+	}
+	for name := range batches {
+		if err := flush(name); err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// Snapshot names become object keys and file names
+var snapshotNamePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]{0,127}$`)
+
+// Take a snapshot of the inventory, named by ?name= or after the time
+func (app *App) createSnapshot(c *gin.Context) {
+	ctx := c.Request.Context()
+	ctx, span := app.tracer.Start(ctx, "createSnapshot")
+	defer span.End()
+
+	name := c.DefaultQuery("name", "inventory-"+app.clock.Now().UTC().Format("20060102-150405"))
+	if !snapshotNamePattern.MatchString(name) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "name must be letters, digits, '.', '_' and '-', at most 128"})
+		return
+	}
+	span.SetAttributes(attribute.String("snapshot.name", name))
+
+	start := time.Now()
+	info, err := app.snapshots.Create(ctx, name)
+	snapshotDuration.WithLabelValues("create").Observe(time.Since(start).Seconds())
+	if errors.Is(err, errSnapshotRunning) {
+		c.JSON(http.StatusConflict, gin.H{"error": "A snapshot or restore is already running"})
+		return
+	}
+	if err != nil {
+		snapshotOperations.WithLabelValues("create", "error").Inc()
+		logWithTrace(ctx, "ERROR", "Failed to take snapshot", "snapshot", name, "error", err.Error())
+		span.RecordError(err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to take snapshot"})
+		return
+	}
+
+	snapshotOperations.WithLabelValues("create", "success").Inc()
+	snapshotSize.Set(float64(info.Size))
+	requestsTotal.WithLabelValues("POST", "/admin/snapshot", "201").Inc()
+	logWithTrace(ctx, "INFO", "Snapshot taken", "snapshot", name, "key", info.Key,
+		"size", info.Size, "records", info.Records)
+	c.JSON(http.StatusCreated, info)
+}
+
+// Replace the inventory with the snapshot named by ?name=
+func (app *App) restoreSnapshot(c *gin.Context) {
+	ctx := c.Request.Context()
+	ctx, span := app.tracer.Start(ctx, "restoreSnapshot")
+	defer span.End()
+
+	name := c.Query("name")
+	if !snapshotNamePattern.MatchString(name) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "name of the snapshot is required"})
+		return
+	}
+	span.SetAttributes(attribute.String("snapshot.name", name))
+
+	start := time.Now()
+	info, err := app.snapshots.Restore(ctx, name)
+	snapshotDuration.WithLabelValues("restore").Observe(time.Since(start).Seconds())
+	// Some of it may have been restored before a failure
+	if len(info.Records) > 0 {
+		message := "Restored snapshot " + name
+		if err != nil {
+			message = "Restored part of snapshot " + name + " before failing"
+		}
+		app.publishEvent(ctx, eventSnapshotRestored, "snapshot", name, message,
+			map[string]interface{}{"records": info.Records})
+	}
+	switch {
+	case errors.Is(err, errSnapshotRunning):
+		c.JSON(http.StatusConflict, gin.H{"error": "A snapshot or restore is already running"})
+		return
+	case errors.Is(err, errObjectNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "Snapshot not found"})
+		return
+	case err != nil:
+		snapshotOperations.WithLabelValues("restore", "error").Inc()
+		logWithTrace(ctx, "ERROR", "Failed to restore snapshot", "snapshot", name,
+			"records", info.Records, "error", err.Error())
+		span.RecordError(err)
+		if errors.Is(err, errInvalidSnapshot) {
+			c.JSON(http.StatusUnprocessableEntity, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to restore snapshot"})
+		return
+	}
+
+	snapshotOperations.WithLabelValues("restore", "success").Inc()
+	requestsTotal.WithLabelValues("POST", "/admin/restore", "200").Inc()
+	logWithTrace(ctx, "INFO", "Snapshot restored", "snapshot", name, "created_at", info.CreatedAt, "records", info.Records)
+	c.JSON(http.StatusOK, info)
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel/attribute"
+
+	"inventory-service/internal/testkit"
+)
+
+// fakeSnapshotStore holds the records of one database
+type fakeSnapshotStore struct {
+	records []snapshotRecord
+}
+
+func (s *fakeSnapshotStore) Dump(ctx context.Context, fn func(kind string, data interface{}) error) error {
+	for _, rec := range s.records {
+		if err := fn(rec.Kind, rec.Data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *fakeSnapshotStore) Restore(ctx context.Context, next func() (snapshotRecord, error)) (int, error) {
+	s.records = nil
+	for {
+		rec, err := next()
+		if err == io.EOF {
+			return len(s.records), nil
+		}
+		if err != nil {
+			return len(s.records), err
+		}
+		s.records = append(s.records, rec)
+	}
+}
+
+func newSnapshotApp(t *testing.T, dir string, pg, mongo *fakeSnapshotStore) (*App, *gin.Engine) {
+	app := newFakeApp(t, &fakeItemStore{}, &fakeStockStore{}, &fixedClock{now: time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)})
+	app.snapshots = &Snapshotter{
+		objects: &dirObjectStore{dir: dir},
+		prefix:  "snapshots/",
+		sources: []snapshotSource{{db: "postgres", store: pg}, {db: "mongodb", store: mongo}},
+		tracer:  app.tracer,
+		clock:   app.clock,
+	}
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.POST("/admin/snapshot", app.createSnapshot)
+	router.POST("/admin/restore", app.restoreSnapshot)
+	return app, router
+}
+
+func post(router *gin.Engine, target string) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, target, nil))
+	return rec
+}
+
+func TestSnapshotRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	pg := &fakeSnapshotStore{records: []snapshotRecord{
+		{DB: "postgres", Kind: "warehouse", Data: json.RawMessage(`{"name":"Warehouse A","region":"eu-west","capacity":100}`)},
+		{DB: "postgres", Kind: "item", Data: json.RawMessage(`{"id":1,"sku":"W-1"}`)},
+	}}
+	mongo := &fakeSnapshotStore{records: []snapshotRecord{
+		{DB: "mongodb", Kind: "stock_level", Data: json.RawMessage(`{"_id":{"$oid":"65e1c0a0f1d2c3b4a5968778"},"product_sku":"W-1"}`)},
+	}}
+	_, router := newSnapshotApp(t, dir, pg, mongo)
+
+	rec := post(router, "/admin/snapshot")
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("snapshot: got status %d: %s", rec.Code, rec.Body.String())
+	}
+	var info SnapshotInfo
+	json.Unmarshal(rec.Body.Bytes(), &info)
+	if info.Name != "inventory-20240301-120000" || info.Records["postgres"] != 2 || info.Records["mongodb"] != 1 {
+		t.Errorf("unexpected snapshot %+v", info)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "snapshots", info.Name+".jsonl.gz")); err != nil {
+		t.Fatalf("snapshot not written: %v", err)
+	}
+
+	// Restored on another replica with other contents
+	other := &fakeSnapshotStore{records: []snapshotRecord{{DB: "postgres", Kind: "item", Data: json.RawMessage(`{"id":9}`)}}}
+	otherMongo := &fakeSnapshotStore{}
+	app, router := newSnapshotApp(t, dir, other, otherMongo)
+	tr := testkit.InstallTracing(t)
+	app.snapshots.tracer = tr.Tracer("test")
+	rec = post(router, "/admin/restore?name="+info.Name)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("restore: got status %d: %s", rec.Code, rec.Body.String())
+	}
+	if !reflect.DeepEqual(other.records, pg.records) || !reflect.DeepEqual(otherMongo.records, mongo.records) {
+		t.Errorf("restored %v and %v, want %v and %v", other.records, otherMongo.records, pg.records, mongo.records)
+	}
+	tr.AssertSpan(t, "snapshot.restore postgres", attribute.Int("snapshot.records", 2))
+}
+
+func TestRestoreSnapshotErrors(t *testing.T) {
+	dir := t.TempDir()
+	pg := &fakeSnapshotStore{}
+	_, router := newSnapshotApp(t, dir, pg, &fakeSnapshotStore{})
+
+	if rec := post(router, "/admin/restore?name=missing"); rec.Code != http.StatusNotFound {
+		t.Errorf("missing snapshot: got status %d, want 404", rec.Code)
+	}
+	if rec := post(router, "/admin/restore?name=../etc"); rec.Code != http.StatusBadRequest {
+		t.Errorf("bad name: got status %d, want 400", rec.Code)
+	}
+
+	// Not gzipped
+	os.MkdirAll(filepath.Join(dir, "snapshots"), 0o755)
+	os.WriteFile(filepath.Join(dir, "snapshots", "corrupt.jsonl.gz"), []byte(`{"format":1}`), 0o644)
+	if rec := post(router, "/admin/restore?name=corrupt"); rec.Code != http.StatusUnprocessableEntity {
+		t.Errorf("corrupt snapshot: got status %d, want 422", rec.Code)
+	}
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	dependencyReady = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "startup_dependency_ready",
+			Help: "1 once a dependency checked at startup is reachable",
+		},
+		[]string{"dependency"},
+	)
+
+	dependencyWait = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "startup_dependency_wait_seconds",
+			Help: "Time a dependency took to become reachable at startup",
+		},
+		[]string{"dependency"},
+	)
+)
+
+// The dependencies checked at startup, as named in STARTUP_OPTIONAL
+const (
+	dependencyPostgres  = "postgres"
+	dependencyMongo     = "mongodb"
+	dependencyRedis     = "redis"
+	dependencyCollector = "collector"
+)
+
+var startupDependencies = []string{dependencyPostgres, dependencyMongo, dependencyRedis, dependencyCollector}
+
+// Longest pause between the attempts to reach a dependency the service
+// started without
+const maxDependencyBackoff = 30 * time.Second
+
+// Parse STARTUP_OPTIONAL, the comma separated dependencies the service may
+// start without
+func parseOptionalDependencies(s string) (map[string]bool, error) {
+	optional := map[string]bool{}
+	for _, name := range strings.Split(s, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		known := false
+		for _, d := range startupDependencies {
+			known = known || d == name
+		}
+		if !known {
+			return nil, fmt.Errorf("unknown dependency %q (known: %s)", name, strings.Join(startupDependencies, ", "))
+		}
+		optional[name] = true
+	}
+	return optional, nil
+}
+
+// Dependency is something the service needs to reach at startup. Check is
+// called until it succeeds or STARTUP_TIMEOUT is up; it may do the setup
+// that needs the dependency, such as creating the schema.
+type Dependency struct {
+	Name  string
+	Check func(ctx context.Context) error
+}
+
+// DependencyStatus is the outcome of a dependency's startup check
+type DependencyStatus struct {
+	Name     string
+	Ready    bool
+	Optional bool
+	Attempts int
+	Took     time.Duration
+	Err      error
+}
+
+// Startup checks the service's dependencies concurrently, each with
+// STARTUP_TIMEOUT, and decides whether the service can start: required
+// dependencies that can't be reached stop it, optional ones (STARTUP_OPTIONAL)
+// leave it running degraded while they are tried in the background.
+type Startup struct {
+	timeout       time.Duration
+	retryInterval time.Duration
+	optional      map[string]bool
+	deps          []Dependency
+
+	mu    sync.Mutex
+	ready map[string]bool
+}
+
+func newStartup(cfg StartupConfig) *Startup {
+	// Checked by the config validation
+	optional, _ := parseOptionalDependencies(cfg.Optional)
+	return &Startup{
+		timeout:       cfg.Timeout,
+		retryInterval: cfg.RetryInterval,
+		optional:      optional,
+		ready:         map[string]bool{},
+	}
+}
+
+// Add a dependency to check
+func (s *Startup) Add(name string, check func(ctx context.Context) error) {
+	s.deps = append(s.deps, Dependency{Name: name, Check: check})
+}
+
+// Optional reports whether the service may run without the dependency
+func (s *Startup) Optional(name string) bool {
+	return s != nil && s.optional[name]
+}
+
+// Ready reports whether the dependency has been reached since startup
+func (s *Startup) Ready(name string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.ready[name]
+}
+
+func (s *Startup) setReady(name string) {
+	s.mu.Lock()
+	s.ready[name] = true
+	s.mu.Unlock()
+	dependencyReady.WithLabelValues(name).Set(1)
+}
+
+// Run checks all dependencies at once and logs the report. It returns an
+// error if a required one couldn't be reached; the optional ones that
+// couldn't are tried again in the background until ctx is canceled.
+func (s *Startup) Run(ctx context.Context) ([]DependencyStatus, error) {
+	statuses := make([]DependencyStatus, len(s.deps))
+	var wg sync.WaitGroup
+	for i, dep := range s.deps {
+		dependencyReady.WithLabelValues(dep.Name).Set(0)
+		wg.Add(1)
+		go func(i int, dep Dependency) {
+			defer wg.Done()
+			statuses[i] = s.check(ctx, dep)
+		}(i, dep)
+	}
+	wg.Wait()
+
+	var missing []string
+	for _, status := range statuses {
+		fields := []interface{}{
+			"log_type", "startup",
+			"dependency", status.Name,
+			"ready", status.Ready,
+			"optional", status.Optional,
+			"attempts", status.Attempts,
+			"took_ms", status.Took.Milliseconds(),
+		}
+		level := "INFO"
+		if status.Err != nil {
+			fields = append(fields, "error", status.Err.Error())
+			level = "WARN"
+			if !status.Optional {
+				level = "ERROR"
+				missing = append(missing, fmt.Sprintf("%s (%v)", status.Name, status.Err))
+			}
+		}
+		logWithTrace(ctx, level, "Startup dependency check", fields...)
+	}
+	if len(missing) > 0 {
+		sort.Strings(missing)
+		return statuses, fmt.Errorf("required dependencies unavailable: %s", strings.Join(missing, ", "))
+	}
+
+	for i, status := range statuses {
+		if !status.Ready {
+			log.Printf("Starting without %s, retrying in the background", status.Name)
+			go s.retry(ctx, s.deps[i])
+		}
+	}
+	return statuses, nil
+}
+
+// Check a dependency until it's reachable or the timeout is up
+func (s *Startup) check(ctx context.Context, dep Dependency) DependencyStatus {
+	status := DependencyStatus{Name: dep.Name, Optional: s.optional[dep.Name]}
+	start := time.Now()
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+
+	for {
+		status.Attempts++
+		status.Err = dep.Check(ctx)
+		if status.Err == nil {
+			status.Ready = true
+			status.Took = time.Since(start)
+			s.setReady(dep.Name)
+			dependencyWait.WithLabelValues(dep.Name).Set(status.Took.Seconds())
+			return status
+		}
+
+		select {
+		case <-time.After(s.retryInterval):
+		case <-ctx.Done():
+			status.Took = time.Since(start)
+			if errors.Is(status.Err, context.DeadlineExceeded) || errors.Is(status.Err, context.Canceled) {
+				status.Err = fmt.Errorf("not reachable within %s: %w", s.timeout, status.Err)
+			}
+			return status
+		}
+	}
+}
+
+// Keep checking a dependency the service started without, backing off up
+// to maxDependencyBackoff, until it's reachable
+func (s *Startup) retry(ctx context.Context, dep Dependency) {
+	backoff := s.retryInterval
+	for {
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return
+		}
+
+		checkCtx, cancel := context.WithTimeout(ctx, s.timeout)
+		err := dep.Check(checkCtx)
+		cancel()
+		if err == nil {
+			s.setReady(dep.Name)
+			log.Printf("Dependency %s is reachable now", dep.Name)
+			return
+		}
+		if backoff *= 2; backoff > maxDependencyBackoff {
+			backoff = maxDependencyBackoff
+		}
+	}
+}
+
+// Check that the collector accepts connections. The exporter connects by
+// itself and drops the spans it can't send, so this is for the report.
+func checkCollector(endpoint string) func(ctx context.Context) error {
+	return func(ctx context.Context) error {
+		var d net.Dialer
+		conn, err := d.DialContext(ctx, "tcp", endpoint)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// A check that fails until it has been called n times
+func failTimes(n int32) func(context.Context) error {
+	var calls atomic.Int32
+	return func(ctx context.Context) error {
+		if calls.Add(1) <= n {
+			return errors.New("connection refused")
+		}
+		return nil
+	}
+}
+
+func TestStartupRequiredDependency(t *testing.T) {
+	startup := newStartup(StartupConfig{Timeout: 50 * time.Millisecond, RetryInterval: 5 * time.Millisecond, Optional: "collector"})
+	startup.Add(dependencyPostgres, failTimes(2))
+	startup.Add(dependencyMongo, failTimes(1000))
+	startup.Add(dependencyCollector, failTimes(1000))
+
+	statuses, err := startup.Run(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "mongodb") || strings.Contains(err.Error(), "collector") {
+		t.Fatalf("got error %v, want MongoDB to stop the startup", err)
+	}
+	if s := statuses[0]; !s.Ready || s.Attempts != 3 || !startup.Ready(dependencyPostgres) {
+		t.Errorf("got status %+v, want PostgreSQL reached at the third attempt", s)
+	}
+	if s := statuses[1]; s.Ready || s.Optional || !strings.Contains(s.Err.Error(), "connection refused") {
+		t.Errorf("got status %+v", s)
+	}
+}
+
+func TestStartupDegraded(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	startup := newStartup(StartupConfig{Timeout: 20 * time.Millisecond, RetryInterval: 5 * time.Millisecond, Optional: "mongodb"})
+	startup.Add(dependencyPostgres, failTimes(0))
+	// Down at startup, back after a few retries in the background
+	var calls atomic.Int32
+	startup.Add(dependencyMongo, func(ctx context.Context) error {
+		if calls.Add(1) < 4 {
+			<-ctx.Done()
+			return ctx.Err()
+		}
+		return nil
+	})
+
+	statuses, err := startup.Run(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := statuses[1]; s.Ready || !s.Optional || !errors.Is(s.Err, context.DeadlineExceeded) {
+		t.Errorf("got status %+v, want MongoDB timed out", s)
+	}
+
+	// Unhealthy without PostgreSQL, only degraded without MongoDB
+	app := newFakeApp(t, &fakeItemStore{}, &fakeStockStore{err: errors.New("connection refused")}, systemClock{})
+	app.startup = startup
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.GET("/health", app.healthCheck)
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/health", nil))
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"status":"degraded"`) {
+		t.Errorf("got status %d: %s", rec.Code, rec.Body.String())
+	}
+	app.itemStore = &fakeItemStore{err: errors.New("connection refused")}
+	rec = httptest.NewRecorder()
+	router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/health", nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("got status %d without PostgreSQL, want 503", rec.Code)
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for !startup.Ready(dependencyMongo) && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if !startup.Ready(dependencyMongo) {
+		t.Error("MongoDB not picked up in the background")
+	}
+}
@@ -0,0 +1,379 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var (
+	stockLevelsMigrated = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "stock_level_migrated_total",
+			Help: "Stock levels moved from the stock_levels collection to their warehouse's",
+		},
+	)
+
+	stockLevelsUnmigrated = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "stock_level_migration_remaining",
+			Help: "Stock levels still in the stock_levels collection, waiting to move to their warehouse's",
+		},
+	)
+)
+
+// How the stock levels are laid out in MongoDB (STOCK_LEVELS_LAYOUT)
+const (
+	// All in the stock_levels collection
+	stockLayoutSingle = "single"
+	// In a stock_levels.<warehouse> collection per warehouse
+	stockLayoutPerWarehouse = "per_warehouse"
+)
+
+const stockLevelsCollection = "stock_levels"
+
+// MongoDB's duplicate key error
+const mongoDuplicateKey = 11000
+
+// Characters not kept in the collection names
+var collectionNameUnsafe = regexp.MustCompile(`[^a-z0-9_-]+`)
+
+// The collection of the warehouse's stock levels in the per_warehouse
+// layout. Names differing only in case or punctuation share a collection,
+// which is why the queries still filter by warehouse.
+func warehouseStockCollection(warehouse string) string {
+	name := strings.Trim(collectionNameUnsafe.ReplaceAllString(strings.ToLower(warehouse), "_"), "_")
+	if name == "" {
+		name = "unassigned"
+	}
+	return stockLevelsCollection + "." + name
+}
+
+// The per warehouse stock level collections there are, by name
+func warehouseStockCollections(ctx context.Context, db *mongo.Database) ([]string, error) {
+	names, err := db.ListCollectionNames(ctx, bson.M{"name": bson.M{"$regex": `^` + regexp.QuoteMeta(stockLevelsCollection+".")}})
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// The value of a top level field of the document, nil if it has none
+func documentField(doc bson.D, key string) interface{} {
+	for _, e := range doc {
+		if e.Key == key {
+			return e.Value
+		}
+	}
+	return nil
+}
+
+// The warehouse of a stock level document
+func documentWarehouse(doc bson.D) string {
+	w, _ := documentField(doc, "warehouse").(string)
+	return w
+}
+
+// shardedStockStore is the StockStore on MongoDB with a collection per
+// warehouse, so the stock levels of one warehouse are read without
+// scanning everyone's. Stock levels from the single layout are moved over
+// by Migrate on the leader; until the stock_levels collection is empty, it
+// is read and written alongside, and a stock level being moved may be
+// listed twice. The other replicas find out it's empty with CheckMigrated.
+type shardedStockStore struct {
+	db    func() *mongo.Database
+	chaos *Chaos
+	// Stock levels moved per Migrate run
+	batch int
+
+	// Set once the stock_levels collection is empty
+	migrated atomic.Bool
+	// The collections known to have their product_sku index
+	indexed sync.Map
+}
+
+func (s *shardedStockStore) legacy() *mongo.Collection {
+	return s.db().Collection(stockLevelsCollection)
+}
+
+// The warehouse's collection, with the unique SKU index the upserts need
+func (s *shardedStockStore) collection(ctx context.Context, warehouse string) (*mongo.Collection, error) {
+	name := warehouseStockCollection(warehouse)
+	coll := s.db().Collection(name)
+	if _, ok := s.indexed.Load(name); ok {
+		return coll, nil
+	}
+	if err := createSKUIndex(ctx, coll); err != nil {
+		return nil, err
+	}
+	s.indexed.Store(name, true)
+	return coll, nil
+}
+
+func (s *shardedStockStore) InsertStockLevel(ctx context.Context, level StockLevel) (interface{}, error) {
+	start := time.Now()
+	defer observeQuery("mongodb", "insert_stock_level", start)
+
+	if err := s.chaos.mongoFaults(ctx, s.db()); err != nil {
+		return nil, err
+	}
+	coll, err := s.collection(ctx, level.Warehouse)
+	if err != nil {
+		return nil, err
+	}
+	res, err := coll.InsertOne(ctx, level)
+	if err != nil {
+		return nil, err
+	}
+	return res.InsertedID, nil
+}
+
+func (s *shardedStockStore) UpsertStockLevel(ctx context.Context, level StockLevel) (interface{}, bool, error) {
+	start := time.Now()
+	defer observeQuery("mongodb", "upsert_stock_level", start)
+
+	if err := s.chaos.mongoFaults(ctx, s.db()); err != nil {
+		return nil, false, err
+	}
+	// Not moved over yet
+	if !s.migrated.Load() {
+		var doc struct {
+			ID interface{} `bson:"_id"`
+		}
+		err := s.legacy().FindOne(ctx, bson.M{"product_sku": level.ProductSKU},
+			options.FindOne().SetProjection(bson.M{"_id": 1})).Decode(&doc)
+		if err == nil {
+			return doc.ID, false, nil
+		}
+		if err != mongo.ErrNoDocuments {
+			return nil, false, err
+		}
+	}
+	coll, err := s.collection(ctx, level.Warehouse)
+	if err != nil {
+		return nil, false, err
+	}
+	return upsertStockLevel(ctx, coll, level)
+}
+
+func (s *shardedStockStore) DeleteStockLevel(ctx context.Context, warehouse string, id interface{}) error {
+	start := time.Now()
+	defer observeQuery("mongodb", "delete_stock_level", start)
+
+	if err := s.chaos.mongoFaults(ctx, s.db()); err != nil {
+		return err
+	}
+	res, err := s.db().Collection(warehouseStockCollection(warehouse)).DeleteOne(ctx, bson.M{"_id": id})
+	if err != nil {
+		return err
+	}
+	if res.DeletedCount == 0 && !s.migrated.Load() {
+		_, err = s.legacy().DeleteOne(ctx, bson.M{"_id": id})
+	}
+	return err
+}
+
+func (s *shardedStockStore) DeleteStockLevelsBySKU(ctx context.Context, warehouse string, skus []string) (int64, error) {
+	start := time.Now()
+	defer observeQuery("mongodb", "delete_stock_levels", start)
+
+	if err := s.chaos.mongoFaults(ctx, s.db()); err != nil {
+		return 0, err
+	}
+	filter := bson.M{"warehouse": warehouse, "product_sku": bson.M{"$in": skus}}
+	// From the stock_levels collection first: a copy Migrate makes after
+	// that is either deleted below or found deleted by Migrate
+	var n int64
+	if !s.migrated.Load() {
+		res, err := s.legacy().DeleteMany(ctx, filter)
+		if err != nil {
+			return 0, err
+		}
+		n = res.DeletedCount
+	}
+	res, err := s.db().Collection(warehouseStockCollection(warehouse)).DeleteMany(ctx, filter)
+	if err != nil {
+		return n, err
+	}
+	return n + res.DeletedCount, nil
+}
+
+func (s *shardedStockStore) ListStockLevels(ctx context.Context, warehouse string) ([]StockLevel, error) {
+	start := time.Now()
+	defer observeQuery("mongodb", "find_stock_levels", start)
+
+	if err := s.chaos.mongoFaults(ctx, s.db()); err != nil {
+		return nil, err
+	}
+	names := []string{warehouseStockCollection(warehouse)}
+	if warehouse == "" {
+		var err error
+		if names, err = warehouseStockCollections(ctx, s.db()); err != nil {
+			return nil, err
+		}
+	}
+	if !s.migrated.Load() {
+		names = append(names, stockLevelsCollection)
+	}
+
+	var stockLevels []StockLevel
+	for _, name := range names {
+		levels, err := findStockLevels(ctx, s.db().Collection(name), warehouse)
+		if err != nil {
+			return nil, err
+		}
+		stockLevels = append(stockLevels, levels...)
+	}
+	return stockLevels, nil
+}
+
+func (s *shardedStockStore) Ping(ctx context.Context) error {
+	if err := s.chaos.mongoFault(); err != nil {
+		return err
+	}
+	return s.db().Client().Ping(ctx, nil)
+}
+
+// Migrate moves up to a batch of stock levels from the stock_levels
+// collection to their warehouse's. A stock level is copied before it's
+// removed, so a run cut short is picked up by the next one without losing
+// or doubling any. Runs on the leader until the collection is empty.
+func (s *shardedStockStore) Migrate(ctx context.Context) error {
+	if s.migrated.Load() {
+		return nil
+	}
+	start := time.Now()
+	defer observeQuery("mongodb", "migrate_stock_levels", start)
+
+	if err := s.chaos.mongoFaults(ctx, s.db()); err != nil {
+		return err
+	}
+	cursor, err := s.legacy().Find(ctx, bson.M{},
+		options.Find().SetSort(bson.D{{Key: "_id", Value: 1}}).SetLimit(int64(s.batch)))
+	if err != nil {
+		return err
+	}
+	var docs []bson.D
+	if err := cursor.All(ctx, &docs); err != nil {
+		return err
+	}
+
+	byWarehouse := map[string][]interface{}{}
+	ids := make([]interface{}, 0, len(docs))
+	for _, doc := range docs {
+		w := documentWarehouse(doc)
+		byWarehouse[w] = append(byWarehouse[w], doc)
+		ids = append(ids, documentField(doc, "_id"))
+	}
+	for w, batch := range byWarehouse {
+		coll, err := s.collection(ctx, w)
+		if err != nil {
+			return err
+		}
+		// Copied by a run that didn't get to remove them
+		_, err = coll.InsertMany(ctx, batch, options.InsertMany().SetOrdered(false))
+		if err != nil && !onlyDuplicateKeys(err) {
+			return err
+		}
+	}
+
+	// Stock levels deleted since the batch was read, e.g. of an item that
+	// couldn't be created, mustn't come back with the copy. Those deleted
+	// from here on are deleted from the warehouse's collection as well.
+	cursor, err = s.legacy().Find(ctx, bson.M{"_id": bson.M{"$in": ids}}, options.Find().SetProjection(bson.M{"_id": 1}))
+	if err != nil {
+		return err
+	}
+	var left []bson.D
+	if err := cursor.All(ctx, &left); err != nil {
+		return err
+	}
+	for w, gone := range deletedDocuments(byWarehouse, left) {
+		if _, err := s.db().Collection(warehouseStockCollection(w)).DeleteMany(ctx, bson.M{"_id": bson.M{"$in": gone}}); err != nil {
+			return err
+		}
+	}
+	if len(left) > 0 {
+		if _, err := s.legacy().DeleteMany(ctx, bson.M{"_id": bson.M{"$in": ids}}); err != nil {
+			return err
+		}
+		stockLevelsMigrated.Add(float64(len(left)))
+	}
+
+	remaining, err := s.legacy().CountDocuments(ctx, bson.M{})
+	if err != nil {
+		return err
+	}
+	stockLevelsUnmigrated.Set(float64(remaining))
+	if remaining == 0 {
+		s.migrated.Store(true)
+		log.Printf("Stock levels migrated to per warehouse collections")
+	} else if len(left) > 0 {
+		logWithTrace(ctx, "INFO", "Migrated stock levels", "moved", len(left), "remaining", remaining)
+	}
+	return nil
+}
+
+// The IDs of the documents read by warehouse that are no longer among
+// those left, by warehouse
+func deletedDocuments(byWarehouse map[string][]interface{}, left []bson.D) map[string][]interface{} {
+	present := map[string]bool{}
+	for _, doc := range left {
+		present[fmt.Sprint(documentField(doc, "_id"))] = true
+	}
+	gone := map[string][]interface{}{}
+	for w, docs := range byWarehouse {
+		for _, doc := range docs {
+			if id := documentField(doc.(bson.D), "_id"); !present[fmt.Sprint(id)] {
+				gone[w] = append(gone[w], id)
+			}
+		}
+	}
+	return gone
+}
+
+// CheckMigrated finds out whether the leader has emptied the stock_levels
+// collection, so a replica that doesn't run Migrate stops reading and
+// writing it as well
+func (s *shardedStockStore) CheckMigrated(ctx context.Context) error {
+	if s.migrated.Load() {
+		return nil
+	}
+	n, err := s.legacy().CountDocuments(ctx, bson.M{}, options.Count().SetLimit(1))
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		s.migrated.Store(true)
+		log.Printf("Stock levels found migrated to per warehouse collections")
+	}
+	return nil
+}
+
+// Whether all writes of an insert failed on a duplicate key
+func onlyDuplicateKeys(err error) bool {
+	var bwe mongo.BulkWriteException
+	if !errors.As(err, &bwe) || bwe.WriteConcernError != nil || len(bwe.WriteErrors) == 0 {
+		return false
+	}
+	for _, we := range bwe.WriteErrors {
+		if we.Code != mongoDuplicateKey {
+			return false
+		}
+	}
+	return true
+}
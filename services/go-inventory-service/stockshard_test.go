@@ -0,0 +1,103 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+func TestWarehouseStockCollection(t *testing.T) {
+	for warehouse, want := range map[string]string{
+		"Warehouse A":     "stock_levels.warehouse_a",
+		"warehouse-a":     "stock_levels.warehouse-a",
+		"  Köln / Nord  ": "stock_levels.k_ln_nord",
+		"$system.x":       "stock_levels.system_x",
+		"":                "stock_levels.unassigned",
+		"...":             "stock_levels.unassigned",
+	} {
+		if got := warehouseStockCollection(warehouse); got != want {
+			t.Errorf("%q: got %q, want %q", warehouse, got, want)
+		}
+	}
+}
+
+func TestDocumentWarehouse(t *testing.T) {
+	doc := bson.D{{Key: "_id", Value: 7}, {Key: "product_sku", Value: "WID-1"}, {Key: "warehouse", Value: "Warehouse B"}}
+	if w := documentWarehouse(doc); w != "Warehouse B" {
+		t.Errorf("got %q", w)
+	}
+	if id := documentField(doc, "_id"); id != 7 {
+		t.Errorf("got _id %v", id)
+	}
+	if w := documentWarehouse(bson.D{{Key: "warehouse", Value: 3}}); w != "" {
+		t.Errorf("got %q for a warehouse that isn't a string", w)
+	}
+}
+
+func TestDeletedDocuments(t *testing.T) {
+	doc := func(id int) interface{} { return bson.D{{Key: "_id", Value: id}} }
+	byWarehouse := map[string][]interface{}{
+		"Warehouse A": {doc(1), doc(2)},
+		"Warehouse B": {doc(3)},
+	}
+	// 2 and 3 were deleted after the batch was read
+	gone := deletedDocuments(byWarehouse, []bson.D{{{Key: "_id", Value: 1}}})
+	if want := map[string][]interface{}{"Warehouse A": {2}, "Warehouse B": {3}}; !reflect.DeepEqual(gone, want) {
+		t.Errorf("got %v, want %v", gone, want)
+	}
+	if gone := deletedDocuments(byWarehouse, []bson.D{{{Key: "_id", Value: 1}}, {{Key: "_id", Value: 2}}, {{Key: "_id", Value: 3}}}); len(gone) != 0 {
+		t.Errorf("got %v with none deleted", gone)
+	}
+}
+
+func TestOnlyDuplicateKeys(t *testing.T) {
+	dup := mongo.WriteError{Code: mongoDuplicateKey}
+	for _, tt := range []struct {
+		err  error
+		want bool
+	}{
+		{mongo.BulkWriteException{WriteErrors: []mongo.BulkWriteError{{WriteError: dup}, {WriteError: dup}}}, true},
+		{mongo.BulkWriteException{WriteErrors: []mongo.BulkWriteError{{WriteError: dup}, {WriteError: mongo.WriteError{Code: 2}}}}, false},
+		{mongo.BulkWriteException{WriteConcernError: &mongo.WriteConcernError{Code: 64}}, false},
+		{mongo.ErrClientDisconnected, false},
+	} {
+		if got := onlyDuplicateKeys(tt.err); got != tt.want {
+			t.Errorf("%v: got %v, want %v", tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestGetStockLevelsByWarehouse(t *testing.T) {
+	stock := &fakeStockStore{levels: []StockLevel{
+		{ProductSKU: "WID-1", Warehouse: "Warehouse A"},
+		{ProductSKU: "WID-2", Warehouse: "Warehouse B"},
+		{ProductSKU: "WID-3", Warehouse: "Warehouse A"},
+	}}
+	app := newFakeApp(t, &fakeItemStore{}, stock, systemClock{})
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.GET("/api/stock-levels", app.getStockLevels)
+	for path, want := range map[string]int{
+		"/api/stock-levels":                         3,
+		"/api/stock-levels?warehouse=Warehouse+A":   2,
+		"/api/stock-levels?warehouse=Warehouse+Z":   0,
+		"/api/stock-levels?warehouse=Warehouse%20B": 1,
+	} {
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		var levels []StockLevel
+		if err := json.Unmarshal(rec.Body.Bytes(), &levels); err != nil {
+			t.Fatalf("%s: %v: %s", path, err, rec.Body.String())
+		}
+		if rec.Code != http.StatusOK || len(levels) != want {
+			t.Errorf("%s: got status %d and %d stock levels, want %d", path, rec.Code, len(levels), want)
+		}
+	}
+}
@@ -0,0 +1,333 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var (
+	stockLevelRetries = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "stock_level_write_retries_total",
+			Help: "Stock level writes retried within the request that created the item",
+		},
+	)
+
+	stockSyncFailures = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "stock_level_sync_failures_total",
+			Help: "New items whose stock level couldn't be written to MongoDB, by result: queued in the outbox or lost",
+		},
+		[]string{"result"},
+	)
+
+	stockSyncAttempts = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "stock_level_outbox_attempts_total",
+			Help: "Tries to write a stock level from the outbox, by result: synced or failed",
+		},
+		[]string{"result"},
+	)
+
+	stockSyncPending = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "stock_level_outbox_pending",
+			Help: "Stock levels waiting in the outbox, as of the last sync",
+		},
+	)
+)
+
+var errNoStockOutbox = errors.New("no stock level outbox")
+
+// Stock levels that couldn't be written to MongoDB with their item. One per
+// SKU; deleting the item drops it.
+const createStockOutboxQuery = `
+	CREATE TABLE IF NOT EXISTS stock_level_outbox (
+		id BIGSERIAL PRIMARY KEY,
+		item_id INTEGER NOT NULL REFERENCES inventory (id) ON DELETE CASCADE,
+		product_sku VARCHAR(100) NOT NULL UNIQUE,
+		level JSONB NOT NULL,
+		attempts INTEGER NOT NULL DEFAULT 0,
+		next_attempt_at TIMESTAMP NOT NULL,
+		last_error TEXT NOT NULL DEFAULT '',
+		created_at TIMESTAMP NOT NULL,
+		trace_id VARCHAR(32) NOT NULL DEFAULT '',
+		span_id VARCHAR(16) NOT NULL DEFAULT ''
+	);
+	CREATE INDEX IF NOT EXISTS stock_level_outbox_due ON stock_level_outbox (next_attempt_at);
+`
+
+// StockOutboxEntry is a stock level waiting to be written to MongoDB
+type StockOutboxEntry struct {
+	ID            int64
+	ItemID        int
+	Level         StockLevel
+	Attempts      int
+	NextAttemptAt time.Time
+	LastError     string
+	CreatedAt     time.Time
+	// The request that created the item
+	TraceID string
+	SpanID  string
+}
+
+// The span context of the request that created the item, invalid if it
+// wasn't traced
+func (e StockOutboxEntry) origin() trace.SpanContext {
+	traceID, _ := trace.TraceIDFromHex(e.TraceID)
+	spanID, _ := trace.SpanIDFromHex(e.SpanID)
+	return trace.NewSpanContext(trace.SpanContextConfig{
+		TraceID: traceID, SpanID: spanID, TraceFlags: trace.FlagsSampled, Remote: true,
+	})
+}
+
+// StockOutboxStore holds the stock levels waiting for MongoDB (PostgreSQL)
+type StockOutboxStore interface {
+	// Queue the entry. One already queued for its SKU is kept.
+	EnqueueStockLevel(ctx context.Context, e StockOutboxEntry) error
+	// Up to limit entries due by now, the oldest first
+	DueStockLevels(ctx context.Context, now time.Time, limit int) ([]StockOutboxEntry, error)
+	// Remove an entry once its stock level is written
+	DeleteStockLevelEntry(ctx context.Context, id int64) error
+	// Record a failed try and when to try again
+	RetryStockLevelEntry(ctx context.Context, id int64, next time.Time, lastError string) error
+	CountStockLevelEntries(ctx context.Context) (int, error)
+}
+
+// postgresStockOutboxStore is the StockOutboxStore on PostgreSQL
+type postgresStockOutboxStore struct {
+	db    func() *sql.DB
+	chaos *Chaos
+}
+
+func (s *postgresStockOutboxStore) EnqueueStockLevel(ctx context.Context, e StockOutboxEntry) error {
+	start := time.Now()
+	defer observeQuery("postgres", "enqueue_stock_level", start)
+	s.chaos.slowPostgres(ctx, s.db())
+
+	level, err := json.Marshal(e.Level)
+	if err != nil {
+		return err
+	}
+	_, err = s.db().ExecContext(ctx, `
+		INSERT INTO stock_level_outbox (item_id, product_sku, level, next_attempt_at, last_error, created_at, trace_id, span_id)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+		ON CONFLICT (product_sku) DO NOTHING
+	`, e.ItemID, e.Level.ProductSKU, level, e.NextAttemptAt, e.LastError, e.CreatedAt, e.TraceID, e.SpanID)
+	return err
+}
+
+func (s *postgresStockOutboxStore) DueStockLevels(ctx context.Context, now time.Time, limit int) ([]StockOutboxEntry, error) {
+	start := time.Now()
+	defer observeQuery("postgres", "due_stock_levels", start)
+	s.chaos.slowPostgres(ctx, s.db())
+
+	rows, err := s.db().QueryContext(ctx, `
+		SELECT id, item_id, level, attempts, next_attempt_at, last_error, created_at, trace_id, span_id
+		FROM stock_level_outbox
+		WHERE next_attempt_at <= $1
+		ORDER BY id
+		LIMIT $2
+	`, now, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var entries []StockOutboxEntry
+	for rows.Next() {
+		var e StockOutboxEntry
+		var level []byte
+		if err := rows.Scan(&e.ID, &e.ItemID, &level, &e.Attempts, &e.NextAttemptAt, &e.LastError,
+			&e.CreatedAt, &e.TraceID, &e.SpanID); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(level, &e.Level); err != nil {
+			return nil, err
+		}
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
+
+func (s *postgresStockOutboxStore) DeleteStockLevelEntry(ctx context.Context, id int64) error {
+	start := time.Now()
+	defer observeQuery("postgres", "delete_stock_level_entry", start)
+	s.chaos.slowPostgres(ctx, s.db())
+
+	_, err := s.db().ExecContext(ctx, `DELETE FROM stock_level_outbox WHERE id = $1`, id)
+	return err
+}
+
+func (s *postgresStockOutboxStore) RetryStockLevelEntry(ctx context.Context, id int64, next time.Time, lastError string) error {
+	start := time.Now()
+	defer observeQuery("postgres", "retry_stock_level_entry", start)
+	s.chaos.slowPostgres(ctx, s.db())
+
+	_, err := s.db().ExecContext(ctx, `
+		UPDATE stock_level_outbox SET attempts = attempts + 1, next_attempt_at = $2, last_error = $3
+		WHERE id = $1
+	`, id, next, lastError)
+	return err
+}
+
+func (s *postgresStockOutboxStore) CountStockLevelEntries(ctx context.Context) (int, error) {
+	start := time.Now()
+	defer observeQuery("postgres", "count_stock_level_entries", start)
+
+	var n int
+	err := s.db().QueryRowContext(ctx, `SELECT COUNT(*) FROM stock_level_outbox`).Scan(&n)
+	return n, err
+}
+
+// Write a new item's stock level, retrying STOCK_SYNC_RETRIES times with
+// full jitter. Retries upsert by SKU, as a write that timed out may have
+// landed. With MongoDB's circuit open, there is no point in retrying.
+// Returns the ID of the stock level if this call inserted it, nil if its
+// SKU had one already, and the number of attempts.
+func (app *App) writeStockLevel(ctx context.Context, level StockLevel) (interface{}, int, error) {
+	id, err := app.stockStore.InsertStockLevel(ctx, level)
+	attempts := 1
+	for ; err != nil && !errors.Is(err, errCircuitOpen) && attempts <= app.stockSyncCfg.Retries; attempts++ {
+		ceiling := app.stockSyncCfg.RetryBackoff << (attempts - 1)
+		wait := time.Duration(0)
+		if ceiling > 0 {
+			wait = time.Duration(rand.Int63n(int64(ceiling)))
+		}
+		trace.SpanFromContext(ctx).AddEvent("mongodb.retry", trace.WithAttributes(
+			attribute.Int("mongodb.retry.attempt", attempts),
+			attribute.String("mongodb.retry.reason", err.Error()),
+		))
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, attempts, err
+		case <-timer.C:
+		}
+		stockLevelRetries.Inc()
+		var inserted bool
+		// Another item's stock level is not ours to remove if the item
+		// can't be created
+		if id, inserted, err = app.stockStore.UpsertStockLevel(ctx, level); !inserted {
+			id = nil
+		}
+	}
+	return id, attempts, err
+}
+
+// The item was created but its stock level wasn't: mark the divergence on
+// the request's span and queue the stock level in the outbox
+func (app *App) queueStockLevel(ctx context.Context, item InventoryItem, level StockLevel, writeErr error) {
+	span := trace.SpanFromContext(ctx)
+	now := app.clock.Now()
+	e := StockOutboxEntry{
+		ItemID:        item.ID,
+		Level:         level,
+		NextAttemptAt: now.Add(app.stockSyncCfg.Interval),
+		LastError:     writeErr.Error(),
+		CreatedAt:     now,
+	}
+	e.TraceID, e.SpanID = spanIDs(ctx)
+
+	err := errNoStockOutbox
+	if app.stockOutbox != nil {
+		err = app.stockOutbox.EnqueueStockLevel(ctx, e)
+	}
+	span.AddEvent("stock_level.diverged", trace.WithAttributes(
+		attribute.String("item.sku", item.SKU),
+		attribute.String("stock_level.error", writeErr.Error()),
+		attribute.Bool("stock_level.queued", err == nil),
+	))
+	if err != nil {
+		stockSyncFailures.WithLabelValues("lost").Inc()
+		logWithTrace(ctx, "ERROR", "Stock level lost, MongoDB and the outbox failed", "item_id", item.ID, "sku", item.SKU,
+			"mongo_error", writeErr.Error(), "error", err.Error())
+		return
+	}
+	stockSyncFailures.WithLabelValues("queued").Inc()
+	logWithTrace(ctx, "WARN", "Stock level queued for sync", "item_id", item.ID, "sku", item.SKU,
+		"error", writeErr.Error())
+}
+
+// Stock levels written from the outbox per run
+const stockSyncBatch = 50
+
+// Write the stock levels due in the outbox to MongoDB. Runs on the leader
+// only.
+func (app *App) syncStockLevels(ctx context.Context) error {
+	n, err := app.stockOutbox.CountStockLevelEntries(ctx)
+	if err != nil {
+		return err
+	}
+	stockSyncPending.Set(float64(n))
+	if n == 0 {
+		return nil
+	}
+
+	entries, err := app.stockOutbox.DueStockLevels(ctx, app.clock.Now(), stockSyncBatch)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if err := app.syncStockLevel(ctx, e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Try to write one entry, in a span linked to the request that created the
+// item. Only failing to update the outbox is returned.
+func (app *App) syncStockLevel(ctx context.Context, e StockOutboxEntry) error {
+	var opts []trace.SpanStartOption
+	if origin := e.origin(); origin.IsValid() {
+		opts = append(opts, trace.WithLinks(trace.Link{SpanContext: origin}))
+	}
+	opts = append(opts, trace.WithAttributes(
+		attribute.Int("item.id", e.ItemID),
+		attribute.String("item.sku", e.Level.ProductSKU),
+		attribute.Int("stock_level.attempts", e.Attempts),
+		attribute.String("stock_level.origin_trace_id", e.TraceID),
+	))
+	ctx, span := app.tracer.Start(ctx, "stock_level.sync", opts...)
+	defer span.End()
+
+	fields := []interface{}{"item_id", e.ItemID, "sku", e.Level.ProductSKU, "attempts", e.Attempts + 1,
+		"origin_trace_id", e.TraceID}
+	if _, _, err := app.stockStore.UpsertStockLevel(ctx, e.Level); err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		stockSyncAttempts.WithLabelValues("failed").Inc()
+		logWithTrace(ctx, "WARN", "Stock level sync failed", append(fields, "error", err.Error())...)
+
+		// The interval, doubled for every failed try
+		backoff := app.stockSyncCfg.Interval << (e.Attempts + 1)
+		if backoff <= 0 || backoff > app.stockSyncCfg.MaxBackoff {
+			backoff = app.stockSyncCfg.MaxBackoff
+		}
+		return app.stockOutbox.RetryStockLevelEntry(ctx, e.ID, app.clock.Now().Add(backoff), err.Error())
+	}
+	if err := app.stockOutbox.DeleteStockLevelEntry(ctx, e.ID); err != nil {
+		return err
+	}
+
+	stockSyncAttempts.WithLabelValues("synced").Inc()
+	app.publishEvent(ctx, eventStockLevelRepaired, "stock_level", e.Level.ProductSKU,
+		fmt.Sprintf("Wrote the stock level of %s to MongoDB, %d tries after its item was created", e.Level.ProductSKU, e.Attempts+1),
+		map[string]interface{}{"sku": e.Level.ProductSKU, "item_id": e.ItemID, "attempts": e.Attempts + 1})
+	logWithTrace(ctx, "INFO", "Stock level synced from the outbox", fields...)
+	return nil
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+
+	"inventory-service/internal/testkit"
+)
+
+// fakeStockOutbox keeps the outbox in memory
+type fakeStockOutbox struct {
+	entries []StockOutboxEntry
+}
+
+func (s *fakeStockOutbox) EnqueueStockLevel(ctx context.Context, e StockOutboxEntry) error {
+	e.ID = int64(len(s.entries) + 1)
+	s.entries = append(s.entries, e)
+	return nil
+}
+
+func (s *fakeStockOutbox) DueStockLevels(ctx context.Context, now time.Time, limit int) ([]StockOutboxEntry, error) {
+	var due []StockOutboxEntry
+	for _, e := range s.entries {
+		if !e.NextAttemptAt.After(now) && len(due) < limit {
+			due = append(due, e)
+		}
+	}
+	return due, nil
+}
+
+func (s *fakeStockOutbox) DeleteStockLevelEntry(ctx context.Context, id int64) error {
+	for i, e := range s.entries {
+		if e.ID == id {
+			s.entries = append(s.entries[:i], s.entries[i+1:]...)
+			break
+		}
+	}
+	return nil
+}
+
+func (s *fakeStockOutbox) RetryStockLevelEntry(ctx context.Context, id int64, next time.Time, lastError string) error {
+	for i := range s.entries {
+		if e := &s.entries[i]; e.ID == id {
+			e.Attempts++
+			e.NextAttemptAt, e.LastError = next, lastError
+		}
+	}
+	return nil
+}
+
+func (s *fakeStockOutbox) CountStockLevelEntries(ctx context.Context) (int, error) {
+	return len(s.entries), nil
+}
+
+func newStockSyncApp(t *testing.T, stock *fakeStockStore, clock Clock) (*App, *fakeStockOutbox) {
+	app := newFakeApp(t, &fakeItemStore{}, stock, clock)
+	outbox := &fakeStockOutbox{}
+	app.stockOutbox = outbox
+	app.stockSyncCfg = StockSyncConfig{Retries: 2, RetryBackoff: time.Millisecond, Interval: 15 * time.Second, MaxBackoff: time.Minute}
+	return app, outbox
+}
+
+func TestCreateItemRetriesStockLevel(t *testing.T) {
+	stock := &fakeStockStore{failWrites: 2}
+	app, outbox := newStockSyncApp(t, stock, systemClock{})
+
+	testkit.AssertCounterDelta(t, stockLevelRetries, 2, func() {
+		if rec := postItem(app); rec.Code != http.StatusCreated {
+			t.Fatalf("got status %d, want 201", rec.Code)
+		}
+	})
+	if len(stock.levels) != 1 || len(outbox.entries) != 0 {
+		t.Errorf("got stock levels %+v and outbox %+v, want the stock level written", stock.levels, outbox.entries)
+	}
+}
+
+func TestFailedCreateKeepsOtherItemsStockLevel(t *testing.T) {
+	stock := &fakeStockStore{}
+	app, _ := newStockSyncApp(t, stock, systemClock{})
+	if rec := postItem(app); rec.Code != http.StatusCreated {
+		t.Fatalf("got status %d, want 201", rec.Code)
+	}
+
+	// The insert of the duplicate's stock level fails, and the retry finds
+	// the first item's; PostgreSQL turns the duplicate SKU down
+	stock.failWrites = 1
+	app.itemStore.(*fakeItemStore).err = errors.New(`duplicate key value violates unique constraint "inventory_sku_key"`)
+	if rec := postItem(app); rec.Code != http.StatusInternalServerError {
+		t.Fatalf("got status %d, want 500", rec.Code)
+	}
+	if len(stock.deleted) != 0 || len(stock.levels) != 1 {
+		t.Errorf("deleted %v of stock levels %+v, want the first item's kept", stock.deleted, stock.levels)
+	}
+}
+
+func TestStockLevelOutbox(t *testing.T) {
+	tr := testkit.InstallTracing(t)
+	clock := &fixedClock{now: time.Date(2024, 6, 1, 9, 0, 0, 0, time.UTC)}
+	stock := &fakeStockStore{err: errMongoUnavailable}
+	app, outbox := newStockSyncApp(t, stock, clock)
+	app.tracer = tr.Tracer("test")
+	events := &fakeEventStore{}
+	app.events = events
+
+	// Still failing after the retries: the item is created and its stock
+	// level queued
+	testkit.AssertCounterDelta(t, stockSyncFailures.WithLabelValues("queued"), 1, func() {
+		if rec := postItem(app); rec.Code != http.StatusCreated {
+			t.Fatalf("got status %d, want 201", rec.Code)
+		}
+	})
+	if len(outbox.entries) != 1 || outbox.entries[0].Level.ProductSKU != "W-1" || outbox.entries[0].ItemID != 1 {
+		t.Fatalf("got outbox %+v, want the stock level of W-1", outbox.entries)
+	}
+	testkit.AssertSpanEvent(t, tr.AssertSpan(t, "createItem"), "stock_level.diverged",
+		attribute.String("item.sku", "W-1"), attribute.Bool("stock_level.queued", true))
+	tr.AssertSpan(t, "mongodb.insert_stock_level", attribute.Int("mongodb.attempts", 3))
+
+	// Not due yet
+	if err := app.syncStockLevels(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if outbox.entries[0].Attempts != 0 {
+		t.Fatalf("entry tried before it was due: %+v", outbox.entries[0])
+	}
+
+	// MongoDB still down: tried again after twice the interval
+	clock.now = clock.now.Add(15 * time.Second)
+	if err := app.syncStockLevels(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if e := outbox.entries[0]; e.Attempts != 1 || !e.NextAttemptAt.Equal(clock.now.Add(30*time.Second)) {
+		t.Fatalf("got entry %+v after a failed try", e)
+	}
+
+	// MongoDB is back
+	stock.err = nil
+	clock.now = clock.now.Add(30 * time.Second)
+	testkit.AssertCounterDelta(t, stockSyncAttempts.WithLabelValues("synced"), 1, func() {
+		if err := app.syncStockLevels(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	})
+	if len(outbox.entries) != 0 || len(stock.levels) != 1 {
+		t.Errorf("got outbox %+v and stock levels %+v, want the stock level synced", outbox.entries, stock.levels)
+	}
+	span := tr.AssertSpan(t, "stock_level.sync", attribute.String("item.sku", "W-1"))
+	if len(span.Links) != 1 || span.Links[0].SpanContext.TraceID() != tr.AssertSpan(t, "createItem").SpanContext.TraceID() {
+		t.Errorf("sync span not linked to the request that created the item: %+v", span.Links)
+	}
+	if n := len(events.events); n == 0 || events.events[n-1].Type != eventStockLevelRepaired {
+		t.Errorf("got events %+v, want the repair last", events.events)
+	}
+}
@@ -0,0 +1,401 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// ItemStore holds the inventory items (PostgreSQL). Handlers only talk to
+// the database through it, so tests can put in a fake that fails or times
+// out on demand.
+type ItemStore interface {
+	// Insert the item, setting its ID, CreatedAt and UpdatedAt. Returns
+	// errWarehouseFull if its warehouse has no room for it.
+	CreateItem(ctx context.Context, item *InventoryItem) error
+	ListItems(ctx context.Context, skip, limit int) ([]InventoryItem, error)
+	// Find the item whose column ("id" or "sku") equals value. Returns
+	// sql.ErrNoRows if there is none.
+	FindItem(ctx context.Context, column string, value interface{}) (InventoryItem, error)
+	CountItems(ctx context.Context) (int64, error)
+	// The planner's row estimate, -1 when the table was never analyzed
+	EstimateItems(ctx context.Context) (int64, error)
+	// Up to limit changes after the afterSeq cursor and the since time, in
+	// order. Only changes that can no longer be overtaken by a transaction
+	// still in flight are returned.
+	ListChanges(ctx context.Context, afterSeq int64, since time.Time, limit int) ([]ItemChange, error)
+	// The sequence number of the oldest change kept, 0 when there is none
+	OldestChangeSeq(ctx context.Context) (int64, error)
+	Ping(ctx context.Context) error
+}
+
+// StockStore holds the stock levels (MongoDB)
+type StockStore interface {
+	// Insert the stock level, returning its ID
+	InsertStockLevel(ctx context.Context, level StockLevel) (interface{}, error)
+	// Insert the stock level unless its SKU has one already, returning the
+	// ID of either and whether it was inserted. Safe to repeat after a write
+	// that may have landed.
+	UpsertStockLevel(ctx context.Context, level StockLevel) (id interface{}, inserted bool, err error)
+	// Delete the stock level of the warehouse with the ID
+	DeleteStockLevel(ctx context.Context, warehouse string, id interface{}) error
+	// Delete the stock levels of the warehouse's SKUs, returning how many
+	DeleteStockLevelsBySKU(ctx context.Context, warehouse string, skus []string) (int64, error)
+	// The stock levels of the warehouse, or of all of them if it's empty
+	ListStockLevels(ctx context.Context, warehouse string) ([]StockLevel, error)
+	Ping(ctx context.Context) error
+}
+
+// postgresItemStore is the ItemStore on PostgreSQL. Every query records its
+// duration and goes through the chaos slow query simulation. Reads go to the
+// replica, if there is one.
+type postgresItemStore struct {
+	db      func() *sql.DB
+	replica *ReadReplica
+	chaos   *Chaos
+	clock   Clock
+}
+
+func (s *postgresItemStore) CreateItem(ctx context.Context, item *InventoryItem) error {
+	query := `
+		INSERT INTO inventory (product_name, sku, quantity, location, created_at, updated_at, last_trace_id, last_span_id, unit_price)
+		VALUES ($1, $2, $3, $4, $5, $5, $6, $7, $8)
+		RETURNING id, created_at, updated_at
+	`
+
+	start := time.Now()
+	s.chaos.slowPostgres(ctx, s.db())
+	traceID, spanID := spanIDs(ctx)
+	err := s.db().QueryRowContext(ctx, query,
+		item.ProductName, item.SKU, item.Quantity, item.Location, s.clock.Now(), traceID, spanID, item.UnitPrice,
+	).Scan(&item.ID, &item.CreatedAt, &item.UpdatedAt)
+	observeQuery("postgres", "insert_item", start)
+	return warehouseError(err)
+}
+
+func (s *postgresItemStore) ListItems(ctx context.Context, skip, limit int) ([]InventoryItem, error) {
+	query := `
+		SELECT id, product_name, sku, quantity, location, created_at, updated_at, unit_price
+		FROM inventory
+		ORDER BY created_at DESC
+		OFFSET $1 LIMIT $2
+	`
+
+	var items []InventoryItem
+	err := s.replica.Read(ctx, s.db(), func(db *sql.DB) error {
+		start := time.Now()
+		s.chaos.slowPostgres(ctx, db)
+		rows, err := db.QueryContext(ctx, query, skip, limit)
+		observeQuery("postgres", "list_items", start)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		if items, err = scanItems(rows, limit); err != nil {
+			return err
+		}
+		explainQuery(ctx, db, "list_items", query, skip, limit)
+		return nil
+	})
+	return items, err
+}
+
+func (s *postgresItemStore) FindItem(ctx context.Context, column string, value interface{}) (InventoryItem, error) {
+	query := `
+		SELECT id, product_name, sku, quantity, location, created_at, updated_at, unit_price
+		FROM inventory
+		WHERE ` + column + ` = $1
+	`
+
+	operation := "get_item"
+	if column != "id" {
+		operation = "get_item_by_" + column
+	}
+
+	var item InventoryItem
+	err := s.replica.Read(ctx, s.db(), func(db *sql.DB) error {
+		start := time.Now()
+		s.chaos.slowPostgres(ctx, db)
+		err := db.QueryRowContext(ctx, query, value).Scan(
+			&item.ID, &item.ProductName, &item.SKU,
+			&item.Quantity, &item.Location, &item.CreatedAt, &item.UpdatedAt, &item.UnitPrice,
+		)
+		observeQuery("postgres", operation, start)
+		if err != nil {
+			return err
+		}
+		explainQuery(ctx, db, operation, query, value)
+		return nil
+	})
+	return item, err
+}
+
+const countItemsQuery = `SELECT COUNT(*) FROM inventory`
+
+func (s *postgresItemStore) CountItems(ctx context.Context) (int64, error) {
+	var count int64
+	err := s.replica.Read(ctx, s.db(), func(db *sql.DB) error {
+		start := time.Now()
+		s.chaos.slowPostgres(ctx, db)
+		err := db.QueryRowContext(ctx, countItemsQuery).Scan(&count)
+		observeQuery("postgres", "count_items", start)
+		if err != nil {
+			return err
+		}
+		explainQuery(ctx, db, "count_items", countItemsQuery)
+		return nil
+	})
+	return count, err
+}
+
+func (s *postgresItemStore) EstimateItems(ctx context.Context) (int64, error) {
+	var estimate int64
+	err := s.replica.Read(ctx, s.db(), func(db *sql.DB) error {
+		start := time.Now()
+		err := db.QueryRowContext(ctx,
+			`SELECT reltuples::bigint FROM pg_class WHERE oid = 'inventory'::regclass`,
+		).Scan(&estimate)
+		observeQuery("postgres", "estimate_count_items", start)
+		return err
+	})
+	return estimate, err
+}
+
+func (s *postgresItemStore) ListChanges(ctx context.Context, afterSeq int64, since time.Time, limit int) ([]ItemChange, error) {
+	// A change's sequence number is taken when it is written but becomes
+	// visible at commit, so a later number can commit first. Stopping at the
+	// oldest transaction still running keeps a client's cursor from skipping
+	// past a change that commits afterwards. A replica that is behind
+	// returns fewer changes, never skips any.
+	query := `
+		SELECT c.seq, c.op, c.item_id, c.changed_at,
+			i.product_name, i.sku, i.quantity, i.location, i.created_at, i.updated_at, i.unit_price
+		FROM inventory_changes c
+		LEFT JOIN inventory i ON i.id = c.item_id AND c.op <> 'deleted'
+		WHERE c.seq > $1 AND c.changed_at > $2
+			AND c.txid < txid_snapshot_xmin(txid_current_snapshot())
+		ORDER BY c.seq
+		LIMIT $3
+	`
+
+	var changes []ItemChange
+	err := s.replica.Read(ctx, s.db(), func(db *sql.DB) error {
+		start := time.Now()
+		s.chaos.slowPostgres(ctx, db)
+		rows, err := db.QueryContext(ctx, query, afterSeq, since, limit)
+		observeQuery("postgres", "list_changes", start)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		if changes, err = scanChanges(rows, limit); err != nil {
+			return err
+		}
+		explainQuery(ctx, db, "list_changes", query, afterSeq, since, limit)
+		return nil
+	})
+	return changes, err
+}
+
+func (s *postgresItemStore) OldestChangeSeq(ctx context.Context) (int64, error) {
+	var seq int64
+	err := s.replica.Read(ctx, s.db(), func(db *sql.DB) error {
+		start := time.Now()
+		err := db.QueryRowContext(ctx, `SELECT COALESCE(MIN(seq), 0) FROM inventory_changes`).Scan(&seq)
+		observeQuery("postgres", "oldest_change", start)
+		return err
+	})
+	return seq, err
+}
+
+func scanChanges(rows *sql.Rows, limit int) ([]ItemChange, error) {
+	changes := make([]ItemChange, 0, min(max(limit, 0), maxItemsPrealloc))
+	for rows.Next() {
+		var change ItemChange
+		var name, sku, location sql.NullString
+		var quantity sql.NullInt64
+		var createdAt, updatedAt sql.NullTime
+		var unitPrice *float64
+		if err := rows.Scan(&change.Seq, &change.Op, &change.ItemID, &change.ChangedAt,
+			&name, &sku, &quantity, &location, &createdAt, &updatedAt, &unitPrice); err != nil {
+			return nil, fmt.Errorf("failed to scan change row %d: %w", len(changes), err)
+		}
+		// No item for a deletion, or when the item was deleted since
+		if name.Valid {
+			change.Item = &InventoryItem{
+				ID: change.ItemID, ProductName: name.String, SKU: sku.String,
+				Quantity: int(quantity.Int64), Location: location.String,
+				CreatedAt: createdAt.Time, UpdatedAt: updatedAt.Time, UnitPrice: unitPrice,
+			}
+		}
+		changes = append(changes, change)
+	}
+	return changes, rows.Err()
+}
+
+func (s *postgresItemStore) Ping(ctx context.Context) error {
+	return s.db().PingContext(ctx)
+}
+
+// mongoStockStore is the StockStore on MongoDB, with the chaos Mongo faults
+// applied ahead of every operation. All stock levels are in one collection;
+// see shardedStockStore for one per warehouse.
+type mongoStockStore struct {
+	db    func() *mongo.Database
+	chaos *Chaos
+	// Whether the collection has its SKU index
+	indexed atomic.Bool
+}
+
+func (s *mongoStockStore) collection() *mongo.Collection {
+	return s.db().Collection(stockLevelsCollection)
+}
+
+// The collection for writes, with the SKU index created on the first one
+func (s *mongoStockStore) writeCollection(ctx context.Context) (*mongo.Collection, error) {
+	coll := s.collection()
+	if s.indexed.Load() {
+		return coll, nil
+	}
+	if err := createSKUIndex(ctx, coll); err != nil {
+		return nil, err
+	}
+	s.indexed.Store(true)
+	return coll, nil
+}
+
+// Make the SKU unique in the collection, so that concurrent upserts of a
+// SKU can't insert a stock level each
+func createSKUIndex(ctx context.Context, coll *mongo.Collection) error {
+	_, err := coll.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "product_sku", Value: 1}},
+		Options: options.Index().SetUnique(true),
+	})
+	return err
+}
+
+func (s *mongoStockStore) InsertStockLevel(ctx context.Context, level StockLevel) (interface{}, error) {
+	start := time.Now()
+	defer observeQuery("mongodb", "insert_stock_level", start)
+
+	if err := s.chaos.mongoFaults(ctx, s.db()); err != nil {
+		return nil, err
+	}
+	coll, err := s.writeCollection(ctx)
+	if err != nil {
+		return nil, err
+	}
+	res, err := coll.InsertOne(ctx, level)
+	if err != nil {
+		return nil, err
+	}
+	return res.InsertedID, nil
+}
+
+func (s *mongoStockStore) UpsertStockLevel(ctx context.Context, level StockLevel) (interface{}, bool, error) {
+	start := time.Now()
+	defer observeQuery("mongodb", "upsert_stock_level", start)
+
+	if err := s.chaos.mongoFaults(ctx, s.db()); err != nil {
+		return nil, false, err
+	}
+	coll, err := s.writeCollection(ctx)
+	if err != nil {
+		return nil, false, err
+	}
+	return upsertStockLevel(ctx, coll, level)
+}
+
+// Insert the stock level into the collection unless its SKU has one. The
+// ID is chosen here, so the document from before the update tells which
+// of the two it was.
+func upsertStockLevel(ctx context.Context, coll *mongo.Collection, level StockLevel) (interface{}, bool, error) {
+	if level.ID.IsZero() {
+		level.ID = primitive.NewObjectID()
+	}
+	var doc struct {
+		ID interface{} `bson:"_id"`
+	}
+	err := coll.FindOneAndUpdate(ctx,
+		bson.M{"product_sku": level.ProductSKU},
+		bson.M{"$setOnInsert": level},
+		options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.Before).SetProjection(bson.M{"_id": 1}),
+	).Decode(&doc)
+	if err == mongo.ErrNoDocuments {
+		return level.ID, true, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	return doc.ID, false, nil
+}
+
+func (s *mongoStockStore) DeleteStockLevel(ctx context.Context, warehouse string, id interface{}) error {
+	start := time.Now()
+	defer observeQuery("mongodb", "delete_stock_level", start)
+
+	if err := s.chaos.mongoFaults(ctx, s.db()); err != nil {
+		return err
+	}
+	_, err := s.collection().DeleteOne(ctx, bson.M{"_id": id})
+	return err
+}
+
+func (s *mongoStockStore) DeleteStockLevelsBySKU(ctx context.Context, warehouse string, skus []string) (int64, error) {
+	start := time.Now()
+	defer observeQuery("mongodb", "delete_stock_levels", start)
+
+	if err := s.chaos.mongoFaults(ctx, s.db()); err != nil {
+		return 0, err
+	}
+	res, err := s.collection().DeleteMany(ctx, bson.M{"warehouse": warehouse, "product_sku": bson.M{"$in": skus}})
+	if err != nil {
+		return 0, err
+	}
+	return res.DeletedCount, nil
+}
+
+func (s *mongoStockStore) ListStockLevels(ctx context.Context, warehouse string) ([]StockLevel, error) {
+	start := time.Now()
+	defer observeQuery("mongodb", "find_stock_levels", start)
+
+	if err := s.chaos.mongoFaults(ctx, s.db()); err != nil {
+		return nil, err
+	}
+	return findStockLevels(ctx, s.collection(), warehouse)
+}
+
+// The stock levels in the collection, only the warehouse's unless it's empty
+func findStockLevels(ctx context.Context, coll *mongo.Collection, warehouse string) ([]StockLevel, error) {
+	filter := bson.M{}
+	if warehouse != "" {
+		filter["warehouse"] = warehouse
+	}
+	cursor, err := coll.Find(ctx, filter)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	var stockLevels []StockLevel
+	if err := cursor.All(ctx, &stockLevels); err != nil {
+		return nil, err
+	}
+	return stockLevels, nil
+}
+
+func (s *mongoStockStore) Ping(ctx context.Context) error {
+	if err := s.chaos.mongoFault(); err != nil {
+		return err
+	}
+	return s.db().Client().Ping(ctx, nil)
+}
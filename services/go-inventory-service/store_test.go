@@ -0,0 +1,296 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"inventory-service/internal/testkit"
+)
+
+// fakeItemStore keeps items in memory and fails with err when set
+type fakeItemStore struct {
+	items   []InventoryItem
+	changes []ItemChange
+	err     error
+}
+
+func (s *fakeItemStore) CreateItem(ctx context.Context, item *InventoryItem) error {
+	if s.err != nil {
+		return s.err
+	}
+	item.ID = len(s.items) + 1
+	s.items = append(s.items, *item)
+	return nil
+}
+
+func (s *fakeItemStore) ListItems(ctx context.Context, skip, limit int) ([]InventoryItem, error) {
+	return s.items, s.err
+}
+
+func (s *fakeItemStore) FindItem(ctx context.Context, column string, value interface{}) (InventoryItem, error) {
+	for _, item := range s.items {
+		if column == "id" && item.ID == value || column == "sku" && item.SKU == value {
+			return item, nil
+		}
+	}
+	return InventoryItem{}, sql.ErrNoRows
+}
+
+func (s *fakeItemStore) CountItems(ctx context.Context) (int64, error) {
+	return int64(len(s.items)), s.err
+}
+
+func (s *fakeItemStore) EstimateItems(ctx context.Context) (int64, error) {
+	return -1, s.err
+}
+
+func (s *fakeItemStore) ListChanges(ctx context.Context, afterSeq int64, since time.Time, limit int) ([]ItemChange, error) {
+	changes := []ItemChange{}
+	for _, change := range s.changes {
+		if change.Seq > afterSeq && change.ChangedAt.After(since) && len(changes) < limit {
+			changes = append(changes, change)
+		}
+	}
+	return changes, s.err
+}
+
+func (s *fakeItemStore) OldestChangeSeq(ctx context.Context) (int64, error) {
+	if len(s.changes) == 0 {
+		return 0, s.err
+	}
+	return s.changes[0].Seq, s.err
+}
+
+func (s *fakeItemStore) Ping(ctx context.Context) error { return s.err }
+
+// fakeStockStore records the stock levels written and deleted
+type fakeStockStore struct {
+	levels  []StockLevel
+	deleted []interface{}
+	err     error
+	// Writes fail with errMongoUnavailable until this many have
+	failWrites int
+}
+
+func (s *fakeStockStore) InsertStockLevel(ctx context.Context, level StockLevel) (interface{}, error) {
+	if s.err != nil {
+		return nil, s.err
+	}
+	if s.failWrites > 0 {
+		s.failWrites--
+		return nil, errMongoUnavailable
+	}
+	s.levels = append(s.levels, level)
+	return len(s.levels), nil
+}
+
+func (s *fakeStockStore) UpsertStockLevel(ctx context.Context, level StockLevel) (interface{}, bool, error) {
+	if s.err != nil {
+		return nil, false, s.err
+	}
+	for i, l := range s.levels {
+		if l.ProductSKU == level.ProductSKU {
+			return i + 1, false, nil
+		}
+	}
+	id, err := s.InsertStockLevel(ctx, level)
+	return id, err == nil, err
+}
+
+func (s *fakeStockStore) DeleteStockLevel(ctx context.Context, warehouse string, id interface{}) error {
+	s.deleted = append(s.deleted, id)
+	return nil
+}
+
+func (s *fakeStockStore) DeleteStockLevelsBySKU(ctx context.Context, warehouse string, skus []string) (int64, error) {
+	if s.err != nil {
+		return 0, s.err
+	}
+	var n int64
+	kept := s.levels[:0]
+	for _, l := range s.levels {
+		if l.Warehouse == warehouse && slices.Contains(skus, l.ProductSKU) {
+			n++
+			continue
+		}
+		kept = append(kept, l)
+	}
+	s.levels = kept
+	return n, nil
+}
+
+func (s *fakeStockStore) ListStockLevels(ctx context.Context, warehouse string) ([]StockLevel, error) {
+	if warehouse == "" || s.err != nil {
+		return s.levels, s.err
+	}
+	var levels []StockLevel
+	for _, l := range s.levels {
+		if l.Warehouse == warehouse {
+			levels = append(levels, l)
+		}
+	}
+	return levels, nil
+}
+
+func (s *fakeStockStore) Ping(ctx context.Context) error { return s.err }
+
+// fakeWarehouseStore allocates from a fixed list of warehouses
+type fakeWarehouseStore struct {
+	warehouses []Warehouse
+}
+
+func (s *fakeWarehouseStore) ListWarehouses(ctx context.Context) ([]Warehouse, error) {
+	return s.warehouses, nil
+}
+
+func (s *fakeWarehouseStore) PutWarehouse(ctx context.Context, w Warehouse) error {
+	s.warehouses = append(s.warehouses, w)
+	return nil
+}
+
+func (s *fakeWarehouseStore) AllocateWarehouse(ctx context.Context, quantity int, region string) (Warehouse, error) {
+	var best *Warehouse
+	for i, w := range s.warehouses {
+		if w.Free() >= quantity && (region == "" || w.Region == region) && (best == nil || w.Free() > best.Free()) {
+			best = &s.warehouses[i]
+		}
+	}
+	if best == nil {
+		return Warehouse{}, errNoWarehouseCapacity
+	}
+	return *best, nil
+}
+
+type fixedClock struct{ now time.Time }
+
+func (c *fixedClock) Now() time.Time { return c.now }
+
+// fixedRand returns the same number every time
+type fixedRand float64
+
+func (r fixedRand) Float64() float64 { return float64(r) }
+
+func newFakeApp(t *testing.T, items ItemStore, stock StockStore, clock Clock) *App {
+	tr := testkit.InstallTracing(t)
+	chaos := &Chaos{rand: fixedRand(0.5), leakRelease: make(chan struct{})}
+	return &App{
+		tracer:     tr.Tracer("test"),
+		json:       jsonEncoders["std"],
+		chaos:      chaos,
+		items:      &ItemCache{},
+		itemStore:  items,
+		stockStore: stock,
+		clock:      skewedClock{base: clock, chaos: chaos},
+	}
+}
+
+func postItem(app *App) *httptest.ResponseRecorder {
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.POST("/api/inventory", app.createItem)
+
+	body := `{"product_name": "Widget", "sku": "W-1", "quantity": 3, "location": "Warehouse A"}`
+	req := httptest.NewRequest(http.MethodPost, "/api/inventory", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestCreateItemRemovesOrphanedStockLevel(t *testing.T) {
+	stock := &fakeStockStore{}
+	app := newFakeApp(t, &fakeItemStore{err: context.DeadlineExceeded}, stock, systemClock{})
+
+	rec := postItem(app)
+	if rec.Code != http.StatusInternalServerError {
+		t.Fatalf("got status %d, want 500", rec.Code)
+	}
+	if len(stock.deleted) != 1 || stock.deleted[0] != 1 {
+		t.Errorf("orphaned stock level not deleted, deleted %v", stock.deleted)
+	}
+}
+
+func TestCreateItemMongoFailure(t *testing.T) {
+	items := &fakeItemStore{}
+	app := newFakeApp(t, items, &fakeStockStore{err: errMongoUnavailable}, systemClock{})
+
+	// MongoDB is secondary storage, its failure doesn't fail the request
+	rec := postItem(app)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("got status %d, want 201", rec.Code)
+	}
+	if len(items.items) != 1 {
+		t.Errorf("item not stored")
+	}
+}
+
+func TestCreateItemClockSkew(t *testing.T) {
+	now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	stock := &fakeStockStore{}
+	app := newFakeApp(t, &fakeItemStore{}, stock, &fixedClock{now: now})
+	app.chaos.SetClockSkew(-5 * time.Minute)
+
+	if rec := postItem(app); rec.Code != http.StatusCreated {
+		t.Fatalf("got status %d, want 201", rec.Code)
+	}
+	if len(stock.levels) != 1 || !stock.levels[0].UpdatedAt.Equal(now.Add(-5*time.Minute)) {
+		t.Errorf("stock level not written with the skewed clock: %+v", stock.levels)
+	}
+
+	app.chaos.Reset()
+	if got := app.clock.Now(); !got.Equal(now) {
+		t.Errorf("clock still skewed after reset: %s", got)
+	}
+}
+
+func TestSlowQueryDecision(t *testing.T) {
+	ch := &Chaos{rand: fixedRand(0.25)}
+	ch.SetSlowQueries(30, time.Second)
+	if got := ch.nextSlowQuery(); got != time.Second {
+		t.Errorf("query at 25 with 30%% slow: got delay %s, want 1s", got)
+	}
+
+	ch.SetSlowQueries(20, 0)
+	if got := ch.nextSlowQuery(); got != 0 {
+		t.Errorf("query at 25 with 20%% slow: got delay %s, want 0", got)
+	}
+}
+
+func TestLRUCacheExpiry(t *testing.T) {
+	clock := &fixedClock{now: time.Now()}
+	cache := newLRUCache[int, string]("test", 10, time.Minute, clock)
+
+	cache.Add(1, "one")
+	clock.now = clock.now.Add(59 * time.Second)
+	if _, ok := cache.Get(1); !ok {
+		t.Fatal("entry expired before its TTL")
+	}
+
+	clock.now = clock.now.Add(2 * time.Second)
+	if _, ok := cache.Get(1); ok {
+		t.Error("entry still cached after its TTL")
+	}
+}
+
+func TestHealthCheckStoreFailure(t *testing.T) {
+	app := newFakeApp(t, &fakeItemStore{}, &fakeStockStore{err: errors.New("connection refused")}, systemClock{})
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.GET("/health", app.healthCheck)
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/health", nil))
+
+	if rec.Code != http.StatusServiceUnavailable || !strings.Contains(rec.Body.String(), `"mongodb":"error"`) {
+		t.Errorf("got status %d: %s", rec.Code, rec.Body.String())
+	}
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"google.golang.org/grpc/credentials"
+)
+
+var exporterRestarts = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "otel_exporter_restarts_total",
+		Help: "Span exporters replaced through the admin API by result: success or failed",
+	},
+	[]string{"result"},
+)
+
+// How long the admin API waits for the collector
+const telemetryAdminTimeout = 30 * time.Second
+
+var errCollectorUnreachable = errors.New("collector is not reachable")
+
+// Telemetry is the span pipeline to the collector. Its exporter can be
+// flushed, and replaced by one for another collector, at runtime.
+// Metrics are scraped by Prometheus, so there is nothing to flush for them.
+type Telemetry struct {
+	tp      *sdktrace.TracerProvider
+	batcher *spanBatcher
+	certs   *CertReloader
+
+	// The collector the spans go to
+	mu       sync.Mutex
+	endpoint string
+	insecure bool
+}
+
+// TelemetryStatus is the collector the spans go to
+type TelemetryStatus struct {
+	Endpoint string `json:"endpoint"`
+	Insecure bool   `json:"insecure"`
+}
+
+// Create an OTLP exporter for the collector at endpoint. It uses TLS unless
+// insecure, presenting the service's certificate if mutual TLS is
+// configured.
+func newOTLPExporter(ctx context.Context, endpoint string, insecure bool, certs *CertReloader) (sdktrace.SpanExporter, error) {
+	opts := []otlptracegrpc.Option{otlptracegrpc.WithEndpoint(endpoint)}
+	if !insecure {
+		tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+		if certs != nil {
+			tlsConfig = certs.ClientConfig()
+		}
+		opts = append(opts, otlptracegrpc.WithTLSCredentials(credentials.NewTLS(tlsConfig)))
+	} else {
+		opts = append(opts, otlptracegrpc.WithInsecure())
+	}
+
+	exporter, err := otlptracegrpc.New(ctx, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create trace exporter: %w", err)
+	}
+	return exporter, nil
+}
+
+func (t *Telemetry) Status() TelemetryStatus {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return TelemetryStatus{Endpoint: t.endpoint, Insecure: t.insecure}
+}
+
+// Flush exports the spans ended so far
+func (t *Telemetry) Flush(ctx context.Context) error {
+	return t.tp.ForceFlush(ctx)
+}
+
+// Restart sends the spans to the collector at endpoint from now on. The
+// spans queued so far still go to the current one, which is shut down
+// after. A collector that can't be reached is refused, keeping the
+// current one.
+func (t *Telemetry) Restart(ctx context.Context, endpoint string, insecure bool) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if err := checkCollector(endpoint)(ctx); err != nil {
+		return fmt.Errorf("%w: %v", errCollectorUnreachable, err)
+	}
+	exporter, err := newOTLPExporter(ctx, endpoint, insecure, t.certs)
+	if err != nil {
+		return err
+	}
+	old, err := t.batcher.SwapExporter(ctx, exporter)
+	if err != nil {
+		exporter.Shutdown(ctx)
+		return err
+	}
+	t.endpoint, t.insecure = endpoint, insecure
+
+	if err := old.Shutdown(ctx); err != nil {
+		logWithTrace(ctx, "WARN", "Failed to shut down the previous span exporter", "error", err.Error())
+	}
+	return nil
+}
+
+// Export the spans ended so far, e.g. before looking for them in Tempo
+func (app *App) flushTelemetry(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), telemetryAdminTimeout)
+	defer cancel()
+
+	start := time.Now()
+	if err := app.telemetry.Flush(ctx); err != nil {
+		logWithTrace(ctx, "ERROR", "Failed to flush spans", "error", err.Error())
+		c.JSON(http.StatusGatewayTimeout, gin.H{"error": "Failed to flush spans: " + err.Error()})
+		return
+	}
+	requestsTotal.WithLabelValues("POST", "/admin/telemetry/flush", "200").Inc()
+	c.JSON(http.StatusOK, gin.H{"flushed": true, "took_ms": time.Since(start).Milliseconds()})
+}
+
+// TelemetryRestartRequest switches to another collector; the fields left
+// out keep their current values
+type TelemetryRestartRequest struct {
+	Endpoint string `json:"endpoint"`
+	Insecure *bool  `json:"insecure"`
+}
+
+// Rebuild the span exporter, for another collector or for the same one
+// after it was replaced
+func (app *App) restartTelemetry(c *gin.Context) {
+	ctx, span := app.tracer.Start(c.Request.Context(), "restartTelemetry")
+	defer span.End()
+
+	var req TelemetryRestartRequest
+	// An empty body rebuilds the exporter as it is
+	if c.Request.ContentLength != 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+	current := app.telemetry.Status()
+	if req.Endpoint == "" {
+		req.Endpoint = current.Endpoint
+	} else if _, _, err := net.SplitHostPort(req.Endpoint); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "endpoint must be host:port"})
+		return
+	}
+	insecure := current.Insecure
+	if req.Insecure != nil {
+		insecure = *req.Insecure
+	}
+	span.SetAttributes(
+		attribute.String("telemetry.endpoint", req.Endpoint),
+		attribute.String("telemetry.previous_endpoint", current.Endpoint),
+	)
+
+	ctx, cancel := context.WithTimeout(ctx, telemetryAdminTimeout)
+	defer cancel()
+	if err := app.telemetry.Restart(ctx, req.Endpoint, insecure); err != nil {
+		exporterRestarts.WithLabelValues("failed").Inc()
+		span.RecordError(err)
+		logWithTrace(ctx, "ERROR", "Failed to restart the span exporter", "endpoint", req.Endpoint, "error", err.Error())
+		status := http.StatusInternalServerError
+		if errors.Is(err, errCollectorUnreachable) {
+			status = http.StatusBadGateway
+		}
+		c.JSON(status, gin.H{"error": err.Error()})
+		return
+	}
+
+	exporterRestarts.WithLabelValues("success").Inc()
+	requestsTotal.WithLabelValues("POST", "/admin/telemetry/restart", "200").Inc()
+	logWithTrace(ctx, "INFO", "Span exporter restarted", "endpoint", req.Endpoint,
+		"insecure", insecure, "previous_endpoint", current.Endpoint)
+	c.JSON(http.StatusOK, app.telemetry.Status())
+}
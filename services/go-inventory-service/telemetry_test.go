@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+
+	"inventory-service/internal/testkit"
+)
+
+func TestRestartTelemetry(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	batcher := newSpanBatcher(exporter, SpanBatchConfig{MaxQueueSize: 10, ScheduleDelay: 1000, ExportTimeout: 1000, MaxExportBatchSize: 5})
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(batcher))
+	defer tp.Shutdown(context.Background())
+
+	app := newFakeApp(t, &fakeItemStore{}, &fakeStockStore{}, systemClock{})
+	app.telemetry = &Telemetry{tp: tp, batcher: batcher, endpoint: "otel-collector:4317", insecure: true}
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.POST("/admin/telemetry/flush", app.flushTelemetry)
+	router.POST("/admin/telemetry/restart", app.restartTelemetry)
+	post := func(path, body string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, path, strings.NewReader(body)))
+		return rec
+	}
+
+	endSpans(tp, 2)
+	if rec := post("/admin/telemetry/flush", ""); rec.Code != http.StatusOK || len(exporter.GetSpans()) != 2 {
+		t.Fatalf("got status %d and %d spans exported, want both", rec.Code, len(exporter.GetSpans()))
+	}
+
+	// The collector is down: the current exporter stays
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed.Close()
+	testkit.AssertCounterDelta(t, exporterRestarts.WithLabelValues("failed"), 1, func() {
+		if rec := post("/admin/telemetry/restart", `{"endpoint": "`+closed.Addr().String()+`"}`); rec.Code != http.StatusBadGateway {
+			t.Errorf("got status %d, want 502", rec.Code)
+		}
+	})
+	if rec := post("/admin/telemetry/restart", `{"endpoint": "otel-collector"}`); rec.Code != http.StatusBadRequest {
+		t.Errorf("got status %d, want 400 without a port", rec.Code)
+	}
+
+	collector, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer collector.Close()
+	rec := post("/admin/telemetry/restart", `{"endpoint": "`+collector.Addr().String()+`"}`)
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"endpoint":"`+collector.Addr().String()+`","insecure":true`) {
+		t.Errorf("got status %d: %s", rec.Code, rec.Body.String())
+	}
+}
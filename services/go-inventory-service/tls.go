@@ -0,0 +1,272 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	tlsReloads = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "tls_reloads_total",
+			Help: "Total number of TLS certificate reloads by result",
+		},
+		[]string{"result"},
+	)
+
+	tlsCertExpiry = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "tls_certificate_expiry_timestamp_seconds",
+			Help: "Expiry time of the service's TLS certificate as a Unix timestamp",
+		},
+	)
+)
+
+// TLSFiles are the mounted certificate files used for mutual TLS
+type TLSFiles struct {
+	CertFile string `yaml:"cert_file" env:"TLS_CERT_FILE"`
+	KeyFile  string `yaml:"key_file" env:"TLS_KEY_FILE"`
+	// CA bundle that client certificates are verified against. When set,
+	// the server requires client certificates.
+	ClientCAFile string `yaml:"client_ca_file" env:"TLS_CLIENT_CA_FILE"`
+	// CA bundle that servers are verified against on outgoing calls.
+	// Defaults to the system roots.
+	CAFile string `yaml:"ca_file" env:"TLS_CA_FILE"`
+	// "require" (default) or "verify_if_given", for clients such as kubelet
+	// probes that can't present a certificate
+	ClientAuth string `yaml:"client_auth" env:"TLS_CLIENT_AUTH" default:"require"`
+}
+
+// CertReloader serves the certificate and CA bundles from TLSFiles and
+// reloads them when the files change, so rotated secrets are picked up
+// without a restart
+type CertReloader struct {
+	files TLSFiles
+
+	mu        sync.RWMutex
+	cert      *tls.Certificate
+	clientCAs *x509.CertPool
+	rootCAs   *x509.CertPool
+	modTimes  map[string]time.Time
+}
+
+func newCertReloader(files TLSFiles) (*CertReloader, error) {
+	r := &CertReloader{files: files}
+	if _, err := r.reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Load the files again if any of them changed. Returns whether anything was
+// reloaded.
+func (r *CertReloader) reload() (bool, error) {
+	paths := []string{r.files.CertFile, r.files.KeyFile, r.files.ClientCAFile, r.files.CAFile}
+	modTimes := map[string]time.Time{}
+	changed := false
+	for _, path := range paths {
+		if path == "" {
+			continue
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			return false, err
+		}
+		modTimes[path] = info.ModTime()
+		if !info.ModTime().Equal(r.modTimes[path]) {
+			changed = true
+		}
+	}
+	if !changed {
+		return false, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(r.files.CertFile, r.files.KeyFile)
+	if err != nil {
+		return false, fmt.Errorf("failed to load TLS certificate: %w", err)
+	}
+	var clientCAs, rootCAs *x509.CertPool
+	if r.files.ClientCAFile != "" {
+		if clientCAs, err = loadCertPool(r.files.ClientCAFile); err != nil {
+			return false, err
+		}
+	}
+	if r.files.CAFile != "" {
+		if rootCAs, err = loadCertPool(r.files.CAFile); err != nil {
+			return false, err
+		}
+	}
+
+	if leaf, err := x509.ParseCertificate(cert.Certificate[0]); err == nil {
+		cert.Leaf = leaf
+		tlsCertExpiry.Set(float64(leaf.NotAfter.Unix()))
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.cert = &cert
+	r.clientCAs = clientCAs
+	r.rootCAs = rootCAs
+	r.modTimes = modTimes
+	return true, nil
+}
+
+func loadCertPool(path string) (*x509.CertPool, error) {
+	pem, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in %s", path)
+	}
+	return pool, nil
+}
+
+// Check polls the files for changes and reloads them. It runs every
+// TLS_RELOAD_INTERVAL as a background job: Kubernetes updates mounted
+// secrets by swapping a symlink, so polling is more reliable than file
+// system notifications.
+func (r *CertReloader) Check(ctx context.Context) error {
+	reloaded, err := r.reload()
+	if err != nil {
+		// Keep serving the previous certificate
+		tlsReloads.WithLabelValues("error").Inc()
+		return fmt.Errorf("failed to reload TLS certificates: %w", err)
+	}
+	if reloaded {
+		tlsReloads.WithLabelValues("success").Inc()
+		logWithTrace(ctx, "INFO", "Reloaded TLS certificates")
+	}
+	return nil
+}
+
+func (r *CertReloader) current() (*tls.Certificate, *x509.CertPool, *x509.CertPool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.cert, r.clientCAs, r.rootCAs
+}
+
+// ServerConfig returns the TLS configuration for the HTTP server. Each
+// handshake uses the latest certificate and client CA bundle.
+func (r *CertReloader) ServerConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			cert, clientCAs, _ := r.current()
+			cfg := &tls.Config{
+				MinVersion:   tls.VersionTLS12,
+				Certificates: []tls.Certificate{*cert},
+			}
+			if clientCAs != nil {
+				cfg.ClientCAs = clientCAs
+				cfg.ClientAuth = tls.RequireAndVerifyClientCert
+				if r.files.ClientAuth == "verify_if_given" {
+					cfg.ClientAuth = tls.VerifyClientCertIfGiven
+				}
+			}
+			return cfg, nil
+		},
+	}
+}
+
+// ClientConfig returns the TLS configuration for outgoing calls, presenting
+// the service's certificate to the server. The server is verified against
+// the latest CA bundle on every connection, which is why the built-in
+// verification is replaced by VerifyConnection.
+func (r *CertReloader) ClientConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetClientCertificate: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			cert, _, _ := r.current()
+			return cert, nil
+		},
+		InsecureSkipVerify: true,
+		VerifyConnection: func(cs tls.ConnectionState) error {
+			if len(cs.PeerCertificates) == 0 {
+				return errors.New("server presented no certificate")
+			}
+			_, _, rootCAs := r.current()
+			opts := x509.VerifyOptions{
+				Roots:         rootCAs,
+				DNSName:       cs.ServerName,
+				Intermediates: x509.NewCertPool(),
+			}
+			for _, cert := range cs.PeerCertificates[1:] {
+				opts.Intermediates.AddCert(cert)
+			}
+			_, err := cs.PeerCertificates[0].Verify(opts)
+			return err
+		},
+	}
+}
+
+// Apply the POSTGRES_SSL* settings to the postgresql:// URL. They override
+// the matching URL parameters, so the default sslmode=disable can be
+// hardened without rewriting the connection string.
+func applyPostgresTLS(dsn string, cfg PostgresConfig) (string, error) {
+	params := map[string]string{
+		"sslmode":     cfg.SSLMode,
+		"sslrootcert": cfg.SSLRootCert,
+		"sslcert":     cfg.SSLCert,
+		"sslkey":      cfg.SSLKey,
+	}
+
+	changed := false
+	for _, v := range params {
+		changed = changed || v != ""
+	}
+	if !changed {
+		return dsn, nil
+	}
+
+	u, err := url.Parse(dsn)
+	if err != nil || (u.Scheme != "postgres" && u.Scheme != "postgresql") {
+		return "", errors.New("must be a postgresql:// URL to use POSTGRES_SSL* settings")
+	}
+	query := u.Query()
+	for name, v := range params {
+		if v != "" {
+			query.Set(name, v)
+		}
+	}
+	u.RawQuery = query.Encode()
+	return u.String(), nil
+}
+
+// Build the TLS configuration for MongoDB from the MONGODB_TLS* settings.
+// Returns nil when MONGODB_TLS is not "true", leaving TLS to the URI
+// (e.g. ?tls=true or mongodb+srv://).
+func mongoTLSConfig(cfg MongoConfig) (*tls.Config, error) {
+	if !cfg.TLS {
+		return nil, nil
+	}
+
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	if cfg.TLSCAFile != "" {
+		pool, err := loadCertPool(cfg.TLSCAFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if cfg.TLSCertFile != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.TLSCertFile, cfg.TLSKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load MongoDB client certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return tlsConfig, nil
+}
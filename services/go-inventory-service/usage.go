@@ -0,0 +1,264 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var (
+	usageRequests = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "api_usage_requests_total",
+			Help: "API requests counted against the caller's usage",
+		},
+		[]string{"caller"},
+	)
+
+	usageBytes = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "api_usage_bytes_total",
+			Help: "Request and response body bytes by caller and direction: in or out",
+		},
+		[]string{"caller", "direction"},
+	)
+
+	quotaRejections = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "api_quota_rejections_total",
+			Help: "API requests turned away with 429 because the caller's daily quota was used up",
+		},
+		[]string{"caller"},
+	)
+
+	quotaRemaining = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "api_quota_remaining",
+			Help: "Requests left in today's quota of callers that have one",
+		},
+		[]string{"caller"},
+	)
+)
+
+// The problem type of the quota rejections, see RFC 9457
+const quotaProblemType = "urn:inventory-service:problem:quota-exceeded"
+
+// Parse USAGE_CLIENT_QUOTAS, which gives clients a daily quota of their
+// own, 0 for none:
+//
+//	USAGE_CLIENT_QUOTAS=order-service=100000,load-generator=0
+func parseClientQuotas(s string) (map[string]int, error) {
+	quotas := map[string]int{}
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		client, value, ok := strings.Cut(entry, "=")
+		quota, err := strconv.Atoi(value)
+		if !ok || client == "" || err != nil || quota < 0 {
+			return nil, fmt.Errorf("invalid USAGE_CLIENT_QUOTAS entry %q", entry)
+		}
+		quotas[client] = quota
+	}
+	return quotas, nil
+}
+
+// ClientUsage is what a client used of the API today
+type ClientUsage struct {
+	Caller   string `json:"caller"`
+	Requests int64  `json:"requests"`
+	BytesIn  int64  `json:"bytes_in"`
+	BytesOut int64  `json:"bytes_out"`
+	// Requests turned away because the quota was used up
+	Rejected int64 `json:"rejected"`
+	// Daily quota, 0 for none
+	Quota     int    `json:"quota"`
+	Remaining *int64 `json:"remaining,omitempty"`
+}
+
+// UsageReport is the usage of the clients on the current day (UTC)
+type UsageReport struct {
+	Day      string        `json:"day"`
+	ResetsAt time.Time     `json:"resets_at"`
+	Clients  []ClientUsage `json:"clients"`
+}
+
+// UsageMeter counts the requests and bytes of every API caller per day
+// (UTC) and turns callers away with a 429 once their daily quota is used
+// up. The counts are kept in memory by each replica, so quotas apply per
+// replica; the Prometheus counters add up across all of them.
+type UsageMeter struct {
+	clock  Clock
+	quota  int
+	quotas map[string]int
+
+	mu      sync.Mutex
+	day     string
+	clients map[string]*ClientUsage
+}
+
+func newUsageMeter(cfg UsageConfig, clock Clock) *UsageMeter {
+	// Checked by the config validation
+	quotas, _ := parseClientQuotas(cfg.ClientQuotas)
+	return &UsageMeter{clock: clock, quota: cfg.DailyRequestQuota, quotas: quotas, clients: map[string]*ClientUsage{}}
+}
+
+func (m *UsageMeter) quotaOf(caller string) int {
+	if quota, ok := m.quotas[caller]; ok {
+		return quota
+	}
+	return m.quota
+}
+
+// Start over at midnight UTC. Called with mu held.
+func (m *UsageMeter) rollover() {
+	if day := m.clock.Now().UTC().Format(time.DateOnly); day != m.day {
+		m.day, m.clients = day, map[string]*ClientUsage{}
+		quotaRemaining.Reset()
+	}
+}
+
+// Today's usage of the caller. Called with mu held.
+func (m *UsageMeter) usage(caller string) *ClientUsage {
+	m.rollover()
+	u, ok := m.clients[caller]
+	if !ok {
+		u = &ClientUsage{Caller: caller, Quota: m.quotaOf(caller)}
+		m.clients[caller] = u
+	}
+	return u
+}
+
+// Count a request of the caller if its quota allows it. The request counts
+// from the start, so concurrent requests can't go over the quota together.
+func (m *UsageMeter) admit(caller string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	u := m.usage(caller)
+	if u.Quota > 0 && u.Requests >= int64(u.Quota) {
+		u.Rejected++
+		return false
+	}
+	u.Requests++
+	if u.Quota > 0 {
+		quotaRemaining.WithLabelValues(caller).Set(float64(int64(u.Quota) - u.Requests))
+	}
+	return true
+}
+
+func (m *UsageMeter) addBytes(caller string, in, out int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	u := m.usage(caller)
+	u.BytesIn += in
+	u.BytesOut += out
+}
+
+// Report the usage of the callers, or of everyone without a filter
+func (m *UsageMeter) Report(filter func(caller string) bool) UsageReport {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.rollover()
+
+	report := UsageReport{Day: m.day, ResetsAt: m.resetsAt(), Clients: []ClientUsage{}}
+	for caller, u := range m.clients {
+		if filter != nil && !filter(caller) {
+			continue
+		}
+		usage := *u
+		if usage.Quota > 0 {
+			remaining := int64(usage.Quota) - usage.Requests
+			usage.Remaining = &remaining
+		}
+		report.Clients = append(report.Clients, usage)
+	}
+	sort.Slice(report.Clients, func(i, j int) bool { return report.Clients[i].Caller < report.Clients[j].Caller })
+	return report
+}
+
+// The next midnight UTC, when the quotas start over
+func (m *UsageMeter) resetsAt() time.Time {
+	now := m.clock.Now().UTC()
+	return time.Date(now.Year(), now.Month(), now.Day()+1, 0, 0, 0, 0, time.UTC)
+}
+
+// Middleware for the /api routes, after authenticate: counts the request
+// and its bytes against the caller, or turns it away with a 429 problem
+// document once the caller's quota is used up. Without authentication
+// every request is the "anonymous" caller's.
+func (m *UsageMeter) Middleware(c *gin.Context) {
+	if m == nil {
+		c.Next()
+		return
+	}
+
+	ctx := c.Request.Context()
+	caller := "anonymous"
+	if principal, ok := principalFromContext(ctx); ok {
+		caller = principal.Caller
+	}
+
+	if !m.admit(caller) {
+		resetsAt := m.resetsAt()
+		quotaRejections.WithLabelValues(caller).Inc()
+		requestsTotal.WithLabelValues(c.Request.Method, c.FullPath(), "429").Inc()
+		trace.SpanFromContext(ctx).SetAttributes(attribute.Bool("usage.quota_exceeded", true))
+		recordSecurityEvent(c, securityEventRateLimited, caller, http.StatusTooManyRequests, "quota", m.quotaOf(caller))
+
+		c.Header("Retry-After", strconv.Itoa(int(math.Ceil(resetsAt.Sub(m.clock.Now()).Seconds()))))
+		c.Header("Content-Type", "application/problem+json")
+		c.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{
+			"type":      quotaProblemType,
+			"title":     "Daily request quota exceeded",
+			"status":    http.StatusTooManyRequests,
+			"detail":    fmt.Sprintf("%s has used its quota of %d requests for today", caller, m.quotaOf(caller)),
+			"instance":  c.Request.URL.Path,
+			"resets_at": resetsAt,
+		})
+		return
+	}
+
+	c.Next()
+
+	in := c.Request.ContentLength
+	if in < 0 {
+		in = 0
+	}
+	out := int64(c.Writer.Size())
+	if out < 0 {
+		out = 0
+	}
+	m.addBytes(caller, in, out)
+	usageRequests.WithLabelValues(caller).Inc()
+	usageBytes.WithLabelValues(caller, "in").Add(float64(in))
+	usageBytes.WithLabelValues(caller, "out").Add(float64(out))
+}
+
+// Show today's API usage. Callers see their own, admins (and everyone,
+// without authentication) see all clients'.
+func (app *App) getUsage(c *gin.Context) {
+	ctx, span := app.tracer.Start(c.Request.Context(), "getUsage")
+	defer span.End()
+
+	var filter func(string) bool
+	if principal, ok := principalFromContext(ctx); ok && !principal.HasRole(roleAdmin) {
+		filter = func(caller string) bool { return caller == principal.Caller }
+	}
+	report := app.usage.Report(filter)
+	span.SetAttributes(attribute.Int("usage.clients", len(report.Clients)))
+
+	requestsTotal.WithLabelValues("GET", "/api/usage", "200").Inc()
+	app.renderJSON(c, http.StatusOK, report)
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"inventory-service/internal/testkit"
+)
+
+func TestUsageQuota(t *testing.T) {
+	clock := &fixedClock{time.Date(2024, 6, 1, 23, 0, 0, 0, time.UTC)}
+	app := newFakeApp(t, &fakeItemStore{}, &fakeStockStore{}, clock)
+	app.apiKeys = &APIKeyStore{
+		identities: map[[sha256.Size]byte]string{
+			sha256.Sum256([]byte("order-key")):    "order-service",
+			sha256.Sum256([]byte("operator-key")): "demo-operator",
+		},
+		roles: map[string][]string{"demo-operator": {roleAdmin}},
+	}
+	app.usage = newUsageMeter(UsageConfig{DailyRequestQuota: 2, ClientQuotas: "demo-operator=0"}, clock)
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	api := router.Group("/api", app.authenticate, app.usage.Middleware)
+	api.POST("/echo", func(c *gin.Context) { c.String(http.StatusOK, "hello") })
+	api.GET("/usage", app.getUsage)
+	do := func(method, path, key, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("X-API-Key", key)
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		return rec
+	}
+
+	testkit.AssertCounterDelta(t, usageBytes.WithLabelValues("order-service", "in"), 3, func() {
+		if rec := do(http.MethodPost, "/api/echo", "order-key", "abc"); rec.Code != http.StatusOK {
+			t.Fatalf("got status %d", rec.Code)
+		}
+	})
+	do(http.MethodPost, "/api/echo", "order-key", "")
+
+	// The third request of the day is over the quota
+	var rec *httptest.ResponseRecorder
+	testkit.AssertCounterDelta(t, quotaRejections.WithLabelValues("order-service"), 1, func() {
+		testkit.AssertCounterDelta(t, securityEventsTotal.WithLabelValues(securityEventRateLimited, "order-service"), 1, func() {
+			rec = do(http.MethodGet, "/api/usage", "order-key", "")
+		})
+	})
+	if rec.Code != http.StatusTooManyRequests || rec.Header().Get("Retry-After") != "3600" {
+		t.Fatalf("got status %d with Retry-After %q, want 429 with an hour to midnight", rec.Code, rec.Header().Get("Retry-After"))
+	}
+
+	// Admins see everyone, and have no quota
+	var report UsageReport
+	for i := 0; i < 3; i++ {
+		rec = do(http.MethodGet, "/api/usage", "operator-key", "")
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &report); err != nil {
+		t.Fatal(err)
+	}
+	if rec.Code != http.StatusOK || report.Day != "2024-06-01" || len(report.Clients) != 2 {
+		t.Fatalf("got status %d, report %+v", rec.Code, report)
+	}
+	if u := report.Clients[1]; u.Caller != "order-service" || u.Requests != 2 || u.Rejected != 1 ||
+		u.BytesIn != 3 || u.BytesOut != 10 || u.Remaining == nil || *u.Remaining != 0 {
+		t.Errorf("got usage %+v", u)
+	}
+	if u := report.Clients[0]; u.Caller != "demo-operator" || u.Requests != 3 || u.Remaining != nil {
+		t.Errorf("got usage %+v, want three requests without a quota", u)
+	}
+
+	// The quota starts over at midnight, and callers only see their own usage
+	clock.now = clock.now.Add(time.Hour)
+	rec = do(http.MethodGet, "/api/usage", "order-key", "")
+	report = UsageReport{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &report); err != nil {
+		t.Fatal(err)
+	}
+	if rec.Code != http.StatusOK || len(report.Clients) != 1 || report.Clients[0].Requests != 1 || *report.Clients[0].Remaining != 1 {
+		t.Errorf("got status %d, report %+v, want one request on the new day", rec.Code, report)
+	}
+}
@@ -0,0 +1,302 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	vaultLeaseRenewals = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "vault_lease_renewals_total",
+			Help: "Total number of Vault lease renewals by database and result",
+		},
+		[]string{"database", "result"},
+	)
+
+	vaultCredentialRotations = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "vault_credential_rotations_total",
+			Help: "Total number of database credential rotations by database and result",
+		},
+		[]string{"database", "result"},
+	)
+
+	vaultLeaseExpiry = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "vault_lease_expiry_timestamp_seconds",
+			Help: "Expiry time of the current database credential lease as a Unix timestamp",
+		},
+		[]string{"database"},
+	)
+)
+
+// VaultClient fetches dynamic database credentials from HashiCorp Vault
+type VaultClient struct {
+	addr   string
+	client httpDoer
+
+	// Kubernetes auth, used when no static token is configured
+	k8sRole      string
+	k8sMount     string
+	k8sTokenPath string
+
+	mu    sync.Mutex
+	token string
+}
+
+// VaultLease is a set of database credentials and the lease they belong to
+type VaultLease struct {
+	ID        string
+	Duration  time.Duration
+	Renewable bool
+	Username  string
+	Password  string
+	ExpiresAt time.Time
+}
+
+// Create a Vault client. Returns nil when VAULT_ADDR is not set.
+// Authenticates with VAULT_TOKEN, or with the pod's service account token
+// through Vault's Kubernetes auth method when VAULT_K8S_ROLE is set.
+func newVaultClient(ctx context.Context, cfg VaultConfig, clientCfg HTTPClientConfig) (*VaultClient, error) {
+	if cfg.Addr == "" {
+		return nil, nil
+	}
+
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	if cfg.CACert != "" {
+		pool, err := loadCertPool(cfg.CACert)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	v := &VaultClient{
+		addr:         strings.TrimSuffix(cfg.Addr, "/"),
+		client:       newHTTPClient("vault", clientCfg, tlsConfig),
+		k8sRole:      cfg.K8sRole,
+		k8sMount:     cfg.K8sMount,
+		k8sTokenPath: "/var/run/secrets/kubernetes.io/serviceaccount/token",
+		token:        cfg.Token,
+	}
+
+	if v.token == "" {
+		if err := v.login(ctx); err != nil {
+			return nil, err
+		}
+	}
+
+	log.Printf("Vault integration enabled (%s)", v.addr)
+	return v, nil
+}
+
+// Log in with the Kubernetes auth method
+func (v *VaultClient) login(ctx context.Context) error {
+	jwt, err := os.ReadFile(v.k8sTokenPath)
+	if err != nil {
+		return fmt.Errorf("failed to read service account token: %w", err)
+	}
+
+	var resp struct {
+		Auth struct {
+			ClientToken string `json:"client_token"`
+		} `json:"auth"`
+	}
+	body := map[string]string{"role": v.k8sRole, "jwt": strings.TrimSpace(string(jwt))}
+	if err := v.request(ctx, http.MethodPost, "auth/"+v.k8sMount+"/login", "", body, &resp); err != nil {
+		return fmt.Errorf("vault login failed: %w", err)
+	}
+
+	v.mu.Lock()
+	v.token = resp.Auth.ClientToken
+	v.mu.Unlock()
+	return nil
+}
+
+type vaultError struct {
+	status int
+	errors []string
+}
+
+func (e *vaultError) Error() string {
+	return fmt.Sprintf("vault returned %d: %s", e.status, strings.Join(e.errors, "; "))
+}
+
+// Call the Vault HTTP API, logging in again once if the token was rejected
+func (v *VaultClient) do(ctx context.Context, method, path string, in, out interface{}) error {
+	v.mu.Lock()
+	token := v.token
+	v.mu.Unlock()
+
+	err := v.request(ctx, method, path, token, in, out)
+	var vErr *vaultError
+	if errors.As(err, &vErr) && vErr.status == http.StatusForbidden && v.k8sRole != "" {
+		if err := v.login(ctx); err != nil {
+			return err
+		}
+		v.mu.Lock()
+		token = v.token
+		v.mu.Unlock()
+		err = v.request(ctx, method, path, token, in, out)
+	}
+	return err
+}
+
+func (v *VaultClient) request(ctx context.Context, method, path, token string, in, out interface{}) error {
+	var body io.Reader
+	if in != nil {
+		data, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, v.addr+"/v1/"+path, body)
+	if err != nil {
+		return err
+	}
+	if token != "" {
+		req.Header.Set("X-Vault-Token", token)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := v.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		var errResp struct {
+			Errors []string `json:"errors"`
+		}
+		json.NewDecoder(resp.Body).Decode(&errResp)
+		return &vaultError{status: resp.StatusCode, errors: errResp.Errors}
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// ReadCredentials requests new credentials from a database secrets engine
+// path such as database/creds/inventory
+func (v *VaultClient) ReadCredentials(ctx context.Context, path string) (*VaultLease, error) {
+	var resp struct {
+		LeaseID       string `json:"lease_id"`
+		LeaseDuration int    `json:"lease_duration"`
+		Renewable     bool   `json:"renewable"`
+		Data          struct {
+			Username string `json:"username"`
+			Password string `json:"password"`
+		} `json:"data"`
+	}
+	if err := v.do(ctx, http.MethodGet, path, nil, &resp); err != nil {
+		return nil, fmt.Errorf("failed to read credentials from %s: %w", path, err)
+	}
+
+	duration := time.Duration(resp.LeaseDuration) * time.Second
+	return &VaultLease{
+		ID:        resp.LeaseID,
+		Duration:  duration,
+		Renewable: resp.Renewable,
+		Username:  resp.Data.Username,
+		Password:  resp.Data.Password,
+		ExpiresAt: time.Now().Add(duration),
+	}, nil
+}
+
+// Renew a lease, returning its new remaining duration
+func (v *VaultClient) renew(ctx context.Context, lease *VaultLease) (time.Duration, error) {
+	var resp struct {
+		LeaseDuration int `json:"lease_duration"`
+	}
+	body := map[string]interface{}{
+		"lease_id":  lease.ID,
+		"increment": int(lease.Duration.Seconds()),
+	}
+	if err := v.do(ctx, http.MethodPut, "sys/leases/renew", body, &resp); err != nil {
+		return 0, err
+	}
+	return time.Duration(resp.LeaseDuration) * time.Second, nil
+}
+
+// KeepCredentials keeps the credentials of a lease valid until ctx is done.
+// The lease is renewed at two thirds of its duration; once it can't be
+// renewed any more (not renewable, renewal failed or max TTL reached), new
+// credentials are requested and passed to rotate, which rebuilds whatever
+// uses them.
+func (v *VaultClient) KeepCredentials(ctx context.Context, database, path string, lease *VaultLease,
+	rotate func(context.Context, *VaultLease) error) {
+	vaultLeaseExpiry.WithLabelValues(database).Set(float64(lease.ExpiresAt.Unix()))
+
+	for {
+		wait := time.Until(lease.ExpiresAt) * 2 / 3
+		if err := sleepContext(ctx, wait); err != nil {
+			return
+		}
+
+		if lease.Renewable {
+			ttl, err := v.renew(ctx, lease)
+			switch {
+			case err != nil:
+				vaultLeaseRenewals.WithLabelValues(database, "error").Inc()
+				log.Printf("Failed to renew %s credential lease: %v", database, err)
+			case ttl < lease.Duration/3:
+				// Vault capped the renewal at the lease's max TTL
+				vaultLeaseRenewals.WithLabelValues(database, "max_ttl").Inc()
+			default:
+				vaultLeaseRenewals.WithLabelValues(database, "success").Inc()
+				lease.ExpiresAt = time.Now().Add(ttl)
+				vaultLeaseExpiry.WithLabelValues(database).Set(float64(lease.ExpiresAt.Unix()))
+				continue
+			}
+		}
+
+		newLease, err := v.ReadCredentials(ctx, path)
+		if err == nil {
+			err = rotate(ctx, newLease)
+		}
+		if err != nil {
+			vaultCredentialRotations.WithLabelValues(database, "error").Inc()
+			log.Printf("Failed to rotate %s credentials: %v", database, err)
+			// Try again soon; the old credentials are still valid for a while
+			if err := sleepContext(ctx, 10*time.Second); err != nil {
+				return
+			}
+			continue
+		}
+
+		vaultCredentialRotations.WithLabelValues(database, "success").Inc()
+		log.Printf("Rotated %s credentials (lease %s, valid for %s)", database, newLease.ID, newLease.Duration)
+		lease = newLease
+		vaultLeaseExpiry.WithLabelValues(database).Set(float64(lease.ExpiresAt.Unix()))
+	}
+}
+
+// Replace the user and password in a postgresql:// or mongodb:// URL
+func withCredentials(rawURL, username, password string) (string, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", fmt.Errorf("connection string must be a URL to use Vault credentials: %w", err)
+	}
+	u.User = url.UserPassword(username, password)
+	return u.String(), nil
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"net/http"
+	"runtime"
+	"runtime/debug"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Set at build time with
+//
+//	go build -ldflags "-X main.version=1.2.0 -X main.gitSHA=abc1234 -X main.buildDate=2024-03-01T12:00:00Z"
+//
+// For a plain go build from a checkout, the SHA and date come from the VCS
+// information Go embeds in the binary.
+var (
+	version   = "dev"
+	gitSHA    = ""
+	buildDate = ""
+)
+
+var buildInfo = promauto.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "app_build_info",
+		Help: "Always 1, labeled with the build running in this process",
+	},
+	[]string{"version", "git_sha", "build_date", "go_version"},
+)
+
+// BuildInfo identifies the running build
+type BuildInfo struct {
+	Version   string `json:"version"`
+	GitSHA    string `json:"git_sha"`
+	BuildDate string `json:"build_date"`
+	GoVersion string `json:"go_version"`
+	Platform  string `json:"platform"`
+	Compiler  string `json:"compiler"`
+}
+
+var currentBuild = readBuildInfo()
+
+func readBuildInfo() BuildInfo {
+	info := BuildInfo{
+		Version:   version,
+		GitSHA:    gitSHA,
+		BuildDate: buildDate,
+		GoVersion: runtime.Version(),
+		Platform:  runtime.GOOS + "/" + runtime.GOARCH,
+		Compiler:  runtime.Compiler,
+	}
+
+	if bi, ok := debug.ReadBuildInfo(); ok {
+		for _, s := range bi.Settings {
+			switch s.Key {
+			case "vcs.revision":
+				if info.GitSHA == "" && len(s.Value) >= 7 {
+					info.GitSHA = s.Value[:7]
+				}
+			case "vcs.time":
+				if info.BuildDate == "" {
+					info.BuildDate = s.Value
+				}
+			}
+		}
+	}
+	if info.GitSHA == "" {
+		info.GitSHA = "unknown"
+	}
+	if info.BuildDate == "" {
+		info.BuildDate = "unknown"
+	}
+	return info
+}
+
+func init() {
+	buildInfo.WithLabelValues(currentBuild.Version, currentBuild.GitSHA, currentBuild.BuildDate, currentBuild.GoVersion).Set(1)
+}
+
+// Build version handler
+func (app *App) versionInfo(c *gin.Context) {
+	c.JSON(http.StatusOK, currentBuild)
+}
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/lib/pq"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+var (
+	warehouseCapacity = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "warehouse_capacity_units",
+			Help: "Units a warehouse can hold",
+		},
+		[]string{"warehouse", "region"},
+	)
+
+	warehouseUsed = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "warehouse_used_units",
+			Help: "Units of inventory stored in a warehouse",
+		},
+		[]string{"warehouse", "region"},
+	)
+
+	warehouseUtilization = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "warehouse_utilization_ratio",
+			Help: "Share of a warehouse's capacity in use, from 0 to 1",
+		},
+		[]string{"warehouse", "region"},
+	)
+)
+
+var (
+	// No warehouse (in the region) has room for the quantity
+	errNoWarehouseCapacity = errors.New("no warehouse has enough free capacity")
+	// The item's warehouse doesn't have room for it
+	errWarehouseFull = errors.New("warehouse is full")
+)
+
+// Warehouse is a location with a capacity. Items whose location is a
+// warehouse count against its capacity; other locations are unbounded.
+type Warehouse struct {
+	Name     string `json:"name"`
+	Region   string `json:"region"`
+	Capacity int    `json:"capacity"`
+	// Sum of the quantities of its items
+	Used int `json:"used"`
+}
+
+func (w Warehouse) Free() int { return w.Capacity - w.Used }
+
+func (w Warehouse) Utilization() float64 {
+	if w.Capacity == 0 {
+		return 1
+	}
+	return float64(w.Used) / float64(w.Capacity)
+}
+
+// WarehouseStore holds the warehouses (PostgreSQL)
+type WarehouseStore interface {
+	ListWarehouses(ctx context.Context) ([]Warehouse, error)
+	// Create the warehouse or change its region and capacity
+	PutWarehouse(ctx context.Context, w Warehouse) error
+	// The warehouse with the most free capacity that fits quantity, in
+	// region unless it is empty. Returns errNoWarehouseCapacity if none fits.
+	AllocateWarehouse(ctx context.Context, quantity int, region string) (Warehouse, error)
+}
+
+// The warehouses table, and a trigger that rejects inventory writes that
+// would put a warehouse over its capacity. Locking the warehouse row makes
+// concurrent writes to the same warehouse check one after the other.
+const createWarehousesQuery = `
+	CREATE TABLE IF NOT EXISTS warehouses (
+		name VARCHAR(255) PRIMARY KEY,
+		region VARCHAR(100) NOT NULL,
+		capacity INTEGER NOT NULL CHECK (capacity >= 0)
+	);
+	CREATE INDEX IF NOT EXISTS inventory_location ON inventory (location);
+
+	CREATE OR REPLACE FUNCTION check_warehouse_capacity() RETURNS trigger AS $$
+	DECLARE
+		cap INTEGER;
+		used BIGINT;
+	BEGIN
+		SELECT capacity INTO cap FROM warehouses WHERE name = NEW.location FOR UPDATE;
+		IF NOT FOUND THEN
+			RETURN NEW;
+		END IF;
+		SELECT COALESCE(SUM(quantity), 0) INTO used FROM inventory
+		WHERE location = NEW.location AND id <> NEW.id;
+		IF used + NEW.quantity > cap THEN
+			RAISE EXCEPTION 'warehouse % is full (% of % units used)', NEW.location, used, cap
+				USING ERRCODE = 'check_violation', CONSTRAINT = 'warehouse_capacity';
+		END IF;
+		RETURN NEW;
+	END;
+	$$ LANGUAGE plpgsql;
+
+	CREATE OR REPLACE TRIGGER warehouse_capacity
+	BEFORE INSERT OR UPDATE OF quantity, location ON inventory
+	FOR EACH ROW EXECUTE FUNCTION check_warehouse_capacity();
+`
+
+// Map the capacity trigger's error to errWarehouseFull
+func warehouseError(err error) error {
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) && pqErr.Constraint == "warehouse_capacity" {
+		return errWarehouseFull
+	}
+	return err
+}
+
+// postgresWarehouseStore is the WarehouseStore on PostgreSQL
+type postgresWarehouseStore struct {
+	db func() *sql.DB
+	// For the listing; allocations read the primary, where the capacity
+	// trigger checks them
+	replica *ReadReplica
+	chaos   *Chaos
+}
+
+// Warehouses with the units used by their items
+const warehouseUsageQuery = `
+	SELECT w.name, w.region, w.capacity, COALESCE(SUM(i.quantity), 0)
+	FROM warehouses w
+	LEFT JOIN inventory i ON i.location = w.name
+	GROUP BY w.name
+`
+
+func (s *postgresWarehouseStore) ListWarehouses(ctx context.Context) ([]Warehouse, error) {
+	var warehouses []Warehouse
+	err := s.replica.Read(ctx, s.db(), func(db *sql.DB) error {
+		start := time.Now()
+		s.chaos.slowPostgres(ctx, db)
+		rows, err := db.QueryContext(ctx, warehouseUsageQuery+` ORDER BY w.name`)
+		observeQuery("postgres", "list_warehouses", start)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		if warehouses, err = scanWarehouses(rows); err != nil {
+			return err
+		}
+		explainQuery(ctx, db, "list_warehouses", warehouseUsageQuery+` ORDER BY w.name`)
+		return nil
+	})
+	return warehouses, err
+}
+
+func scanWarehouses(rows *sql.Rows) ([]Warehouse, error) {
+	warehouses := []Warehouse{}
+	for rows.Next() {
+		var w Warehouse
+		if err := rows.Scan(&w.Name, &w.Region, &w.Capacity, &w.Used); err != nil {
+			return nil, err
+		}
+		warehouses = append(warehouses, w)
+	}
+	return warehouses, rows.Err()
+}
+
+func (s *postgresWarehouseStore) PutWarehouse(ctx context.Context, w Warehouse) error {
+	query := `
+		INSERT INTO warehouses (name, region, capacity) VALUES ($1, $2, $3)
+		ON CONFLICT (name) DO UPDATE SET region = EXCLUDED.region, capacity = EXCLUDED.capacity
+	`
+
+	start := time.Now()
+	s.chaos.slowPostgres(ctx, s.db())
+	_, err := s.db().ExecContext(ctx, query, w.Name, w.Region, w.Capacity)
+	observeQuery("postgres", "put_warehouse", start)
+	return err
+}
+
+func (s *postgresWarehouseStore) AllocateWarehouse(ctx context.Context, quantity int, region string) (Warehouse, error) {
+	query := `
+		SELECT * FROM (` + warehouseUsageQuery + `) w (name, region, capacity, used)
+		WHERE capacity - used >= $1 AND ($2 = '' OR region = $2)
+		ORDER BY capacity - used DESC, name
+		LIMIT 1
+	`
+
+	var w Warehouse
+	start := time.Now()
+	s.chaos.slowPostgres(ctx, s.db())
+	err := s.db().QueryRowContext(ctx, query, quantity, region).Scan(&w.Name, &w.Region, &w.Capacity, &w.Used)
+	observeQuery("postgres", "allocate_warehouse", start)
+	if err == sql.ErrNoRows {
+		return Warehouse{}, errNoWarehouseCapacity
+	}
+	return w, err
+}
+
+// Refresh the utilization gauges from the database. Run periodically, so
+// warehouses that were removed drop out of the gauges.
+func (app *App) refreshWarehouseMetrics(ctx context.Context) error {
+	warehouses, err := app.warehouses.ListWarehouses(ctx)
+	if err != nil {
+		return err
+	}
+	warehouseCapacity.Reset()
+	warehouseUsed.Reset()
+	warehouseUtilization.Reset()
+	for _, w := range warehouses {
+		warehouseCapacity.WithLabelValues(w.Name, w.Region).Set(float64(w.Capacity))
+		warehouseUsed.WithLabelValues(w.Name, w.Region).Set(float64(w.Used))
+		warehouseUtilization.WithLabelValues(w.Name, w.Region).Set(w.Utilization())
+	}
+	return nil
+}
+
+// WarehouseStatus is a warehouse with its free capacity, as listed by the API
+type WarehouseStatus struct {
+	Warehouse
+	Free        int     `json:"free"`
+	Utilization float64 `json:"utilization"`
+}
+
+// List the warehouses with their capacity and utilization (PostgreSQL)
+func (app *App) listWarehouses(c *gin.Context) {
+	ctx := c.Request.Context()
+	ctx, span := app.tracer.Start(ctx, "listWarehouses")
+	defer span.End()
+
+	warehouses, err := app.warehouses.ListWarehouses(ctx)
+	if err != nil {
+		logWithTrace(ctx, "ERROR", "Error listing warehouses", "error", err.Error())
+		span.RecordError(err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list warehouses"})
+		return
+	}
+
+	statuses := make([]WarehouseStatus, len(warehouses))
+	for i, w := range warehouses {
+		statuses[i] = WarehouseStatus{Warehouse: w, Free: w.Free(), Utilization: w.Utilization()}
+	}
+	requestsTotal.WithLabelValues("GET", "/api/warehouses", "200").Inc()
+	c.JSON(http.StatusOK, statuses)
+}
+
+// PutWarehouseRequest creates or changes a warehouse
+type PutWarehouseRequest struct {
+	Region   string `json:"region" binding:"required"`
+	Capacity *int   `json:"capacity" binding:"required,min=0"`
+}
+
+// Create a warehouse or change its region and capacity (PostgreSQL)
+func (app *App) putWarehouse(c *gin.Context) {
+	ctx := c.Request.Context()
+	ctx, span := app.tracer.Start(ctx, "putWarehouse")
+	defer span.End()
+
+	var req PutWarehouseRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	w := Warehouse{Name: c.Param("name"), Region: req.Region, Capacity: *req.Capacity}
+	span.SetAttributes(attribute.String("warehouse.name", w.Name), attribute.Int("warehouse.capacity", w.Capacity))
+
+	if err := app.warehouses.PutWarehouse(ctx, w); err != nil {
+		logWithTrace(ctx, "ERROR", "Error saving warehouse", "warehouse", w.Name, "error", err.Error())
+		span.RecordError(err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save warehouse"})
+		return
+	}
+	// Show the new capacity right away rather than on the next refresh
+	if err := app.refreshWarehouseMetrics(ctx); err != nil {
+		logWithTrace(ctx, "WARN", "Failed to refresh warehouse metrics", "error", err.Error())
+	}
+
+	logWithTrace(ctx, "INFO", "Warehouse saved", "warehouse", w.Name, "region", w.Region, "capacity", w.Capacity)
+	c.JSON(http.StatusOK, gin.H{"name": w.Name, "region": w.Region, "capacity": w.Capacity})
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func postItemWithoutLocation(app *App, quantity, region string) *httptest.ResponseRecorder {
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.POST("/api/inventory", app.createItem)
+
+	body := `{"product_name": "Widget", "sku": "W-1", "quantity": ` + quantity + `, "region": "` + region + `"}`
+	req := httptest.NewRequest(http.MethodPost, "/api/inventory", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestCreateItemAllocatesWarehouse(t *testing.T) {
+	items, stock := &fakeItemStore{}, &fakeStockStore{}
+	app := newFakeApp(t, items, stock, systemClock{})
+	app.warehouses = &fakeWarehouseStore{warehouses: []Warehouse{
+		{Name: "Warehouse A", Region: "eu-west", Capacity: 100, Used: 90},
+		{Name: "Warehouse B", Region: "eu-west", Capacity: 100, Used: 40},
+		{Name: "Warehouse C", Region: "us-east", Capacity: 1000},
+	}}
+
+	// The most free capacity in the region
+	if rec := postItemWithoutLocation(app, "5", "eu-west"); rec.Code != http.StatusCreated {
+		t.Fatalf("got status %d: %s", rec.Code, rec.Body.String())
+	}
+	if items.items[0].Location != "Warehouse B" || stock.levels[0].Warehouse != "Warehouse B" {
+		t.Errorf("item allocated to %q, stock level to %q, want Warehouse B", items.items[0].Location, stock.levels[0].Warehouse)
+	}
+
+	if rec := postItemWithoutLocation(app, "500", "eu-west"); rec.Code != http.StatusConflict {
+		t.Errorf("item too big for the region: got status %d, want 409", rec.Code)
+	}
+}
+
+func TestCreateItemWarehouseFull(t *testing.T) {
+	stock := &fakeStockStore{}
+	app := newFakeApp(t, &fakeItemStore{err: errWarehouseFull}, stock, systemClock{})
+
+	if rec := postItem(app); rec.Code != http.StatusConflict {
+		t.Fatalf("got status %d, want 409", rec.Code)
+	}
+	if len(stock.deleted) != 1 {
+		t.Error("stock level of the rejected item not deleted")
+	}
+}
+
+func TestWarehouseMetrics(t *testing.T) {
+	app := &App{warehouses: &fakeWarehouseStore{warehouses: []Warehouse{
+		{Name: "Warehouse A", Region: "eu-west", Capacity: 200, Used: 50},
+	}}}
+	if err := app.refreshWarehouseMetrics(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if got := testutil.ToFloat64(warehouseUtilization.WithLabelValues("Warehouse A", "eu-west")); got != 0.25 {
+		t.Errorf("got utilization %g, want 0.25", got)
+	}
+
+	// A removed warehouse drops out of the gauges
+	app.warehouses = &fakeWarehouseStore{}
+	app.refreshWarehouseMetrics(context.Background())
+	if n := testutil.CollectAndCount(warehouseUtilization); n != 0 {
+		t.Errorf("%d warehouses still reported", n)
+	}
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"runtime"
+	"runtime/pprof"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	goroutineGrowthRate = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "goroutine_growth_rate",
+			Help: "Change in the number of goroutines per second over the last watchdog interval",
+		},
+	)
+
+	goroutineLeakSuspected = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "goroutine_leak_suspected",
+			Help: "Whether the goroutine growth rate is above the leak threshold (1) or not (0)",
+		},
+	)
+
+	goroutineLeakAlerts = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "goroutine_leak_alerts_total",
+			Help: "Total number of times the goroutine growth rate crossed the leak threshold",
+		},
+	)
+)
+
+// GoroutineWatchdog samples the number of goroutines and flags sustained
+// growth as a suspected leak, logging where the goroutines are parked.
+type GoroutineWatchdog struct {
+	interval time.Duration
+	// Growth rate in goroutines per second above which a leak is suspected
+	threshold float64
+	// Number of distinct stacks included in the leak log entry
+	topStacks int
+
+	// State between samples
+	last      int
+	suspected bool
+}
+
+func newGoroutineWatchdog(cfg WatchdogConfig) *GoroutineWatchdog {
+	return &GoroutineWatchdog{
+		interval:  cfg.Interval,
+		threshold: cfg.GrowthThreshold,
+		topStacks: 5,
+		last:      runtime.NumGoroutine(),
+	}
+}
+
+// Sample takes one sample. It runs every interval as a background job.
+func (w *GoroutineWatchdog) Sample(ctx context.Context) error {
+	current := runtime.NumGoroutine()
+	rate := float64(current-w.last) / w.interval.Seconds()
+	w.last = current
+	goroutineGrowthRate.Set(rate)
+
+	if rate < w.threshold {
+		if w.suspected {
+			logWithTrace(ctx, "INFO", "Goroutine growth back below threshold",
+				"goroutines", current, "growth_per_second", rate)
+		}
+		w.suspected = false
+		goroutineLeakSuspected.Set(0)
+		return nil
+	}
+
+	// Log once per crossing rather than on every sample
+	if !w.suspected {
+		goroutineLeakAlerts.Inc()
+		logWithTrace(ctx, "WARN", "Goroutine leak suspected",
+			"goroutines", current,
+			"growth_per_second", rate,
+			"threshold", w.threshold,
+			"top_stacks", summarizeGoroutines(w.topStacks),
+		)
+	}
+	w.suspected = true
+	goroutineLeakSuspected.Set(1)
+	return nil
+}
+
+// goroutineStack is one group of goroutines sharing the same stack
+type goroutineStack struct {
+	Count    int    `json:"count"`
+	Function string `json:"function"`
+	Location string `json:"location"`
+}
+
+// summarizeGoroutines groups goroutines by stack and returns the n largest
+// groups, each identified by its innermost frame outside the runtime.
+func summarizeGoroutines(n int) []goroutineStack {
+	var buf bytes.Buffer
+	if err := pprof.Lookup("goroutine").WriteTo(&buf, 1); err != nil {
+		return nil
+	}
+
+	// With debug=1 the profile is a list of blocks like:
+	//
+	//	12 @ 0x43e0ae 0x44f1d5 ...
+	//	#	0x8b7a1c	main.leakedWorker+0x3c	/app/chaos.go:171
+	var stacks []goroutineStack
+	var current *goroutineStack
+	scanner := bufio.NewScanner(&buf)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if count, _, ok := strings.Cut(line, " @ "); ok {
+			c, err := strconv.Atoi(count)
+			if err != nil {
+				continue
+			}
+			stacks = append(stacks, goroutineStack{Count: c})
+			current = &stacks[len(stacks)-1]
+			continue
+		}
+
+		if current == nil || current.Function != "" || !strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 4 {
+			continue
+		}
+		function, _, _ := strings.Cut(fields[2], "+")
+		if strings.HasPrefix(function, "runtime.") {
+			continue
+		}
+		current.Function = function
+		current.Location = fields[3]
+	}
+
+	sort.Slice(stacks, func(i, j int) bool { return stacks[i].Count > stacks[j].Count })
+	if len(stacks) > n {
+		stacks = stacks[:n]
+	}
+	return stacks
+}
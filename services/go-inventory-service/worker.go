@@ -0,0 +1,250 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"runtime/debug"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var (
+	workerQueueDepth = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "worker_queue_depth",
+			Help: "Number of background jobs waiting for a worker",
+		},
+	)
+
+	workerBusy = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "worker_busy",
+			Help: "Number of background jobs running",
+		},
+	)
+
+	workerJobs = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "worker_jobs_total",
+			Help: "Total number of background jobs run by job and result",
+		},
+		[]string{"job", "result"},
+	)
+
+	workerJobDuration = promauto.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "worker_job_duration_seconds",
+			Help:    "Background job duration in seconds",
+			Buckets: []float64{.001, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30},
+		},
+		[]string{"job"},
+	)
+
+	workerQueueWait = promauto.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "worker_queue_wait_seconds",
+			Help:    "Time background jobs spent queued before a worker picked them up",
+			Buckets: []float64{.001, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10},
+		},
+		[]string{"job"},
+	)
+)
+
+var (
+	errWorkerQueueFull = errors.New("worker queue is full")
+	errWorkersStopped  = errors.New("workers are shutting down")
+)
+
+// JobFunc is a unit of background work. The context is canceled when the
+// shutdown deadline passes.
+type JobFunc func(ctx context.Context) error
+
+type queuedJob struct {
+	name     string
+	fn       JobFunc
+	link     trace.Link
+	queuedAt time.Time
+}
+
+// WorkerPool runs background jobs: one-off jobs submitted to a bounded queue
+// and served by a fixed number of workers, and periodic jobs on their own
+// schedule. Every run is a span, is measured, and a panic fails the run
+// instead of the process. Shutdown stops taking jobs and drains the queue.
+type WorkerPool struct {
+	tracer trace.Tracer
+	queue  chan queuedJob
+
+	// Canceled once the drain deadline passes, to abort running jobs
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mu       sync.RWMutex
+	stopping bool
+	// Closed when shutdown starts, to stop the periodic jobs
+	stop     chan struct{}
+	workers  sync.WaitGroup
+	periodic sync.WaitGroup
+}
+
+func newWorkerPool(tracer trace.Tracer, cfg WorkerConfig) *WorkerPool {
+	ctx, cancel := context.WithCancel(context.Background())
+	p := &WorkerPool{
+		tracer: tracer,
+		queue:  make(chan queuedJob, cfg.QueueSize),
+		ctx:    ctx,
+		cancel: cancel,
+		stop:   make(chan struct{}),
+	}
+	for i := 0; i < cfg.Size; i++ {
+		p.workers.Add(1)
+		go p.work()
+	}
+	return p
+}
+
+func (p *WorkerPool) work() {
+	defer p.workers.Done()
+	for job := range p.queue {
+		workerQueueDepth.Dec()
+		if p.ctx.Err() != nil {
+			// Past the shutdown deadline
+			workerJobs.WithLabelValues(job.name, "dropped").Inc()
+			continue
+		}
+		workerQueueWait.WithLabelValues(job.name).Observe(time.Since(job.queuedAt).Seconds())
+		p.run(job.name, job.fn, trace.WithLinks(job.link))
+	}
+}
+
+// Submit queues a job. Its span is linked to the span in ctx, but the job
+// outlives ctx. It fails rather than blocks when the queue is full.
+func (p *WorkerPool) Submit(ctx context.Context, name string, fn JobFunc) error {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if p.stopping {
+		return errWorkersStopped
+	}
+
+	job := queuedJob{name: name, fn: fn, link: trace.LinkFromContext(ctx), queuedAt: time.Now()}
+	select {
+	case p.queue <- job:
+		workerQueueDepth.Inc()
+		return nil
+	default:
+		workerJobs.WithLabelValues(name, "rejected").Inc()
+		return errWorkerQueueFull
+	}
+}
+
+// Every runs fn every interval until shutdown. Runs of the same job never
+// overlap; a run that takes longer than the interval delays the next one.
+func (p *WorkerPool) Every(name string, interval time.Duration, fn JobFunc) {
+	p.every(name, interval, nil, fn)
+}
+
+// EveryAsLeader is Every for singleton jobs: a run only happens on the
+// replica that is the leader at that moment
+func (p *WorkerPool) EveryAsLeader(name string, interval time.Duration, leader *LeaderElector, fn JobFunc) {
+	p.every(name, interval, leader.IsLeader, fn)
+}
+
+// Run fn every interval, skipping the runs for which enabled (when set)
+// returns false
+func (p *WorkerPool) every(name string, interval time.Duration, enabled func() bool, fn JobFunc) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if p.stopping {
+		return
+	}
+
+	p.periodic.Add(1)
+	go func() {
+		defer p.periodic.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-p.stop:
+				return
+			case <-ticker.C:
+				if enabled != nil && !enabled() {
+					continue
+				}
+				p.run(name, fn, trace.WithAttributes(attribute.String("job.interval", interval.String())))
+			}
+		}
+	}()
+}
+
+// Run one job in its own trace, recovering from a panic
+func (p *WorkerPool) run(name string, fn JobFunc, opts ...trace.SpanStartOption) {
+	workerBusy.Inc()
+	defer workerBusy.Dec()
+
+	opts = append(opts, trace.WithNewRoot(), trace.WithAttributes(attribute.String("job.name", name)))
+	ctx, span := p.tracer.Start(p.ctx, "job "+name, opts...)
+	defer span.End()
+
+	start := time.Now()
+	result := "success"
+	err := func() (err error) {
+		defer func() {
+			if r := recover(); r != nil {
+				result = "panic"
+				err = fmt.Errorf("panic: %v", r)
+				logWithTrace(ctx, "ERROR", "Background job panicked",
+					"job", name, "panic", fmt.Sprint(r), "stack", string(debug.Stack()))
+			}
+		}()
+		return fn(ctx)
+	}()
+	workerJobDuration.WithLabelValues(name).Observe(time.Since(start).Seconds())
+
+	if err != nil {
+		if result != "panic" {
+			result = "error"
+			logWithTrace(ctx, "WARN", "Background job failed", "job", name, "error", err.Error())
+		}
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	workerJobs.WithLabelValues(name, result).Inc()
+}
+
+// Shutdown stops the periodic jobs, refuses new ones and waits for the
+// queued and running jobs to finish. When ctx ends first, the running jobs
+// are canceled and the jobs still queued are dropped.
+func (p *WorkerPool) Shutdown(ctx context.Context) error {
+	p.mu.Lock()
+	if p.stopping {
+		p.mu.Unlock()
+		return nil
+	}
+	p.stopping = true
+	close(p.stop)
+	close(p.queue)
+	p.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		p.periodic.Wait()
+		p.workers.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		p.cancel()
+		return nil
+	case <-ctx.Done():
+		p.cancel()
+		return fmt.Errorf("background jobs did not finish in time: %w", ctx.Err())
+	}
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+
+	"inventory-service/internal/testkit"
+)
+
+func TestWorkerPoolRunsJobInLinkedSpan(t *testing.T) {
+	tr := testkit.InstallTracing(t)
+	pool := newWorkerPool(tr.Tracer("test"), WorkerConfig{Size: 1, QueueSize: 10})
+
+	ctx, parent := tr.Tracer("test").Start(context.Background(), "request")
+	ran := make(chan struct{})
+	if err := pool.Submit(ctx, "test_job", func(ctx context.Context) error {
+		close(ran)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	parent.End()
+	<-ran
+
+	if err := pool.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	span := tr.AssertSpan(t, "job test_job", attribute.String("job.name", "test_job"))
+	if span.Parent.IsValid() {
+		t.Error("job span is not a root span")
+	}
+	if len(span.Links) != 1 || span.Links[0].SpanContext.SpanID() != parent.SpanContext().SpanID() {
+		t.Errorf("job span not linked to the submitting span: %+v", span.Links)
+	}
+}
+
+func TestWorkerPoolIsolatesPanics(t *testing.T) {
+	tr := testkit.InstallTracing(t)
+	pool := newWorkerPool(tr.Tracer("test"), WorkerConfig{Size: 1, QueueSize: 10})
+
+	testkit.AssertCounterDelta(t, workerJobs.WithLabelValues("panicky", "panic"), 1, func() {
+		pool.Submit(context.Background(), "panicky", func(ctx context.Context) error {
+			panic("boom")
+		})
+		// The worker survives and runs the next job
+		ran := make(chan struct{})
+		pool.Submit(context.Background(), "after", func(ctx context.Context) error {
+			close(ran)
+			return nil
+		})
+		<-ran
+	})
+	pool.Shutdown(context.Background())
+
+	if span := tr.AssertSpan(t, "job panicky"); span.Status.Code != codes.Error {
+		t.Errorf("panicked job span has status %v", span.Status)
+	}
+}
+
+func TestWorkerPoolRejectsWhenFull(t *testing.T) {
+	pool := newWorkerPool(testkit.InstallTracing(t).Tracer("test"), WorkerConfig{Size: 1, QueueSize: 1})
+	block := make(chan struct{})
+	started := make(chan struct{})
+	pool.Submit(context.Background(), "blocker", func(ctx context.Context) error {
+		close(started)
+		<-block
+		return nil
+	})
+	<-started
+	noop := func(ctx context.Context) error { return nil }
+
+	if err := pool.Submit(context.Background(), "queued", noop); err != nil {
+		t.Fatalf("queue with room rejected a job: %v", err)
+	}
+	if err := pool.Submit(context.Background(), "overflow", noop); !errors.Is(err, errWorkerQueueFull) {
+		t.Errorf("got %v, want errWorkerQueueFull", err)
+	}
+	close(block)
+	pool.Shutdown(context.Background())
+}
+
+func TestWorkerPoolShutdownDrainsQueue(t *testing.T) {
+	pool := newWorkerPool(testkit.InstallTracing(t).Tracer("test"), WorkerConfig{Size: 1, QueueSize: 10})
+	var done atomic.Int32
+	for i := 0; i < 5; i++ {
+		pool.Submit(context.Background(), "slow", func(ctx context.Context) error {
+			time.Sleep(5 * time.Millisecond)
+			done.Add(1)
+			return nil
+		})
+	}
+
+	if err := pool.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if done.Load() != 5 {
+		t.Errorf("%d of 5 queued jobs finished before shutdown returned", done.Load())
+	}
+	if err := pool.Submit(context.Background(), "late", func(ctx context.Context) error { return nil }); !errors.Is(err, errWorkersStopped) {
+		t.Errorf("got %v after shutdown, want errWorkersStopped", err)
+	}
+}
+
+func TestWorkerPoolShutdownDeadlineCancelsJobs(t *testing.T) {
+	pool := newWorkerPool(testkit.InstallTracing(t).Tracer("test"), WorkerConfig{Size: 1, QueueSize: 10})
+	canceled := make(chan struct{})
+	started := make(chan struct{})
+	pool.Submit(context.Background(), "stuck", func(ctx context.Context) error {
+		close(started)
+		<-ctx.Done()
+		close(canceled)
+		return ctx.Err()
+	})
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := pool.Shutdown(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("got %v, want a deadline error", err)
+	}
+	select {
+	case <-canceled:
+	case <-time.After(time.Second):
+		t.Error("running job not canceled after the shutdown deadline")
+	}
+}
+
+func TestWorkerPoolEvery(t *testing.T) {
+	pool := newWorkerPool(testkit.InstallTracing(t).Tracer("test"), WorkerConfig{Size: 1, QueueSize: 10})
+	var runs atomic.Int32
+	pool.Every("tick", time.Millisecond, func(ctx context.Context) error {
+		runs.Add(1)
+		return errors.New("flaky")
+	})
+
+	deadline := time.Now().Add(time.Second)
+	for runs.Load() < 3 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	// A failed run doesn't stop the schedule
+	if runs.Load() < 3 {
+		t.Fatalf("periodic job ran %d times, want at least 3", runs.Load())
+	}
+
+	pool.Shutdown(context.Background())
+	after := runs.Load()
+	time.Sleep(10 * time.Millisecond)
+	if runs.Load() != after {
+		t.Error("periodic job still running after shutdown")
+	}
+}